@@ -4,36 +4,100 @@ import (
 	"crypto/rand"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"runtime/pprof"
+	"strconv"
 	"strings"
 
 	"github.com/kr/pretty"
 	"github.com/snapcore/spread/spread"
+	"golang.org/x/crypto/ssh/terminal"
 	"os/signal"
 )
 
 var (
-	verbose  = flag.Bool("v", false, "Show detailed progress information")
-	vverbose = flag.Bool("vv", false, "Show debugging messages as well")
-	list     = flag.Bool("list", false, "Just show list of jobs that would run")
-	pass     = flag.String("pass", "", "Server password to use, defaults to random")
-	keep     = flag.Bool("keep", false, "Keep servers running for reuse")
-	reuse    = flag.String("reuse", "", "Reuse servers held running by -keep")
-	resend   = flag.Bool("resend", false, "Resend project data to reused servers")
-	debug    = flag.Bool("debug", false, "Run shell after script errors")
-	shell    = flag.Bool("shell", false, "Run shell instead of task scripts")
-	abend    = flag.Bool("abend", false, "Stop without restoring on first error")
-	restore  = flag.Bool("restore", false, "Run only the restore scripts")
+	verbose   = flag.Bool("v", false, "Show detailed progress information")
+	vverbose  = flag.Bool("vv", false, "Show debugging messages as well")
+	color     = flag.String("color", "auto", "Color messages by severity: auto, always, or never")
+	list      = flag.Bool("list", false, "Just show list of jobs that would run")
+	graph     = flag.Bool("graph", false, "Just show graph of jobs that would run in Graphviz DOT format")
+	dump      = flag.Bool("dump", false, "Just show jobs that would run fully resolved in YAML format")
+	estimate  = flag.Bool("estimate", false, "Just show how long jobs that would run may take and their estimated cost")
+	orphans   = flag.Bool("orphans", false, "Just show servers left behind by runs no longer in progress")
+	dorphans  = flag.Bool("discard-orphans", false, "Discard servers left behind by runs no longer in progress")
+	validate  = flag.Bool("validate", false, "Just check the project for problems without running anything")
+	check     = flag.Bool("check", false, "Just check that backends can allocate and connect to servers without running anything")
+	source    = flag.String("project", "", "Fetch and run the project at the given git URL or tar archive")
+	pass      = flag.String("pass", "", "Server password to use, defaults to random")
+	keep      = flag.Bool("keep", false, "Keep servers running for reuse")
+	reuse     = flag.String("reuse", "", "Reuse servers held running by -keep")
+	resend    = flag.Bool("resend", false, "Resend project data to reused servers")
+	images    = flag.String("image", "", "Allocate servers for the given [backend:]system=image pairs from that provider image")
+	reuseWait = flag.Duration("reuse-wait", 0, "Keep trying to connect to unreachable reused servers for this long")
+	reuseStrc = flag.Bool("reuse-strict", false, "Refuse to reuse servers allocated with a different backend configuration")
+	debug     = flag.Bool("debug", false, "Run shell after script errors")
+	shell     = flag.Bool("shell", false, "Run shell instead of task scripts")
+	abend     = flag.Bool("abend", false, "Stop without restoring on first error")
+	restore   = flag.Bool("restore", false, "Run only the restore scripts")
+	noRecord  = flag.Bool("no-record", false, "Do not record on servers what workers are inside of for later -restore runs")
+	affinity  = flag.Bool("affinity", false, "Pin tasks to workers deterministically")
+	order     = flag.Bool("order", false, "Run tasks in the order they are declared in the project")
+	balance   = flag.Bool("balance", false, "Spread suites over workers by their queued tasks instead of keeping workers in their suite")
+	pipeline  = flag.Bool("pipeline", false, "Prepare the next task of a suite while the previous one is restored")
+	quarant   = flag.String("quarantine", "", "Do not fail the run for failures of tasks listed in file")
+	stopBroke = flag.Bool("stop-on-broken", false, "Stop the run on the first prepare or restore error, but not on task errors")
+	logFile   = flag.String("log", "", "Also write all messages, including debug ones, to file")
+	logSize   = flag.Int("log-size", 0, "Rotate the -log file when it grows beyond this many megabytes")
+	logGzip   = flag.Bool("log-gzip", false, "Compress rotated -log files with gzip")
+	jobLogs   = flag.String("job-logs", "", "Also write the output of the scripts of each job to its own file in the given directory")
+	from      = flag.String("from", "", "Skip tasks declared before the given suite/task")
+	until     = flag.String("until", "", "Skip tasks declared after the given suite/task")
+	contFrom  = flag.String("continue-from", "", "Skip all suites declared before the given suite")
+	local     = flag.Bool("local", false, "Allow local backends to run tasks directly on this system")
+	profile   = flag.String("profile", "", "Write CPU and memory profiles of spread to <path>.cpu and <path>.mem")
+	artifacts = flag.String("artifacts", "", "Fetch task artifacts into the given directory")
+	skipPrep  = flag.Bool("skip-prepared", false, "Skip prepare scripts already run successfully on reused servers")
+	taskOnly  = flag.Bool("task-only", false, "Run only task scripts on reused or local servers, skipping project, backend, suite, and fixture prepare and restore")
+	results   = flag.String("results", "", "Write the outcome and reported results of all jobs to file")
+	cache     = flag.String("cache", "", "Skip tasks that passed before with the same inputs, recording passing tasks in the given directory")
+	manifest  = flag.String("manifest", "", "Write what the run ran with, including versions, images, and project hash, to file")
+	control   = flag.String("control", "", "Listen for commands such as \"abandon <worker>\" or \"pause\" on unix socket")
+	notify    = flag.Duration("notify-idle", 0, "Print a progress summary whenever nothing was shown for this long")
+	github    = flag.Bool("github", false, "Report failures as GitHub Actions annotations when done")
+	keepEnv   = flag.Bool("keep-failed-env", false, "Record the environment of failed tasks in the results and artifacts")
+	sendLimit = flag.Int("send-limit", 0, "Send project data to at most this many servers at once")
+	chkState  = flag.Bool("check-state", false, "Probe the project state on servers around each task and report changes left behind")
+	chkIdemp  = flag.Bool("check-idempotent", false, "Run prepare and restore scripts twice and fail those that cannot run again")
+	failSkip  = flag.Bool("fail-on-skip", false, "Fail the run if any task is skipped, including those for unavailable systems")
+	minPassed = flag.String("min-passed", "", "Succeed if at least this many tasks, or percentage of them with a % suffix, passed")
 )
 
 //var discard = flag.Bool("discard", false, "Discard reused servers without running")
 
+// Exit codes used when tasks fail, or when there were problems running
+// them. Any other error exits with status 1.
+const (
+	exitTaskFailure  = 2
+	exitInfraFailure = 3
+)
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode returns the status to exit with after run returned err.
+func exitCode(err error) int {
+	if rerr, ok := err.(*spread.RunError); ok && rerr.Infrastructure() {
+		return exitInfraFailure
+	} else if ok {
+		return exitTaskFailure
 	}
+	return 1
 }
 
 func run() error {
@@ -43,6 +107,24 @@ func run() error {
 	spread.Verbose = *verbose
 	spread.Debug = *vverbose
 
+	switch *color {
+	case "auto":
+		spread.Color = terminal.IsTerminal(int(os.Stdout.Fd())) && os.Getenv("NO_COLOR") == ""
+	case "always":
+		spread.Color = true
+	case "never":
+	default:
+		return fmt.Errorf("invalid -color value %q, must be auto, always, or never", *color)
+	}
+
+	if *profile != "" {
+		stop, err := startProfile(*profile)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
 	if *reuse != "" && *pass == "" {
 		return fmt.Errorf("cannot have -reuse without -pass")
 	}
@@ -55,6 +137,9 @@ func run() error {
 		}
 		other = other || b
 	}
+	if *taskOnly && *restore {
+		return fmt.Errorf("cannot have -task-only with -restore")
+	}
 
 	password := *pass
 	if password == "" {
@@ -75,23 +160,120 @@ func run() error {
 		}
 	}
 
+	var quarantine spread.Filter
+	if *quarant != "" {
+		quarantine, err = spread.NewFilterFile(*quarant)
+		if err != nil {
+			return err
+		}
+	}
+
 	options := &spread.Options{
 		Password: password,
 		Filter:   filter,
+		From:     *from,
+		Until:    *until,
+		Continue: *contFrom,
 		Keep:     *keep,
 		Resend:   *resend,
 		Debug:    *debug,
 		Shell:    *shell,
 		Abend:    *abend,
 		Restore:  *restore,
+		NoRecord: *noRecord,
+		Affinity: *affinity,
+		Order:    *order,
+		Balance:  *balance,
+		Local:    *local,
+		Pipeline: *pipeline,
+
+		Quarantine:   quarantine,
+		StopOnBroken: *stopBroke,
+
+		Artifacts: *artifacts,
+
+		SkipPrepared: *skipPrep,
+		TaskOnly:     *taskOnly,
+		ReuseWait:    *reuseWait,
+		ReuseStrict:  *reuseStrc,
+		NotifyIdle:   *notify,
+		Results:      *results,
+		Manifest:     *manifest,
+		Control:      *control,
+		GitHub:       *github,
+		SendLimit:    *sendLimit,
+		FailOnSkip:   *failSkip,
+		CheckState:   *chkState,
+
+		CheckIdempotent: *chkIdemp,
+
+		KeepFailedEnv: *keepEnv,
 		//Discard:  *discard,
+
+		Args: os.Args[1:],
+
+		LogFile:     *logFile,
+		LogSize:     int64(*logSize) << 20,
+		LogCompress: *logGzip,
+		JobLogs:     *jobLogs,
 	}
 
-	project, err := spread.Load(".")
+	path := "."
+	if *source != "" {
+		dir, err := ioutil.TempDir("", "spread-project-")
+		if err != nil {
+			return fmt.Errorf("cannot create directory for project: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		path, err = spread.FetchProject(*source, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	project, err := spread.Load(path)
 	if err != nil {
 		return err
 	}
 
+	if *validate {
+		errs := project.Validate(options)
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) > 0 {
+			if len(errs) == 1 {
+				return fmt.Errorf("found 1 problem in project")
+			}
+			return fmt.Errorf("found %d problems in project", len(errs))
+		}
+		fmt.Println("Project is valid.")
+		return nil
+	}
+
+	if *orphans || *dorphans {
+		// Orphans found on some backends are still shown when
+		// others cannot list their servers.
+		orphaned, ferr := spread.FindOrphans(project, options)
+		var failed bool
+		for _, o := range orphaned {
+			fmt.Printf("%s at %s from run %s\n", o.Server, o.Server.Address(), o.RunID)
+			if *dorphans {
+				if err := o.Server.Discard(); err != nil {
+					fmt.Fprintf(os.Stderr, "cannot discard %s: %v\n", o.Server, err)
+					failed = true
+				}
+			}
+		}
+		if ferr != nil {
+			return ferr
+		}
+		if failed {
+			return fmt.Errorf("cannot discard all orphaned servers")
+		}
+		return nil
+	}
+
 	if *list {
 		jobs, err := project.Jobs(options)
 		if err != nil {
@@ -103,6 +285,40 @@ func run() error {
 		return nil
 	}
 
+	if *graph {
+		return project.Graph(os.Stdout, options)
+	}
+
+	if *dump {
+		return project.Dump(os.Stdout, options)
+	}
+
+	if *estimate {
+		return project.Estimate(os.Stdout, options)
+	}
+
+	if *cache != "" {
+		options.Cache = spread.NewDirCache(*cache)
+	}
+
+	if *minPassed != "" {
+		if err := parseMinPassed(options, *minPassed); err != nil {
+			return err
+		}
+	}
+
+	if *images != "" {
+		value, err := parseImages(project, *images)
+		if err != nil {
+			return err
+		}
+		options.Images = value
+	}
+
+	if *check {
+		return spread.CheckBackends(os.Stdout, project, options)
+	}
+
 	if *reuse != "" {
 		value, err := parseReuse(project, *reuse)
 		if err != nil {
@@ -126,6 +342,31 @@ func run() error {
 	return runner.Wait()
 }
 
+func startProfile(path string) (stop func(), err error) {
+	cpuf, err := os.Create(path + ".cpu")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create CPU profile: %v", err)
+	}
+	if err := pprof.StartCPUProfile(cpuf); err != nil {
+		cpuf.Close()
+		return nil, fmt.Errorf("cannot start CPU profile: %v", err)
+	}
+	stop = func() {
+		pprof.StopCPUProfile()
+		cpuf.Close()
+
+		memf, err := os.Create(path + ".mem")
+		if err == nil {
+			err = pprof.WriteHeapProfile(memf)
+			memf.Close()
+		}
+		if err != nil {
+			printf("Cannot write memory profile: %v", err)
+		}
+	}
+	return stop, nil
+}
+
 func printf(format string, v ...interface{}) {
 	if spread.Logger != nil {
 		spread.Logger.Output(2, pretty.Sprintf(format, v...))
@@ -147,6 +388,50 @@ func parseReuse(project *spread.Project, s string) (map[string][]string, error)
 	return reuse, nil
 }
 
+func parseMinPassed(options *spread.Options, s string) error {
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("-min-passed percentage must be above 0%% and at most 100%%: %s", s)
+		}
+		options.MinPassedPercent = percent
+		return nil
+	}
+	count, err := strconv.Atoi(s)
+	if err != nil || count < 1 {
+		return fmt.Errorf("-min-passed must be a positive number of tasks or a percentage: %s", s)
+	}
+	options.MinPassed = count
+	return nil
+}
+
+func parseImages(project *spread.Project, s string) (map[string]string, error) {
+	images := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		i := strings.Index(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("-image must be formatted as 'backend1:system1=image1,system2=image2'")
+		}
+		system, image := entry[:i], entry[i+1:]
+		bname := ""
+		if j := strings.Index(system, ":"); j >= 0 {
+			bname, system = system[:j], system[j+1:]
+		}
+		found := false
+		for _, backend := range project.Backends {
+			if bname != "" && backend.Name != bname || backend.SystemWorkers[system] == 0 {
+				continue
+			}
+			images[backend.Name+":"+system] = image
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("-image refers to unknown system %q", entry[:i])
+		}
+	}
+	return images, nil
+}
+
 func parseReuseEntry(entry string) (backend string, addrs []string) {
 	if i := strings.Index(entry, ":"); i > 0 {
 		return entry[:i], strings.Split(entry[i+1:], ",")
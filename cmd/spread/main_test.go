@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type MainSuite struct{}
+
+var _ = Suite(&MainSuite{})
+
+var parseImagesTests = []struct {
+	s      string
+	images map[string]string
+	err    string
+}{{
+	s:      "lxd:ubuntu-16.04=ubuntu:16.04",
+	images: map[string]string{"lxd:ubuntu-16.04": "ubuntu:16.04"},
+}, {
+	s:      "ubuntu-16.04=custom",
+	images: map[string]string{"lxd:ubuntu-16.04": "custom", "qemu:ubuntu-16.04": "custom"},
+}, {
+	s:      "lxd:ubuntu-16.04=a,qemu:ubuntu-16.04=b,debian-9=c",
+	images: map[string]string{"lxd:ubuntu-16.04": "a", "qemu:ubuntu-16.04": "b", "qemu:debian-9": "c"},
+}, {
+	s:   "ubuntu-16.04",
+	err: "-image must be formatted as 'backend1:system1=image1,system2=image2'",
+}, {
+	s:   "=image",
+	err: "-image must be formatted as 'backend1:system1=image1,system2=image2'",
+}, {
+	s:   "ubuntu-16.04=",
+	err: "-image must be formatted as 'backend1:system1=image1,system2=image2'",
+}, {
+	s:   "lxd:debian-9=image",
+	err: `-image refers to unknown system "lxd:debian-9"`,
+}, {
+	s:   "other:ubuntu-16.04=image",
+	err: `-image refers to unknown system "other:ubuntu-16.04"`,
+}}
+
+func (s *MainSuite) TestParseImages(c *C) {
+	project := &spread.Project{Backends: map[string]*spread.Backend{
+		"lxd":  {Name: "lxd", SystemWorkers: map[string]int{"ubuntu-16.04": 1}},
+		"qemu": {Name: "qemu", SystemWorkers: map[string]int{"ubuntu-16.04": 2, "debian-9": 1}},
+	}}
+	for _, test := range parseImagesTests {
+		images, err := parseImages(project, test.s)
+		if test.err != "" {
+			c.Check(err, ErrorMatches, test.err)
+			continue
+		}
+		c.Check(err, IsNil)
+		c.Check(images, DeepEquals, test.images, Commentf("images: %q", test.s))
+	}
+}
+
+var exitCodeTests = []struct {
+	err  error
+	code int
+}{
+	{fmt.Errorf("cannot load project"), 1},
+	{&spread.RunError{Failed: 1}, 2},
+	{&spread.RunError{Skipped: 1}, 2},
+	{&spread.RunError{Aborted: 1}, 3},
+	{&spread.RunError{Broken: 1}, 3},
+	{&spread.RunError{Failed: 2, Broken: 1}, 3},
+}
+
+func (s *MainSuite) TestExitCode(c *C) {
+	for _, test := range exitCodeTests {
+		c.Check(exitCode(test.err), Equals, test.code, Commentf("error: %#v", test.err))
+	}
+}
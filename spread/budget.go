@@ -0,0 +1,45 @@
+package spread
+
+import (
+	"time"
+)
+
+// budgetExceeded is the reason given for jobs aborted because their
+// suite used up its time budget.
+const budgetExceeded = "suite time budget exceeded"
+
+// spend adds the time a worker spent on job since it started working on
+// it to the time spent in its suite on its backend system. It must be
+// called with r.mu held.
+func (r *Runner) spend(job *Job, started time.Time) {
+	if job.Suite.Budget == 0 || started.IsZero() {
+		return
+	}
+	if r.suiteSpent == nil {
+		r.suiteSpent = make(map[[3]string]time.Duration)
+	}
+	r.suiteSpent[suiteWorkersKey(job)] += time.Since(started)
+}
+
+// overBudget returns whether the suite of job already spent its time
+// budget on the backend system of job, in which case no more of its
+// jobs are started there and job is marked as aborted. Jobs already
+// running carry on. It must be called with r.mu held.
+func (r *Runner) overBudget(job *Job) bool {
+	key := suiteWorkersKey(job)
+	if job.Suite.Budget == 0 || r.suiteSpent[key] < job.Suite.Budget {
+		return false
+	}
+	if !r.overSpent[key] {
+		if r.overSpent == nil {
+			r.overSpent = make(map[[3]string]bool)
+		}
+		r.overSpent[key] = true
+		printf("Suite %s exceeded its time budget of %s on %s:%s, aborting its remaining tasks there.", job.Suite, job.Suite.Budget, job.Backend.Name, job.System)
+	}
+	if job.parent != nil {
+		job = job.parent
+	}
+	r.aborted[job] = budgetExceeded
+	return true
+}
@@ -0,0 +1,82 @@
+package spread
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// caCertsFile is where the CA bundle is sent to before being installed
+// into the trust store of the server.
+const caCertsFile = "/var/tmp/spread-ca-certs.crt"
+
+// caCertsScript installs $SPREAD_CA_CERTS into the system trust store,
+// looking for the layout used by the major distributions in turn.
+const caCertsScript = `
+install_certs() {
+	mkdir -p "$1"
+	cp "$SPREAD_CA_CERTS" "$1/spread.crt"
+	shift
+	"$@"
+}
+if [ -d /etc/pki/ca-trust/source/anchors ]; then
+	install_certs /etc/pki/ca-trust/source/anchors update-ca-trust extract
+elif [ -d /etc/pki/trust/anchors ]; then
+	install_certs /etc/pki/trust/anchors update-ca-certificates
+elif [ -d /etc/ca-certificates/trust-source/anchors ]; then
+	install_certs /etc/ca-certificates/trust-source/anchors update-ca-trust extract
+elif command -v update-ca-certificates >/dev/null; then
+	install_certs /usr/local/share/ca-certificates update-ca-certificates
+else
+	echo "cannot find how to install CA certificates on this system"
+	exit 1
+fi
+rm -f "$SPREAD_CA_CERTS"
+`
+
+// checkCACerts returns the path of the CA bundle set in the ca-certs
+// field of context, resolved against the project directory, after making
+// sure it holds certificates.
+func checkCACerts(context fmt.Stringer, projectPath, filename string) (string, error) {
+	if filename == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(projectPath, filename)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("%s has invalid ca-certs: %v", context, err)
+	}
+	if !bytes.Contains(data, []byte("-----BEGIN CERTIFICATE-----")) {
+		return "", fmt.Errorf("%s has invalid ca-certs: no certificates in %s", context, filename)
+	}
+	return filename, nil
+}
+
+// installCACerts installs the CA bundle of the backend, or else of the
+// project, into the trust store of the server the client is connected
+// to, so that scripts may reach services using certificates it signed.
+func (r *Runner) installCACerts(client *Client, backend *Backend) error {
+	filename := backend.CACerts
+	if filename == "" {
+		filename = r.project.CACerts
+	}
+	if filename == "" || backend.Type == "local" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("cannot read CA certificates: %v", err)
+	}
+	logf("Installing CA certificates from %s on %s...", filename, client.Server())
+	err = client.WriteFile(caCertsFile, data)
+	if err == nil {
+		err = client.Run(caCertsScript, "", map[string]string{"SPREAD_CA_CERTS": caCertsFile})
+	}
+	if err != nil {
+		return fmt.Errorf("cannot install CA certificates: %v", err)
+	}
+	return nil
+}
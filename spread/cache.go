@@ -0,0 +1,157 @@
+package spread
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ResultCache remembers the keys of jobs that passed, so that later runs
+// may skip jobs whose inputs have not changed since.
+type ResultCache interface {
+	// Has returns whether a job with the given key passed before.
+	Has(key string) (bool, error)
+	// Add records that the named job with the given key passed.
+	Add(key, name string) error
+}
+
+// NewDirCache returns a ResultCache that keeps its entries as files in
+// the given local directory.
+func NewDirCache(dir string) ResultCache {
+	return &dirCache{dir}
+}
+
+type dirCache struct {
+	dir string
+}
+
+func (c *dirCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+func (c *dirCache) Has(key string) (bool, error) {
+	_, err := os.Stat(c.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *dirCache) Add(key, name string) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(name+"\n"), 0644)
+}
+
+// cacheKey returns the key identifying the inputs of job: its name, all
+// scripts run for it, its environment, the content of its task directory
+// and files, and the hash of the project tree sent to servers. Any change
+// to these yields a different key, so results cached under the old one
+// no longer apply.
+func cacheKey(job *Job, tree string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "job %q\n", job.Name)
+	fmt.Fprintf(h, "tree %q\n", tree)
+	scripts := []string{
+		job.Project.Prepare, job.Project.Restore,
+		job.Backend.Prepare, job.Backend.Restore,
+		job.Suite.Prepare, job.Suite.Restore,
+		job.Task.Prepare, job.Task.Execute, job.Task.Restore,
+		job.Task.If, job.Task.XFail, fmt.Sprint(job.Task.Exit),
+	}
+	if fixture := job.Task.fixture; fixture != nil {
+		scripts = append(scripts, fixture.Prepare, fixture.Restore)
+	}
+	for _, script := range scripts {
+		fmt.Fprintf(h, "script %q\n", script)
+	}
+	keys := make([]string, 0, len(job.Environment))
+	for k := range job.Environment {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "env %q=%q\n", k, job.Environment[k])
+	}
+	err := filepath.Walk(job.Task.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(job.Task.Path, path)
+		if err != nil {
+			return err
+		}
+		return hashFile(h, "file "+rel, path)
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, f := range job.Task.Files {
+		if err := hashFile(h, "send "+f.To, f.From); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func hashFile(h hash.Hash, label, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(h, "%s\n", label)
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// cached returns whether job passed before with the same inputs per the
+// result cache, remembering its key otherwise so that it gets cached if
+// it passes in this run. Sharded tasks are never cached, and nothing is
+// when the project tree could not be hashed.
+func (r *Runner) cached(job *Job) bool {
+	if job.parent != nil {
+		return false
+	}
+	if r.cacheTree == "" {
+		return false
+	}
+	key, err := cacheKey(job, r.cacheTree)
+	if err != nil {
+		printf("WARNING: Cannot compute cache key of %s: %v", job, err)
+		return false
+	}
+	has, err := r.options.Cache.Has(key)
+	if err != nil {
+		printf("WARNING: Cannot check result cache for %s: %v", job, err)
+		return false
+	}
+	if has {
+		debugf("Found %s in result cache with key %s.", job, key)
+		return true
+	}
+	r.cacheKeys[job] = key
+	return false
+}
+
+// cachePassed records job as passed in the result cache, if its key is
+// known. Keys are only set up before workers start, so r.mu is not needed.
+func (r *Runner) cachePassed(job *Job) {
+	if job == nil || r.options.Cache == nil {
+		return
+	}
+	key, ok := r.cacheKeys[job]
+	if !ok {
+		return
+	}
+	if err := r.options.Cache.Add(key, job.Name); err != nil {
+		printf("WARNING: Cannot add %s to result cache: %v", job, err)
+	}
+}
@@ -0,0 +1,105 @@
+package spread
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CheckBackends verifies that every backend used by the selected jobs
+// works, without running any of them, by allocating a server for the
+// first system each backend runs jobs on, connecting to it, running a
+// trivial command there, and discarding it. The outcome for each
+// backend is written to w, and an error is returned if any failed.
+func CheckBackends(w io.Writer, project *Project, options *Options) error {
+	jobs, err := project.Jobs(options)
+	if err != nil {
+		return err
+	}
+	images := make(map[string]ImageID)
+	var bnames []string
+	for _, job := range jobs {
+		if _, ok := images[job.Backend.Name]; !ok {
+			images[job.Backend.Name] = job.System
+			bnames = append(bnames, job.Backend.Name)
+		}
+	}
+	sort.Strings(bnames)
+
+	errs := make([]error, len(bnames))
+	var wg sync.WaitGroup
+	for i, bname := range bnames {
+		wg.Add(1)
+		go func(i int, backend *Backend) {
+			defer wg.Done()
+			errs[i] = checkBackend(project, backend, images[backend.Name], options)
+		}(i, project.Backends[bname])
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, bname := range bnames {
+		if errs[i] != nil {
+			fmt.Fprintf(w, "%s:%s failed: %v\n", bname, images[bname], errs[i])
+			failed++
+		} else {
+			fmt.Fprintf(w, "%s:%s ok\n", bname, images[bname])
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d backends failed", failed, len(bnames))
+	}
+	return nil
+}
+
+// checkBackend allocates a server for image on backend, connects to it
+// and runs a trivial command, and discards it.
+func checkBackend(project *Project, backend *Backend, image ImageID, options *Options) error {
+	provider, err := newProvider(project, backend, options)
+	if err != nil {
+		return err
+	}
+	printf("Allocating %s:%s...", backend.Name, image.SystemID())
+	server, err := provider.Allocate(image, options.Password)
+	if err != nil {
+		return fmt.Errorf("cannot allocate: %v", err)
+	}
+	defer func() {
+		printf("Discarding %s...", server)
+		if err := server.Discard(); err != nil {
+			printf("Cannot discard %s: %v", server, err)
+		}
+	}()
+	if err := forgetHostKey(backend, server.Address()); err != nil {
+		printf("WARNING: %v", err)
+	}
+
+	printf("Connecting to %s...", server)
+	var client *Client
+	retry := &retrier{backoff: &backend.Backoff}
+	timeout := time.After(60 * time.Second)
+Dial:
+	for {
+		client, err = Dial(server, backend, options.Password)
+		if err == nil {
+			break
+		}
+		debugf("Cannot connect to %s: %v", server, err)
+		select {
+		case <-time.After(retry.next()):
+		case <-timeout:
+			break Dial
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %v", server, err)
+	}
+	defer client.Close()
+
+	if err := client.Run("true", "", nil); err != nil {
+		return fmt.Errorf("cannot run commands on %s: %v", server, err)
+	}
+	return nil
+}
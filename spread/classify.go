@@ -0,0 +1,85 @@
+package spread
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Classes of errors found while allocating or connecting to servers.
+const (
+	// Transient errors are retried as set by the backoff of the backend.
+	transientError = "transient"
+	// Fatal errors make spread give up on the server right away.
+	fatalError = "fatal"
+	// Quota errors are retried, but only after waiting for as long as
+	// the backoff of the backend allows, as capacity is unlikely to
+	// free up quickly.
+	quotaError = "quota"
+)
+
+// quotaDelay is how long to wait after quota errors when the backoff
+// of the backend has no maximum delay.
+const quotaDelay = time.Minute
+
+// ErrorRule classifies errors whose message matches its regular
+// expression, overriding the default classification of errors found
+// while allocating or connecting to servers.
+type ErrorRule struct {
+	Match string
+	Class string
+
+	regexp *regexp.Regexp
+}
+
+// checkErrorRules compiles the error rules of context.
+func checkErrorRules(context fmt.Stringer, rules []*ErrorRule) error {
+	for _, rule := range rules {
+		if rule == nil || rule.Match == "" {
+			return fmt.Errorf("%s has error rule without match", context)
+		}
+		switch rule.Class {
+		case transientError, fatalError, quotaError:
+		default:
+			return fmt.Errorf("%s has invalid error class %q, must be transient, fatal, or quota", context, rule.Class)
+		}
+		var err error
+		rule.regexp, err = regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("%s has invalid error match %q: %v", context, rule.Match, err)
+		}
+	}
+	return nil
+}
+
+// classify returns the class of err found while allocating or connecting
+// to a server of backend. The error rules of the backend are checked
+// first, then the ones of the project. Errors matching none of them are
+// transient unless they are a *FatalError.
+func (r *Runner) classify(backend *Backend, err error) string {
+	msg := err.Error()
+	for _, rules := range [][]*ErrorRule{backend.Errors, r.project.Errors} {
+		for _, rule := range rules {
+			if rule.regexp.MatchString(msg) {
+				return rule.Class
+			}
+		}
+	}
+	if _, ok := err.(*FatalError); ok {
+		return fatalError
+	}
+	return transientError
+}
+
+// retryDelay returns how long to wait before retrying after an error of
+// the given class.
+func (rt *retrier) retryDelay(class string) time.Duration {
+	if class != quotaError {
+		return rt.next()
+	}
+	rt.delay = rt.backoff.Max
+	if rt.delay == 0 {
+		rt.delay = quotaDelay
+	}
+	return rt.delay
+}
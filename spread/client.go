@@ -3,43 +3,364 @@ package spread
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 type Client struct {
 	server Server
-	sshc   *ssh.Client
+	config *ssh.ClientConfig
+
+	// mu guards sshc, which Reconnect replaces while other goroutines
+	// may be opening sessions on it.
+	mu   sync.Mutex
+	sshc *ssh.Client
+
+	packageManager *packageManager
+	remotePath     string
+	outputs        map[string]string
+	facts          map[string]string
+	commands       map[string]bool
+	nodeRole       string
+
+	// nodeEnv holds the addresses of the nodes of the suite the
+	// server is in, for the scripts run on it.
+	nodeEnv map[string]string
 }
 
-func Dial(server Server, password string) (*Client, error) {
-	config := &ssh.ClientConfig{
-		User:    "root",
-		Auth:    []ssh.AuthMethod{ssh.Password(password)},
-		Timeout: 10 * time.Second,
+func Dial(server Server, backend *Backend, password string) (*Client, error) {
+	if _, ok := server.(*localServer); ok {
+		return &Client{server: server}, nil
+	}
+	hostKeyCallback, err := knownHostsCallback(backend.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %v", server, err)
 	}
-	client, err := ssh.Dial("tcp", server.Address()+":22", config)
+	config := &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		Timeout:         10 * time.Second,
+		HostKeyCallback: hostKeyCallback,
+	}
+	config.Ciphers = backend.Ciphers
+	config.KeyExchanges = backend.KeyExchanges
+	config.MACs = backend.MACs
+	client, err := sshDial("tcp", server.Address()+":22", config)
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect to %s: %v", server, err)
 	}
-	return &Client{server, client}, nil
+	return &Client{server: server, sshc: client, config: config}, nil
+}
+
+var sshDial = ssh.Dial
+
+// Reconnect dials the server again after the connection to it was lost,
+// keeping everything else about the client as it was.
+func (c *Client) Reconnect() error {
+	if c.local() {
+		return nil
+	}
+	sshc, err := sshDial("tcp", c.server.Address()+":22", c.config)
+	if err != nil {
+		return fmt.Errorf("cannot reconnect to %s: %v", c.server, err)
+	}
+	c.mu.Lock()
+	old := c.sshc
+	c.sshc = sshc
+	c.mu.Unlock()
+	old.Close()
+	return nil
+}
+
+// DisconnectError is returned when a script could not run to completion
+// because the connection to the server was lost, rather than because the
+// script itself failed.
+type DisconnectError struct {
+	Err error
+}
+
+func (e *DisconnectError) Error() string {
+	return fmt.Sprintf("connection lost: %v", e.Err)
+}
+
+// ExitStatusError is returned when a script ran to completion but
+// exited with a non-zero status.
+type ExitStatusError struct {
+	Status int
+	Err    error
+
+	// Command is the last command traced before a traced script
+	// exited, which is usually the one that failed. It is empty if
+	// the script was not traced, traced nothing, or its output was
+	// truncated.
+	Command string
+}
+
+func (e *ExitStatusError) Error() string {
+	if e.Command != "" {
+		return fmt.Sprintf("failed at `%s` (exit %d): %v", e.Command, e.Status, e.Err)
+	}
+	return e.Err.Error()
+}
+
+// failedCommand returns the last command traced by set -x in output,
+// or an empty string if there is none.
+func failedCommand(output []byte) string {
+	lines := strings.Split(string(output), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimLeft(lines[i], "+")
+		if len(line) < len(lines[i]) && strings.HasPrefix(line, " ") {
+			return strings.TrimSpace(line)
+		}
+	}
+	return ""
+}
+
+// exitStatus returns the exit status reported by err, returned by an ssh
+// or local session, and whether it reports one at all.
+func exitStatus(err error) (int, bool) {
+	switch err := err.(type) {
+	case *ssh.ExitError:
+		return err.ExitStatus(), true
+	case *exec.ExitError:
+		if ws, ok := err.Sys().(syscall.WaitStatus); ok {
+			return ws.ExitStatus(), true
+		}
+	}
+	return 0, false
+}
+
+// disconnected returns whether err, returned by an ssh session, reports
+// that the connection was lost rather than that the command failed.
+func (c *Client) disconnected(err error) bool {
+	if c.local() {
+		return false
+	}
+	switch err.(type) {
+	case *ssh.ExitError:
+		return false
+	case *ssh.ExitMissingError:
+		return true
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+const (
+	knownHostsAcceptNew = "accept-new"
+	knownHostsStrict    = "strict"
+	knownHostsOff       = "off"
+)
+
+var knownHostsMu sync.Mutex
+
+// knownHostsFile returns the file holding known host keys for the given
+// policy. Keys accepted automatically are kept apart from the ones the
+// user manages, as addresses of ephemeral servers are often recycled.
+func knownHostsFile(policy string) string {
+	if policy == knownHostsStrict {
+		return os.ExpandEnv("$HOME/.ssh/known_hosts")
+	}
+	return os.ExpandEnv("$HOME/.spread/known_hosts")
+}
+
+func knownHostsCallback(policy string) (ssh.HostKeyCallback, error) {
+	if policy == knownHostsOff {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	filename := knownHostsFile(policy)
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+
+		if policy == knownHostsAcceptNew {
+			if err := touchKnownHosts(filename); err != nil {
+				return err
+			}
+		}
+		check, err := knownhosts.New(filename)
+		if err != nil {
+			return fmt.Errorf("cannot read known hosts: %v", err)
+		}
+		err = check(hostname, remote, key)
+		if kerr, ok := err.(*knownhosts.KeyError); ok && len(kerr.Want) == 0 && policy == knownHostsAcceptNew {
+			debugf("Adding host key of %s to %s.", hostname, filename)
+			return appendKnownHost(filename, hostname, key)
+		}
+		if kerr, ok := err.(*knownhosts.KeyError); ok && len(kerr.Want) == 0 {
+			return fmt.Errorf("host key for %s not found in %s", hostname, filename)
+		}
+		if kerr, ok := err.(*knownhosts.KeyError); ok {
+			return fmt.Errorf("host key for %s does not match the one in %s", hostname, kerr.Want[0].Filename)
+		}
+		return err
+	}, nil
+}
+
+func touchKnownHosts(filename string) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot create known hosts file: %v", err)
+	}
+	return nil
+}
+
+func appendKnownHost(filename, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = f.Write([]byte(knownhosts.Line([]string{hostname}, key) + "\n"))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot add host key to %s: %v", filename, err)
+	}
+	return nil
+}
+
+// forgetHostKey drops any key automatically accepted in the past for
+// the given address, so a freshly allocated server reusing the address
+// of an old one may be connected to.
+func forgetHostKey(backend *Backend, addr string) error {
+	if backend.KnownHosts != knownHostsAcceptNew {
+		return nil
+	}
+
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	filename := knownHostsFile(backend.KnownHosts)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read known hosts: %v", err)
+	}
+
+	host := knownhosts.Normalize(addr + ":22")
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && contains(strings.Split(fields[0], ","), host) {
+			continue
+		}
+		buf.WriteString(line)
+	}
+	err = ioutil.WriteFile(filename, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write known hosts: %v", err)
+	}
+	return nil
 }
 
 func (c *Client) Close() error {
+	if c.local() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.sshc.Close()
 }
 
+// local returns whether the client runs commands directly on the
+// local system rather than over ssh.
+func (c *Client) local() bool {
+	return c.config == nil
+}
+
+// session holds the subset of the ssh.Session API used by the client,
+// so that commands may also run on the local system.
+type session interface {
+	SetStdin(r io.Reader)
+	SetStdout(w io.Writer)
+	SetStderr(w io.Writer)
+	StdinPipe() (io.WriteCloser, error)
+	RequestPty(term string, h, w int, modes ssh.TerminalModes) error
+	Run(cmd string) error
+	CombinedOutput(cmd string) ([]byte, error)
+	Close() error
+}
+
+func (c *Client) newSession() (session, error) {
+	if c.local() {
+		return &localSession{cmd: exec.Command("/bin/sh")}, nil
+	}
+	c.mu.Lock()
+	sshc := c.sshc
+	c.mu.Unlock()
+	s, err := sshc.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return sshSession{s}, nil
+}
+
+type sshSession struct {
+	*ssh.Session
+}
+
+func (s sshSession) SetStdin(r io.Reader)  { s.Stdin = r }
+func (s sshSession) SetStdout(w io.Writer) { s.Stdout = w }
+func (s sshSession) SetStderr(w io.Writer) { s.Stderr = w }
+
+type localSession struct {
+	cmd *exec.Cmd
+}
+
+func (s *localSession) SetStdin(r io.Reader)  { s.cmd.Stdin = r }
+func (s *localSession) SetStdout(w io.Writer) { s.cmd.Stdout = w }
+func (s *localSession) SetStderr(w io.Writer) { s.cmd.Stderr = w }
+
+func (s *localSession) StdinPipe() (io.WriteCloser, error) {
+	return s.cmd.StdinPipe()
+}
+
+func (s *localSession) RequestPty(term string, h, w int, modes ssh.TerminalModes) error {
+	// The local terminal is used as-is.
+	return nil
+}
+
+func (s *localSession) Run(cmd string) error {
+	s.cmd.Args = []string{"/bin/sh", "-c", cmd}
+	return s.cmd.Run()
+}
+
+func (s *localSession) CombinedOutput(cmd string) ([]byte, error) {
+	s.cmd.Args = []string{"/bin/sh", "-c", cmd}
+	return s.cmd.CombinedOutput()
+}
+
+func (s *localSession) Close() error {
+	return nil
+}
+
 func (c *Client) Server() Server {
 	return c.server
 }
 
 func (c *Client) WriteFile(path string, data []byte) error {
-	session, err := c.sshc.NewSession()
+	session, err := c.newSession()
 	if err != nil {
 		return err
 	}
@@ -86,7 +407,7 @@ func outputErr(output []byte, err error) error {
 }
 
 func (c *Client) ReadFile(path string) ([]byte, error) {
-	session, err := c.sshc.NewSession()
+	session, err := c.newSession()
 	if err != nil {
 		return nil, err
 	}
@@ -112,35 +433,80 @@ const (
 )
 
 func (c *Client) Run(script string, dir string, env map[string]string) error {
-	_, err := c.run(script, dir, env, combinedOutput)
+	_, err := c.run(script, dir, env, combinedOutput, "", nil)
 	return err
 }
 
 func (c *Client) Output(script string, dir string, env map[string]string) (output []byte, err error) {
-	return c.run(script, dir, env, splitOutput)
+	return c.run(script, dir, env, splitOutput, "", nil)
 }
 
 func (c *Client) CombinedOutput(script string, dir string, env map[string]string) (output []byte, err error) {
-	return c.run(script, dir, env, combinedOutput)
+	return c.run(script, dir, env, combinedOutput, "", nil)
 }
 
 func (c *Client) Trace(script string, dir string, env map[string]string) (output []byte, err error) {
-	return c.run(script, dir, env, traceOutput)
+	return c.run(script, dir, env, traceOutput, "", nil)
+}
+
+// TraceLimit is like Trace, but runs the script with the given shell
+// instead of /bin/sh if set, and keeps at most limit bytes of output
+// when limit is positive, dropping the rest while the script goes on.
+// It reports whether any output was dropped, and returns the output
+// kept even when the script fails.
+func (c *Client) TraceLimit(script string, dir string, env map[string]string, shell string, limit int64) (output []byte, truncated bool, err error) {
+	stdout := &limitedBuffer{limit: limit}
+	_, err = c.run(script, dir, env, traceOutput, shell, stdout)
+	return stdout.Bytes(), stdout.truncated, err
 }
 
 func (c *Client) Shell(script string, dir string, env map[string]string) error {
-	_, err := c.run(script, dir, env, shellOutput)
+	_, err := c.run(script, dir, env, shellOutput, "", nil)
 	return err
 }
 
-func (c *Client) run(script string, dir string, env map[string]string, mode int) (output []byte, err error) {
+// limitedBuffer is a buffer that keeps at most limit bytes written to it
+// when limit is positive, replacing the rest with a marker. It does not
+// embed bytes.Buffer so that io.Copy can't bypass Write via ReadFrom.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+const truncatedMarker = "\n...truncated...\n"
+
+func (b *limitedBuffer) Write(data []byte) (int, error) {
+	if b.limit <= 0 {
+		return b.buf.Write(data)
+	}
+	if b.truncated {
+		return len(data), nil
+	}
+	if room := b.limit - int64(b.buf.Len()); int64(len(data)) > room {
+		b.buf.Write(data[:room])
+		b.buf.WriteString(truncatedMarker)
+		b.truncated = true
+		return len(data), nil
+	}
+	return b.buf.Write(data)
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func (c *Client) run(script string, dir string, env map[string]string, mode int, shell string, stdout *limitedBuffer) (output []byte, err error) {
 	script = strings.TrimSpace(script)
 	if len(script) == 0 {
 		return nil, nil
 	}
 	script += "\n"
-	session, err := c.sshc.NewSession()
+	session, err := c.newSession()
 	if err != nil {
+		if c.disconnected(err) {
+			err = &DisconnectError{err}
+		}
 		return nil, err
 	}
 	defer session.Close()
@@ -164,7 +530,7 @@ func (c *Client) run(script string, dir string, env map[string]string, mode int)
 
 	errch := make(chan error, 2)
 	if mode == shellOutput {
-		session.Stdin = os.Stdin
+		session.SetStdin(os.Stdin)
 		errch <- nil
 	} else {
 		stdin, err := session.StdinPipe()
@@ -184,18 +550,22 @@ func (c *Client) run(script string, dir string, env map[string]string, mode int)
 
 	debugf("Sending script to %s:\n-----\n%s\n------", c.server, buf.Bytes())
 
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
 	var stderr bytes.Buffer
 	var cmd string
 	switch mode {
 	case traceOutput, combinedOutput:
-		cmd = "/bin/sh -e - 2>&1"
+		cmd = shell + " -e - 2>&1"
 	case splitOutput:
-		cmd = "/bin/sh -e -"
-		session.Stderr = &stderr
+		cmd = shell + " -e -"
+		session.SetStderr(&stderr)
 	case shellOutput:
 		cmd = "{\n" + buf.String() + "\n}"
-		session.Stdout = os.Stdout
-		session.Stderr = os.Stderr
+		session.SetStdout(os.Stdout)
+		session.SetStderr(os.Stderr)
 		w, h, err := terminal.GetSize(0)
 		if err != nil {
 			return nil, fmt.Errorf("cannot get local terminal size: %v", err)
@@ -211,7 +581,11 @@ func (c *Client) run(script string, dir string, env map[string]string, mode int)
 		cmd = fmt.Sprintf(`cd "%s" && %s`, dir, cmd)
 	}
 
-	if mode == shellOutput {
+	if mode == shellOutput && c.local() {
+		termLock()
+		err = session.Run(cmd)
+		termUnlock()
+	} else if mode == shellOutput {
 		tstate, err := terminal.MakeRaw(0)
 		if err != nil {
 			return nil, fmt.Errorf("cannot put local terminal in raw mode: %v", err)
@@ -221,7 +595,12 @@ func (c *Client) run(script string, dir string, env map[string]string, mode int)
 		termUnlock()
 		terminal.Restore(0, tstate)
 	} else {
-		output, err = session.Output(cmd)
+		if stdout == nil {
+			stdout = &limitedBuffer{}
+		}
+		session.SetStdout(stdout)
+		err = session.Run(cmd)
+		output = stdout.Bytes()
 	}
 
 	if len(output) > 0 {
@@ -232,11 +611,22 @@ func (c *Client) run(script string, dir string, env map[string]string, mode int)
 	}
 
 	if err != nil {
+		disconnected := c.disconnected(err)
+		status, exited := exitStatus(err)
 		if mode == splitOutput {
 			err = outputErr(stderr.Bytes(), err)
 		} else {
 			err = outputErr(output, err)
 		}
+		if disconnected {
+			err = &DisconnectError{err}
+		} else if exited {
+			e := &ExitStatusError{Status: status, Err: err}
+			if mode == traceOutput && !stdout.truncated {
+				e.Command = failedCommand(output)
+			}
+			err = e
+		}
 		return nil, err
 	}
 
@@ -246,6 +636,26 @@ func (c *Client) run(script string, dir string, env map[string]string, mode int)
 	return output, nil
 }
 
+func (c *Client) exists(path string) bool {
+	_, err := c.CombinedOutput(fmt.Sprintf(`test -e "%s"`, path), "", nil)
+	return err == nil
+}
+
+// hasCommand returns whether the named command is available on the
+// server, remembering the answer for later calls.
+func (c *Client) hasCommand(name string) bool {
+	has, ok := c.commands[name]
+	if !ok {
+		_, err := c.CombinedOutput(fmt.Sprintf(`command -v "%s"`, name), "", nil)
+		has = err == nil
+		if c.commands == nil {
+			c.commands = make(map[string]bool)
+		}
+		c.commands[name] = has
+	}
+	return has
+}
+
 func (c *Client) RemoveAll(path string) error {
 	_, err := c.CombinedOutput(fmt.Sprintf(`rm -rf "%s"`, path), "", nil)
 	return err
@@ -277,7 +687,7 @@ func (c *Client) Send(from, to string, include []string, exclude []string) error
 		return fmt.Errorf("remote directory %s is not empty", to)
 	}
 
-	session, err := c.sshc.NewSession()
+	session, err := c.newSession()
 	if err != nil {
 		return err
 	}
@@ -321,3 +731,56 @@ func (c *Client) Send(from, to string, include []string, exclude []string) error
 
 	return nil
 }
+
+// RecvDir pulls the content of the remote directory from into the local
+// directory to, streaming it all over a single tar session. The include
+// patterns are expanded by the remote shell, the exclude ones are matched
+// by tar against every path found under them, and files that are missing
+// or unreadable are skipped.
+func (c *Client) RecvDir(from, to string, include []string, exclude []string) error {
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return fmt.Errorf("cannot create local directory: %v", err)
+	}
+
+	session, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	cmd := exec.Command("tar", "-xz")
+	cmd.Dir = to
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	defer stdin.Close()
+
+	var stderr bytes.Buffer
+	session.SetStdout(stdin)
+	session.SetStderr(&stderr)
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("cannot start local tar command: %v", err)
+	}
+
+	args := []string{"/bin/tar", "-cz", "--ignore-failed-read"}
+	for _, pattern := range exclude {
+		args = append(args, fmt.Sprintf(`--exclude="%s"`, pattern))
+	}
+	if len(include) == 0 {
+		include = []string{"."}
+	}
+	args = append(args, include...)
+
+	err = session.Run(fmt.Sprintf(`cd "%s" && %s`, from, strings.Join(args, " ")))
+	stdin.Close()
+	if werr := cmd.Wait(); err == nil && werr != nil {
+		return fmt.Errorf("local tar command returned error: %v", werr)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot receive %s from %s: %v", from, c.server, outputErr(stderr.Bytes(), err))
+	}
+	return nil
+}
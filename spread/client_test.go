@@ -0,0 +1,177 @@
+package spread_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type ClientSuite struct{}
+
+var _ = Suite(&ClientSuite{})
+
+// sshServer serves a single ssh connection over loopback, counting the
+// sessions opened on it and accepting none.
+type sshServer struct {
+	sessions int32
+	closed   chan bool
+}
+
+func (s *sshServer) dial(c *C, config *ssh.ClientConfig) (*ssh.Client, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	signer, err := ssh.NewSignerFromKey(key)
+	c.Assert(err, IsNil)
+	sconfig := &ssh.ServerConfig{NoClientAuth: true}
+	sconfig.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		defer close(s.closed)
+		nconn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		conn, chans, reqs, err := ssh.NewServerConn(nconn, sconfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		for ch := range chans {
+			atomic.AddInt32(&s.sessions, 1)
+			ch.Reject(ssh.Prohibited, "no sessions here")
+		}
+		conn.Wait()
+	}()
+	return ssh.Dial("tcp", l.Addr().String(), config)
+}
+
+func (s *ClientSuite) TestReconnect(c *C) {
+	var mu sync.Mutex
+	var servers []*sshServer
+	defer spread.FakeSSHDial(func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		server := &sshServer{closed: make(chan bool)}
+		mu.Lock()
+		servers = append(servers, server)
+		mu.Unlock()
+		return server.dial(c, config)
+	})()
+
+	backend := &spread.Backend{Name: "backend", KnownHosts: "off"}
+	client, err := spread.Dial(&spread.UnknownServer{Addr: "10.0.0.1"}, backend, "secret")
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	// Sessions may be opened while the connection is replaced.
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					spread.ClientSession(client)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		c.Assert(client.Reconnect(), IsNil)
+	}
+	close(stop)
+	wg.Wait()
+
+	// Earlier connections are closed, and new sessions use the last one.
+	c.Assert(servers, HasLen, 4)
+	for _, server := range servers[:3] {
+		<-server.closed
+	}
+	last := servers[3]
+	sessions := atomic.LoadInt32(&last.sessions)
+	c.Assert(spread.ClientSession(client), ErrorMatches, ".*no sessions here.*")
+	c.Assert(atomic.LoadInt32(&last.sessions), Equals, sessions+1)
+}
+
+func hostKey(c *C) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	key, err := ssh.NewPublicKey(pub)
+	c.Assert(err, IsNil)
+	return key
+}
+
+var knownHostsTests = []struct {
+	policy    string
+	unknown   string
+	changed   string
+	forgotten string
+}{{
+	policy:  "accept-new",
+	changed: "host key for 10.0.0.1:22 does not match the one in .*/.spread/known_hosts",
+}, {
+	policy:    "strict",
+	unknown:   "host key for 10.0.0.2:22 not found in .*/.ssh/known_hosts",
+	changed:   "host key for 10.0.0.1:22 does not match the one in .*/.ssh/known_hosts",
+	forgotten: "host key for 10.0.0.1:22 does not match the one in .*/.ssh/known_hosts",
+}, {
+	policy: "off",
+}}
+
+func (s *ClientSuite) TestKnownHosts(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+	oldKey := hostKey(c)
+	newKey := hostKey(c)
+	for _, test := range knownHostsTests {
+		home := c.MkDir()
+		os.Setenv("HOME", home)
+		c.Assert(os.Mkdir(filepath.Join(home, ".ssh"), 0700), IsNil)
+		line := knownhosts.Line([]string{"10.0.0.1"}, oldKey) + "\n"
+		c.Assert(ioutil.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line), 0644), IsNil)
+
+		callback, err := spread.KnownHostsCallback(test.policy)
+		c.Assert(err, IsNil)
+		check := func(hostname string, key ssh.PublicKey, expected string) {
+			err := callback(hostname, remote, key)
+			if expected == "" {
+				c.Check(err, IsNil, Commentf("policy %s", test.policy))
+			} else {
+				c.Check(err, ErrorMatches, expected, Commentf("policy %s", test.policy))
+			}
+		}
+
+		// Only keys in ~/.ssh/known_hosts are trusted under the strict
+		// policy, while accept-new keeps the keys it has seen apart.
+		check("10.0.0.1:22", oldKey, "")
+		check("10.0.0.2:22", oldKey, test.unknown)
+		check("10.0.0.1:22", newKey, test.changed)
+
+		// Allocating a new server on the address forgets the key it
+		// had, where the key was accepted automatically.
+		backend := &spread.Backend{Name: "backend", KnownHosts: test.policy}
+		c.Assert(spread.ForgetHostKey(backend, "10.0.0.1"), IsNil)
+		check("10.0.0.1:22", newKey, test.forgotten)
+
+		_, err = os.Stat(filepath.Join(home, ".spread", "known_hosts"))
+		c.Check(err == nil, Equals, test.policy == "accept-new", Commentf("policy %s", test.policy))
+	}
+}
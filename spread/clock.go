@@ -0,0 +1,76 @@
+package spread
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockSkew returns how far ahead of the local clock the server clock is.
+func clockSkew(client *Client) (time.Duration, error) {
+	before := time.Now()
+	output, err := client.Output("date +%s.%N", "", nil)
+	after := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	remote, err := parseRemoteTime(string(output))
+	if err != nil {
+		return 0, err
+	}
+	// Assume the remote time was taken halfway through the round trip.
+	local := before.Add(after.Sub(before) / 2)
+	return remote.Sub(local), nil
+}
+
+// parseRemoteTime parses the output of date +%s.%N run on a server.
+func parseRemoteTime(output string) (time.Time, error) {
+	stamp := strings.TrimSpace(output)
+	secs, nsecs := stamp, ""
+	if i := strings.Index(stamp, "."); i >= 0 {
+		secs, nsecs = stamp[:i], stamp[i+1:]
+	}
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse remote time %q", stamp)
+	}
+	// Some date implementations don't support %N.
+	nsec, err := strconv.ParseInt(nsecs, 10, 64)
+	if err != nil || len(nsecs) != 9 {
+		nsec = 0
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// checkClock warns when the server clock is further off from the local
+// one than the backend tolerates, after waiting for it to get in sync
+// for as long as the backend allows.
+func (r *Runner) checkClock(client *Client, backend *Backend) {
+	if backend.ClockSkew == 0 {
+		return
+	}
+	server := client.Server()
+	deadline := time.Now().Add(backend.ClockSync)
+	for {
+		skew, err := clockSkew(client)
+		if err != nil {
+			printf("Cannot check clock of %s: %v", server, err)
+			return
+		}
+		if skew <= backend.ClockSkew && skew >= -backend.ClockSkew {
+			debugf("Clock of %s is off by %s.", server, skew)
+			return
+		}
+		if time.Now().After(deadline) {
+			printf("WARNING: Clock of %s is off by %s.", server, skew.Round(time.Millisecond))
+			return
+		}
+		printf("Clock of %s is off by %s, waiting for it to synchronize...", server, skew.Round(time.Millisecond))
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.tomb.Dying():
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package spread
+
+import (
+	"strings"
+)
+
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorDim    = "\x1b[2m"
+	colorReset  = "\x1b[0m"
+)
+
+// colorPrefixes maps the start of messages to the color they are shown
+// in when Color is set, in order of precedence.
+var colorPrefixes = []struct {
+	prefix string
+	color  string
+}{
+	{"Error ", colorRed},
+	{"Cannot ", colorRed},
+	{"Failed ", colorRed},
+	{"Unexpectedly successful ", colorRed},
+	{"WARNING:", colorYellow},
+	{"Successful tasks:", colorGreen},
+}
+
+// colorize returns the message with its first line colored by severity:
+// errors in red, warnings in yellow, successes in green, and progress
+// messages, the ones ending in "...", dimmed. Following lines, such as
+// script output, are left alone.
+func colorize(msg string) string {
+	line, rest := msg, ""
+	if i := strings.Index(msg, "\n"); i >= 0 {
+		line, rest = msg[:i], msg[i:]
+	}
+	color := ""
+	for _, c := range colorPrefixes {
+		if strings.HasPrefix(line, c.prefix) {
+			color = c.color
+			break
+		}
+	}
+	if color == "" && strings.HasSuffix(line, "...") {
+		color = colorDim
+	}
+	if color == "" || line == "" {
+		return msg
+	}
+	return color + line + colorReset + rest
+}
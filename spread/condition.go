@@ -0,0 +1,348 @@
+package spread
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// condition is a parsed task condition, which decides whether the task
+// runs on a given server based on facts about it and on the environment
+// of the job. Conditions are made of comparisons between operands, which
+// may be combined with &&, ||, ! and parentheses:
+//
+//	os == "ubuntu" && kernel >= 5.4
+//	arch =~ "^(x86_64|aarch64)$" || $FORCE == "yes"
+//
+// Operands are fact names as listed by isFact, $VARIABLES from the job
+// environment, or literal values, quoted or not. An operand alone is true unless
+// it is empty, "0", or "false". Ordering comparisons compare versions,
+// with numeric components compared as numbers.
+type condition interface {
+	eval(facts, env map[string]string) (bool, error)
+}
+
+type condNot struct{ c condition }
+type condAnd struct{ a, b condition }
+type condOr struct{ a, b condition }
+type condValue struct{ v operand }
+type condCompare struct {
+	op   string
+	a, b operand
+}
+
+func (c condNot) eval(facts, env map[string]string) (bool, error) {
+	ok, err := c.c.eval(facts, env)
+	return !ok, err
+}
+
+func (c condAnd) eval(facts, env map[string]string) (bool, error) {
+	ok, err := c.a.eval(facts, env)
+	if err != nil || !ok {
+		return false, err
+	}
+	return c.b.eval(facts, env)
+}
+
+func (c condOr) eval(facts, env map[string]string) (bool, error) {
+	ok, err := c.a.eval(facts, env)
+	if err != nil || ok {
+		return ok, err
+	}
+	return c.b.eval(facts, env)
+}
+
+func (c condValue) eval(facts, env map[string]string) (bool, error) {
+	v, err := c.v.value(facts, env)
+	return v != "" && v != "0" && v != "false", err
+}
+
+func (c condCompare) eval(facts, env map[string]string) (bool, error) {
+	a, err := c.a.value(facts, env)
+	if err != nil {
+		return false, err
+	}
+	b, err := c.b.value(facts, env)
+	if err != nil {
+		return false, err
+	}
+	switch c.op {
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	case "=~", "!~":
+		re, err := regexp.Compile(b)
+		if err != nil {
+			return false, fmt.Errorf("invalid regular expression %q: %v", b, err)
+		}
+		return re.MatchString(a) == (c.op == "=~"), nil
+	case "<":
+		return compareVersions(a, b) < 0, nil
+	case "<=":
+		return compareVersions(a, b) <= 0, nil
+	case ">":
+		return compareVersions(a, b) > 0, nil
+	case ">=":
+		return compareVersions(a, b) >= 0, nil
+	}
+	panic("unknown condition operator " + c.op)
+}
+
+// operand is a fact name, a $VARIABLE, or a literal value.
+type operand struct {
+	kind byte // 'f'act, 'v'ariable, or 'l'iteral
+	text string
+}
+
+func (o operand) value(facts, env map[string]string) (string, error) {
+	switch o.kind {
+	case 'f':
+		return facts[o.text], nil
+	case 'v':
+		return env[o.text], nil
+	}
+	return o.text, nil
+}
+
+// compareVersions compares a and b component by component, splitting them
+// on dots, dashes, and other separators. Components that are both numbers
+// are compared numerically and others lexically.
+func compareVersions(a, b string) int {
+	split := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	}
+	as, bs := split(a), split(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.ParseUint(as[i], 10, 64)
+		bn, berr := strconv.ParseUint(bs[i], 10, 64)
+		switch {
+		case aerr == nil && berr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case (aerr != nil || berr != nil) && as[i] != bs[i]:
+			if as[i] < bs[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// parseCondition parses a task condition expression.
+func parseCondition(expr string) (condition, error) {
+	tokens, err := condTokens(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &condParser{tokens: tokens}
+	c, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return c, nil
+}
+
+type condToken struct {
+	kind byte // 'o'perator or operand kind
+	text string
+}
+
+var condOperators = []string{"&&", "||", "==", "!=", "=~", "!~", "<=", ">=", "<", ">", "!", "(", ")"}
+
+func condTokens(expr string) ([]condToken, error) {
+	var tokens []condToken
+	s := expr
+Next:
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return tokens, nil
+		}
+		for _, op := range condOperators {
+			if strings.HasPrefix(s, op) {
+				tokens = append(tokens, condToken{'o', op})
+				s = s[len(op):]
+				continue Next
+			}
+		}
+		switch c := s[0]; {
+		case c == '"' || c == '\'':
+			i := strings.IndexByte(s[1:], c)
+			if i < 0 {
+				return nil, fmt.Errorf("unterminated string in %q", expr)
+			}
+			tokens = append(tokens, condToken{'l', s[1 : i+1]})
+			s = s[i+2:]
+			continue Next
+		case c == '$':
+			name := strings.TrimPrefix(s[1:], "{")
+			braces := len(name) < len(s[1:])
+			n := 0
+			for n < len(name) && (name[n] == '_' || unicode.IsLetter(rune(name[n])) || n > 0 && unicode.IsDigit(rune(name[n]))) {
+				n++
+			}
+			if n == 0 || braces && (n == len(name) || name[n] != '}') {
+				return nil, fmt.Errorf("invalid variable reference in %q", expr)
+			}
+			tokens = append(tokens, condToken{'v', name[:n]})
+			s = name[n:]
+			if braces {
+				s = s[1:]
+			}
+			continue Next
+		}
+		n := 0
+		for n < len(s) && (unicode.IsLetter(rune(s[n])) || unicode.IsDigit(rune(s[n])) || strings.IndexByte("._-+:", s[n]) >= 0) {
+			n++
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("unexpected %q in %q", s[:1], expr)
+		}
+		word := s[:n]
+		s = s[n:]
+		if isFact(word) {
+			tokens = append(tokens, condToken{'f', word})
+		} else {
+			tokens = append(tokens, condToken{'l', word})
+		}
+	}
+}
+
+type condParser struct {
+	tokens []condToken
+	pos    int
+}
+
+func (p *condParser) peek() condToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return condToken{}
+}
+
+func (p *condParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == 'o' && t.text == op
+}
+
+func (p *condParser) or() (condition, error) {
+	c, err := p.and()
+	for err == nil && p.isOp("||") {
+		p.pos++
+		var b condition
+		b, err = p.and()
+		c = condOr{c, b}
+	}
+	return c, err
+}
+
+func (p *condParser) and() (condition, error) {
+	c, err := p.unary()
+	for err == nil && p.isOp("&&") {
+		p.pos++
+		var b condition
+		b, err = p.unary()
+		c = condAnd{c, b}
+	}
+	return c, err
+}
+
+func (p *condParser) unary() (condition, error) {
+	switch {
+	case p.isOp("!"):
+		p.pos++
+		c, err := p.unary()
+		return condNot{c}, err
+	case p.isOp("("):
+		p.pos++
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return c, nil
+	}
+	a, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	switch t := p.peek(); t.text {
+	case "==", "!=", "=~", "!~", "<", "<=", ">", ">=":
+		if t.kind != 'o' {
+			break
+		}
+		p.pos++
+		b, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return condCompare{t.text, a, b}, nil
+	}
+	return condValue{a}, nil
+}
+
+func (p *condParser) operand() (operand, error) {
+	t := p.peek()
+	if t.kind == 0 {
+		return operand{}, fmt.Errorf("unexpected end of condition")
+	}
+	if t.kind == 'o' {
+		return operand{}, fmt.Errorf("unexpected %q", t.text)
+	}
+	p.pos++
+	return operand{t.kind, t.text}, nil
+}
+
+// factNames lists the facts gathered from servers by factsScript, in the
+// order it prints them.
+var factNames = []string{"kernel", "arch", "os", "os-version"}
+
+func isFact(name string) bool {
+	switch name {
+	case "backend", "system", "variant":
+		return true
+	}
+	return contains(factNames, name)
+}
+
+const factsScript = `uname -r; uname -m; . /etc/os-release 2>/dev/null; echo "$ID"; echo "$VERSION_ID"`
+
+// conditionHolds evaluates the condition of the task of job against the
+// facts about the server the client is connected to and the job itself.
+func (r *Runner) conditionHolds(client *Client, job *Job) (bool, error) {
+	if client.facts == nil {
+		output, err := client.Output(factsScript, "", nil)
+		if err != nil {
+			return false, fmt.Errorf("cannot gather facts: %v", err)
+		}
+		lines := strings.Split(string(output), "\n")
+		client.facts = make(map[string]string)
+		for i, name := range factNames {
+			if i < len(lines) {
+				client.facts[name] = strings.TrimSpace(lines[i])
+			}
+		}
+		debugf("Facts about %s: %v", client.Server(), client.facts)
+	}
+	facts := map[string]string{
+		"backend": job.Backend.Name,
+		"system":  string(job.System),
+		"variant": job.Variant,
+	}
+	for k, v := range client.facts {
+		facts[k] = v
+	}
+	return job.Task.cond.eval(facts, job.Environment)
+}
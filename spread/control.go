@@ -0,0 +1,150 @@
+package spread
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serveControl accepts connections on the control socket. Each connection
+// sends a single command line and receives a single reply line, which
+// starts with "error: " when the command fails.
+func (r *Runner) serveControl(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go r.handleControl(conn)
+	}
+}
+
+func (r *Runner) handleControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	fields := strings.Fields(line)
+	debugf("Control command received: %q", fields)
+
+	var err error
+	var reply = "ok"
+	switch {
+	case len(fields) == 2 && fields[0] == "abandon":
+		err = r.abandon(fields[1])
+	case len(fields) == 1 && fields[0] == "status":
+		reply, err = r.status()
+	case len(fields) == 1 && fields[0] == "pause":
+		err = r.pause()
+	case len(fields) == 1 && fields[0] == "resume":
+		err = r.resume()
+	default:
+		err = fmt.Errorf("unknown command %q", strings.TrimSpace(line))
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "error: %v\n", err)
+	} else {
+		fmt.Fprintf(conn, "%s\n", reply)
+	}
+}
+
+// pause stops workers from taking further jobs until resume is called.
+// Jobs already running carry on, and workers then wait with their
+// servers kept alive instead of finishing.
+func (r *Runner) pause() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused != nil {
+		return fmt.Errorf("run is already paused")
+	}
+	r.paused = make(chan struct{})
+	printf("Pausing run, no further jobs will be started until it is resumed...")
+	return nil
+}
+
+// resume lets workers waiting after pause take jobs again.
+func (r *Runner) resume() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused == nil {
+		return fmt.Errorf("run is not paused")
+	}
+	close(r.paused)
+	r.paused = nil
+	printf("Resuming run...")
+	return nil
+}
+
+// runStatus is the reply to the status command, with the live state of
+// the run.
+type runStatus struct {
+	RunID   string         `json:"run-id"`
+	Paused  bool           `json:"paused,omitempty"`
+	Pending int            `json:"pending"`
+	Servers int            `json:"servers"`
+	Workers []workerStatus `json:"workers"`
+	Stats   map[string]int `json:"stats"`
+}
+
+type workerStatus struct {
+	Name    string `json:"name"`
+	Server  string `json:"server"`
+	Address string `json:"address"`
+	Job     string `json:"job,omitempty"`
+}
+
+type workersByName []workerStatus
+
+func (ws workersByName) Len() int           { return len(ws) }
+func (ws workersByName) Less(i, j int) bool { return ws[i].Name < ws[j].Name }
+func (ws workersByName) Swap(i, j int)      { ws[i], ws[j] = ws[j], ws[i] }
+
+// status returns the live state of the run as a single line of JSON.
+func (r *Runner) status() (string, error) {
+	status := runStatus{
+		RunID:   r.options.RunID,
+		Pending: len(r.pendingJobs()),
+		Workers: []workerStatus{},
+	}
+
+	r.mu.Lock()
+	status.Paused = r.paused != nil
+	status.Servers = len(r.servers)
+	for _, w := range r.workers {
+		ws := workerStatus{
+			Name:    w.name,
+			Server:  w.client.Server().String(),
+			Address: w.client.Server().Address(),
+		}
+		if w.job != nil {
+			ws.Job = w.job.Name
+		}
+		status.Workers = append(status.Workers, ws)
+	}
+	s := &r.stats
+	status.Stats = map[string]int{
+		"passed":      len(s.TaskDone),
+		"failed":      len(s.TaskError),
+		"xfailed":     len(s.TaskXFail),
+		"xpassed":     len(s.TaskXPass),
+		"quarantined": len(s.TaskQuarantine),
+		"aborted":     len(s.TaskAbort),
+		"skipped":     len(s.TaskSkip),
+		"slow":        len(s.TaskSlow),
+	}
+	for _, list := range s.brokenLists() {
+		status.Stats["broken"] += len(*list)
+	}
+	r.mu.Unlock()
+
+	sort.Sort(workersByName(status.Workers))
+	data, err := json.Marshal(status)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal status: %v", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,117 @@
+package spread
+
+import (
+	"fmt"
+	"time"
+)
+
+// startController allocates the controller server of the project, if
+// any, before workers start so that its address may be provided to all
+// jobs as $SPREAD_CONTROLLER. The controller is allocated on its own,
+// leaving the servers allocated in batches for the workers.
+func (r *Runner) startController() error {
+	c := r.project.Controller
+	if c == nil {
+		return nil
+	}
+	backend := r.project.Backends[c.Backend]
+	image := ImageID(c.System)
+
+	printf("Allocating controller %s:%s...", backend.Name, c.System)
+	var server Server
+	var err error
+	retry := &retrier{backoff: &backend.Backoff}
+	timeout := time.After(5 * time.Minute)
+Allocate:
+	for {
+		server, err = r.providers[backend.Name].Allocate(image, r.options.Password)
+		if err == nil {
+			break
+		}
+		debugf("Cannot allocate controller %s:%s: %v", backend.Name, c.System, err)
+		class := r.classify(backend, err)
+		if class == fatalError {
+			break
+		}
+		select {
+		case <-time.After(retry.retryDelay(class)):
+		case <-timeout:
+			break Allocate
+		case <-r.tomb.Dying():
+			break Allocate
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot allocate controller: %v", err)
+	}
+	if err := forgetHostKey(backend, server.Address()); err != nil {
+		printf("WARNING: %v", err)
+	}
+	r.controller = server
+	r.addServer(backend, server)
+
+	printf("Connecting to controller %s...", server)
+	var client *Client
+	retry = &retrier{backoff: &backend.Backoff}
+	timeout = time.After(60 * time.Second)
+Dial:
+	for {
+		client, err = Dial(server, backend, r.options.Password)
+		if err == nil {
+			break
+		}
+		debugf("Cannot connect to controller %s: %v", server, err)
+		select {
+		case <-time.After(retry.next()):
+		case <-timeout:
+			break Dial
+		case <-r.tomb.Dying():
+			break Dial
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot connect to controller: %v", err)
+	}
+	defer client.Close()
+
+	if c.Prepare != "" {
+		printf("Preparing controller %s...", server)
+		env := map[string]string{
+			"SPREAD_PROJECT":    r.project.Name,
+			"SPREAD_BACKEND":    backend.Name,
+			"SPREAD_SYSTEM":     c.System,
+			"SPREAD_CONTROLLER": server.Address(),
+		}
+		if _, err := client.Trace(c.Prepare, "", env); err != nil {
+			return fmt.Errorf("cannot prepare controller: %v", err)
+		}
+	}
+	printf("Controller %s ready at %s.", server, server.Address())
+	return nil
+}
+
+// stopController discards the controller server, if one was allocated,
+// or keeps it under -keep.
+func (r *Runner) stopController() {
+	if r.controller == nil {
+		return
+	}
+	if r.options.Keep {
+		printf("Keeping controller %s at %s", r.controller, r.controller.Address())
+		r.controller = nil
+		return
+	}
+	r.mu.Lock()
+	for i, s := range r.servers {
+		if s == r.controller {
+			r.servers = append(r.servers[:i], r.servers[i+1:]...)
+			break
+		}
+	}
+	r.mu.Unlock()
+	printf("Discarding controller %s...", r.controller)
+	if err := r.discard(r.controller); err != nil {
+		printf("Error discarding controller %s: %v", r.controller, err)
+	}
+	r.controller = nil
+}
@@ -0,0 +1,40 @@
+package spread
+
+import (
+	"fmt"
+	runtimedebug "runtime/debug"
+)
+
+// crashed reports the panic v recovered in the given part of the runner
+// and stops the run with an error, so that the other workers wind down
+// and discard their servers as usual instead of leaking them when the
+// process dies. The given servers of the part that crashed are
+// discarded right away as nothing else will take care of them, unless
+// servers are being kept.
+func (r *Runner) crashed(what string, v interface{}, servers ...Server) error {
+	err := fmt.Errorf("internal error in %s: %v", what, v)
+	printf("PANIC in %s: %v\n%s", what, v, runtimedebug.Stack())
+	r.tomb.Kill(err)
+	for _, server := range servers {
+		if r.options.Keep {
+			printf("Keeping %s at %s", server, server.Address())
+			continue
+		}
+		printf("Discarding %s...", server)
+		if err := r.discard(server); err != nil {
+			printf("Error discarding %s: %v", server, err)
+		}
+	}
+	return err
+}
+
+// drain waits for all alive workers to finish, refusing to replace any.
+func (r *Runner) drain() {
+	for r.alive > 0 {
+		select {
+		case <-r.done:
+			r.alive--
+		case <-r.spawn:
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package spread
+
+import (
+	"time"
+)
+
+// allocateTimeout is how long a worker keeps trying to allocate a server
+// before reconsidering, and degradeRounds is how many such rounds in a
+// row have to fail before it may give up as per degrade.
+var allocateTimeout = 30 * time.Second
+
+const degradeRounds = 3
+
+// degrade returns whether a worker that failed to allocate a server for
+// image on backend for the given number of rounds should give up,
+// leaving the jobs of the system to the workers already running for it,
+// which drain the same queue just slower. Every time a worker gives up
+// this way, the shortfall is reported.
+//
+// Workers never give up before failing degradeRounds rounds, nor while
+// none of their system is running, so that jobs are not aborted while
+// the provider is merely slow. With the Affinity option set, the jobs
+// pinned to a worker giving up are moved to the ones still running.
+func (r *Runner) degrade(backend *Backend, image ImageID, rounds int) bool {
+	if rounds < degradeRounds {
+		return false
+	}
+	key := [2]string{backend.Name, string(image)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	running := 0
+	for _, w := range r.workers {
+		if w.system == key {
+			running++
+		}
+	}
+	if running == 0 {
+		return false
+	}
+	requested := r.systemWorkers[key]
+	printf("Cannot allocate more servers for %s:%s, requested %d worker%s, running with %d.",
+		backend.Name, image.SystemID(), requested, nth(requested, "s", "", "s"), running)
+	return true
+}
@@ -0,0 +1,134 @@
+package spread
+
+import (
+	"io"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// dumpedJob holds a job as fully resolved from the project, as written
+// out by Project.Dump.
+type dumpedJob struct {
+	Job     string `yaml:"job"`
+	Backend string `yaml:"backend"`
+	System  string `yaml:"system"`
+	Suite   string `yaml:"suite"`
+	Task    string `yaml:"task"`
+	Variant string `yaml:"variant,omitempty"`
+	Shard   string `yaml:"shard,omitempty"`
+	Fixture string `yaml:"fixture,omitempty"`
+
+	Environment map[string]string `yaml:"environment,omitempty"`
+
+	Prepare string `yaml:"prepare,omitempty"`
+	Execute string `yaml:"execute,omitempty"`
+	Restore string `yaml:"restore,omitempty"`
+
+	FixturePrepare string `yaml:"fixture-prepare,omitempty"`
+	FixtureRestore string `yaml:"fixture-restore,omitempty"`
+	SuitePrepare   string `yaml:"suite-prepare,omitempty"`
+	SuiteRestore   string `yaml:"suite-restore,omitempty"`
+	BackendPrepare string `yaml:"backend-prepare,omitempty"`
+	BackendRestore string `yaml:"backend-restore,omitempty"`
+	ProjectPrepare string `yaml:"project-prepare,omitempty"`
+	ProjectRestore string `yaml:"project-restore,omitempty"`
+
+	Workdir          string        `yaml:"workdir,omitempty"`
+	If               string        `yaml:"if,omitempty"`
+	XFail            string        `yaml:"xfail,omitempty"`
+	OutputLimit      int64         `yaml:"output-limit,omitempty"`
+	ExpectedDuration time.Duration `yaml:"expected-duration,omitempty"`
+	Artifacts        []string      `yaml:"artifacts,omitempty"`
+	Destructive      bool          `yaml:"destructive,omitempty"`
+	Restartable      bool          `yaml:"restartable,omitempty"`
+	AlwaysRestore    bool          `yaml:"always-restore,omitempty"`
+	Quarantined      bool          `yaml:"quarantined,omitempty"`
+	Skip             string        `yaml:"skip,omitempty"`
+}
+
+// secretVarname matches names of variables likely to hold secrets.
+var secretVarname = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|CREDENTIAL|_KEY$|^KEY$)`)
+
+// maskVariable returns the value of the named variable fully masked if
+// the name suggests it holds a secret, or with known secrets masked.
+func maskVariable(name, value string) string {
+	if secretVarname.MatchString(name) {
+		return "*****"
+	}
+	return maskSecrets(value)
+}
+
+// Dump writes the jobs selected by options to w in YAML format, each
+// with its final environment and scripts after all defaults, variants,
+// and inheritance are resolved, so that the effect of the project
+// configuration may be inspected without running anything. Values of
+// variables named like secrets and of known secrets are masked.
+func (p *Project) Dump(w io.Writer, options *Options) error {
+	jobs, err := p.Jobs(options)
+	if err != nil {
+		return err
+	}
+
+	var dumped []dumpedJob
+	for _, job := range jobs {
+		env := make(map[string]string, len(job.Environment))
+		for k, v := range job.Environment {
+			env[k] = maskVariable(k, v)
+		}
+		outputLimit := p.outputLimit
+		if job.Task.outputLimit > 0 {
+			outputLimit = job.Task.outputLimit
+		}
+		d := dumpedJob{
+			Job:     job.Name,
+			Backend: job.Backend.Name,
+			System:  string(job.System),
+			Suite:   job.Suite.Name,
+			Task:    job.Task.Name,
+			Variant: job.Variant,
+
+			Environment: env,
+
+			Prepare: maskSecrets(job.Task.Prepare),
+			Execute: maskSecrets(job.Task.Execute),
+			Restore: maskSecrets(job.Task.Restore),
+
+			SuitePrepare:   maskSecrets(job.Suite.Prepare),
+			SuiteRestore:   maskSecrets(job.Suite.Restore),
+			BackendPrepare: maskSecrets(job.Backend.Prepare),
+			BackendRestore: maskSecrets(job.Backend.Restore),
+			ProjectPrepare: maskSecrets(p.Prepare),
+			ProjectRestore: maskSecrets(p.Restore),
+
+			Workdir:          job.Task.Workdir,
+			If:               job.Task.If,
+			XFail:            job.Task.XFail,
+			OutputLimit:      outputLimit,
+			ExpectedDuration: job.Task.ExpectedDuration,
+			Artifacts:        job.Task.Artifacts,
+			Destructive:      job.Task.Destructive,
+			Restartable:      job.Task.Restartable || job.Suite.Restartable,
+			AlwaysRestore:    job.Task.AlwaysRestore,
+			Quarantined:      job.quarantined,
+			Skip:             job.skip,
+		}
+		if fixture := job.Task.fixture; fixture != nil {
+			d.Fixture = fixture.Name
+			d.FixturePrepare = maskSecrets(fixture.Prepare)
+			d.FixtureRestore = maskSecrets(fixture.Restore)
+		}
+		if job.Task.Shards > 1 {
+			d.Shard = job.Environment["SPREAD_SHARD"] + "/" + job.Environment["SPREAD_SHARDS"]
+		}
+		dumped = append(dumped, d)
+	}
+
+	data, err := yaml.Marshal(dumped)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,88 @@
+package spread
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultTaskDuration is how long tasks without an expected-duration are
+// assumed to take when estimating costs.
+const defaultTaskDuration = time.Minute
+
+// Estimate writes to w a rough estimate of how long running the jobs
+// selected by options would take on each backend system, and how much
+// it would cost per the price set for the backends. Jobs are assumed
+// to take their expected-duration, spread evenly over the workers that
+// would run them, with each server allocated for those workers billed in
+// the minimum increments of its backend.
+func (p *Project) Estimate(w io.Writer, options *Options) error {
+	jobs, err := p.Jobs(options)
+	if err != nil {
+		return err
+	}
+	var pending []*Job
+	for _, job := range jobs {
+		if job.skip == "" {
+			pending = append(pending, job)
+		}
+	}
+
+	durations := make(map[[2]string]time.Duration)
+	counts := make(map[[2]string]int)
+	var guessed int
+	for _, job := range pending {
+		key := [2]string{job.Backend.Name, string(job.System)}
+		d := job.Task.ExpectedDuration
+		if d == 0 {
+			d = defaultTaskDuration
+			guessed++
+		}
+		durations[key] += d
+		counts[key]++
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	var total float64
+	var priced bool
+	workers := p.workerCounts(pending)
+	for _, key := range p.systemKeys() {
+		n := workers[key]
+		if n == 0 {
+			continue
+		}
+		backend := p.Backends[key[0]]
+		servers := n
+		if s := backend.SystemServers[key[1]]; s > 0 && s < n {
+			servers = s
+		}
+		wall := (durations[key] + time.Duration(n-1)) / time.Duration(n)
+		billed := wall
+		if backend.Billing > 0 {
+			billed = (wall + backend.Billing - 1) / backend.Billing * backend.Billing
+		}
+		cost := "-"
+		if backend.Price > 0 {
+			c := backend.Price * billed.Hours() * float64(servers)
+			cost = fmt.Sprintf("~%.2f", c)
+			total += c
+			priced = true
+		}
+		fmt.Fprintf(tw, "%s:%s\t%d job%s\t%d worker%s\t%d server%s\t~%s\t%s\n", key[0], key[1],
+			counts[key], nth(counts[key], "s", "", "s"), n, nth(n, "s", "", "s"),
+			servers, nth(servers, "s", "", "s"), wall.Round(time.Second), cost)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if priced {
+		fmt.Fprintf(w, "Estimated cost: ~%.2f\n", total)
+	} else {
+		fmt.Fprintf(w, "Estimated cost: unknown, no backend sets a price\n")
+	}
+	if guessed > 0 {
+		fmt.Fprintf(w, "%d job%s without expected-duration assumed to take %s.\n", guessed, nth(guessed, "s", "", "s"), defaultTaskDuration)
+	}
+	return nil
+}
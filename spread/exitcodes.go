@@ -0,0 +1,52 @@
+package spread
+
+import (
+	"fmt"
+)
+
+// Outcomes that exit codes of scripts may be mapped to.
+const (
+	// Scripts exiting with a retry code are run again, up to the number
+	// of exit-retries set in the project.
+	exitRetry = "retry"
+	// Scripts exiting with a fail code fail as usual.
+	exitFail = "fail"
+	// Scripts exiting with a pass code are considered successful.
+	exitPass = "pass"
+)
+
+// checkExitCodes makes sure the exit codes mapped by context are valid.
+func checkExitCodes(context fmt.Stringer, codes map[int]string) error {
+	for code, outcome := range codes {
+		if code < 1 || code > 255 {
+			return fmt.Errorf("%s has invalid exit code %d in exit-codes", context, code)
+		}
+		switch outcome {
+		case exitRetry, exitFail, exitPass:
+		default:
+			return fmt.Errorf("%s has invalid outcome %q for exit code %d, must be retry, fail, or pass", context, outcome, code)
+		}
+	}
+	return nil
+}
+
+// exitOutcome returns the outcome that the exit code reported by err,
+// returned by a script run for job, is mapped to in the exit-codes of
+// its backend, or else of the project. It returns an empty string for
+// errors not reporting an exit code or codes not mapped at all. Execute
+// scripts of tasks expecting a specific exit-code are never mapped.
+//
+// A script exiting with 255, such as when an ssh connection it opened is
+// dropped, reports that code as usual. Losing the connection that runs
+// the script reports no exit code at all, though, as it is a
+// DisconnectError, which is handled by the reconnect setting instead.
+func (r *Runner) exitOutcome(job *Job, verb string, context interface{}, err error) string {
+	e, ok := err.(*ExitStatusError)
+	if !ok || verb == executing && context == job && job.Task.Exit != 0 {
+		return ""
+	}
+	if outcome, ok := job.Backend.ExitCodes[e.Status]; ok {
+		return outcome
+	}
+	return r.project.ExitCodes[e.Status]
+}
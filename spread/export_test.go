@@ -0,0 +1,346 @@
+package spread
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// NewQueueRunner returns a runner holding the provided jobs in its
+// queues, without starting any workers.
+func NewQueueRunner(jobs []*Job, options *Options) *Runner {
+	r := &Runner{
+		options:       options,
+		pending:       jobs,
+		suiteWorkers:  make(map[[3]string]int),
+		suiteOwners:   make(map[[3]string]int),
+		systemWorkers: make(map[[2]string]int),
+		running:       make(map[*Job]bool),
+	}
+	r.queueJobs()
+	return r
+}
+
+func (r *Runner) NextJob(backend *Backend, system ImageID, suite *Suite) *Job {
+	return r.NextWorkerJob(backend, system, 0, suite)
+}
+
+func (r *Runner) NextWorkerJob(backend *Backend, system ImageID, worker int, suite *Suite) *Job {
+	job := r.job(backend, system, worker, suite)
+	if job != nil {
+		r.suiteWorkers[suiteWorkersKey(job)]++
+		r.running[job] = true
+	}
+	return job
+}
+
+// NewLinearRunner returns a runner holding the provided jobs in a single
+// pending list, for picking them with LinearNextJob.
+func NewLinearRunner(jobs []*Job, options *Options) *Runner {
+	return &Runner{
+		options:      options,
+		pending:      append([]*Job(nil), jobs...),
+		suiteWorkers: make(map[[3]string]int),
+	}
+}
+
+// LinearNextJob picks the next job by scanning every pending job, as
+// done before jobs were queued per system. It's kept for comparing the
+// queues against it in benchmarks.
+func (r *Runner) LinearNextJob(backend *Backend, system ImageID, suite *Suite) *Job {
+	var best = -1
+	var bestWorkers = 1000000
+	for i, job := range r.pending {
+		if job == nil || job.Backend != backend || job.System != system {
+			continue
+		}
+		if job.Suite.Serial && r.suiteWorkers[suiteWorkersKey(job)] > 0 {
+			continue
+		}
+		if job.Suite == suite {
+			best = i
+			break
+		}
+		if c := r.suiteWorkers[suiteWorkersKey(job)]; c < bestWorkers {
+			best = i
+			bestWorkers = c
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	job := r.pending[best]
+	r.pending[best] = nil
+	r.suiteWorkers[suiteWorkersKey(job)]++
+	return job
+}
+
+func (r *Runner) DoneJob(job *Job) {
+	r.suiteWorkers[suiteWorkersKey(job)]--
+	delete(r.running, job)
+}
+
+func Classify(project *Project, backend *Backend, err error) string {
+	r := &Runner{project: project}
+	return r.classify(backend, err)
+}
+
+func ShellFor(project *Project, job *Job, executing bool) string {
+	r := &Runner{project: project}
+	if executing {
+		return r.shell(job, "executing")
+	}
+	return r.shell(job, "preparing")
+}
+
+// FakeProviders has the providers of the backends in later runs
+// wrapped by wrap, until the returned function is called.
+func FakeProviders(wrap func(p Provider) Provider) (restore func()) {
+	newProvider = func(project *Project, backend *Backend, options *Options) (Provider, error) {
+		p, err := backendProvider(project, backend, options)
+		if err != nil {
+			return nil, err
+		}
+		return wrap(p), nil
+	}
+	return func() { newProvider = backendProvider }
+}
+
+func OpenRotatingFile(path string, maxSize int64, compress bool) (io.WriteCloser, error) {
+	return openRotatingFile(path, maxSize, compress)
+}
+
+const LogFileKeep = logFileKeep
+
+func ReuseConfig(backend *Backend, image ImageID) string {
+	r := &Runner{options: &Options{}}
+	return r.reuseConfig(backend, image)
+}
+
+// StatusWorker is a worker of the run described by RunStatus.
+type StatusWorker struct {
+	Name, Addr, Job string
+}
+
+// RunStatus returns the reply to the status command for a run with the
+// given number of pending jobs and workers, and with the given number of
+// tasks passed, failed, and projects broken.
+func RunStatus(pending int, paused bool, workers []StatusWorker, passed, failed, broken int) (string, error) {
+	r := &Runner{
+		options: &Options{RunID: "run"},
+		workers: make(map[string]*workerState),
+		pending: make([]*Job, pending),
+	}
+	if paused {
+		r.paused = make(chan struct{})
+	}
+	for _, w := range workers {
+		server := &UnknownServer{Addr: w.Addr}
+		r.servers = append(r.servers, server)
+		ws := &workerState{name: w.Name, client: &Client{server: server}}
+		if w.Job != "" {
+			ws.job = &Job{Name: w.Job}
+		}
+		r.workers[w.Name] = ws
+	}
+	r.stats.TaskDone = make([]*Job, passed)
+	r.stats.TaskError = make([]*Job, failed)
+	r.stats.ProjectPrepareError = make([]*Job, broken)
+	return r.status()
+}
+
+func (r *Runner) HandleControl(conn net.Conn) {
+	r.handleControl(conn)
+}
+
+func ExitOutcome(project *Project, job *Job, err error) string {
+	r := &Runner{project: project}
+	return r.exitOutcome(job, "restoring", job, err)
+}
+
+func ReuseArgs(servers []Server, options *Options) string {
+	r := &Runner{servers: servers, options: options}
+	return r.reuseArgs()
+}
+
+var SnapshotKey = snapshotKey
+var LXDImage = lxdImage
+
+func LXDSnapshotAlias(p Provider, image ImageID) string {
+	return p.(*lxd).snapshotAlias(image)
+}
+
+func LXDServer(p Provider, name string, image ImageID) Server {
+	return &lxdServer{l: p.(*lxd), d: lxdServerData{Name: name, Image: image}}
+}
+
+func LXDName(p Provider, image ImageID) (string, error) {
+	return p.(*lxd).name(image)
+}
+
+func SetAllocateTimeout(timeout time.Duration) (restore func()) {
+	old := allocateTimeout
+	allocateTimeout = timeout
+	return func() { allocateTimeout = old }
+}
+
+func CheckLimits(limits *Limits) error {
+	return checkLimits(&Backend{Name: "lxd"}, limits)
+}
+
+func LimitArgs(limits *Limits, hasCommand func(name string) bool) (cmd, missing []string) {
+	return limitArgs(limits, hasCommand)
+}
+
+var FailedCommand = failedCommand
+
+var Colorize = colorize
+
+var EscapeData = escapeData
+var EscapeProperty = escapeProperty
+
+var PlacementOrder = placementOrder
+
+var ParseRemoteTime = parseRemoteTime
+
+var EnvFile = envFile
+
+var ParseSize = parseSize
+
+var TooSlow = tooSlow
+
+var TreeHash = treeHash
+
+var CheckReuseData = checkReuseData
+
+func (b *Backend) StorageSize(image ImageID) int64 {
+	return b.storageSize(image)
+}
+
+var JobLogEntry = jobLogEntry
+
+func JobLogPath(dir string, job *Job) string {
+	r := &Runner{options: &Options{JobLogs: dir}}
+	return r.jobLogPath(job)
+}
+
+func CheckCACerts(backend *Backend, projectPath, filename string) (string, error) {
+	return checkCACerts(backend, projectPath, filename)
+}
+
+func RemotePath(project *Project, backend *Backend, system ImageID) string {
+	r := &Runner{project: project}
+	return r.remotePath(backend, system)
+}
+
+// AbortReason returns why job was left pending by a run with the given
+// number of workers for its system, the reason the last of them quit,
+// and whether the run was stopped, finishing with err.
+func AbortReason(job *Job, err error, workers int, quit string, stopped bool) string {
+	key := [2]string{job.Backend.Name, string(job.System)}
+	r := &Runner{
+		systemWorkers: map[[2]string]int{key: workers},
+		quits:         map[[2]string]string{key: quit},
+	}
+	if stopped {
+		r.tomb.Kill(nil)
+	}
+	return r.abortReason(job, err)
+}
+
+// LimitedWrite writes each of data in turn to a buffer keeping at most
+// limit bytes, returning what it kept and whether anything was dropped.
+func LimitedWrite(limit int64, data ...string) (kept string, truncated bool) {
+	b := &limitedBuffer{limit: limit}
+	for _, d := range data {
+		b.Write([]byte(d))
+	}
+	return string(b.Bytes()), b.truncated
+}
+
+func CheckFiles(backend *Backend, dir string, files []*File) error {
+	return checkFiles(backend, dir, files)
+}
+
+func (f *File) Perm() os.FileMode {
+	return f.perm
+}
+
+func (job *Job) Skip() string {
+	return job.skip
+}
+
+func EvalCondition(expr string, facts, env map[string]string) (bool, error) {
+	cond, err := parseCondition(expr)
+	if err != nil {
+		return false, err
+	}
+	return cond.eval(facts, env)
+}
+
+// FakeLinodeAPI has requests to the Linode API answered by handler,
+// until the returned function is called.
+func FakeLinodeAPI(handler http.Handler) (restore func()) {
+	old := client.Transport
+	client.Transport = handlerTransport{handler}
+	return func() { client.Transport = old }
+}
+
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	t.handler.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+// LinodePick lists the servers in the Linode account and reserves one
+// for image as Allocate would, returning its label and zone.
+func LinodeName(p Provider, image ImageID) string {
+	return p.(*linode).name(image)
+}
+
+// LinodeCreateConfig creates a configuration for image on a server.
+func LinodeCreateConfig(p Provider, image ImageID) (configID int, err error) {
+	return p.(*linode).createConfig(&linodeServer{ID: 1}, image, "", []int{1, 2})
+}
+
+func LinodePick(p Provider, image ImageID) (label string, zone int, err error) {
+	l := p.(*linode)
+	servers, err := l.list()
+	if err != nil {
+		return "", 0, err
+	}
+	server := l.pick(servers, image)
+	if server == nil {
+		return "", 0, nil
+	}
+	return server.Label, server.Zone, nil
+}
+
+var KnownHostsCallback = knownHostsCallback
+var ForgetHostKey = forgetHostKey
+
+// FakeSSHDial has clients connect to servers using dial, until the
+// returned function is called.
+func FakeSSHDial(dial func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error)) (restore func()) {
+	old := sshDial
+	sshDial = dial
+	return func() { sshDial = old }
+}
+
+// ClientSession opens a session on the server and closes it right away.
+func ClientSession(c *Client) error {
+	s, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
@@ -0,0 +1,109 @@
+package spread
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var archiveSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz"}
+
+// FetchProject fetches the project at source into dir, and returns the
+// path of the project inside it. The source is either the URL or local
+// path of a tar archive, or a git repository URL, optionally followed by
+// #ref to check out a branch or tag other than the default one.
+func FetchProject(source, dir string) (path string, err error) {
+	if isArchive(source) {
+		printf("Fetching project archive %s...", source)
+		err = fetchArchive(source, dir)
+	} else {
+		printf("Cloning project repository %s...", source)
+		err = fetchGit(source, dir)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Archives commonly hold a single top directory with everything
+	// else inside it.
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("cannot read fetched project: %v", err)
+	}
+	if len(infos) == 1 && infos[0].IsDir() {
+		return filepath.Join(dir, infos[0].Name()), nil
+	}
+	return dir, nil
+}
+
+func isArchive(source string) bool {
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(source, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func fetchArchive(source, dir string) error {
+	filename := source
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		f, err := ioutil.TempFile("", "spread-archive-")
+		if err != nil {
+			return fmt.Errorf("cannot download project archive: %v", err)
+		}
+		f.Close()
+		filename = f.Name()
+		defer os.Remove(filename)
+		if err := download(source, filename); err != nil {
+			return err
+		}
+	}
+	output, err := exec.Command("tar", "-xf", filename, "-C", dir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot extract project archive: %v", outputErr(output, err))
+	}
+	return nil
+}
+
+func download(url, filename string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return fmt.Errorf("cannot download project archive: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot download project archive: %s", resp.Status)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("cannot download project archive: %v", err)
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot download project archive: %v", err)
+	}
+	return nil
+}
+
+func fetchGit(source, dir string) error {
+	args := []string{"clone", "--quiet", "--depth=1"}
+	if i := strings.LastIndex(source, "#"); i >= 0 {
+		args = append(args, "--branch", source[i+1:])
+		source = source[:i]
+	}
+	args = append(args, source, dir)
+	output, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot clone project repository: %v", outputErr(output, err))
+	}
+	return nil
+}
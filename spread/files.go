@@ -0,0 +1,66 @@
+package spread
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// contextFiles returns the files to be sent to the server before the
+// given context of job is prepared. Backend files are sent right after
+// connecting instead.
+func contextFiles(job *Job, context interface{}) []*File {
+	switch context {
+	case job.Suite:
+		return job.Suite.Files
+	case job:
+		return job.Task.Files
+	}
+	return nil
+}
+
+// sendFiles sends the given local files to the server the client is
+// connected to, recording secret ones so they may be removed later.
+func (r *Runner) sendFiles(client *Client, files []*File) error {
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f.From)
+		if err != nil {
+			return fmt.Errorf("cannot read file to send: %v", err)
+		}
+		if f.Secret {
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); len(line) > 7 {
+					maskSecret(line)
+				}
+			}
+			r.mu.Lock()
+			r.secretFiles[client.Server()] = append(r.secretFiles[client.Server()], f.To)
+			r.mu.Unlock()
+		}
+		logf("Sending %s to %s at %s...", f.From, client.Server(), f.To)
+		// Set the mode before writing so secrets are never exposed.
+		err = client.Run(fmt.Sprintf(`mkdir -p "%s" && touch "%s" && chmod %o "%s"`, path.Dir(f.To), f.To, f.perm, f.To), "", nil)
+		if err == nil {
+			err = client.WriteFile(f.To, data)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot send %s: %v", f.From, err)
+		}
+	}
+	return nil
+}
+
+// removeSecretFiles removes from the server the client is connected to
+// all secret files sent to it.
+func (r *Runner) removeSecretFiles(client *Client) {
+	r.mu.Lock()
+	files := r.secretFiles[client.Server()]
+	delete(r.secretFiles, client.Server())
+	r.mu.Unlock()
+	for _, filename := range files {
+		if err := client.RemoveAll(filename); err != nil {
+			printf("Cannot remove secret file from %s: %v", client.Server(), err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package spread
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// failed records the error output of a script that failed, so it may be
+// reported again once the run is over.
+func (r *Runner) failed(job *Job, verb string, context interface{}, err error) {
+	if !r.options.GitHub {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures == nil {
+		r.failures = make(map[string]string)
+	}
+	r.failures[verb+" "+job.StringFor(context)] = err.Error()
+	if job.parent != nil && context == job {
+		key := verb + " " + job.parent.StringFor(job.parent)
+		r.failures[key] = strings.TrimSpace(r.failures[key] + "\n" + err.Error())
+	}
+}
+
+// githubAnnotations prints a GitHub Actions workflow command for every
+// failure in the run, so that they show up as annotations in the workflow
+// run and in the affected task files.
+func (r *Runner) githubAnnotations() {
+	s := &r.stats
+	for _, f := range []struct {
+		jobs    []*Job
+		verb    string
+		context func(job *Job) interface{}
+	}{
+		{s.TaskError, executing, func(job *Job) interface{} { return job }},
+		{s.TaskPrepareError, preparing, func(job *Job) interface{} { return job }},
+		{s.TaskRestoreError, restoring, func(job *Job) interface{} { return job }},
+		{s.FixturePrepareError, preparing, func(job *Job) interface{} { return job.Task.fixture }},
+		{s.FixtureRestoreError, restoring, func(job *Job) interface{} { return job.Task.fixture }},
+		{s.SuitePrepareError, preparing, func(job *Job) interface{} { return job.Suite }},
+		{s.SuiteRestoreError, restoring, func(job *Job) interface{} { return job.Suite }},
+		{s.BackendPrepareError, preparing, func(job *Job) interface{} { return job.Backend }},
+		{s.BackendRestoreError, restoring, func(job *Job) interface{} { return job.Backend }},
+		{s.ProjectPrepareError, preparing, func(job *Job) interface{} { return job.Project }},
+		{s.ProjectRestoreError, restoring, func(job *Job) interface{} { return job.Project }},
+	} {
+		seen := make(map[string]bool)
+		for _, job := range f.jobs {
+			context := f.context(job)
+			title := fmt.Sprintf("Error %s %s", f.verb, job.StringFor(context))
+			if seen[title] {
+				continue
+			}
+			seen[title] = true
+
+			var props []string
+			if context == job {
+				if rel, err := filepath.Rel(r.project.Path, job.Task.Path); err == nil {
+					props = append(props, "file="+escapeProperty(filepath.ToSlash(filepath.Join(rel, "task.yaml"))))
+				}
+			}
+			msg := r.failures[f.verb+" "+job.StringFor(context)]
+			if msg == "" {
+				msg = title + "."
+			}
+			props = append(props, "title="+escapeProperty(title))
+			githubCommand("error", props, msg)
+		}
+	}
+	for _, job := range s.TaskXPass {
+		githubCommand("error", []string{"title=" + escapeProperty("Unexpected success of "+job.String())}, job.Name+" was expected to fail but passed.")
+	}
+	for _, job := range s.TaskQuarantine {
+		verb := executing
+		msg := r.failures[executing+" "+job.StringFor(job)]
+		if m := r.failures[preparing+" "+job.StringFor(job)]; m != "" {
+			verb, msg = preparing, m
+		}
+		if msg == "" {
+			msg = job.Name + " failed while quarantined."
+		}
+		githubCommand("warning", []string{"title=" + escapeProperty("Error "+verb+" quarantined "+job.String())}, msg)
+	}
+}
+
+func githubCommand(command string, props []string, msg string) {
+	fmt.Fprintf(os.Stdout, "::%s %s::%s\n", command, strings.Join(props, ","), escapeData(msg))
+}
+
+var dataEscaper = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+var propertyEscaper = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+
+func escapeData(s string) string     { return dataEscaper.Replace(s) }
+func escapeProperty(s string) string { return propertyEscaper.Replace(s) }
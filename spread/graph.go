@@ -0,0 +1,72 @@
+package spread
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Graph writes the jobs selected by options to w as a Graphviz graph in
+// DOT format. Jobs are grouped by the backend system they run on and by
+// suite, and jobs of serial and colocated suites, which cannot run in
+// parallel, are chained in the order they run.
+func (p *Project) Graph(w io.Writer, options *Options) error {
+	jobs, err := p.Jobs(options)
+	if err != nil {
+		return err
+	}
+
+	var systems [][2]string
+	bySystem := make(map[[2]string][]*Job)
+	for _, job := range jobs {
+		key := [2]string{job.Backend.Name, string(job.System)}
+		if _, ok := bySystem[key]; !ok {
+			systems = append(systems, key)
+		}
+		bySystem[key] = append(bySystem[key], job)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph spread {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for i, key := range systems {
+		prefix := key[0] + ":" + key[1] + ":"
+		workers := p.Backends[key[0]].SystemWorkers[key[1]]
+		label := fmt.Sprintf("%s:%s (%d worker%s)", key[0], key[1], workers, nth(workers, "s", "", "s"))
+		fmt.Fprintf(&buf, "\tsubgraph cluster_%d {\n\t\tlabel=%q;\n", i, label)
+
+		var suites []*Suite
+		bySuite := make(map[*Suite][]*Job)
+		for _, job := range bySystem[key] {
+			if _, ok := bySuite[job.Suite]; !ok {
+				suites = append(suites, job.Suite)
+			}
+			bySuite[job.Suite] = append(bySuite[job.Suite], job)
+		}
+		for _, suite := range suites {
+			id := prefix + suite.Name
+			label := suite.Name
+			if suite.Serial {
+				label += " (serial)"
+			} else if suite.Colocate {
+				label += " (colocated)"
+			}
+			fmt.Fprintf(&buf, "\t\t%q [label=%q, shape=folder];\n", id, label)
+			prev := id
+			for _, job := range bySuite[suite] {
+				fmt.Fprintf(&buf, "\t\t%q [label=%q];\n", job.Name, strings.TrimPrefix(job.Name, prefix))
+				if suite.Serial || suite.Colocate {
+					fmt.Fprintf(&buf, "\t\t%q -> %q [style=bold];\n", prev, job.Name)
+					prev = job.Name
+				} else {
+					fmt.Fprintf(&buf, "\t\t%q -> %q;\n", id, job.Name)
+				}
+			}
+		}
+		buf.WriteString("\t}\n")
+	}
+	buf.WriteString("}\n")
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
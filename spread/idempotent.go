@@ -0,0 +1,42 @@
+package spread
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checksIdempotent returns whether the prepare and restore scripts run
+// with the given verb are run a second time once they succeed, to verify
+// that they may safely run again on a server that already went through
+// them, as happens when servers are reused.
+func (r *Runner) checksIdempotent(verb string) bool {
+	return r.options.CheckIdempotent && !r.options.Restore && verb != executing
+}
+
+// checkIdempotent runs a prepare or restore script of context that just
+// succeeded once more with rerun, and returns an error if it fails the
+// second time or changes the output of any state probe of the project.
+func (r *Runner) checkIdempotent(client *Client, job *Job, verb string, context interface{}, rerun func() error) error {
+	var before map[string]string
+	if len(r.project.State) > 0 {
+		before = r.probeState(client, job)
+	}
+	logf("%s %s again to check that it is idempotent...", strings.Title(verb), job.StringFor(context))
+	if err := rerun(); err != nil {
+		return fmt.Errorf("not idempotent, failed when run again: %v", err)
+	}
+	if before == nil {
+		return nil
+	}
+	after := r.probeState(client, job)
+	var changed []string
+	for _, name := range sortedKeys(before) {
+		if state, ok := after[name]; ok && state != before[name] {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("not idempotent, running it again changed %s state", strings.Join(changed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package spread
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// insideDir returns where workers record on the server the client is
+// connected to which contexts they are inside of, so that a later
+// -restore run may restore exactly those even if the run that entered
+// them died without restoring them. Local servers are this very system,
+// so records are kept in the user's spread directory instead.
+func insideDir(client *Client) string {
+	if client.local() {
+		return os.ExpandEnv("$HOME/.spread")
+	}
+	return "/var/tmp"
+}
+
+// insideState records the contexts a worker is inside of on its server.
+// The job is the one the suite, fixture, and task were entered for, and
+// is used to restore them with the same environment.
+type insideState struct {
+	Job     string `yaml:"job"`
+	Project bool   `yaml:"project,omitempty"`
+	Backend bool   `yaml:"backend,omitempty"`
+	Suite   bool   `yaml:"suite,omitempty"`
+	Fixture bool   `yaml:"fixture,omitempty"`
+	Task    bool   `yaml:"task,omitempty"`
+}
+
+// insidePrefix returns the path prefix of the records of the project on
+// the server the client is connected to, which is followed by the number
+// of the worker and a .yaml suffix.
+func (r *Runner) insidePrefix(client *Client) string {
+	return fmt.Sprintf("%s/spread-inside-%s-", insideDir(client), r.project.Name)
+}
+
+func (r *Runner) insidePath(client *Client, index int) string {
+	return fmt.Sprintf("%s%d.yaml", r.insidePrefix(client), index+1)
+}
+
+// saveInside records state as the contexts the worker with the given
+// index is inside of on the server the client is connected to.
+func (r *Runner) saveInside(client *Client, index int, state *insideState) {
+	if r.options.Restore || r.options.NoRecord {
+		return
+	}
+	data, err := yaml.Marshal(state)
+	if err == nil && client.local() {
+		err = os.MkdirAll(insideDir(client), 0755)
+	}
+	if err == nil {
+		err = client.WriteFile(r.insidePath(client, index), data)
+	}
+	if err != nil {
+		printf("Cannot record state of %s: %v", client.Server(), err)
+	}
+}
+
+// clearInside removes the record of the contexts the worker with the
+// given index is inside of, once it restored them all.
+func (r *Runner) clearInside(client *Client, index int) {
+	if r.options.Restore || r.options.NoRecord {
+		return
+	}
+	if err := client.RemoveAll(r.insidePath(client, index)); err != nil {
+		printf("Cannot remove recorded state of %s: %v", client.Server(), err)
+	}
+}
+
+// replayInside runs the restore scripts of the contexts recorded on the
+// server by the workers of an earlier run, in the order they would have
+// run then, and returns whether any such record was found. Task, fixture,
+// and suite restores run for each recorded worker, while the backend and
+// project ones run once for all of them.
+func (r *Runner) replayInside(w *workerState, client *Client, backend *Backend, abend *bool) bool {
+	prefix := r.insidePrefix(client)
+	output, err := client.Output(fmt.Sprintf(`ls %s*.yaml 2>/dev/null || true`, prefix), "", nil)
+	if err != nil {
+		printf("Cannot find recorded state of %s: %v", client.Server(), err)
+		return false
+	}
+	// Records of projects with names extending this one are left alone.
+	var paths []string
+	for _, path := range strings.Fields(string(output)) {
+		n := strings.TrimSuffix(strings.TrimPrefix(path, prefix), ".yaml")
+		if _, err := strconv.Atoi(n); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return false
+	}
+	sort.Strings(paths)
+
+	jobs, err := r.allJobs()
+	if err != nil {
+		printf("Cannot restore recorded state of %s: %v", client.Server(), err)
+		return false
+	}
+
+	var stats = &r.stats
+	var last *Job
+	var project, inBackend bool
+	for _, path := range paths {
+		data, err := client.ReadFile(path)
+		var state insideState
+		if err == nil {
+			err = yaml.Unmarshal(data, &state)
+		}
+		if err != nil {
+			printf("Cannot read recorded state of %s: %v", client.Server(), err)
+			continue
+		}
+		job := jobs[state.Job]
+		if job == nil {
+			printf("Cannot restore recorded state of %s, job %q is not in the project.", client.Server(), state.Job)
+			continue
+		}
+		printf("Restoring recorded state of %s from %s...", client.Server(), path)
+		last = job
+		if state.Task && !r.run(client, job, restoring, job, job.Task.Restore, abend) {
+			r.record(w, &stats.TaskRestoreError, job)
+		}
+		fixture := job.Task.fixture
+		if state.Fixture && fixture != nil && !r.run(client, job, restoring, fixture, fixture.Restore, abend) {
+			r.record(w, &stats.FixtureRestoreError, job)
+		}
+		if state.Suite && !r.run(client, job, restoring, job.Suite, job.Suite.Restore, abend) {
+			r.record(w, &stats.SuiteRestoreError, job)
+		}
+		project = project || state.Project
+		inBackend = inBackend || state.Backend
+		if err := client.RemoveAll(path); err != nil {
+			printf("Cannot remove recorded state of %s: %v", client.Server(), err)
+		}
+	}
+	if last == nil {
+		return true
+	}
+	if inBackend && !r.run(client, last, restoring, backend, backend.Restore, abend) {
+		r.record(w, &stats.BackendRestoreError, last)
+	}
+	if project && !r.run(client, last, restoring, r.project, r.project.Restore, abend) {
+		r.record(w, &stats.ProjectRestoreError, last)
+	}
+	return true
+}
+
+// allJobs returns all jobs of the project by name, whatever the filter
+// selecting the jobs of the run.
+func (r *Runner) allJobs() (map[string]*Job, error) {
+	options := *r.options
+	options.Filter = nil
+	options.From, options.Until, options.Continue = "", "", ""
+	jobs, err := r.project.Jobs(&options)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*Job, len(jobs))
+	for _, job := range jobs {
+		byName[job.Name] = job
+	}
+	return byName, nil
+}
@@ -0,0 +1,72 @@
+package spread
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// jobLogPath returns the file holding the output of the scripts run for
+// job under the JobLogs option, named after the job with its suite and
+// task path split as backend:system:suite:task:variant.
+func (r *Runner) jobLogPath(job *Job) string {
+	return filepath.Join(r.options.JobLogs, strings.Replace(job.Name, "/", ":", -1)+".log")
+}
+
+// logJob writes the output of a script run while verb the given context
+// of job to the log file of the job, so that what happened to a single
+// job may be inspected without going through the output of all workers.
+// The file is truncated when first written in the run.
+func (r *Runner) logJob(client *Client, job *Job, verb string, context interface{}, output []byte, err error) {
+	if r.options.JobLogs == "" {
+		return
+	}
+	filename := r.jobLogPath(job)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	r.mu.Lock()
+	if r.jobLogs == nil {
+		r.jobLogs = make(map[string]bool)
+	}
+	if !r.jobLogs[filename] {
+		r.jobLogs[filename] = true
+		flags |= os.O_TRUNC
+	}
+	r.mu.Unlock()
+
+	if err := os.MkdirAll(r.options.JobLogs, 0755); err != nil {
+		printf("Cannot write log of %s: %v", job, err)
+		return
+	}
+	f, ferr := os.OpenFile(filename, flags, 0644)
+	if ferr != nil {
+		printf("Cannot write log of %s: %v", job, ferr)
+		return
+	}
+	defer f.Close()
+
+	f.WriteString(jobLogEntry(verb, job.StringFor(context), client.Server().String(), time.Now(), output, err))
+}
+
+// jobLogEntry returns the entry for the log file of a job with the output
+// of a script run while verb what on server at the given time.
+func jobLogEntry(verb, what, server string, at time.Time, output []byte, err error) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "-- %s %s on %s at %s\n", strings.Title(verb), what, server, at.Format(time.RFC3339))
+	text := maskSecrets(string(output))
+	if len(text) > 0 && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	buf.WriteString(text)
+	switch e := err.(type) {
+	case nil:
+		fmt.Fprintf(&buf, "-- Done %s\n\n", verb)
+	case *ExitStatusError:
+		fmt.Fprintf(&buf, "-- Error %s: exit status %d\n\n", verb, e.Status)
+	default:
+		fmt.Fprintf(&buf, "-- Error %s: %s\n\n", verb, maskSecrets(err.Error()))
+	}
+	return buf.String()
+}
@@ -0,0 +1,118 @@
+package spread
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Limits defines the resources the execute script of tasks may use on
+// the server, so that tasks sharing a server with other workers do not
+// starve them. The CPU and memory limits are enforced with a transient
+// systemd scope, and the priorities with nice and ionice, each only on
+// systems where the respective tool is available.
+type Limits struct {
+	Nice   *int
+	IONice *int `yaml:"ionice"`
+	CPU    string
+	Memory string
+
+	memory int64
+}
+
+var validCPU = regexp.MustCompile(`^[1-9][0-9]*%$`)
+
+// checkLimits makes sure the limits set in context are valid.
+func checkLimits(context fmt.Stringer, limits *Limits) error {
+	if limits == nil {
+		return nil
+	}
+	if n := limits.Nice; n != nil && (*n < 1 || *n > 19) {
+		return fmt.Errorf("%s has invalid nice limit, must be between 1 and 19: %d", context, *n)
+	}
+	if n := limits.IONice; n != nil && (*n < 1 || *n > 7) {
+		return fmt.Errorf("%s has invalid ionice limit, must be between 1 and 7: %d", context, *n)
+	}
+	if limits.CPU != "" && !validCPU.MatchString(limits.CPU) {
+		return fmt.Errorf("%s has invalid cpu limit, must be a percentage: %q", context, limits.CPU)
+	}
+	if limits.Memory != "" {
+		n, err := parseSize(limits.Memory)
+		if err != nil || n < 1<<20 {
+			return fmt.Errorf("%s has invalid memory limit, must be at least 1M: %q", context, limits.Memory)
+		}
+		limits.memory = n
+	}
+	return nil
+}
+
+// limitCommand returns the command prefix that runs the execute script
+// of job within the limits set by its task, or else by its backend, each
+// limit being resolved on its own. Limits that cannot be enforced on the
+// server are reported and ignored.
+func (r *Runner) limitCommand(client *Client, job *Job) string {
+	var l Limits
+	for _, limits := range []*Limits{job.Task.Limits, job.Backend.Limits} {
+		if limits == nil {
+			continue
+		}
+		if l.Nice == nil {
+			l.Nice = limits.Nice
+		}
+		if l.IONice == nil {
+			l.IONice = limits.IONice
+		}
+		if l.CPU == "" {
+			l.CPU = limits.CPU
+		}
+		if l.memory == 0 {
+			l.memory = limits.memory
+		}
+	}
+	cmd, missing := limitArgs(&l, client.hasCommand)
+	for _, tool := range missing {
+		printf("WARNING: Cannot limit %s of %s on %s, %s is missing.", limitTools[tool], job, client.Server(), tool)
+	}
+	return strings.Join(cmd, " ")
+}
+
+// limitTools maps the tools enforcing limits to what they limit.
+var limitTools = map[string]string{
+	"systemd-run": "CPU and memory",
+	"ionice":      "I/O priority",
+	"nice":        "CPU priority",
+}
+
+// limitArgs returns the command prefix enforcing the checked limits l
+// with the tools that hasCommand reports as available, and the tools
+// that are missing for the limits left unenforced.
+func limitArgs(l *Limits, hasCommand func(name string) bool) (cmd, missing []string) {
+	if l.CPU != "" || l.memory > 0 {
+		if hasCommand("systemd-run") {
+			cmd = append(cmd, "systemd-run", "--quiet", "--scope")
+			if l.CPU != "" {
+				cmd = append(cmd, "-p", "CPUQuota="+l.CPU)
+			}
+			if l.memory > 0 {
+				cmd = append(cmd, "-p", fmt.Sprintf("MemoryMax=%d", l.memory))
+			}
+		} else {
+			missing = append(missing, "systemd-run")
+		}
+	}
+	if l.IONice != nil {
+		if hasCommand("ionice") {
+			cmd = append(cmd, "ionice", "-c", "2", "-n", fmt.Sprint(*l.IONice))
+		} else {
+			missing = append(missing, "ionice")
+		}
+	}
+	if l.Nice != nil {
+		if hasCommand("nice") {
+			cmd = append(cmd, "nice", "-n", fmt.Sprint(*l.Nice))
+		} else {
+			missing = append(missing, "nice")
+		}
+	}
+	return cmd, missing
+}
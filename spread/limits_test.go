@@ -0,0 +1,95 @@
+package spread_test
+
+import (
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type LimitsSuite struct{}
+
+var _ = Suite(&LimitsSuite{})
+
+func intp(n int) *int { return &n }
+
+var checkLimitsTests = []struct {
+	limits spread.Limits
+	err    string
+}{
+	{spread.Limits{}, ""},
+	{spread.Limits{Nice: intp(1), IONice: intp(1)}, ""},
+	{spread.Limits{Nice: intp(19), IONice: intp(7)}, ""},
+	{spread.Limits{Nice: intp(0)}, `backend "lxd" has invalid nice limit, must be between 1 and 19: 0`},
+	{spread.Limits{Nice: intp(20)}, `backend "lxd" has invalid nice limit, must be between 1 and 19: 20`},
+	{spread.Limits{Nice: intp(-1)}, `backend "lxd" has invalid nice limit, must be between 1 and 19: -1`},
+	{spread.Limits{IONice: intp(0)}, `backend "lxd" has invalid ionice limit, must be between 1 and 7: 0`},
+	{spread.Limits{IONice: intp(8)}, `backend "lxd" has invalid ionice limit, must be between 1 and 7: 8`},
+	{spread.Limits{CPU: "150%"}, ""},
+	{spread.Limits{CPU: "0%"}, `backend "lxd" has invalid cpu limit, must be a percentage: "0%"`},
+	{spread.Limits{CPU: "150"}, `backend "lxd" has invalid cpu limit, must be a percentage: "150"`},
+	{spread.Limits{Memory: "1M"}, ""},
+	{spread.Limits{Memory: "2G"}, ""},
+	{spread.Limits{Memory: "512K"}, `backend "lxd" has invalid memory limit, must be at least 1M: "512K"`},
+	{spread.Limits{Memory: "lots"}, `backend "lxd" has invalid memory limit, must be at least 1M: "lots"`},
+}
+
+func (s *LimitsSuite) TestCheckLimits(c *C) {
+	c.Assert(spread.CheckLimits(nil), IsNil)
+	for _, test := range checkLimitsTests {
+		limits := test.limits
+		err := spread.CheckLimits(&limits)
+		if test.err == "" {
+			c.Check(err, IsNil, Commentf("limits: %#v", test.limits))
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+}
+
+var limitArgsTests = []struct {
+	limits  spread.Limits
+	tools   []string
+	cmd     []string
+	missing []string
+}{{
+	limits: spread.Limits{},
+	tools:  []string{"systemd-run", "ionice", "nice"},
+}, {
+	limits: spread.Limits{Nice: intp(10), IONice: intp(3)},
+	tools:  []string{"systemd-run", "ionice", "nice"},
+	cmd:    []string{"ionice", "-c", "2", "-n", "3", "nice", "-n", "10"},
+}, {
+	limits: spread.Limits{CPU: "200%", Memory: "2G"},
+	tools:  []string{"systemd-run"},
+	cmd:    []string{"systemd-run", "--quiet", "--scope", "-p", "CPUQuota=200%", "-p", "MemoryMax=2147483648"},
+}, {
+	limits: spread.Limits{Memory: "1M"},
+	tools:  []string{"systemd-run"},
+	cmd:    []string{"systemd-run", "--quiet", "--scope", "-p", "MemoryMax=1048576"},
+}, {
+	limits:  spread.Limits{CPU: "50%", Nice: intp(5), IONice: intp(1)},
+	tools:   []string{"nice"},
+	cmd:     []string{"nice", "-n", "5"},
+	missing: []string{"systemd-run", "ionice"},
+}, {
+	limits:  spread.Limits{Nice: intp(5)},
+	missing: []string{"nice"},
+}}
+
+func (s *LimitsSuite) TestLimitArgs(c *C) {
+	for _, test := range limitArgsTests {
+		limits := test.limits
+		c.Assert(spread.CheckLimits(&limits), IsNil)
+		has := func(name string) bool {
+			for _, tool := range test.tools {
+				if tool == name {
+					return true
+				}
+			}
+			return false
+		}
+		cmd, missing := spread.LimitArgs(&limits, has)
+		c.Check(cmd, DeepEquals, test.cmd, Commentf("limits: %#v", test.limits))
+		c.Check(missing, DeepEquals, test.missing, Commentf("limits: %#v", test.limits))
+	}
+}
@@ -13,15 +13,19 @@ import (
 	"time"
 )
 
-func Linode(b *Backend) Provider {
+func Linode(p *Project, b *Backend, o *Options) Provider {
 	return &linode{
+		project:  p,
 		backend:  b,
+		options:  o,
 		reserved: make(map[int]bool),
 	}
 }
 
 type linode struct {
+	project *Project
 	backend *Backend
+	options *Options
 
 	mu sync.Mutex
 
@@ -29,6 +33,10 @@ type linode struct {
 	keyErr     error
 	reserved   map[int]bool
 
+	// zoneUse counts the servers reserved per system and zone, to
+	// spread them according to the backend placement.
+	zoneUse map[string]map[string]int
+
 	templatesDone  bool
 	templatesCache []*linodeTemplate
 	kernelsCache   []*linodeKernel
@@ -47,6 +55,12 @@ type linodeServer struct {
 	Config int     `json:"-"`
 	Root   int     `json:"-"`
 	Swap   int     `json:"-"`
+	Data   int     `json:"-" yaml:",omitempty"`
+	Zone   int     `json:"DATACENTERID" yaml:"-"`
+
+	// placed holds the system the server was reserved for when
+	// counted in zoneUse.
+	placed string
 }
 
 func (s *linodeServer) String() string {
@@ -65,6 +79,24 @@ func (s *linodeServer) Image() ImageID {
 	return s.Img
 }
 
+// Storage returns the device of the data disk attached to the server,
+// which follows the root and swap disks in its configuration.
+func (s *linodeServer) Storage() string {
+	if s.Data == 0 {
+		return ""
+	}
+	return "/dev/sdc"
+}
+
+// disks returns the IDs of all disks created for the server.
+func (s *linodeServer) disks() []int {
+	disks := []int{s.Root, s.Swap}
+	if s.Data != 0 {
+		disks = append(disks, s.Data)
+	}
+	return disks
+}
+
 func (s *linodeServer) Snapshot() (ImageID, error) {
 	return "", nil
 }
@@ -108,6 +140,54 @@ func (l *linode) DiscardSnapshot(image ImageID) error {
 	return nil
 }
 
+// List returns the servers holding a configuration created by spread for
+// the project backend, as told by the tags in its comments.
+func (l *linode) List() ([]ListedServer, error) {
+	if err := l.checkKey(); err != nil {
+		return nil, err
+	}
+
+	servers, err := l.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var listed []ListedServer
+	for _, server := range servers {
+		server.l = l
+		configs, err := l.configs(server)
+		if err != nil {
+			return nil, err
+		}
+		for _, config := range configs {
+			var tags map[string]string
+			if json.Unmarshal([]byte(config.Comments), &tags) != nil {
+				continue
+			}
+			runID := tags["spread-run-id"]
+			if runID == "" || tags["spread-project"] != l.project.Name || tags["spread-backend"] != l.backend.Name {
+				continue
+			}
+			server.Img = ImageID(tags["spread-system"])
+			server.Config = config.ID
+			if disks := parseDiskList(config.DiskList); len(disks) > 1 {
+				server.Root, server.Swap = disks[0], disks[1]
+				if len(disks) > 2 {
+					server.Data = disks[2]
+				}
+			}
+			ip, err := l.ip(server)
+			if err != nil {
+				return nil, err
+			}
+			server.Addr = ip.IPAddress
+			listed = append(listed, ListedServer{server, runID})
+			break
+		}
+	}
+	return listed, nil
+}
+
 func (l *linode) Reuse(data []byte, password string) (Server, error) {
 	if err := l.checkKey(); err != nil {
 		return nil, err
@@ -136,7 +216,43 @@ func (l *linode) reserve(server *linodeServer) bool {
 func (l *linode) unreserve(server *linodeServer) {
 	l.mu.Lock()
 	delete(l.reserved, server.ID)
+	if server.placed != "" {
+		l.zoneUse[server.placed][strconv.Itoa(server.Zone)]--
+		server.placed = ""
+	}
+	l.mu.Unlock()
+}
+
+// pick reserves the first server among servers that is available to be
+// set up for image, trying them in the order set by the placement of the
+// backend, and returns nil if there is none.
+func (l *linode) pick(servers []*linodeServer, image ImageID) *linodeServer {
+	system := string(image.SystemID())
+	zones := make([]string, len(servers))
+	for i, server := range servers {
+		zones[i] = strconv.Itoa(server.Zone)
+	}
+	l.mu.Lock()
+	order := placementOrder(l.backend.Placement, zones, l.zoneUse[system])
 	l.mu.Unlock()
+	for _, i := range order {
+		server := servers[i]
+		if (server.Status != linodeBrandNew && server.Status != linodePoweredOff) || !l.reserve(server) {
+			continue
+		}
+		l.mu.Lock()
+		if l.zoneUse == nil {
+			l.zoneUse = make(map[string]map[string]int)
+		}
+		if l.zoneUse[system] == nil {
+			l.zoneUse[system] = make(map[string]int)
+		}
+		l.zoneUse[system][zones[i]]++
+		server.placed = system
+		l.mu.Unlock()
+		return server
+	}
+	return nil
 }
 
 func (l *linode) Allocate(image ImageID, password string) (Server, error) {
@@ -151,27 +267,61 @@ func (l *linode) Allocate(image ImageID, password string) (Server, error) {
 	if len(servers) == 0 {
 		return nil, FatalError{fmt.Errorf("no servers in Linode account")}
 	}
-	// Iterate out of order to reduce conflicts.
-	for _, i := range rnd.Perm(len(servers)) {
-		server := servers[i]
-		if (server.Status != linodeBrandNew && server.Status != linodePoweredOff) || !l.reserve(server) {
-			continue
+	server := l.pick(servers, image)
+	if server == nil {
+		if p := l.backend.Placement; p != nil && len(p.Zones) > 0 {
+			return nil, fmt.Errorf("no powered off servers in Linode account in zones %s", strings.Join(p.Zones, ", "))
 		}
-		err := l.setup(server, image, password)
-		if err != nil {
-			l.unreserve(server)
-			return nil, err
+		return nil, fmt.Errorf("no powered off servers in Linode account")
+	}
+	err = l.setup(server, image, password)
+	if err != nil {
+		l.unreserve(server)
+		return nil, err
+	}
+	printf("Allocated %s.", server)
+	return server, nil
+}
+
+// AllocateBatch allocates servers for all the given images listing the
+// servers in the account only once, and sets them up concurrently.
+func (l *linode) AllocateBatch(images []ImageID, password string) ([]Server, error) {
+	if err := l.checkKey(); err != nil {
+		return nil, err
+	}
+
+	servers, err := l.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	result := make([]Server, len(images))
+	for i, image := range images {
+		server := l.pick(servers, image)
+		if server == nil {
+			break
 		}
-		printf("Allocated %s.", server)
-		return server, nil
+		wg.Add(1)
+		go func(i int, server *linodeServer, image ImageID) {
+			defer wg.Done()
+			if err := l.setup(server, image, password); err != nil {
+				l.unreserve(server)
+				printf("Cannot allocate %s: %v", server, err)
+				return
+			}
+			printf("Allocated %s.", server)
+			result[i] = server
+		}(i, server, image)
 	}
-	return nil, fmt.Errorf("no powered off servers in Linode account")
+	wg.Wait()
+	return result, nil
 }
 
 func (s *linodeServer) Discard() error {
 	_, err1 := s.l.shutdown(s)
 	err2 := s.l.removeConfig(s, s.Config)
-	err3 := s.l.removeDisks(s, s.Root, s.Swap)
+	err3 := s.l.removeDisks(s, s.disks()...)
 	s.l.unreserve(s)
 	return firstErr(err1, err2, err3)
 }
@@ -221,36 +371,41 @@ func (l *linode) setup(server *linodeServer, image ImageID, password string) err
 	server.l = l
 	server.Img = image
 
-	rootJob, swapJob, err := l.createDisk(server, image, password)
+	name := l.name(image)
+
+	rootJob, swapJob, dataJob, err := l.createDisk(server, image, name, password)
 	if err != nil {
 		return err
 	}
 	server.Root = rootJob.DiskID
 	server.Swap = swapJob.DiskID
+	if dataJob != nil {
+		server.Data = dataJob.DiskID
+	}
 
 	if _, err := l.waitJob(server, "allocate disk", rootJob.JobID); err != nil {
-		l.removeDisks(server, server.Root, server.Swap)
+		l.removeDisks(server, server.disks()...)
 		return err
 	}
 
 	if status, err := l.status(server); err != nil {
-		l.removeDisks(server, server.Root, server.Swap)
+		l.removeDisks(server, server.disks()...)
 		return err
 	} else if status != linodeBrandNew && status != linodePoweredOff {
-		l.removeDisks(server, server.Root, server.Swap)
+		l.removeDisks(server, server.disks()...)
 		return fmt.Errorf("server %s concurrently allocated, giving up on it.", server)
 	}
 	if conflict, err := l.hasRecentDisk(server, server.Root); err != nil {
-		l.removeDisks(server, server.Root, server.Swap)
+		l.removeDisks(server, server.disks()...)
 		return err
 	} else if conflict {
-		l.removeDisks(server, server.Root, server.Swap)
+		l.removeDisks(server, server.disks()...)
 		return fmt.Errorf("server %s concurrently allocated, giving up on it.", server)
 	}
 
-	configID, err := l.createConfig(server, image, server.Root, server.Swap)
+	configID, err := l.createConfig(server, image, name, server.disks())
 	if err != nil {
-		l.removeDisks(server, server.Root, server.Swap)
+		l.removeDisks(server, server.disks()...)
 		return err
 	}
 	server.Config = configID
@@ -261,7 +416,7 @@ func (l *linode) setup(server *linodeServer, image ImageID, password string) err
 	}
 	if err != nil {
 		l.removeConfig(server, server.Config)
-		l.removeDisks(server, server.Root, server.Swap)
+		l.removeDisks(server, server.disks()...)
 		return err
 	}
 
@@ -328,30 +483,64 @@ type linodeDiskJobResult struct {
 	Data *linodeDiskJob `json:"DATA"`
 }
 
-func (l *linode) createDisk(server *linodeServer, image ImageID, password string) (root, swap *linodeDiskJob, err error) {
+// linodeNameMax is the longest label accepted for disks and configurations.
+const linodeNameMax = 40
+
+// name returns the name for a new server running image, after the
+// instance-name template of the backend, or an empty string if unset.
+func (l *linode) name(image ImageID) string {
+	if l.backend.InstanceName == "" {
+		return ""
+	}
+	return instanceName(l.backend, l.options, image, linodeNameMax)
+}
+
+// label returns the label for disks and configurations created for a
+// server, named after the instance-name template of the backend if set.
+func (l *linode) label(image ImageID, name, note string) string {
+	if name == "" {
+		return image.Label(note)
+	}
+	if note != "" {
+		return name + " (" + note + ")"
+	}
+	return name
+}
+
+func (l *linode) createDisk(server *linodeServer, image ImageID, name, password string) (root, swap, data *linodeDiskJob, err error) {
 	template, err := l.template(image)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	createRoot := linodeParams{
 		"LinodeID": server.ID,
-		"Label":    image.Label("root"),
+		"Label":    l.label(image, name, "root"),
 		"Size":     2048,
 		"rootPass": password,
 	}
 	createSwap := linodeParams{
 		"api_action": "linode.disk.create",
 		"LinodeID":   server.ID,
-		"Label":      image.Label("swap"),
+		"Label":      l.label(image, name, "swap"),
 		"Size":       64,
 		"Type":       "swap",
 	}
 
 	logf("Creating disk on %s with %s...", server, image)
+	batch := []linodeParams{createRoot, createSwap}
+	if size := l.backend.storageSize(image); size > 0 {
+		batch = append(batch, linodeParams{
+			"api_action": "linode.disk.create",
+			"LinodeID":   server.ID,
+			"Label":      l.label(image, name, "data"),
+			"Size":       (size + 1<<20 - 1) >> 20,
+			"Type":       "raw",
+		})
+	}
 	params := linodeParams{
 		"api_action":       "batch",
-		"api_requestArray": []linodeParams{createRoot, createSwap},
+		"api_requestArray": batch,
 	}
 
 	if template.DistroID > 0 {
@@ -363,27 +552,35 @@ func (l *linode) createDisk(server *linodeServer, image ImageID, password string
 	}
 
 	var results []linodeDiskJobResult
+	var created []*linodeDiskJob
 	err = l.do(params, &results)
-	for i, result := range results {
+	for _, result := range results {
 		if e := result.err(); e != nil {
 			err = e
 			break
 		}
-		if i == 0 {
-			root = result.Data
+		created = append(created, result.Data)
+		if len(created) < len(batch) {
 			continue
 		}
-		swap = result.Data
-		return root, swap, nil
+		root, swap = created[0], created[1]
+		if len(created) > 2 {
+			data = created[2]
+		}
+		return root, swap, data, nil
 	}
 
-	if root != nil {
-		l.removeDisks(server, root.DiskID)
+	var diskIDs []int
+	for _, job := range created {
+		diskIDs = append(diskIDs, job.DiskID)
 	}
-	if len(results) == 0 {
+	if len(diskIDs) > 0 {
+		l.removeDisks(server, diskIDs...)
+	}
+	if err == nil {
 		err = fmt.Errorf("empty batch result")
 	}
-	return nil, nil, fmt.Errorf("cannot create Linode disk with %s: %v", image, err)
+	return nil, nil, nil, fmt.Errorf("cannot create Linode disk with %s: %v", image, err)
 }
 
 func (l *linode) removeDisks(server *linodeServer, diskIDs ...int) error {
@@ -420,7 +617,7 @@ type linodeConfigResult struct {
 	} `json:"DATA"`
 }
 
-func (l *linode) createConfig(server *linodeServer, image ImageID, rootID, swapID int) (configID int, err error) {
+func (l *linode) createConfig(server *linodeServer, image ImageID, name string, diskIDs []int) (configID int, err error) {
 	logf("Creating configuration on %s with %s...", server, image)
 
 	template, err := l.template(image)
@@ -432,8 +629,9 @@ func (l *linode) createConfig(server *linodeServer, image ImageID, rootID, swapI
 		"api_action":             "linode.config.create",
 		"LinodeID":               server.ID,
 		"KernelID":               template.Kernel.ID,
-		"Label":                  image.Label(""),
-		"DiskList":               fmt.Sprintf("%d,%d", rootID, swapID),
+		"Label":                  l.label(image, name, ""),
+		"Comments":               l.comments(image),
+		"DiskList":               diskList(diskIDs),
 		"RootDeviceNum":          1,
 		"RootDeviceR0":           true,
 		"helper_disableUpdateDB": true,
@@ -454,6 +652,66 @@ func (l *linode) createConfig(server *linodeServer, image ImageID, rootID, swapI
 	return result.Data.ConfigID, nil
 }
 
+type linodeConfig struct {
+	ID       int    `json:"ConfigID"`
+	Comments string `json:"Comments"`
+	DiskList string `json:"DiskList"`
+}
+
+type linodeConfigListResult struct {
+	linodeResult
+	Data []*linodeConfig `json:"DATA"`
+}
+
+func (l *linode) configs(server *linodeServer) ([]*linodeConfig, error) {
+	debugf("Listing configurations of %s...", server)
+	params := linodeParams{
+		"api_action": "linode.config.list",
+		"LinodeID":   server.ID,
+	}
+	var result linodeConfigListResult
+	err := l.do(params, &result)
+	if err == nil {
+		err = result.err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot list configurations of %s: %v", server, err)
+	}
+	return result.Data, nil
+}
+
+// comments returns the comments for configurations created for a server
+// running image, holding the server tags so it may be found later.
+func (l *linode) comments(image ImageID) string {
+	data, err := json.Marshal(instanceTags(l.project, l.backend, l.options, image))
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// diskList returns the given disk IDs in the format of a configuration
+// disk list, in which they become /dev/sda, /dev/sdb, and so on.
+func diskList(diskIDs []int) string {
+	var ids []string
+	for _, id := range diskIDs {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return strings.Join(ids, ",")
+}
+
+// parseDiskList returns the disk IDs in a configuration disk list, which
+// has empty entries for unused devices.
+func parseDiskList(list string) []int {
+	var ids []int
+	for _, s := range strings.Split(list, ",") {
+		if id, err := strconv.Atoi(s); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
 func (l *linode) removeConfig(server *linodeServer, configID int) error {
 	logf("Removing configuration from %s...", server)
 
@@ -537,7 +795,7 @@ func (l *linode) waitJob(server *linodeServer, verb string, jobID int) (*linodeJ
 				return nil, infoErr
 			}
 			l.removeConfig(server, server.Config)
-			l.removeDisks(server, server.Root, server.Swap)
+			l.removeDisks(server, server.disks()...)
 			return nil, fmt.Errorf("timeout waiting for %s to %s", server, verb)
 
 		case <-retry.C:
@@ -713,6 +971,11 @@ func (l *linode) template(image ImageID) (*linodeTemplate, error) {
 	l.templatesDone = true
 
 	var system = string(image.SystemID())
+	if override := l.options.image(l.backend, image); override != "" {
+		system = override
+	} else if alias := l.backend.imageAlias(image); alias != "" {
+		system = alias
+	}
 	var best *linodeTemplate
 	for _, template := range l.templatesCache {
 		if template.Name != system {
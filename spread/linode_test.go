@@ -0,0 +1,318 @@
+package spread_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type LinodeSuite struct{}
+
+var _ = Suite(&LinodeSuite{})
+
+// linodeList answers linode.list requests with the given servers, as
+// a JSON array of objects in the Linode API format.
+func linodeList(servers string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if action := req.FormValue("api_action"); action != "linode.list" {
+			http.Error(w, "unexpected action "+action, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"ERRORARRAY": [], "ACTION": "linode.list", "DATA": %s}`, servers)
+	})
+}
+
+const linodeServers = `[
+	{"LINODEID": 1, "LABEL": "one", "STATUS": 1, "DATACENTERID": 2},
+	{"LINODEID": 2, "LABEL": "two", "STATUS": 2, "DATACENTERID": 2},
+	{"LINODEID": 3, "LABEL": "three", "STATUS": 2, "DATACENTERID": 6},
+	{"LINODEID": 4, "LABEL": "four", "STATUS": 0, "DATACENTERID": 9}
+]`
+
+var linodePickTests = []struct {
+	placement *spread.Placement
+	labels    []string
+	zones     []int
+}{{
+	// Running servers are never picked.
+	placement: nil,
+	labels:    []string{"four", "three", "two"},
+	zones:     []int{2, 6, 9},
+}, {
+	placement: &spread.Placement{Policy: "pin", Zones: []string{"6"}},
+	labels:    []string{"three"},
+	zones:     []int{6},
+}, {
+	placement: &spread.Placement{Policy: "pin", Zones: []string{"2", "9"}},
+	labels:    []string{"four", "two"},
+	zones:     []int{2, 9},
+}, {
+	placement: &spread.Placement{Policy: "spread", Zones: []string{"6", "9"}},
+	labels:    []string{"four", "three"},
+	zones:     []int{6, 9},
+}}
+
+func (s *LinodeSuite) TestPickPlacement(c *C) {
+	defer spread.FakeLinodeAPI(linodeList(linodeServers))()
+
+	for _, test := range linodePickTests {
+		backend := &spread.Backend{Name: "linode", Type: "linode", Placement: test.placement}
+		p := spread.Linode(&spread.Project{}, backend, &spread.Options{})
+		var labels []string
+		var zones []int
+		for {
+			label, zone, err := spread.LinodePick(p, "ubuntu-16.04")
+			c.Assert(err, IsNil)
+			if label == "" {
+				break
+			}
+			labels = append(labels, label)
+			zones = append(zones, zone)
+		}
+		sort.Strings(labels)
+		sort.Ints(zones)
+		c.Check(labels, DeepEquals, test.labels, Commentf("placement: %#v", test.placement))
+		c.Check(zones, DeepEquals, test.zones, Commentf("placement: %#v", test.placement))
+	}
+}
+
+func (s *LinodeSuite) TestPickSpreadsZones(c *C) {
+	defer spread.FakeLinodeAPI(linodeList(`[
+		{"LINODEID": 1, "LABEL": "a1", "STATUS": 2, "DATACENTERID": 2},
+		{"LINODEID": 2, "LABEL": "a2", "STATUS": 2, "DATACENTERID": 2},
+		{"LINODEID": 3, "LABEL": "b1", "STATUS": 2, "DATACENTERID": 6},
+		{"LINODEID": 4, "LABEL": "b2", "STATUS": 2, "DATACENTERID": 6}
+	]`))()
+
+	// The first two servers picked are in different zones.
+	backend := &spread.Backend{Name: "linode", Type: "linode", Placement: &spread.Placement{Policy: "spread"}}
+	p := spread.Linode(&spread.Project{}, backend, &spread.Options{})
+	_, zone1, err := spread.LinodePick(p, "ubuntu-16.04")
+	c.Assert(err, IsNil)
+	_, zone2, err := spread.LinodePick(p, "ubuntu-16.04")
+	c.Assert(err, IsNil)
+	c.Assert(zone1, Not(Equals), zone2)
+}
+
+// linodeActions answers each Linode API action with its respective
+// DATA and ERRORARRAY contents.
+func linodeActions(data, errors map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		action := req.FormValue("api_action")
+		d, ok := data[action]
+		if !ok {
+			http.Error(w, "unexpected action "+action, http.StatusBadRequest)
+			return
+		}
+		e := errors[action]
+		if e == "" {
+			e = "[]"
+		}
+		fmt.Fprintf(w, `{"ERRORARRAY": %s, "ACTION": %q, "DATA": %s}`, e, action, d)
+	})
+}
+
+var linodeBatchTests = []struct {
+	data    map[string]string
+	errors  map[string]string
+	servers int
+	err     string
+}{{
+	data:   map[string]string{"test.echo": "{}"},
+	errors: map[string]string{"test.echo": `[{"ERRORCODE": 4, "ERRORMESSAGE": "Authentication failed"}]`},
+	err:    "authentication failed",
+}, {
+	data:   map[string]string{"test.echo": "{}", "linode.list": "[]"},
+	errors: map[string]string{"linode.list": `[{"ERRORCODE": 5, "ERRORMESSAGE": "Object not found"}]`},
+	err:    "object not found",
+}, {
+	// Running servers are left alone, and images get no server.
+	data:    map[string]string{"test.echo": "{}", "linode.list": `[{"LINODEID": 1, "LABEL": "one", "STATUS": 1}]`},
+	servers: 0,
+}}
+
+func (s *LinodeSuite) TestAllocateBatch(c *C) {
+	for _, test := range linodeBatchTests {
+		restore := spread.FakeLinodeAPI(linodeActions(test.data, test.errors))
+		backend := &spread.Backend{Name: "linode", Type: "linode", Key: "key"}
+		p := spread.Linode(&spread.Project{}, backend, &spread.Options{})
+		servers, err := p.(spread.BatchAllocator).AllocateBatch([]spread.ImageID{"ubuntu-16.04", "ubuntu-18.04"}, "secret")
+		restore()
+		if test.err != "" {
+			c.Check(err, ErrorMatches, test.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(servers, HasLen, 2)
+		allocated := 0
+		for _, server := range servers {
+			if server != nil {
+				allocated++
+			}
+		}
+		c.Check(allocated, Equals, test.servers)
+	}
+}
+
+var linodeNameTests = []struct {
+	template string
+	backend  string
+	system   spread.ImageID
+	runID    string
+	name     string
+}{{
+	template: "",
+	backend:  "linode",
+	system:   "ubuntu-16.04",
+	name:     "",
+}, {
+	template: "spread-$RUN_ID-$SYSTEM-$RANDOM",
+	backend:  "linode",
+	system:   "ubuntu-16.04",
+	runID:    "abc",
+	name:     "spread-abc-ubuntu-16-04-[0-9a-f]{6}",
+}, {
+	// Long names are cut, but the random part is kept.
+	template: "$BACKEND-$SYSTEM-$RANDOM",
+	backend:  strings.Repeat("b", 50),
+	system:   spread.ImageID("ubuntu-" + strings.Repeat("s", 60)),
+	name:     "b{16}-ubuntu-s{9}-[0-9a-f]{6}",
+}, {
+	template: "spread-$RUN_ID-$RANDOM",
+	backend:  "linode",
+	system:   "ubuntu-16.04",
+	runID:    strings.Repeat("r", 70),
+	name:     "spread-r{26}-[0-9a-f]{6}",
+}, {
+	template: strings.Repeat("x", 70) + "-$SYSTEM-$RANDOM",
+	backend:  "linode",
+	system:   "ubuntu-16.04",
+	name:     "x{33}-[0-9a-f]{6}",
+}}
+
+func (s *LinodeSuite) TestName(c *C) {
+	for _, test := range linodeNameTests {
+		backend := &spread.Backend{Name: test.backend, Type: "linode", InstanceName: test.template}
+		p := spread.Linode(&spread.Project{}, backend, &spread.Options{RunID: test.runID})
+		name1 := spread.LinodeName(p, test.system)
+		name2 := spread.LinodeName(p, test.system)
+		c.Check(name1, Matches, test.name, Commentf("template: %s", test.template))
+		if test.name != "" {
+			c.Check(name2, Not(Equals), name1)
+		}
+	}
+}
+
+// linodeTemplates holds the answers to the Linode API actions used to
+// find the distribution and kernel for ubuntu-16.04.
+var linodeTemplates = map[string]string{
+	"avail.distributions": `[{"DISTRIBUTIONID": 1, "LABEL": "Ubuntu 16.04 LTS", "IS64BIT": 1}]`,
+	"image.list":          `[]`,
+	"avail.kernels":       `[{"KERNELID": 1, "LABEL": "Latest 64 bit (4.1)"}, {"KERNELID": 2, "LABEL": "Latest 32 bit (4.1)"}]`,
+}
+
+func (s *LinodeSuite) TestConfigTags(c *C) {
+	data := map[string]string{"linode.config.create": `{"CONFIGID": 7}`}
+	for action, answer := range linodeTemplates {
+		data[action] = answer
+	}
+	var comments string
+	handler := linodeActions(data, nil)
+	defer spread.FakeLinodeAPI(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("api_action") == "linode.config.create" {
+			comments = req.FormValue("Comments")
+		}
+		handler.ServeHTTP(w, req)
+	}))()
+
+	project := &spread.Project{Name: "project"}
+	backend := &spread.Backend{Name: "linode", Type: "linode", Tags: map[string]string{"team": "devices"}}
+	p := spread.Linode(project, backend, &spread.Options{RunID: "abc"})
+	configID, err := spread.LinodeCreateConfig(p, "ubuntu-16.04")
+	c.Assert(err, IsNil)
+	c.Assert(configID, Equals, 7)
+
+	var tags map[string]string
+	c.Assert(json.Unmarshal([]byte(comments), &tags), IsNil)
+	c.Assert(tags, DeepEquals, map[string]string{
+		"team":           "devices",
+		"spread-project": "project",
+		"spread-backend": "linode",
+		"spread-system":  "ubuntu-16.04",
+		"spread-run-id":  "abc",
+	})
+}
+
+// linodeOrphanConfigs holds the configurations of each server in
+// linodeOrphanServers, by server ID.
+var linodeOrphanConfigs = map[string]string{
+	"1": `[{"ConfigID": 10, "DiskList": "11,12,13,,,,,,", "Comments": "{\"spread-project\": \"project\", \"spread-backend\": \"linode\", \"spread-system\": \"ubuntu-16.04\", \"spread-run-id\": \"gone\"}"}]`,
+	"2": `[{"ConfigID": 20, "DiskList": "21,22,,,,,,,", "Comments": "{\"spread-project\": \"other\", \"spread-backend\": \"linode\", \"spread-system\": \"ubuntu-16.04\", \"spread-run-id\": \"gone\"}"}]`,
+	"3": `[{"ConfigID": 30, "DiskList": "31,32,,,,,,,", "Comments": "Created by hand."}]`,
+	"4": `[]`,
+}
+
+const linodeOrphanServers = `[
+	{"LINODEID": 1, "LABEL": "one", "STATUS": 1},
+	{"LINODEID": 2, "LABEL": "two", "STATUS": 1},
+	{"LINODEID": 3, "LABEL": "three", "STATUS": 1},
+	{"LINODEID": 4, "LABEL": "four", "STATUS": 2}
+]`
+
+// linodeOrphans answers the Linode API actions used to list and discard
+// the servers in linodeOrphanServers, recording the requests made to
+// change them in changes.
+func linodeOrphans(changes *[]string) http.Handler {
+	handler := linodeActions(map[string]string{
+		"test.echo":            "{}",
+		"linode.list":          linodeOrphanServers,
+		"linode.ip.list":       `[{"IPADDRESS": "10.0.0.1", "ISPUBLIC": 1}]`,
+		"linode.shutdown":      `{"JOBID": 1}`,
+		"linode.config.delete": `{}`,
+	}, nil)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch action := req.FormValue("api_action"); action {
+		case "linode.config.list":
+			fmt.Fprintf(w, `{"ERRORARRAY": [], "DATA": %s}`, linodeOrphanConfigs[req.FormValue("LinodeID")])
+		case "batch":
+			*changes = append(*changes, action+" "+req.FormValue("api_requestArray"))
+			fmt.Fprintf(w, `[{"ERRORARRAY": []}]`)
+		default:
+			if action != "test.echo" && !strings.HasSuffix(action, ".list") {
+				*changes = append(*changes, action+" "+req.FormValue("LinodeID")+" "+req.FormValue("ConfigID"))
+			}
+			handler.ServeHTTP(w, req)
+		}
+	})
+}
+
+func (s *LinodeSuite) TestList(c *C) {
+	var changes []string
+	defer spread.FakeLinodeAPI(linodeOrphans(&changes))()
+
+	// Only servers with a configuration tagged for the project backend
+	// are listed.
+	backend := &spread.Backend{Name: "linode", Type: "linode", Key: "key"}
+	p := spread.Linode(&spread.Project{Name: "project"}, backend, &spread.Options{})
+	listed, err := p.List()
+	c.Assert(err, IsNil)
+	c.Assert(listed, HasLen, 1)
+	c.Assert(listed[0].RunID, Equals, "gone")
+	server := listed[0].Server
+	c.Assert(server.String(), Equals, "linode:ubuntu-16.04 (one)")
+	c.Assert(server.Address(), Equals, "10.0.0.1")
+	c.Assert(server.Image(), Equals, spread.ImageID("ubuntu-16.04"))
+
+	// Discarding it removes the configuration and disks found.
+	c.Assert(server.Discard(), IsNil)
+	c.Assert(changes, HasLen, 3)
+	c.Check(changes[0], Equals, "linode.shutdown 1 ")
+	c.Check(changes[1], Equals, "linode.config.delete 1 10")
+	c.Check(changes[2], Matches, `batch \[(\{"DiskID":1[123],[^}]*\},?){3}\]`)
+}
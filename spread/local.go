@@ -0,0 +1,70 @@
+package spread
+
+import (
+	"fmt"
+)
+
+func Local(p *Project, b *Backend, o *Options) Provider {
+	return &local{p, b, o}
+}
+
+type local struct {
+	project *Project
+	backend *Backend
+	options *Options
+}
+
+type localServer struct {
+	l     *local
+	image ImageID
+}
+
+func (s *localServer) String() string {
+	return fmt.Sprintf("%s:%s (localhost)", s.l.backend.Name, s.image.SystemID())
+}
+
+func (s *localServer) Provider() Provider {
+	return s.l
+}
+
+func (s *localServer) Address() string {
+	return "localhost"
+}
+
+func (s *localServer) Image() ImageID {
+	return s.image
+}
+
+func (s *localServer) Snapshot() (ImageID, error) {
+	return "", nil
+}
+
+func (s *localServer) ReuseData() []byte {
+	return nil
+}
+
+func (s *localServer) Discard() error {
+	return nil
+}
+
+func (l *local) Backend() *Backend {
+	return l.backend
+}
+
+func (l *local) DiscardSnapshot(image ImageID) error {
+	return nil
+}
+
+func (l *local) List() ([]ListedServer, error) {
+	return nil, nil
+}
+
+func (l *local) Reuse(data []byte, password string) (Server, error) {
+	return nil, fmt.Errorf("cannot reuse servers on %s", l.backend)
+}
+
+func (l *local) Allocate(image ImageID, password string) (Server, error) {
+	server := &localServer{l, image}
+	printf("Allocated %s.", server)
+	return server, nil
+}
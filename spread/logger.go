@@ -2,9 +2,16 @@ package spread
 
 import (
 	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
 	stdlog "log"
-	"github.com/kr/pretty"
+	"os"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/kr/pretty"
 )
 
 // Logger defines the logger where messages should be sent to.
@@ -16,39 +23,51 @@ var Verbose bool
 // Debug defines whether to also deliver debug messages to the log. Implies Verbose if set.
 var Debug bool
 
+// Color defines whether to color messages delivered to Logger by severity.
+// Messages sent to the log file are never colored.
+var Color bool
+
+// logging reports whether messages are delivered anywhere, given whether
+// they are to be shown by Logger, so that unused ones aren't formatted.
+func logging(show bool) bool {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return show && Logger != nil || logFile != nil
+}
+
 func print(args ...interface{}) {
-	if Logger != nil {
-		writeLog(pretty.Sprint(args...))
+	if logging(true) {
+		writeLog(true, pretty.Sprint(args...))
 	}
 }
 
 func printf(format string, args ...interface{}) {
-	if Logger != nil {
-		writeLog(pretty.Sprintf(format, args...))
+	if logging(true) {
+		writeLog(true, pretty.Sprintf(format, args...))
 	}
 }
 
 func log(args ...interface{}) {
-	if (Verbose || Debug) && Logger != nil {
-		writeLog(pretty.Sprint(args...))
+	if logging(Verbose || Debug) {
+		writeLog((Verbose || Debug), pretty.Sprint(args...))
 	}
 }
 
 func logf(format string, args ...interface{}) {
-	if (Verbose || Debug) && Logger != nil {
-		writeLog(pretty.Sprintf(format, args...))
+	if logging(Verbose || Debug) {
+		writeLog((Verbose || Debug), pretty.Sprintf(format, args...))
 	}
 }
 
 func debug(args ...interface{}) {
-	if Debug && Logger != nil {
-		writeLog(pretty.Sprint(args...))
+	if logging(Debug) {
+		writeLog(Debug, pretty.Sprint(args...))
 	}
 }
 
 func debugf(format string, args ...interface{}) {
-	if Debug && Logger != nil {
-		writeLog(pretty.Sprintf(format, args...))
+	if logging(Debug) {
+		writeLog(Debug, pretty.Sprintf(format, args...))
 	}
 }
 
@@ -56,11 +75,215 @@ var termMu sync.Mutex
 var logMu sync.Mutex
 var logCache bytes.Buffer
 var logSaved stdlog.Logger
+var logShown time.Time
+var logSecrets []string
+
+// maskSecret replaces all occurrences of secret in messages logged
+// from now on.
+func maskSecret(secret string) {
+	logMu.Lock()
+	logSecrets = append(logSecrets, secret)
+	logMu.Unlock()
+}
+
+// maskSecrets returns s with all secrets registered with maskSecret
+// replaced.
+func maskSecrets(s string) string {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return maskSecretsLocked(s)
+}
+
+func maskSecretsLocked(s string) string {
+	for _, secret := range logSecrets {
+		s = strings.Replace(s, secret, "*****", -1)
+	}
+	return s
+}
 
-func writeLog(line string) {
+func writeLog(show bool, line string) {
 	logMu.Lock()
 	defer logMu.Unlock()
-	Logger.Output(3, line)
+	line = maskSecretsLocked(line)
+	if show && Logger != nil {
+		if Color {
+			Logger.Output(3, colorize(line))
+		} else {
+			Logger.Output(3, line)
+		}
+		logShown = time.Now()
+	}
+	if logFile != nil {
+		logFileLogger.Output(3, line)
+	}
+}
+
+// idleFor returns how long it has been since a message was last shown.
+func idleFor() time.Duration {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return time.Since(logShown)
+}
+
+// logFile holds the file all messages are sent to, including verbose and
+// debug ones, when the LogFile option is set.
+var logFile *rotatingFile
+var logFileLogger *stdlog.Logger
+
+func openLog(path string, maxSize int64, compress bool) error {
+	f, err := openRotatingFile(path, maxSize, compress)
+	if err != nil {
+		return err
+	}
+	logMu.Lock()
+	logFile = f
+	logFileLogger = stdlog.New(f, "", stdlog.LstdFlags)
+	logMu.Unlock()
+	return nil
+}
+
+func closeLog() {
+	logMu.Lock()
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+		logFileLogger = nil
+	}
+	logMu.Unlock()
+}
+
+// How many rotated log files are kept around besides the current one.
+const logFileKeep = 5
+
+// rotatingFile is a file writer that moves the file aside once it grows
+// beyond maxSize, optionally compressing the old content with gzip.
+// Compression happens in the background, as writes are made while all
+// logging is locked.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	compress bool
+	file     *os.File
+	size     int64
+
+	compressing sync.WaitGroup
+}
+
+func openRotatingFile(path string, maxSize int64, compress bool) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, compress: compress}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot open log file: %v", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, fmt.Errorf("log file %s is closed", f.path)
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	f.compressing.Wait()
+	return err
+}
+
+func (f *rotatingFile) rotated(n int) string {
+	name := fmt.Sprintf("%s.%d", f.path, n)
+	if f.compress {
+		name += ".gz"
+	}
+	return name
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("cannot close log file: %v", err)
+	}
+	f.file = nil
+
+	// The file last rotated must be in place before being renumbered.
+	f.compressing.Wait()
+	os.Remove(f.rotated(logFileKeep))
+	for i := logFileKeep - 1; i > 0; i-- {
+		os.Rename(f.rotated(i), f.rotated(i+1))
+	}
+	moved := f.rotated(1)
+	if f.compress {
+		moved = fmt.Sprintf("%s.1", f.path)
+	}
+	if err := os.Rename(f.path, moved); err != nil {
+		return fmt.Errorf("cannot rotate log file: %v", err)
+	}
+	if f.compress {
+		f.compressing.Add(1)
+		go func() {
+			err := gzipFile(moved, f.rotated(1))
+			f.compressing.Done()
+			if err != nil {
+				printf("Cannot compress rotated log file: %v", err)
+			}
+		}()
+	}
+	return f.open()
+}
+
+func gzipFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
 }
 
 func termLock() {
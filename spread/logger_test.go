@@ -0,0 +1,83 @@
+package spread_test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type LoggerSuite struct{}
+
+var _ = Suite(&LoggerSuite{})
+
+func (s *LoggerSuite) TestRotate(c *C) {
+	path := filepath.Join(c.MkDir(), "log")
+	f, err := spread.OpenRotatingFile(path, 10, false)
+	c.Assert(err, IsNil)
+	for _, line := range []string{"line one\n", "line two\n", "line three\n"} {
+		_, err := f.Write([]byte(line))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(f.Close(), IsNil)
+
+	for name, content := range map[string]string{
+		"log":   "line three\n",
+		"log.1": "line two\n",
+		"log.2": "line one\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(path), name))
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, content, Commentf("file %s", name))
+	}
+}
+
+func (s *LoggerSuite) TestRotateKeep(c *C) {
+	path := filepath.Join(c.MkDir(), "log")
+	f, err := spread.OpenRotatingFile(path, 10, false)
+	c.Assert(err, IsNil)
+	for i := 0; i < spread.LogFileKeep+3; i++ {
+		_, err := f.Write([]byte(fmt.Sprintf("line %04d\n", i)))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(f.Close(), IsNil)
+
+	names, err := filepath.Glob(path + "*")
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, spread.LogFileKeep+1)
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s.%d", path, spread.LogFileKeep))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "line 0002\n")
+}
+
+func (s *LoggerSuite) TestRotateCompress(c *C) {
+	path := filepath.Join(c.MkDir(), "log")
+	f, err := spread.OpenRotatingFile(path, 10, true)
+	c.Assert(err, IsNil)
+	for _, line := range []string{"line one\n", "line two\n", "line three\n"} {
+		_, err := f.Write([]byte(line))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(f.Close(), IsNil)
+
+	for name, content := range map[string]string{
+		"log.1.gz": "line two\n",
+		"log.2.gz": "line one\n",
+	} {
+		file, err := os.Open(filepath.Join(filepath.Dir(path), name))
+		c.Assert(err, IsNil)
+		zr, err := gzip.NewReader(file)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(zr)
+		file.Close()
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, content, Commentf("file %s", name))
+	}
+	_, err = os.Stat(path + ".1")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
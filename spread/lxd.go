@@ -11,16 +11,19 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
-func LXD(b *Backend) Provider {
-	return &lxd{b}
+func LXD(p *Project, b *Backend, o *Options) Provider {
+	return &lxd{p, b, o}
 }
 
 type lxd struct {
+	project *Project
 	backend *Backend
+	options *Options
 }
 
 type lxdServer struct {
@@ -32,6 +35,7 @@ type lxdServerData struct {
 	Name    string
 	Address string
 	Image   ImageID
+	Storage string `yaml:",omitempty"`
 }
 
 func (s *lxdServer) String() string {
@@ -50,8 +54,32 @@ func (s *lxdServer) Image() ImageID {
 	return s.d.Image
 }
 
+func (s *lxdServer) Storage() string {
+	return s.d.Storage
+}
+
 func (s *lxdServer) Snapshot() (ImageID, error) {
-	return "", nil
+	image := s.d.Image.Snapshot(snapshotKey(s.l.project, s.l.backend, s.d.Image))
+	snapshot := s.d.Name + "/spread-prepared"
+
+	output, err := exec.Command("lxc", "snapshot", s.d.Name, "spread-prepared").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("cannot snapshot lxd container: %v", outputErr(output, err))
+	}
+	output, err = exec.Command("lxc", "publish", snapshot, "--alias", s.l.snapshotAlias(image)).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("cannot publish lxd container snapshot: %v", outputErr(output, err))
+	}
+
+	// The published image holds what's needed, and leaving the container
+	// snapshot behind would prevent snapshotting the container again.
+	if output, derr := exec.Command("lxc", "delete", snapshot).CombinedOutput(); derr != nil {
+		printf("WARNING: Cannot remove lxd container snapshot %s: %v", snapshot, outputErr(output, derr))
+	}
+	if err != nil {
+		return "", err
+	}
+	return image, nil
 }
 
 func (s *lxdServer) ReuseData() []byte {
@@ -69,6 +97,9 @@ func (s *lxdServer) Discard() error {
 	if err != nil {
 		return fmt.Errorf("cannot discard lxd container: %v", outputErr(output, err))
 	}
+	if s.d.Storage != "" {
+		return s.l.removeStorage(s.d.Name)
+	}
 	return nil
 }
 
@@ -77,6 +108,62 @@ func (l *lxd) Backend() *Backend {
 }
 
 func (l *lxd) DiscardSnapshot(image ImageID) error {
+	output, err := exec.Command("lxc", "image", "delete", l.snapshotAlias(image)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot discard lxd image: %v", outputErr(output, err))
+	}
+	return nil
+}
+
+// snapshotAlias returns the alias of the lxd image holding the given
+// snapshot of a prepared container.
+func (l *lxd) snapshotAlias(image ImageID) string {
+	system := strings.Replace(string(image.SystemID()), ".", "-", -1)
+	return fmt.Sprintf("spread-%s-%s-%s", l.backend.Name, system, image.SnapshotID())
+}
+
+// PrepareImages fetches the given images into the local image store
+// concurrently, so containers are launched from the cache later on.
+// Images already cached are kept up to date by lxd itself.
+func (l *lxd) PrepareImages(images []ImageID) error {
+	// Overridden images, and aliases of images in the local store, are
+	// left for lxc launch to find on its own.
+	var usual []ImageID
+	for _, image := range images {
+		if l.options.image(l.backend, image) == "" && strings.Contains(l.image(image), ":") {
+			usual = append(usual, image)
+		}
+	}
+	images = usual
+	if len(images) == 0 {
+		return nil
+	}
+	printf("Fetching %d LXD image%s for %s...", len(images), nth(len(images), "", "", "s"), l.backend)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var done int
+	errs := make([]error, len(images))
+	for i, image := range images {
+		wg.Add(1)
+		go func(i int, lxdimage string) {
+			defer wg.Done()
+			output, err := exec.Command("lxc", "image", "copy", lxdimage, "local:", "--auto-update").CombinedOutput()
+			if err != nil && !bytes.Contains(output, []byte("already exists")) {
+				errs[i] = fmt.Errorf("cannot fetch %s: %v", lxdimage, outputErr(output, err))
+				return
+			}
+			mu.Lock()
+			done++
+			printf("Fetched %s (%d/%d).", lxdimage, done, len(images))
+			mu.Unlock()
+		}(i, l.image(image))
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -91,13 +178,30 @@ func (l *lxd) Reuse(data []byte, password string) (Server, error) {
 }
 
 func (l *lxd) Allocate(image ImageID, password string) (Server, error) {
-	lxdimage := lxdImage(image)
-	name, err := lxdName(image)
+	lxdimage := l.image(image)
+	name, err := l.name(image)
 	if err != nil {
 		return nil, err
 	}
 
-	output, err := exec.Command("lxc", "launch", lxdimage, name).CombinedOutput()
+	if override := l.options.image(l.backend, image); override != "" {
+		printf("Using image %s for %s...", override, image.SystemID())
+		lxdimage = override
+	} else if l.backend.Snapshot {
+		snapshot := image.Snapshot(snapshotKey(l.project, l.backend, image))
+		alias := l.snapshotAlias(snapshot)
+		if exec.Command("lxc", "image", "info", alias).Run() == nil {
+			printf("Using prepared snapshot %s for %s...", alias, image)
+			lxdimage = alias
+			image = snapshot
+		}
+	}
+
+	args := []string{"launch", lxdimage, name}
+	for key, value := range instanceTags(l.project, l.backend, l.options, image) {
+		args = append(args, "-c", "user."+key+"="+value)
+	}
+	output, err := exec.Command("lxc", args...).CombinedOutput()
 	if err != nil {
 		err = outputErr(output, err)
 		if bytes.Contains(output, []byte("error: not found")) {
@@ -114,6 +218,33 @@ func (l *lxd) Allocate(image ImageID, password string) (Server, error) {
 		},
 	}
 
+	if size := l.backend.storageSize(image); size > 0 {
+		if err := l.attachStorage(name, size); err != nil {
+			server.Discard()
+			return nil, err
+		}
+		server.d.Storage = lxdStoragePath
+	}
+
+	server.d.Address, err = l.waitAddress(name)
+	if err != nil {
+		server.Discard()
+		return nil, err
+	}
+
+	err = l.tuneSSH(name, password)
+	if err != nil {
+		server.Discard()
+		return nil, err
+	}
+
+	printf("Allocated %s.", server)
+	return server, nil
+}
+
+// waitAddress waits for the named container to have an address after
+// it starts, and returns it.
+func (l *lxd) waitAddress(name string) (string, error) {
 	printf("Waiting for LXD container %s to have an address...", name)
 	timeout := time.After(10 * time.Second)
 	retry := time.NewTicker(1 * time.Second)
@@ -121,32 +252,117 @@ func (l *lxd) Allocate(image ImageID, password string) (Server, error) {
 	for {
 		addr, err := l.address(name)
 		if err == nil {
-			server.d.Address = addr
-			break
+			return addr, nil
 		}
 		if _, ok := err.(*lxdNoAddrError); !ok {
-			server.Discard()
-			return nil, err
+			return "", err
 		}
 
 		select {
 		case <-retry.C:
 		case <-timeout:
-			server.Discard()
-			return nil, err
+			return "", err
 		}
 	}
+}
 
-	err = l.tuneSSH(name, password)
+// Stop stops the container of server, keeping it around so that it may
+// be started again by a later run.
+func (l *lxd) Stop(server Server) (name string, err error) {
+	s := server.(*lxdServer)
+	output, err := exec.Command("lxc", "stop", s.d.Name).CombinedOutput()
 	if err != nil {
-		server.Discard()
-		return nil, err
+		return "", fmt.Errorf("cannot stop lxd container: %v", outputErr(output, err))
 	}
+	return s.d.Name, nil
+}
 
-	printf("Allocated %s.", server)
+// Start starts the named container stopped by an earlier run, if there
+// is one created for the project backend.
+func (l *lxd) Start(name string, password string) (Server, error) {
+	s, err := l.server(name)
+	if _, ok := err.(*lxdNoServerError); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Config["user.spread-project"] != l.project.Name || s.Config["user.spread-backend"] != l.backend.Name {
+		return nil, fmt.Errorf("lxd container %q was not created for %s", name, l.backend)
+	}
+	if s.Status != "Running" {
+		printf("Starting stopped LXD container %s...", name)
+		output, err := exec.Command("lxc", "start", name).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("cannot start lxd container: %v", outputErr(output, err))
+		}
+	}
+	server := &lxdServer{
+		l: l,
+		d: lxdServerData{
+			Name:  name,
+			Image: ImageID(s.Config["user.spread-system"]),
+		},
+	}
+	if _, ok := s.Devices[lxdStorageDevice]; ok {
+		server.d.Storage = lxdStoragePath
+	}
+	server.d.Address, err = l.waitAddress(name)
+	if err != nil {
+		return nil, err
+	}
 	return server, nil
 }
 
+const (
+	lxdStoragePool   = "default"
+	lxdStorageDevice = "spread-storage"
+	lxdStoragePath   = "/mnt/spread-storage"
+)
+
+// lxdStorageVolume returns the name of the storage volume attached to
+// the named container.
+func lxdStorageVolume(name string) string {
+	return name + "-storage"
+}
+
+// attachStorage creates a custom volume of the given size in the default
+// storage pool and mounts it into the named container. Containers cannot
+// hold block devices of their own, so tasks find the volume mounted at
+// lxdStoragePath instead.
+func (l *lxd) attachStorage(name string, size int64) error {
+	volume := lxdStorageVolume(name)
+	logf("Attaching storage volume %s to LXD container %s...", volume, name)
+	output, err := exec.Command("lxc", "storage", "volume", "create", lxdStoragePool, volume, fmt.Sprintf("size=%dB", size)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot create lxd storage volume: %v", outputErr(output, err))
+	}
+	output, err = exec.Command("lxc", "storage", "volume", "attach", lxdStoragePool, volume, name, lxdStorageDevice, lxdStoragePath).CombinedOutput()
+	if err != nil {
+		l.removeStorage(name)
+		return fmt.Errorf("cannot attach lxd storage volume: %v", outputErr(output, err))
+	}
+	return nil
+}
+
+// removeStorage deletes the storage volume of the named container.
+func (l *lxd) removeStorage(name string) error {
+	output, err := exec.Command("lxc", "storage", "volume", "delete", lxdStoragePool, lxdStorageVolume(name)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot remove lxd storage volume: %v", outputErr(output, err))
+	}
+	return nil
+}
+
+// image returns the LXD image to launch containers running image from,
+// as aliased in the backend or else derived from the system name.
+func (l *lxd) image(image ImageID) string {
+	if alias := l.backend.imageAlias(image); alias != "" {
+		return alias
+	}
+	return lxdImage(image)
+}
+
 func lxdImage(image ImageID) string {
 	parts := strings.Split(string(image.SystemID()), "-")
 	if parts[0] == "ubuntu" {
@@ -160,6 +376,16 @@ func lxdImage(image ImageID) string {
 	return "images:" + strings.Join(parts, "/")
 }
 
+// lxdNameMax is the longest container name accepted by LXD.
+const lxdNameMax = 63
+
+func (l *lxd) name(image ImageID) (string, error) {
+	if l.backend.InstanceName != "" {
+		return instanceName(l.backend, l.options, image, lxdNameMax), nil
+	}
+	return lxdName(image)
+}
+
 func lxdName(image ImageID) (string, error) {
 	filename := os.ExpandEnv("$HOME/.spread/lxd-count")
 	file, err := os.OpenFile(filename, os.O_RDWR, 0644)
@@ -207,8 +433,11 @@ func lxdName(image ImageID) (string, error) {
 }
 
 type lxdServerJSON struct {
-	Name  string `json:"name"`
-	State struct {
+	Name    string                       `json:"name"`
+	Status  string                       `json:"status"`
+	Config  map[string]string            `json:"config"`
+	Devices map[string]map[string]string `json:"devices"`
+	State   struct {
 		Network map[string]lxdDeviceJSON `json:"network"`
 	} `json:"state"`
 }
@@ -244,12 +473,55 @@ func (l *lxd) address(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	for _, addr := range server.State.Network["eth0"].Addresses {
+	if addr := server.address(); addr != "" {
+		return addr, nil
+	}
+	return "", &lxdNoAddrError{name}
+}
+
+func (s *lxdServerJSON) address() string {
+	for _, addr := range s.State.Network["eth0"].Addresses {
 		if addr.Family == "inet" && addr.Address != "" {
-			return addr.Address, nil
+			return addr.Address
 		}
 	}
-	return "", &lxdNoAddrError{name}
+	return ""
+}
+
+func (l *lxd) List() ([]ListedServer, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("lxc", "list", "--format=json")
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		err = outputErr(stderr.Bytes(), err)
+		return nil, fmt.Errorf("cannot list lxd containers: %v", err)
+	}
+
+	var servers []*lxdServerJSON
+	err = json.Unmarshal(output, &servers)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal lxd list output: %v", err)
+	}
+
+	var listed []ListedServer
+	for _, s := range servers {
+		runID := s.Config["user.spread-run-id"]
+		if runID == "" || s.Config["user.spread-project"] != l.project.Name || s.Config["user.spread-backend"] != l.backend.Name {
+			continue
+		}
+		server := &lxdServer{
+			l: l,
+			d: lxdServerData{
+				Name:    s.Name,
+				Address: s.address(),
+				Image:   ImageID(s.Config["user.spread-system"]),
+			},
+		}
+		listed = append(listed, ListedServer{server, runID})
+	}
+	return listed, nil
 }
 
 func (l *lxd) server(name string) (*lxdServerJSON, error) {
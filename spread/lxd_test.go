@@ -0,0 +1,203 @@
+package spread_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+)
+
+type LXDSuite struct{}
+
+var _ = Suite(&LXDSuite{})
+
+var lxdImageTests = []struct {
+	image spread.ImageID
+	lxd   string
+}{
+	{"ubuntu-16.04", "ubuntu:16.04"},
+	{"ubuntu-16.04-i386", "ubuntu:16.04/i386"},
+	{"debian-9", "images:debian/9/amd64"},
+	{"debian-9-arm64", "images:debian/9/arm64"},
+	{"fedora-26:0123456789ab", "images:fedora/26/amd64"},
+}
+
+func (s *LXDSuite) TestImage(c *C) {
+	for _, test := range lxdImageTests {
+		c.Check(spread.LXDImage(test.image), Equals, test.lxd, Commentf("image: %s", test.image))
+	}
+}
+
+func (s *LXDSuite) TestSnapshotID(c *C) {
+	image := spread.ImageID("ubuntu-16.04").Snapshot("0123456789ab")
+	c.Assert(image, Equals, spread.ImageID("ubuntu-16.04:0123456789ab"))
+	c.Assert(image.SystemID(), Equals, spread.ImageID("ubuntu-16.04"))
+	c.Assert(image.SnapshotID(), Equals, "0123456789ab")
+	c.Assert(image.Snapshot("ba9876543210").SnapshotID(), Equals, "ba9876543210")
+	c.Assert(spread.ImageID("ubuntu-16.04").SnapshotID(), Equals, "")
+
+	backend := &spread.Backend{Name: "lxd", Type: "lxd"}
+	p := spread.LXD(&spread.Project{}, backend, &spread.Options{})
+	c.Assert(spread.LXDSnapshotAlias(p, image), Equals, "spread-lxd-ubuntu-16-04-0123456789ab")
+}
+
+func (s *LXDSuite) TestSnapshotKey(c *C) {
+	newProject := func() *spread.Project {
+		return &spread.Project{
+			Name:        "project",
+			Prepare:     "echo prepare",
+			Environment: map[string]string{"A": "1", "B": "2"},
+		}
+	}
+	newBackend := func() *spread.Backend {
+		return &spread.Backend{Name: "lxd", Prepare: "echo backend"}
+	}
+	key := spread.SnapshotKey(newProject(), newBackend(), "ubuntu-16.04")
+	c.Assert(key, HasLen, 12)
+
+	// The same preparation yields the same key, even for a snapshot.
+	c.Assert(spread.SnapshotKey(newProject(), newBackend(), "ubuntu-16.04:0123456789ab"), Equals, key)
+
+	// Any change to what prepares servers changes it.
+	changes := []struct {
+		image  spread.ImageID
+		change func(p *spread.Project, b *spread.Backend)
+	}{
+		{"ubuntu-16.04", func(p *spread.Project, b *spread.Backend) { p.Prepare += "\necho more" }},
+		{"ubuntu-16.04", func(p *spread.Project, b *spread.Backend) { b.Prepare = "" }},
+		{"ubuntu-16.04", func(p *spread.Project, b *spread.Backend) { p.Environment["A"] = "3" }},
+		{"ubuntu-16.04", func(p *spread.Project, b *spread.Backend) { b.Environment = map[string]string{"A": "1"} }},
+		{"ubuntu-16.04", func(p *spread.Project, b *spread.Backend) { p.Name = "other" }},
+		{"ubuntu-18.04", func(p *spread.Project, b *spread.Backend) {}},
+	}
+	for i, test := range changes {
+		p, b := newProject(), newBackend()
+		test.change(p, b)
+		c.Check(spread.SnapshotKey(p, b, test.image), Not(Equals), key, Commentf("change #%d", i))
+	}
+}
+
+const snapshotProject = `
+project: snapshot
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04]
+        snapshot: true
+suites:
+    suite/:
+        summary: Suite.
+`
+
+func (s *LXDSuite) TestSnapshotBackends(c *C) {
+	dir := writeProject(c, snapshotProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	c.Assert(project.Backends["lxd"].Snapshot, Equals, true)
+
+	dir = writeProject(c, strings.Replace(snapshotProject, "lxd:", "linode:", 1), "suite/a")
+	_, err = spread.Load(dir)
+	c.Assert(err, ErrorMatches, `backend "linode" does not support snapshots`)
+}
+
+var lxdNameTests = []struct {
+	template string
+	backend  string
+	system   spread.ImageID
+	runID    string
+	name     string
+}{{
+	template: "spread-$RUN_ID-$SYSTEM-$RANDOM",
+	backend:  "lxd",
+	system:   "ubuntu-16.04",
+	runID:    "abc",
+	name:     "spread-abc-ubuntu-16-04-[0-9a-f]{6}",
+}, {
+	// Long names are cut, but the random part is kept.
+	template: "$BACKEND-$SYSTEM-$RANDOM",
+	backend:  strings.Repeat("b", 50),
+	system:   spread.ImageID("ubuntu-" + strings.Repeat("s", 60)),
+	name:     "b{27}-ubuntu-s{20}-[0-9a-f]{6}",
+}, {
+	template: "spread-$RUN_ID-$RANDOM",
+	backend:  "lxd",
+	system:   "ubuntu-16.04",
+	runID:    strings.Repeat("r", 70),
+	name:     "spread-r{49}-[0-9a-f]{6}",
+}, {
+	template: strings.Repeat("x", 70) + "-$SYSTEM-$RANDOM",
+	backend:  "lxd",
+	system:   "ubuntu-16.04",
+	name:     "x{56}-[0-9a-f]{6}",
+}}
+
+func (s *LXDSuite) TestName(c *C) {
+	for _, test := range lxdNameTests {
+		backend := &spread.Backend{Name: test.backend, Type: "lxd", InstanceName: test.template}
+		p := spread.LXD(&spread.Project{}, backend, &spread.Options{RunID: test.runID})
+		name1, err := spread.LXDName(p, test.system)
+		c.Assert(err, IsNil)
+		name2, err := spread.LXDName(p, test.system)
+		c.Assert(err, IsNil)
+		c.Check(name1, Matches, test.name, Commentf("template: %s", test.template))
+		c.Check(name2, Not(Equals), name1)
+	}
+}
+
+// fakeLXC puts an lxc command first in the path that records its
+// arguments in the returned log file, and fails when publishing if
+// $FAKE_LXC_FAIL is set, until restore is called.
+func fakeLXC(c *C) (log string, restore func()) {
+	dir := c.MkDir()
+	log = filepath.Join(dir, "log")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nif [ \"$1\" = publish ] && [ -n \"$FAKE_LXC_FAIL\" ]; then echo failed; exit 1; fi\n", log)
+	err := ioutil.WriteFile(filepath.Join(dir, "lxc"), []byte(script), 0755)
+	c.Assert(err, IsNil)
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+path)
+	return log, func() {
+		os.Setenv("PATH", path)
+		os.Unsetenv("FAKE_LXC_FAIL")
+	}
+}
+
+func (s *LXDSuite) TestSnapshotRemoved(c *C) {
+	log, restore := fakeLXC(c)
+	defer restore()
+
+	backend := &spread.Backend{Name: "lxd", Type: "lxd"}
+	p := spread.LXD(&spread.Project{Name: "project"}, backend, &spread.Options{})
+	server := spread.LXDServer(p, "spread-1-ubuntu-16-04", "ubuntu-16.04")
+
+	// The container snapshot is removed once published, so the container
+	// may be snapshotted again.
+	for i := 0; i < 2; i++ {
+		image, err := server.Snapshot()
+		c.Assert(err, IsNil)
+		c.Assert(image.SystemID(), Equals, spread.ImageID("ubuntu-16.04"))
+	}
+	data, err := ioutil.ReadFile(log)
+	c.Assert(err, IsNil)
+	commands := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(commands, HasLen, 6)
+	c.Check(commands[0], Equals, "snapshot spread-1-ubuntu-16-04 spread-prepared")
+	c.Check(commands[1], Matches, "publish spread-1-ubuntu-16-04/spread-prepared --alias spread-lxd-ubuntu-16-04-[0-9a-f]{12}")
+	c.Check(commands[2], Equals, "delete spread-1-ubuntu-16-04/spread-prepared")
+	c.Check(commands[3:], DeepEquals, commands[:3])
+
+	// It's removed when publishing fails as well.
+	os.Remove(log)
+	os.Setenv("FAKE_LXC_FAIL", "1")
+	_, err = server.Snapshot()
+	c.Assert(err, ErrorMatches, "cannot publish lxd container snapshot: failed")
+	data, err = ioutil.ReadFile(log)
+	c.Assert(err, IsNil)
+	commands = strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(commands, HasLen, 3)
+	c.Check(commands[2], Equals, "delete spread-1-ubuntu-16-04/spread-prepared")
+}
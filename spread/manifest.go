@@ -0,0 +1,189 @@
+package spread
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	runtimedebug "runtime/debug"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// manifest describes exactly what a run ran with, as written into the
+// manifest file when the run starts and again with its outcome when it
+// is done, so that the run may be audited and reproduced later.
+type manifest struct {
+	RunID     string     `yaml:"run-id"`
+	Version   string     `yaml:"version"`
+	GoVersion string     `yaml:"go-version"`
+	Started   time.Time  `yaml:"started"`
+	Finished  *time.Time `yaml:"finished,omitempty"`
+
+	Project  string   `yaml:"project"`
+	Commit   string   `yaml:"commit,omitempty"`
+	Dirty    bool     `yaml:"dirty,omitempty"`
+	TreeHash string   `yaml:"tree-hash,omitempty"`
+	Args     []string `yaml:"args,omitempty"`
+	Jobs     []string `yaml:"jobs"`
+
+	Servers []manifestServer `yaml:"servers,omitempty"`
+
+	Outcome map[string][]string `yaml:"outcome,omitempty"`
+	Error   string              `yaml:"error,omitempty"`
+}
+
+// manifestServer describes a server used by the run.
+type manifestServer struct {
+	Name      string        `yaml:"name"`
+	Backend   string        `yaml:"backend"`
+	System    string        `yaml:"system"`
+	Image     string        `yaml:"image"`
+	Provider  string        `yaml:"provider-image,omitempty"`
+	Address   string        `yaml:"address"`
+	ReuseData yaml.MapSlice `yaml:"reuse-data,omitempty"`
+}
+
+// spreadVersion returns the version of spread as recorded in its build.
+func spreadVersion() string {
+	if info, ok := runtimedebug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// startManifest writes the manifest of the run as it starts.
+func (r *Runner) startManifest() error {
+	m := &manifest{
+		RunID:     r.options.RunID,
+		Version:   spreadVersion(),
+		GoVersion: runtime.Version(),
+		Started:   time.Now().UTC(),
+		Project:   r.project.Name,
+	}
+	for _, arg := range r.options.Args {
+		if r.options.Password != "" {
+			arg = strings.Replace(arg, r.options.Password, "*****", -1)
+		}
+		m.Args = append(m.Args, maskSecrets(arg))
+	}
+	for _, job := range r.pending {
+		m.Jobs = append(m.Jobs, job.Name)
+	}
+
+	commit, dirty, err := gitCommit(r.project.Path)
+	if err != nil {
+		debugf("Cannot find git commit of project: %v", err)
+	}
+	m.Commit = commit
+	m.Dirty = dirty
+	m.TreeHash, err = treeHash(r.project.Path, r.project.Include, r.project.Exclude)
+	if err != nil {
+		printf("WARNING: Cannot hash project data for manifest: %v", err)
+	}
+
+	r.manifest = m
+	return r.writeManifest()
+}
+
+// manifestServer records server of backend in the manifest, if one is
+// being written. Must be called with r.mu held.
+func (r *Runner) manifestServer(backend *Backend, server Server) {
+	if r.manifest == nil {
+		return
+	}
+	s := manifestServer{
+		Name:     server.String(),
+		Backend:  backend.Name,
+		System:   string(server.Image().SystemID()),
+		Image:    string(server.Image()),
+		Provider: r.options.image(backend, server.Image()),
+		Address:  server.Address(),
+	}
+	if s.Provider == "" {
+		s.Provider = backend.imageAlias(server.Image())
+	}
+	if data := server.ReuseData(); len(data) > 0 {
+		if err := yaml.Unmarshal(data, &s.ReuseData); err != nil {
+			debugf("Cannot parse reuse data of %s for manifest: %v", server, err)
+		}
+	}
+	r.manifest.Servers = append(r.manifest.Servers, s)
+}
+
+// finishManifest writes the manifest again with the outcome of the run.
+func (r *Runner) finishManifest(err error) error {
+	finished := time.Now().UTC()
+	r.manifest.Finished = &finished
+	r.manifest.Outcome = make(map[string][]string)
+	jobs, status := r.jobStatus()
+	for _, job := range jobs {
+		r.manifest.Outcome[status[job]] = append(r.manifest.Outcome[status[job]], job.Name)
+	}
+	if err != nil {
+		r.manifest.Error = err.Error()
+	}
+	return r.writeManifest()
+}
+
+func (r *Runner) writeManifest() error {
+	data, err := yaml.Marshal(r.manifest)
+	if err != nil {
+		return fmt.Errorf("cannot marshal manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(r.options.Manifest, data, 0644); err != nil {
+		return fmt.Errorf("cannot write manifest file: %v", err)
+	}
+	return nil
+}
+
+// gitCommit returns the git commit checked out at dir, and whether
+// there are uncommitted changes on top of it.
+func gitCommit(dir string) (commit string, dirty bool, err error) {
+	output, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").CombinedOutput()
+	if err != nil {
+		return "", false, outputErr(output, err)
+	}
+	commit = strings.TrimSpace(string(output))
+	output, err = exec.Command("git", "-C", dir, "status", "--porcelain").CombinedOutput()
+	if err != nil {
+		return commit, false, outputErr(output, err)
+	}
+	return commit, len(output) > 0, nil
+}
+
+// treeHash returns the SHA-256 hash of the project data sent to servers,
+// computed over a tar archive of it with file order, times, and owners
+// fixed so that the hash only changes with the content sent.
+func treeHash(dir string, include, exclude []string) (string, error) {
+	args := []string{"-c", "--sort=name", "--mtime=@0", "--owner=0", "--group=0", "--numeric-owner"}
+	for _, pattern := range exclude {
+		args = append(args, "--exclude="+pattern)
+	}
+	args = append(args, include...)
+	cmd := exec.Command("tar", args...)
+	cmd.Dir = dir
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("cannot start local tar command: %v", err)
+	}
+	h := sha256.New()
+	_, cerr := io.Copy(h, stdout)
+	if err := cmd.Wait(); err != nil {
+		return "", outputErr(stderr.Bytes(), err)
+	}
+	if cerr != nil {
+		return "", cerr
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
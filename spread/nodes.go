@@ -0,0 +1,159 @@
+package spread
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// nodeGroup holds the extra servers allocated for a worker while it is
+// inside a suite declaring nodes, and the environment telling scripts
+// where to find them.
+type nodeGroup struct {
+	suite   *Suite
+	clients []*Client
+	env     map[string]string
+}
+
+var nodeVarReplacer = strings.NewReplacer("-", "_", ".", "_")
+
+// checkNodes makes sure the nodes declared by suite are valid.
+func checkNodes(suite *Suite) error {
+	for role, n := range suite.Nodes {
+		if !validName.MatchString(role) {
+			return fmt.Errorf("%s has invalid node role: %q", suite, role)
+		}
+		if n < 1 {
+			return fmt.Errorf("%s has invalid number of %s nodes: %d", suite, role, n)
+		}
+	}
+	return nil
+}
+
+// allocateNodes allocates and connects to the nodes declared by suite,
+// on the same backend and system as the worker asking for them. It
+// returns nil if the run was stopped meanwhile, after releasing the
+// nodes allocated so far.
+func (r *Runner) allocateNodes(backend *Backend, system ImageID, suite *Suite) *nodeGroup {
+	roles := make([]string, 0, len(suite.Nodes))
+	for role := range suite.Nodes {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	g := &nodeGroup{suite: suite, env: make(map[string]string)}
+	var all []string
+	for _, role := range roles {
+		name := strings.ToUpper(nodeVarReplacer.Replace(role))
+		var addrs []string
+		for i := 0; i < suite.Nodes[role]; i++ {
+			printf("Allocating %s node %d of %s for %s...", role, i+1, backend.Name, suite)
+			client := r.client(backend, system)
+			if client == nil {
+				r.releaseNodes(g)
+				return nil
+			}
+			client.nodeRole = role
+			g.clients = append(g.clients, client)
+			addr := client.Server().Address()
+			g.env[fmt.Sprintf("SPREAD_NODE_%s_%d", name, i+1)] = addr
+			addrs = append(addrs, addr)
+		}
+		g.env["SPREAD_NODES_"+name] = strings.Join(addrs, " ")
+		all = append(all, addrs...)
+	}
+	g.env["SPREAD_NODES"] = strings.Join(all, " ")
+	for _, client := range g.clients {
+		client.nodeEnv = g.env
+	}
+	return g
+}
+
+// prepareNodes prepares the project, backend, and suite on all nodes in
+// g, as they are on the server of the worker.
+func (r *Runner) prepareNodes(g *nodeGroup, job *Job, abend *bool) bool {
+	for _, client := range g.clients {
+		if client.Server().Image().SnapshotID() == "" {
+			if !r.run(client, job, preparing, r.project, r.project.Prepare, abend) {
+				return false
+			}
+			if !r.run(client, job, preparing, job.Backend, job.Backend.Prepare, abend) {
+				return false
+			}
+		}
+		if !r.run(client, job, preparing, g.suite, g.suite.Prepare, abend) {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreNodes restores the suite, backend, and project on all nodes in
+// g, unless restore is false, and releases them. The nodes are discarded
+// after restoring anyway, so failures are only reported.
+func (r *Runner) restoreNodes(g *nodeGroup, job *Job, restore bool) {
+	if restore {
+		for _, client := range g.clients {
+			var abend bool
+			r.run(client, job, restoring, g.suite, g.suite.Restore, &abend)
+			r.run(client, job, restoring, job.Backend, job.Backend.Restore, &abend)
+			r.run(client, job, restoring, r.project, r.project.Restore, &abend)
+		}
+	}
+	r.releaseNodes(g)
+}
+
+// runAcross runs the given task script of job on the server of the
+// client and on all nodes in g at once, as tasks of suites declaring
+// nodes run across all of them. It reports whether the script succeeded
+// everywhere.
+func (r *Runner) runAcross(client *Client, g *nodeGroup, job *Job, verb string, script string, abend *bool) bool {
+	if g == nil || strings.TrimSpace(script) == "" {
+		return r.run(client, job, verb, job, script, abend)
+	}
+	results := make(chan bool, len(g.clients))
+	abends := make([]bool, len(g.clients))
+	for i, node := range g.clients {
+		go func(i int, node *Client) {
+			results <- r.run(node, job, verb, job, script, &abends[i])
+		}(i, node)
+	}
+	ok := r.run(client, job, verb, job, script, abend)
+	for range g.clients {
+		if !<-results {
+			ok = false
+		}
+	}
+	for _, nodeAbend := range abends {
+		if nodeAbend {
+			*abend = true
+		}
+	}
+	return ok
+}
+
+// releaseNodes discards the nodes in g, or keeps them under -keep.
+func (r *Runner) releaseNodes(g *nodeGroup) {
+	for _, client := range g.clients {
+		server := client.Server()
+		r.removeSecretFiles(client)
+		client.Close()
+		if r.options.Keep {
+			printf("Keeping %s at %s", server, server.Address())
+			continue
+		}
+		printf("Discarding %s node %s...", client.nodeRole, server)
+		if err := r.discard(server); err != nil {
+			printf("Error discarding %s: %v", server, err)
+		}
+		r.mu.Lock()
+		for i, s := range r.servers {
+			if s == server {
+				r.servers = append(r.servers[:i], r.servers[i+1:]...)
+				break
+			}
+		}
+		r.mu.Unlock()
+	}
+	g.clients = nil
+}
@@ -0,0 +1,94 @@
+package spread
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// runsDir holds a file for each run in progress on this system, locked
+// for as long as the run lasts.
+var runsDir = os.ExpandEnv("$HOME/.spread/runs")
+
+// registerRun records the run with the given ID as being in progress
+// until the returned release function is called.
+func registerRun(runID string) (release func(), err error) {
+	if err := os.MkdirAll(runsDir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create %s: %v", runsDir, err)
+	}
+	filename := filepath.Join(runsDir, runID)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create run file: %v", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot obtain lock on %s: %v", filename, err)
+	}
+	return func() {
+		os.Remove(filename)
+		file.Close()
+	}, nil
+}
+
+// runActive returns whether the run with the given ID is in progress
+// on this system.
+func runActive(runID string) bool {
+	file, err := os.Open(filepath.Join(runsDir, runID))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true
+	}
+	if err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	}
+	return false
+}
+
+// FindOrphans returns the servers created by spread for the project
+// backends that do not belong to any run in progress on this system,
+// usually left behind by runs that crashed. If some backends cannot list
+// their servers, the orphans found on the others are returned along with
+// an error naming them.
+func FindOrphans(project *Project, options *Options) ([]ListedServer, error) {
+	var bnames []string
+	for bname := range project.Backends {
+		bnames = append(bnames, bname)
+	}
+	sort.Strings(bnames)
+
+	var orphans []ListedServer
+	var failed []string
+	for _, bname := range bnames {
+		backend := project.Backends[bname]
+		if backend.Type == "local" {
+			continue
+		}
+		provider, err := newProvider(project, backend, options)
+		if err != nil {
+			return nil, err
+		}
+		listed, err := provider.List()
+		if err != nil {
+			printf("Cannot list servers on %s: %v", backend, err)
+			failed = append(failed, bname)
+			continue
+		}
+		for _, s := range listed {
+			if !runActive(s.RunID) {
+				orphans = append(orphans, s)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return orphans, fmt.Errorf("cannot find orphaned servers of %s backend%s", strings.Join(failed, ", "), nth(len(failed), "", "", "s"))
+	}
+	return orphans, nil
+}
@@ -0,0 +1,67 @@
+package spread
+
+import (
+	"strings"
+)
+
+// packageManager holds the commands used to manage packages on a system,
+// exposed to scripts so they don't have to care about the distribution.
+type packageManager struct {
+	Name    string
+	Install string
+	Remove  string
+	Update  string
+}
+
+// packageManagers lists the known package managers in the order they are
+// looked for on servers, keyed by the command that identifies them.
+var packageManagers = []struct {
+	command string
+	manager packageManager
+}{
+	{"apt-get", packageManager{"apt", "apt-get install -y", "apt-get remove -y", "apt-get update"}},
+	{"dnf", packageManager{"dnf", "dnf install -y", "dnf remove -y", "dnf makecache"}},
+	{"yum", packageManager{"yum", "yum install -y", "yum remove -y", "yum makecache"}},
+	{"zypper", packageManager{"zypper", "zypper -n install", "zypper -n remove", "zypper -n refresh"}},
+	{"pacman", packageManager{"pacman", "pacman -S --noconfirm", "pacman -R --noconfirm", "pacman -Sy"}},
+	{"apk", packageManager{"apk", "apk add", "apk del", "apk update"}},
+}
+
+// detectPackageManager looks for a known package manager on the server
+// and returns it, or nil if none is found.
+func detectPackageManager(client *Client) *packageManager {
+	var commands []string
+	for _, pm := range packageManagers {
+		commands = append(commands, pm.command)
+	}
+	script := "for cmd in " + strings.Join(commands, " ") + "; do if command -v $cmd >/dev/null; then echo $cmd; break; fi; done"
+	output, err := client.Output(script, "", nil)
+	if err != nil {
+		printf("Cannot detect package manager on %s: %v", client.Server(), err)
+		return nil
+	}
+	command := strings.TrimSpace(string(output))
+	for i := range packageManagers {
+		if packageManagers[i].command == command {
+			return &packageManagers[i].manager
+		}
+	}
+	return nil
+}
+
+// packageEnv returns env with the package manager variables added, unless
+// they were explicitly defined already.
+func packageEnv(pm *packageManager, env map[string]string) map[string]string {
+	if pm == nil {
+		return env
+	}
+	penv := make(map[string]string, len(env)+4)
+	penv["SPREAD_PKG_MANAGER"] = pm.Name
+	penv["SPREAD_PKG_INSTALL"] = pm.Install
+	penv["SPREAD_PKG_REMOVE"] = pm.Remove
+	penv["SPREAD_PKG_UPDATE"] = pm.Update
+	for k, v := range env {
+		penv[k] = v
+	}
+	return penv
+}
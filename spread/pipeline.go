@@ -0,0 +1,22 @@
+package spread
+
+// pipelined returns whether the restore script of job may be left
+// running while the worker moves on to prepare the next task.
+//
+// Interactive shells, -abend, and reconnecting after dropped connections
+// all depend on scripts running one at a time, so they rule it out.
+func (r *Runner) pipelined(job *Job) bool {
+	o := r.options
+	if !o.Pipeline || o.Debug || o.Shell || o.Abend || o.Restore || r.checksState(job) {
+		return false
+	}
+	return !job.Task.Destructive && job.Backend.Reconnect == 0 && !job.Suite.Serial
+}
+
+// overlaps returns whether next may be prepared while the restore script
+// of prev is still running. Only tasks of the same suite and fixture
+// qualify, as moving between them runs their scripts, and conditions of
+// next are evaluated against the server only after prev is fully restored.
+func (r *Runner) overlaps(prev, next *Job) bool {
+	return prev.Suite == next.Suite && prev.Task.fixture == next.Task.fixture && next.Task.cond == nil
+}
@@ -0,0 +1,72 @@
+package spread
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Placement defines the zones of its provider that servers of a backend
+// are allocated in. With the spread policy servers of each system are
+// spread evenly over the zones listed, or over all zones when none are,
+// while with the pin policy they are only allocated in the zones listed.
+type Placement struct {
+	Policy string
+	Zones  []string
+}
+
+const (
+	placementSpread = "spread"
+	placementPin    = "pin"
+)
+
+func checkPlacement(backend *Backend) error {
+	p := backend.Placement
+	if p == nil {
+		return nil
+	}
+	if backend.Type != "linode" {
+		return fmt.Errorf("%s does not support placement", backend)
+	}
+	switch p.Policy {
+	case placementSpread:
+	case placementPin:
+		if len(p.Zones) == 0 {
+			return fmt.Errorf("%s pins placement without listing zones", backend)
+		}
+	default:
+		return fmt.Errorf("%s has invalid placement policy %q, must be spread or pin", backend, p.Policy)
+	}
+	for i, zone := range p.Zones {
+		if zone == "" || contains(p.Zones[:i], zone) {
+			return fmt.Errorf("%s has invalid placement zone %q", backend, zone)
+		}
+	}
+	return nil
+}
+
+// placementOrder returns the indexes of candidate servers in the order
+// they should be tried under placement p, given the zone of each of them
+// and how many servers of the same system are already in use per zone.
+// Candidates in zones not allowed by p are left out, and otherwise equal
+// candidates come in random order to reduce conflicts.
+func placementOrder(p *Placement, zones []string, used map[string]int) []int {
+	order := rnd.Perm(len(zones))
+	if p == nil {
+		return order
+	}
+	if len(p.Zones) > 0 {
+		allowed := order[:0]
+		for _, i := range order {
+			if contains(p.Zones, zones[i]) {
+				allowed = append(allowed, i)
+			}
+		}
+		order = allowed
+	}
+	if p.Policy == placementSpread {
+		sort.SliceStable(order, func(a, b int) bool {
+			return used[zones[order[a]]] < used[zones[order[b]]]
+		})
+	}
+	return order
+}
@@ -0,0 +1,144 @@
+package spread
+
+import (
+	"sync"
+)
+
+// sharedServer is a server in the pool of a backend system, which workers
+// are multiplexed over when the backend has fewer servers than workers
+// for that system.
+type sharedServer struct {
+	mu  sync.Mutex
+	key queueKey
+
+	server     Server
+	remotePath string
+	users      int
+
+	// The project and backend are prepared once per server, by the
+	// first worker to need it, and restored by the last one to leave.
+	insideProject bool
+	insideBackend bool
+	failed        bool
+	job           *Job
+
+	// allocating and preparing are closed once the worker that claimed
+	// the allocation or preparation of the server is done with it, so
+	// the scripts and backend calls involved run without s.mu held.
+	allocating chan struct{}
+	preparing  chan struct{}
+
+	// replay has the records of an earlier run on the server restored
+	// once under -restore, on behalf of all workers sharing it.
+	replay   sync.Once
+	replayed bool
+
+	// retired is set when the server becomes unusable, so that the
+	// workers sharing it stop and are replaced by ones on a new server.
+	retired bool
+}
+
+func (s *sharedServer) isRetired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.retired
+}
+
+// leave drops the calling worker from the users of the shared server,
+// and reports whether it was the last one.
+func (s *sharedServer) leave() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users--
+	return s.users == 0
+}
+
+// poolClient returns a client for the worker with the given index. The
+// client is connected to a server of its own unless the backend has fewer
+// servers than workers for the system, in which case it is connected to
+// the server in the worker's slot of the pool, allocated by the first
+// worker to use it.
+func (r *Runner) poolClient(backend *Backend, system ImageID, index int) (*Client, *sharedServer) {
+	servers := backend.SystemServers[string(system)]
+	if servers == 0 || servers >= backend.SystemWorkers[string(system)] {
+		return r.client(backend, system), nil
+	}
+
+	key := queueKey{backend.Name, system, index % servers}
+	r.mu.Lock()
+	s := r.pool[key]
+	if s == nil {
+		s = &sharedServer{key: key}
+		r.pool[key] = s
+	}
+	r.mu.Unlock()
+
+	s.mu.Lock()
+	for s.server == nil {
+		if allocating := s.allocating; allocating != nil {
+			s.mu.Unlock()
+			<-allocating
+			s.mu.Lock()
+			continue
+		}
+		allocating := make(chan struct{})
+		s.allocating = allocating
+		s.mu.Unlock()
+
+		client := r.client(backend, system)
+
+		s.mu.Lock()
+		s.allocating = nil
+		if client != nil {
+			s.server = client.Server()
+			s.remotePath = client.remotePath
+			s.users++
+		}
+		s.mu.Unlock()
+		close(allocating)
+		if client == nil {
+			return nil, nil
+		}
+		return client, s
+	}
+	// Joining before dialing keeps the server from being discarded by
+	// its last user in the meantime.
+	server, remotePath := s.server, s.remotePath
+	s.users++
+	s.mu.Unlock()
+
+	printf("Connecting to shared %s...", server)
+	client, err := Dial(server, backend, r.options.Password)
+	if err != nil {
+		printf("Cannot connect to %s: %v", server, err)
+		s.mu.Lock()
+		s.users--
+		last := s.users == 0
+		s.mu.Unlock()
+		if last {
+			r.retire(s)
+			printf("Discarding %s...", server)
+			if err := r.discard(server); err != nil {
+				printf("Error discarding %s: %v", server, err)
+			}
+		}
+		return nil, nil
+	}
+	client.packageManager = detectPackageManager(client)
+	client.remotePath = remotePath
+	return client, s
+}
+
+// retire marks the shared server as unusable and removes it from the
+// pool, so that workers joining its slot afterwards get a new server.
+func (r *Runner) retire(s *sharedServer) {
+	s.mu.Lock()
+	s.retired = true
+	s.mu.Unlock()
+
+	r.mu.Lock()
+	if r.pool[s.key] == s {
+		delete(r.pool, s.key)
+	}
+	r.mu.Unlock()
+}
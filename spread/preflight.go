@@ -0,0 +1,33 @@
+package spread
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// preflight runs the project preflight script on the local system, so
+// that missing prerequisites are noticed before any server is allocated.
+func (r *Runner) preflight() error {
+	script := strings.TrimSpace(r.project.Preflight)
+	if script == "" {
+		return nil
+	}
+	logf("Running preflight script...")
+	cmd := exec.Command("/bin/sh", "-ec", script)
+	cmd.Dir = r.project.Path
+	cmd.Env = append(os.Environ(),
+		"SPREAD_PROJECT="+r.project.Name,
+		"SPREAD_RUN_ID="+r.options.RunID,
+		"SPREAD_ARTIFACTS="+r.options.Artifacts,
+	)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		debugf("Output from preflight script:\n-----\n%s\n-----", output)
+	}
+	if err != nil {
+		return fmt.Errorf("preflight script failed: %v", outputErr(output, err))
+	}
+	return nil
+}
@@ -6,10 +6,12 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 	"strconv"
@@ -22,38 +24,208 @@ type Project struct {
 
 	Environment map[string]string
 
-	Prepare string
-	Restore string
-	Suites  map[string]*Suite
+	Prepare   string
+	Restore   string
+	Preflight string
+	Suites    map[string]*Suite
+
+	AlwaysRestore bool `yaml:"always-restore"`
 
 	RemotePath string `yaml:"path"`
 
 	Include []string
 	Exclude []string
 
+	CACerts string `yaml:"ca-certs"`
+
+	Shell *Shell
+
+	OutputLimit string  `yaml:"output-limit"`
+	SlowFactor  float64 `yaml:"slow-factor"`
+
+	Errors []*ErrorRule
+
+	ExitCodes   map[int]string `yaml:"exit-codes"`
+	ExitRetries int            `yaml:"exit-retries"`
+
+	State     map[string]string
+	StateLeak string `yaml:"state-leak"`
+
+	EmptyExecute string `yaml:"empty-execute"`
+
+	Controller *Controller
+
 	Path string `yaml:"-"`
+
+	outputLimit int64
 }
 
 func (p *Project) String() string { return "project" }
 
+// Controller defines a server allocated once per run and shared by all
+// jobs, such as a database or message broker that servers talk to.
+type Controller struct {
+	Backend string
+	System  string
+	Prepare string
+}
+
 type Backend struct {
 	Name string `yaml:"-"`
 	Type string
 	Key  string
 
+	KeySecret string `yaml:"key-secret"`
+
 	Systems        []string
+	Workers        int
 	SystemWorkers  map[string]int      `yaml:"-"`
+	SystemServers  map[string]int      `yaml:"-"`
 	SystemVariants map[string][]string `yaml:"-"`
 
 	Prepare string
 	Restore string
 
+	AlwaysRestore bool `yaml:"always-restore"`
+
 	Environment map[string]string
 	Variants    []string
+	Servers     map[string]int
+	Paths       map[string]string
+	Storage     map[string]string
+	Images      map[string]string
+	Files       []*File
+
+	CACerts string `yaml:"ca-certs"`
+
+	Shell  *Shell
+	Shells map[string]*Shell
+	Limits *Limits
+
+	InstanceName string `yaml:"instance-name"`
+	DiscardLimit int    `yaml:"discard-limit"`
+	DiscardMode  string `yaml:"discard-mode"`
+	Snapshot     bool
+	Tags         map[string]string
+	Placement    *Placement
+	Backoff      Backoff
+	Reconnect    int
+	Errors       []*ErrorRule
+	ExitCodes    map[int]string `yaml:"exit-codes"`
+
+	ClockSkew time.Duration `yaml:"clock-skew"`
+	ClockSync time.Duration `yaml:"clock-sync"`
+
+	RampUp time.Duration `yaml:"ramp-up"`
+
+	Price   float64
+	Billing time.Duration
+
+	KnownHosts   string   `yaml:"known-hosts"`
+	Ciphers      []string `yaml:"ciphers"`
+	KeyExchanges []string `yaml:"kex"`
+	MACs         []string `yaml:"macs"`
+
+	storage map[string]int64
 }
 
 func (b *Backend) String() string { return fmt.Sprintf("backend %q", b.Name) }
 
+// imageAlias returns the provider image that servers of the backend
+// running the given system are allocated from, as set in its images
+// field, or an empty string for the provider to derive it from the
+// system name.
+func (b *Backend) imageAlias(image ImageID) string {
+	return b.Images[string(image.SystemID())]
+}
+
+// storageSize returns the size in bytes of the extra data volume to
+// attach to servers of the backend running the given system, or zero
+// for none.
+func (b *Backend) storageSize(image ImageID) int64 {
+	return b.storage[string(image.SystemID())]
+}
+
+// Backoff defines how long to wait before retrying to allocate or to
+// connect to a server. The delay grows by the given factor after each
+// failed attempt, up to the maximum, and jitter randomly shortens each
+// delay by up to that fraction of it.
+type Backoff struct {
+	Delay  time.Duration
+	Max    time.Duration
+	Factor float64
+	Jitter float64
+}
+
+// File is a local file sent to servers, such as credentials or fixtures
+// that don't belong to the project tree. Secret files have their content
+// masked in logs and are removed from servers when workers are done.
+type File struct {
+	From   string
+	To     string
+	Mode   string
+	Secret bool
+
+	perm os.FileMode
+}
+
+// checkFiles validates files and resolves their local paths relative
+// to dir.
+func checkFiles(context fmt.Stringer, dir string, files []*File) error {
+	for _, f := range files {
+		if f.From == "" || f.To == "" {
+			return fmt.Errorf("%s has file entry missing from or to field", context)
+		}
+		if !strings.HasPrefix(f.To, "/") {
+			return fmt.Errorf("%s has file with relative remote path: %q", context, f.To)
+		}
+		if strings.HasPrefix(f.From, "~/") {
+			f.From = filepath.Join(os.Getenv("HOME"), f.From[2:])
+		} else if !filepath.IsAbs(f.From) {
+			f.From = filepath.Join(dir, f.From)
+		}
+		switch {
+		case f.Mode != "":
+			perm, err := strconv.ParseUint(f.Mode, 8, 32)
+			if err != nil || perm > 0777 {
+				return fmt.Errorf("%s has file %s with invalid mode: %q", context, f.To, f.Mode)
+			}
+			f.perm = os.FileMode(perm)
+		case f.Secret:
+			f.perm = 0600
+		default:
+			f.perm = 0644
+		}
+	}
+	return nil
+}
+
+// parseSize parses a size in bytes, optionally followed by a K, M, or G
+// suffix multiplying it by the respective power of 1024. An empty size
+// is zero.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num, mult := s, int64(1)
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		mult = 1 << 10
+	case 'M', 'm':
+		mult = 1 << 20
+	case 'G', 'g':
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
 type Suite struct {
 	Summary  string
 	Systems  []string
@@ -65,13 +237,48 @@ type Suite struct {
 	Prepare string
 	Restore string
 
+	PrepareFile string `yaml:"prepare-file"`
+	RestoreFile string `yaml:"restore-file"`
+
+	AlwaysRestore bool `yaml:"always-restore"`
+
+	Serial      bool
+	Colocate    bool
+	Restartable bool
+
+	EmptyExecute string `yaml:"empty-execute"`
+
+	Nodes  map[string]int
+	Budget time.Duration
+
+	Files    []*File
+	Fixtures map[string]*Fixture
+
 	Name  string           `yaml:"-"`
 	Path  string           `yaml:"-"`
 	Tasks map[string]*Task `yaml:"-"`
+
+	order int
 }
 
 func (s *Suite) String() string { return "suite " + s.Name }
 
+// Fixture holds the scripts setting up state shared by the tasks of a
+// suite that reference it by name. The fixture is prepared on a server
+// before the first of these tasks runs there, and restored once the
+// server moves on to tasks that don't reference it.
+type Fixture struct {
+	Summary string
+
+	Prepare string
+	Restore string
+
+	Name  string `yaml:"-"`
+	Suite string `yaml:"-"`
+}
+
+func (f *Fixture) String() string { return f.Suite + " fixture " + f.Name }
+
 type Task struct {
 	Suite string `yaml:"-"`
 
@@ -87,10 +294,42 @@ type Task struct {
 	Restore string
 	Execute string
 
+	PrepareFile string `yaml:"prepare-file"`
+	RestoreFile string `yaml:"restore-file"`
+	ExecuteFile string `yaml:"execute-file"`
+
+	AlwaysRestore bool `yaml:"always-restore"`
+
 	Disable string
+	Fixture string
+	Workdir string
+	XFail   string `yaml:"xfail"`
+	Exit    int    `yaml:"exit-code"`
+	If      string `yaml:"if"`
+	Shards  int
+
+	Destructive bool
+	Restartable bool
+
+	Artifacts  []string
+	Files      []*File
+	AllowState []string `yaml:"allow-state"`
+
+	ArtifactsExclude []string `yaml:"artifacts-exclude"`
+
+	OutputLimit string `yaml:"output-limit"`
+
+	ExpectedDuration time.Duration `yaml:"expected-duration"`
+
+	Limits *Limits
 
 	Name string `yaml:"-"`
 	Path string `yaml:"-"`
+
+	cond        condition
+	fixture     *Fixture
+	outputLimit int64
+	order       int
 }
 
 func (t *Task) String() string { return t.Name }
@@ -105,6 +344,20 @@ type Job struct {
 
 	Variant     string
 	Environment map[string]string
+
+	// Shard is the index of the job among those running the same
+	// sharded task, which are merged into the parent job outcome.
+	Shard  int
+	parent *Job
+
+	// skip holds why the job cannot run, for jobs reported as skipped
+	// rather than left out with the FailOnSkip option.
+	skip string
+
+	// quarantined is set for jobs matched by the Quarantine option,
+	// whose execute and prepare failures do not fail the run. Restore
+	// failures still do, as they leave the server broken for others.
+	quarantined bool
 }
 
 func (job *Job) String() string {
@@ -119,6 +372,8 @@ func (job *Job) StringFor(v interface{}) string {
 		return fmt.Sprintf("%s:%s", job.Backend.Name, job.System)
 	case job.Suite:
 		return fmt.Sprintf("%s:%s:%s", job.Backend.Name, job.System, job.Suite.Name)
+	case job.Task.fixture:
+		return fmt.Sprintf("%s:%s:%s", job.Backend.Name, job.System, job.Task.fixture)
 	case job.Task:
 		return fmt.Sprintf("%s:%s:%s", job.Backend.Name, job.System, job.Task.Name)
 	case job:
@@ -171,8 +426,54 @@ func Load(path string) (*Project, error) {
 	if project.Include == nil {
 		project.Include = []string{"."}
 	}
+	if project.outputLimit, err = parseSize(project.OutputLimit); err != nil {
+		return nil, fmt.Errorf("invalid project output-limit: %v", err)
+	}
+	if project.SlowFactor == 0 {
+		project.SlowFactor = 1
+	} else if project.SlowFactor < 1 {
+		return nil, fmt.Errorf("invalid project slow-factor, must be at least 1: %v", project.SlowFactor)
+	}
 
 	project.Path = filepath.Dir(filename)
+	if project.CACerts, err = checkCACerts(project, project.Path, project.CACerts); err != nil {
+		return nil, err
+	}
+	if err := checkErrorRules(project, project.Errors); err != nil {
+		return nil, err
+	}
+	if err := checkExitCodes(project, project.ExitCodes); err != nil {
+		return nil, err
+	}
+	if project.ExitRetries < 0 {
+		return nil, fmt.Errorf("invalid project exit-retries: %d", project.ExitRetries)
+	} else if project.ExitRetries == 0 {
+		project.ExitRetries = 1
+	}
+	if err := checkShell(project, "shell", project.Shell); err != nil {
+		return nil, err
+	}
+	for name, probe := range project.State {
+		if !validName.MatchString(name) {
+			return nil, fmt.Errorf("invalid state probe name: %q", name)
+		}
+		if strings.TrimSpace(probe) == "" {
+			return nil, fmt.Errorf("state probe %q is empty", name)
+		}
+	}
+	switch project.StateLeak {
+	case "":
+		project.StateLeak = "warn"
+	case "warn", "fail":
+	default:
+		return nil, fmt.Errorf("invalid project state-leak %q, must be warn or fail", project.StateLeak)
+	}
+	if project.EmptyExecute == "" {
+		project.EmptyExecute = "pass"
+	}
+	if err := checkEmptyExecute(project, project.EmptyExecute); err != nil {
+		return nil, err
+	}
 
 	for bname, backend := range project.Backends {
 		if !validName.MatchString(bname) {
@@ -183,21 +484,109 @@ func Load(path string) (*Project, error) {
 			backend.Type = bname
 		}
 		switch backend.Type {
-		case "linode", "lxd":
+		case "linode", "lxd", "local":
 		default:
 			return nil, fmt.Errorf("%s has unsupported type %q", backend, backend.Type)
 		}
 
+		if backend.InstanceName != "" && !strings.Contains(backend.InstanceName, "$RANDOM") && !strings.Contains(backend.InstanceName, "${RANDOM}") {
+			return nil, fmt.Errorf("%s instance-name must include $RANDOM to keep names unique", backend)
+		}
+
+		if backend.KeySecret != "" {
+			if backend.Key != "" {
+				return nil, fmt.Errorf("%s cannot have both key and key-secret", backend)
+			}
+			if _, _, ok := splitSecret(backend.KeySecret); !ok {
+				return nil, fmt.Errorf("%s has invalid key-secret %q, must be prefixed by one of: %s", backend, backend.KeySecret, strings.Join(secretManagers, ", "))
+			}
+		}
+
+		if len(backend.Tags) > 0 && backend.Type == "local" {
+			return nil, fmt.Errorf("%s does not support tags", backend)
+		}
+		for key := range backend.Tags {
+			if key == "" || strings.ContainsAny(key, " \t\n=") {
+				return nil, fmt.Errorf("%s has invalid tag name %q", backend, key)
+			}
+		}
+
+		if backend.Snapshot && backend.Type != "lxd" {
+			return nil, fmt.Errorf("%s does not support snapshots", backend)
+		}
+		if len(backend.Storage) > 0 && backend.Type != "lxd" && backend.Type != "linode" {
+			return nil, fmt.Errorf("%s does not support storage", backend)
+		}
+		if err := checkPlacement(backend); err != nil {
+			return nil, err
+		}
+
+		if b := &backend.Backoff; b.Delay < 0 || b.Max < 0 || b.Factor != 0 && b.Factor < 1 || b.Jitter < 0 || b.Jitter > 1 {
+			return nil, fmt.Errorf("%s has invalid backoff settings", backend)
+		} else {
+			if b.Delay == 0 {
+				b.Delay = 5 * time.Second
+			}
+			if b.Factor == 0 {
+				b.Factor = 1
+			}
+		}
+
+		if backend.ClockSkew < 0 || backend.ClockSync < 0 {
+			return nil, fmt.Errorf("%s has negative clock-skew or clock-sync", backend)
+		}
+		if backend.ClockSync > 0 && backend.ClockSkew == 0 {
+			return nil, fmt.Errorf("%s has clock-sync without clock-skew", backend)
+		}
+
+		if backend.Reconnect < 0 {
+			return nil, fmt.Errorf("%s has invalid reconnect %d", backend, backend.Reconnect)
+		}
+
+		if backend.RampUp < 0 {
+			return nil, fmt.Errorf("%s has negative ramp-up", backend)
+		}
+		if backend.Workers < 0 {
+			return nil, fmt.Errorf("%s has invalid number of workers: %d", backend, backend.Workers)
+		}
+
+		if backend.DiscardLimit < 0 {
+			return nil, fmt.Errorf("%s has invalid discard-limit %d", backend, backend.DiscardLimit)
+		}
+		switch backend.DiscardMode {
+		case "":
+			backend.DiscardMode = "terminate"
+		case "terminate":
+		case "stop":
+			if backend.Type != "lxd" {
+				return nil, fmt.Errorf("%s cannot stop servers, discard-mode must be terminate", backend)
+			}
+		default:
+			return nil, fmt.Errorf("%s has invalid discard-mode %q, must be terminate or stop", backend, backend.DiscardMode)
+		}
+
+		switch backend.KnownHosts {
+		case "":
+			backend.KnownHosts = knownHostsAcceptNew
+		case knownHostsAcceptNew, knownHostsStrict, knownHostsOff:
+		default:
+			return nil, fmt.Errorf("%s has invalid known-hosts policy %q", backend, backend.KnownHosts)
+		}
+
 		backend.SystemWorkers = make(map[string]int)
 		backend.SystemVariants = make(map[string][]string)
 
 		seen := make(map[string]bool)
 		for i, system := range backend.Systems {
 			system, variants := SplitVariants(system)
+			counted := strings.Contains(system, "*")
 			system, workers, ok := SplitCount(system)
 			if !ok {
 				return nil, fmt.Errorf("%s lists system with invalid count suffix: %q", backend, system)
 			}
+			if !counted && backend.Workers > 0 {
+				workers = backend.Workers
+			}
 			if seen[system] {
 				return nil, fmt.Errorf("%s lists %s system more than once", backend, system)
 			}
@@ -219,18 +608,118 @@ func Load(path string) (*Project, error) {
 			return nil, err
 		}
 
+		backend.SystemServers = make(map[string]int)
+		for system, n := range backend.Servers {
+			if !seen[system] {
+				return nil, fmt.Errorf("%s has servers for unlisted system %q", backend, system)
+			}
+			if n < 1 || n > backend.SystemWorkers[system] {
+				return nil, fmt.Errorf("%s has invalid number of servers for %s: %d", backend, system, n)
+			}
+		}
+		for system, path := range backend.Paths {
+			if !seen[system] {
+				return nil, fmt.Errorf("%s has path for unlisted system %q", backend, system)
+			}
+			if !filepath.IsAbs(path) || filepath.Dir(path) == path {
+				return nil, fmt.Errorf("%s has invalid path for %s, must be absolute and not /: %s", backend, system, path)
+			}
+			backend.Paths[system] = filepath.Clean(path)
+		}
+		for system, image := range backend.Images {
+			if !seen[system] {
+				return nil, fmt.Errorf("%s has image for unlisted system %q", backend, system)
+			}
+			if strings.TrimSpace(image) == "" {
+				return nil, fmt.Errorf("%s has empty image for %s", backend, system)
+			}
+		}
+		for system, shell := range backend.Shells {
+			if !seen[system] {
+				return nil, fmt.Errorf("%s has shell for unlisted system %q", backend, system)
+			}
+			if err := checkShell(backend, "shell for "+system, shell); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkShell(backend, "shell", backend.Shell); err != nil {
+			return nil, err
+		}
+		if err := checkLimits(backend, backend.Limits); err != nil {
+			return nil, err
+		}
+		if len(backend.Images) > 0 && backend.Type == "local" {
+			return nil, fmt.Errorf("%s does not support images", backend)
+		}
+		backend.storage = make(map[string]int64)
+		for system, size := range backend.Storage {
+			if !seen[system] {
+				return nil, fmt.Errorf("%s has storage for unlisted system %q", backend, system)
+			}
+			n, err := parseSize(size)
+			if err != nil || n < 1<<20 {
+				return nil, fmt.Errorf("%s has invalid storage for %s, must be at least 1M: %q", backend, system, size)
+			}
+			backend.storage[system] = n
+		}
+		for _, system := range backend.Systems {
+			if n, ok := backend.Servers[system]; ok {
+				backend.SystemServers[system] = n
+			} else {
+				backend.SystemServers[system] = backend.SystemWorkers[system]
+			}
+		}
+
 		if len(backend.Systems) == 0 {
 			return nil, fmt.Errorf("no systems specified for %s", backend)
 		}
+
+		if err := checkFiles(backend, project.Path, backend.Files); err != nil {
+			return nil, err
+		}
+		if backend.CACerts, err = checkCACerts(backend, project.Path, backend.CACerts); err != nil {
+			return nil, err
+		}
+		if err := checkErrorRules(backend, backend.Errors); err != nil {
+			return nil, err
+		}
+		if err := checkExitCodes(backend, backend.ExitCodes); err != nil {
+			return nil, err
+		}
+		if backend.Price < 0 {
+			return nil, fmt.Errorf("%s has invalid price: %v", backend, backend.Price)
+		}
+		if backend.Billing < 0 {
+			return nil, fmt.Errorf("%s has invalid billing increment: %v", backend, backend.Billing)
+		}
 	}
 
 	if len(project.Backends) == 0 {
 		return nil, fmt.Errorf("must define at least one backend")
 	}
+	if c := project.Controller; c != nil {
+		backend := project.Backends[c.Backend]
+		if backend == nil {
+			return nil, fmt.Errorf("controller refers to undefined backend %q", c.Backend)
+		}
+		if backend.SystemWorkers[c.System] == 0 {
+			return nil, fmt.Errorf("controller refers to system %q not listed by %s", c.System, backend)
+		}
+	}
 	if len(project.Suites) == 0 {
 		return nil, fmt.Errorf("must define at least one task suite")
 	}
 
+	// Suites are a map, so look at the document again to find out
+	// the order in which they were declared.
+	var decl struct {
+		Suites yaml.MapSlice
+	}
+	err = yaml.Unmarshal(data, &decl)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %s: %v", filename, err)
+	}
+
 	orig := project.Suites
 	project.Suites = make(map[string]*Suite)
 	for sname, suite := range orig {
@@ -254,6 +743,39 @@ func Load(path string) (*Project, error) {
 		if err != nil {
 			return nil, err
 		}
+		if err := checkFiles(suite, project.Path, suite.Files); err != nil {
+			return nil, err
+		}
+		if err := checkEmptyExecute(suite, suite.EmptyExecute); err != nil {
+			return nil, err
+		}
+		if err := checkNodes(suite); err != nil {
+			return nil, err
+		}
+		if suite.Budget < 0 {
+			return nil, fmt.Errorf("%s has invalid budget: %v", suite, suite.Budget)
+		}
+		if err := loadScript(suite, "prepare", suite.Path, suite.PrepareFile, &suite.Prepare); err != nil {
+			return nil, err
+		}
+		if err := loadScript(suite, "restore", suite.Path, suite.RestoreFile, &suite.Restore); err != nil {
+			return nil, err
+		}
+		for fname, fixture := range suite.Fixtures {
+			if fixture == nil {
+				fixture = &Fixture{}
+				suite.Fixtures[fname] = fixture
+			}
+			fixture.Name = fname
+			fixture.Suite = suite.Name
+			fixture.Summary = strings.TrimSpace(fixture.Summary)
+			if !validName.MatchString(fname) {
+				return nil, fmt.Errorf("%s has invalid fixture name: %q", suite, fname)
+			}
+			if fixture.Summary == "" {
+				return nil, fmt.Errorf("%s is missing a summary", fixture)
+			}
+		}
 
 		f, err := os.Open(suite.Path)
 		if err != nil {
@@ -267,6 +789,10 @@ func Load(path string) (*Project, error) {
 
 		suite.Tasks = make(map[string]*Task)
 		for _, tname := range tnames {
+			if info, err := os.Stat(filepath.Join(suite.Path, tname)); err == nil && !info.IsDir() {
+				// Such as script files of the suite.
+				continue
+			}
 			tfilename := filepath.Join(suite.Path, tname, "task.yaml")
 			tdata, err := ioutil.ReadFile(tfilename)
 			if os.IsNotExist(err) {
@@ -293,16 +819,91 @@ func Load(path string) (*Project, error) {
 			if task.Summary == "" {
 				return nil, fmt.Errorf("%s is missing a summary", task)
 			}
+			if task.Shards < 0 {
+				return nil, fmt.Errorf("%s has invalid number of shards: %d", task, task.Shards)
+			}
+			for _, script := range []struct {
+				what     string
+				filename string
+				script   *string
+			}{
+				{"prepare", task.PrepareFile, &task.Prepare},
+				{"execute", task.ExecuteFile, &task.Execute},
+				{"restore", task.RestoreFile, &task.Restore},
+			} {
+				if err := loadScript(task, script.what, task.Path, script.filename, script.script); err != nil {
+					return nil, err
+				}
+			}
+			task.XFail = strings.TrimSpace(task.XFail)
+			if task.XFail == "false" {
+				task.XFail = ""
+			}
+			task.If = strings.TrimSpace(task.If)
+			if task.If != "" {
+				task.cond, err = parseCondition(task.If)
+				if err != nil {
+					return nil, fmt.Errorf("%s has invalid condition: %v", task, err)
+				}
+			}
+			if task.outputLimit, err = parseSize(task.OutputLimit); err != nil {
+				return nil, fmt.Errorf("%s has invalid output-limit: %v", task, err)
+			}
+			if task.Exit < 0 || task.Exit > 255 {
+				return nil, fmt.Errorf("%s has invalid exit-code %d", task, task.Exit)
+			}
+			if task.ExpectedDuration < 0 {
+				return nil, fmt.Errorf("%s has invalid expected-duration: %v", task, task.ExpectedDuration)
+			}
+			if err := checkWorkdir(task); err != nil {
+				return nil, err
+			}
+			if err := checkLimits(task, task.Limits); err != nil {
+				return nil, err
+			}
+			for _, name := range task.AllowState {
+				if _, ok := project.State[name]; !ok {
+					return nil, fmt.Errorf("%s allows undefined state %q", task, name)
+				}
+			}
+			if task.Fixture != "" {
+				task.fixture = suite.Fixtures[task.Fixture]
+				if task.fixture == nil {
+					return nil, fmt.Errorf("%s refers to undefined fixture %q", task, task.Fixture)
+				}
+			}
 
 			err = checkSystems(task, task.Systems)
 			if err != nil {
 				return nil, err
 			}
+			if err := checkFiles(task, task.Path, task.Files); err != nil {
+				return nil, err
+			}
 
 			suite.Tasks[tname] = task
 		}
 	}
 
+	order := 0
+	for i, item := range decl.Suites {
+		sname, _ := item.Key.(string)
+		suite := project.Suites[strings.Trim(sname, "/")+"/"]
+		if suite == nil {
+			continue
+		}
+		suite.order = i
+		tnames := make([]string, 0, len(suite.Tasks))
+		for tname := range suite.Tasks {
+			tnames = append(tnames, tname)
+		}
+		sort.Strings(tnames)
+		for _, tname := range tnames {
+			suite.Tasks[tname].order = order
+			order++
+		}
+	}
+
 	debugf("Loaded project: %# v", project)
 	return project, nil
 }
@@ -367,7 +968,7 @@ func (f *filter) Pass(job *Job) bool {
 	return false
 }
 
-var dots = regexp.MustCompile(`\.+|:+`)
+var dots = regexp.MustCompile(`\.+|:+|\*|\?`)
 
 func NewFilter(args []string) (Filter, error) {
 	var err error
@@ -381,6 +982,10 @@ func NewFilter(args []string) (Filter, error) {
 				return `[^:]*`
 			case ":":
 				return "(:.+)*:(.+:)*"
+			case "*":
+				return `[^:/]*`
+			case "?":
+				return `[^:/]`
 			}
 			err = fmt.Errorf("invalid filter string: %q", s)
 			return s
@@ -404,6 +1009,32 @@ func NewFilter(args []string) (Filter, error) {
 	return &filter{exps}, nil
 }
 
+// NewFilterFile returns a filter for the jobs listed in the given file,
+// one per line in the same format taken by NewFilter. Empty lines and
+// lines starting with # are ignored. If the file lists nothing, the
+// returned filter is nil.
+func NewFilterFile(filename string) (Filter, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read filter file: %v", err)
+	}
+	var args []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			args = append(args, line)
+		}
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	f, err := NewFilter(args)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use %s: %v", filename, err)
+	}
+	return f, nil
+}
+
 func contains(set []string, item string) bool {
 	for _, v := range set {
 		if v == item {
@@ -413,17 +1044,123 @@ func contains(set []string, item string) bool {
 	return false
 }
 
+// backendNames returns the names of all backends in sorted order.
 func (p *Project) backendNames() []string {
 	bnames := make([]string, 0, len(p.Backends))
 	for bname, _ := range p.Backends {
 		bnames = append(bnames, bname)
 	}
+	sort.Strings(bnames)
 	return bnames
 }
 
+// systemKeys returns the backend and system names of all systems in all
+// backends, sorted so that iterating over them is reproducible.
+func (p *Project) systemKeys() [][2]string {
+	var keys [][2]string
+	for _, bname := range p.backendNames() {
+		systems := append([]string(nil), p.Backends[bname].Systems...)
+		sort.Strings(systems)
+		for _, system := range systems {
+			keys = append(keys, [2]string{bname, system})
+		}
+	}
+	return keys
+}
+
+// workerCounts returns how many workers are needed to run jobs on each
+// backend and system. Even if multiple workers per system are requested,
+// there are never more workers than jobs.
+func (p *Project) workerCounts(jobs []*Job) map[[2]string]int {
+	counts := make(map[[2]string]int)
+	for _, job := range jobs {
+		counts[[2]string{job.Backend.Name, string(job.System)}]++
+	}
+	workers := make(map[[2]string]int)
+	for _, key := range p.systemKeys() {
+		n := p.Backends[key[0]].SystemWorkers[key[1]]
+		if counts[key] < n {
+			n = counts[key]
+		}
+		workers[key] = n
+	}
+	return workers
+}
+
+type jobsByOrder []*Job
+
+func (jobs jobsByOrder) Len() int      { return len(jobs) }
+func (jobs jobsByOrder) Swap(i, j int) { jobs[i], jobs[j] = jobs[j], jobs[i] }
+func (jobs jobsByOrder) Less(i, j int) bool {
+	ji, jj := jobs[i], jobs[j]
+	if ji.Task.order != jj.Task.order {
+		return ji.Task.order < jj.Task.order
+	}
+	if ji.Backend.Name != jj.Backend.Name {
+		return ji.Backend.Name < jj.Backend.Name
+	}
+	if ji.System != jj.System {
+		return ji.System < jj.System
+	}
+	if ji.Variant != jj.Variant {
+		return ji.Variant < jj.Variant
+	}
+	return ji.Shard < jj.Shard
+}
+
+func (p *Project) task(name string) *Task {
+	for _, suite := range p.Suites {
+		for _, task := range suite.Tasks {
+			if task.Name == name {
+				return task
+			}
+		}
+	}
+	return nil
+}
+
+// taskRange returns the inclusive range of task positions selected by
+// the From and Until options.
+func (p *Project) taskRange(options *Options) (from, until int, err error) {
+	from, until = 0, int(^uint(0)>>1)
+	if options.From != "" {
+		task := p.task(strings.Trim(options.From, "/"))
+		if task == nil {
+			return 0, 0, fmt.Errorf("cannot find task %q to run from", options.From)
+		}
+		from = task.order
+	}
+	if options.Until != "" {
+		task := p.task(strings.Trim(options.Until, "/"))
+		if task == nil {
+			return 0, 0, fmt.Errorf("cannot find task %q to run until", options.Until)
+		}
+		until = task.order
+	}
+	if from > until {
+		return 0, 0, fmt.Errorf("task %s comes after task %s in the project", options.From, options.Until)
+	}
+	return from, until, nil
+}
+
 func (p *Project) Jobs(options *Options) ([]*Job, error) {
 	var jobs []*Job
 
+	from, until, err := p.taskRange(options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Suites declared before the one continued from are reported as
+	// skipped rather than left out, so it's clear they did not run.
+	var cont *Suite
+	if options.Continue != "" {
+		cont = p.Suites[strings.Trim(options.Continue, "/")+"/"]
+		if cont == nil {
+			return nil, fmt.Errorf("cannot find suite %q to continue from", options.Continue)
+		}
+	}
+
 	cmdcache := make(map[string]string)
 	penv := envmap{p, p.Environment}
 	pevr := strmap{p, evars(p.Environment, "")}
@@ -436,7 +1173,16 @@ func (p *Project) Jobs(options *Options) ([]*Job, error) {
 		sbke := strmap{suite, suite.Backends}
 		ssys := strmap{suite, suite.Systems}
 
+		var earlier string
+		if cont != nil && suite.order < cont.order {
+			earlier = "declared before suite " + cont.Name + " continued from"
+		}
+
 		for _, task := range suite.Tasks {
+			if task.order < from || task.order > until {
+				continue
+			}
+
 			tenv := envmap{task, task.Environment}
 			tevr := strmap{task, evars(task.Environment, "+")}
 			tvar := strmap{task, task.Variants}
@@ -450,6 +1196,9 @@ func (p *Project) Jobs(options *Options) ([]*Job, error) {
 
 			for _, bname := range backends {
 				backend := p.Backends[bname]
+				if backend == nil {
+					return nil, fmt.Errorf("%s refers to undefined backend %q", task, bname)
+				}
 				benv := envmap{task, backend.Environment}
 				bevr := strmap{task, evars(backend.Environment, "+")}
 				bvar := strmap{task, backend.Variants}
@@ -461,8 +1210,12 @@ func (p *Project) Jobs(options *Options) ([]*Job, error) {
 				}
 
 				for _, system := range systems {
+					skip := earlier
 					if backend.SystemWorkers[system] == 0 {
-						continue
+						if !options.FailOnSkip {
+							continue
+						}
+						skip = fmt.Sprintf("system %s not provided by %s", system, backend)
 					}
 
 					strmaps := []strmap{pevr, bevr, bvar, sevr, svar, tevr, tvar}
@@ -504,6 +1257,7 @@ func (p *Project) Jobs(options *Options) ([]*Job, error) {
 							Task:        task,
 							Variant:     variant,
 							Environment: env,
+							skip:        skip,
 						}
 
 						if job.Variant == "" {
@@ -523,8 +1277,25 @@ func (p *Project) Jobs(options *Options) ([]*Job, error) {
 						if options.Filter != nil && !options.Filter.Pass(job) {
 							continue
 						}
+						job.quarantined = options.Quarantine != nil && options.Quarantine.Pass(job)
 
-						jobs = append(jobs, job)
+						if task.Shards < 2 || skip != "" {
+							jobs = append(jobs, job)
+							continue
+						}
+						for shard := 0; shard < task.Shards; shard++ {
+							sjob := *job
+							sjob.Name = fmt.Sprintf("%s#%d", job.Name, shard)
+							sjob.Shard = shard
+							sjob.parent = job
+							sjob.Environment = make(map[string]string, len(env)+2)
+							for key, value := range env {
+								sjob.Environment[key] = value
+							}
+							sjob.Environment["SPREAD_SHARD"] = strconv.Itoa(shard)
+							sjob.Environment["SPREAD_SHARDS"] = strconv.Itoa(task.Shards)
+							jobs = append(jobs, &sjob)
+						}
 					}
 				}
 
@@ -551,16 +1322,117 @@ func (p *Project) Jobs(options *Options) ([]*Job, error) {
 	}
 
 	if len(jobs) == 0 {
-		if options.Filter != nil {
+		if options.Filter != nil || options.From != "" || options.Until != "" {
 			return nil, fmt.Errorf("nothing matches provider filter")
 		} else {
 			return nil, fmt.Errorf("cannot find any tasks")
 		}
 	}
 
+	sort.Sort(jobsByOrder(jobs))
+
 	return jobs, nil
 }
 
+// Validate checks the project for problems that would otherwise only be
+// noticed when running it, and returns all of them. Nothing is allocated
+// or run on any backend.
+func (p *Project) Validate(options *Options) []error {
+	var errs []error
+
+	systems := make(map[string]bool)
+	for _, backend := range p.Backends {
+		for _, system := range backend.Systems {
+			systems[system] = true
+		}
+	}
+	checkRefs := func(context fmt.Stringer, bnames, snames []string) {
+		for _, bname := range bnames {
+			if bname = strings.TrimLeft(bname, "+-"); p.Backends[bname] == nil {
+				errs = append(errs, fmt.Errorf("%s refers to undefined backend %q", context, bname))
+			}
+		}
+		for _, sname := range snames {
+			if sname = strings.TrimLeft(sname, "+-"); !systems[sname] {
+				errs = append(errs, fmt.Errorf("%s refers to system %q not listed by any backend", context, sname))
+			}
+		}
+	}
+
+	snames := make([]string, 0, len(p.Suites))
+	for sname := range p.Suites {
+		snames = append(snames, sname)
+	}
+	sort.Strings(snames)
+	for _, sname := range snames {
+		suite := p.Suites[sname]
+		checkRefs(suite, suite.Backends, suite.Systems)
+		if len(suite.Tasks) == 0 {
+			errs = append(errs, fmt.Errorf("%s has no tasks", suite))
+		}
+		tnames := make([]string, 0, len(suite.Tasks))
+		for tname := range suite.Tasks {
+			tnames = append(tnames, tname)
+		}
+		sort.Strings(tnames)
+		for _, tname := range tnames {
+			task := suite.Tasks[tname]
+			checkRefs(task, task.Backends, task.Systems)
+			if strings.TrimSpace(task.Execute) == "" {
+				errs = append(errs, fmt.Errorf("%s has no execute script", task))
+			}
+		}
+	}
+
+	if _, err := p.Jobs(options); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// loadScript reads the named script of context from filename, relative
+// to dir, when one is set, into script. The script must not be set
+// inline as well.
+func loadScript(context fmt.Stringer, what, dir, filename string, script *string) error {
+	if filename == "" {
+		return nil
+	}
+	if *script != "" {
+		return fmt.Errorf("%s has both %s and %s-file", context, what, what)
+	}
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(dir, filename)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("%s has invalid %s-file: %v", context, what, err)
+	}
+	*script = string(data)
+	return nil
+}
+
+// checkWorkdir checks that the workdir of task, if set, is a path
+// relative to the remote project path that does not lead outside of it.
+func checkWorkdir(task *Task) error {
+	if task.Workdir == "" {
+		return nil
+	}
+	workdir := path.Clean(task.Workdir)
+	if path.IsAbs(workdir) || workdir == ".." || strings.HasPrefix(workdir, "../") {
+		return fmt.Errorf("%s has invalid workdir %q, must be relative and within the project", task, task.Workdir)
+	}
+	return nil
+}
+
+// checkEmptyExecute makes sure mode is a valid empty-execute setting.
+func checkEmptyExecute(context fmt.Stringer, mode string) error {
+	switch mode {
+	case "", "pass", "warn", "fail":
+		return nil
+	}
+	return fmt.Errorf("%s has invalid empty-execute %q, must be pass, warn, or fail", context, mode)
+}
+
 func evars(env map[string]string, prefix string) []string {
 	seen := make(map[string]bool, len(env))
 	for key := range env {
@@ -1,11 +1,23 @@
 package spread_test 
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/snapcore/spread/spread"
 
 	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -30,6 +42,10 @@ func (s *FilterSuite) TestFilter(c *C) {
 		"...",
 		"im...",
 		"...ge",
+		"*ariant",
+		":var*",
+		"ima?e",
+		"suite/t*",
 	}
 
 	block := []string{
@@ -39,6 +55,9 @@ func (s *FilterSuite) TestFilter(c *C) {
 		":backend",
 		"suite",
 		"test",
+		"*-arm64",
+		"var?",
+		"suite*",
 	}
 
 	for _, s := range pass {
@@ -53,3 +72,906 @@ func (s *FilterSuite) TestFilter(c *C) {
 		c.Assert(f.Pass(job), Equals, false, Commentf("Filter: %q", s))
 	}
 }
+
+func (s *FilterSuite) TestFilterFile(c *C) {
+	filename := filepath.Join(c.MkDir(), "quarantine")
+	err := ioutil.WriteFile(filename, []byte("# Flaky.\n\nsuite/other\n  backend:image:suite/test  \n"), 0644)
+	c.Assert(err, IsNil)
+
+	f, err := spread.NewFilterFile(filename)
+	c.Assert(err, IsNil)
+	c.Assert(f.Pass(&spread.Job{Name: "backend:image:suite/test:variant"}), Equals, true)
+	c.Assert(f.Pass(&spread.Job{Name: "backend:image:suite/other"}), Equals, true)
+	c.Assert(f.Pass(&spread.Job{Name: "backend:image:suite/third"}), Equals, false)
+
+	err = ioutil.WriteFile(filename, []byte("# Nothing.\n"), 0644)
+	c.Assert(err, IsNil)
+	f, err = spread.NewFilterFile(filename)
+	c.Assert(err, IsNil)
+	c.Assert(f, IsNil)
+}
+
+type ProjectSuite struct{}
+
+var _ = Suite(&ProjectSuite{})
+
+const rangeProject = `
+project: range
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04]
+suites:
+    zsuite/:
+        summary: Declared first.
+    asuite/:
+        summary: Declared second.
+`
+
+func writeProject(c *C, yaml string, tasks ...string) string {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "spread.yaml"), []byte(yaml), 0644)
+	c.Assert(err, IsNil)
+	for _, task := range tasks {
+		err = os.MkdirAll(filepath.Join(dir, task), 0755)
+		c.Assert(err, IsNil)
+		data := []byte("summary: Task " + task + ".\nexecute: echo\n")
+		err = ioutil.WriteFile(filepath.Join(dir, task, "task.yaml"), data, 0644)
+		c.Assert(err, IsNil)
+	}
+	return dir
+}
+
+func jobNames(jobs []*spread.Job) []string {
+	var names []string
+	for _, job := range jobs {
+		names = append(names, job.Name)
+	}
+	return names
+}
+
+const validateProject = `
+project: validate
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04]
+suites:
+    good/:
+        summary: All fine.
+    bad/:
+        summary: Broken references.
+        backends: [linode]
+        systems: [-ubuntu-14.04]
+    empty/:
+        summary: No tasks.
+`
+
+func (s *ProjectSuite) TestValidate(c *C) {
+	dir := writeProject(c, validateProject, "good/a", "bad/b")
+	err := ioutil.WriteFile(filepath.Join(dir, "good/a/task.yaml"), []byte("summary: No script.\n"), 0644)
+	c.Assert(err, IsNil)
+	c.Assert(os.Mkdir(filepath.Join(dir, "empty"), 0755), IsNil)
+
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+
+	var msgs []string
+	for _, err := range project.Validate(&spread.Options{}) {
+		msgs = append(msgs, err.Error())
+	}
+	c.Assert(msgs, DeepEquals, []string{
+		`suite bad/ refers to undefined backend "linode"`,
+		`suite bad/ refers to system "ubuntu-14.04" not listed by any backend`,
+		`suite empty/ has no tasks`,
+		`good/a has no execute script`,
+		`bad/b refers to undefined backend "linode"`,
+	})
+}
+
+const workersProject = `
+project: workers
+path: /remote/path
+backends:
+    lxd:
+        workers: 3
+        systems: [ubuntu-14.04, ubuntu-16.04*2]
+    linode:
+        systems: [ubuntu-16.04]
+suites:
+    suite/:
+        summary: Suite.
+`
+
+func (s *ProjectSuite) TestWorkers(c *C) {
+	dir := writeProject(c, workersProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	c.Assert(project.Backends["lxd"].SystemWorkers, DeepEquals, map[string]int{"ubuntu-14.04": 3, "ubuntu-16.04": 2})
+	c.Assert(project.Backends["linode"].SystemWorkers, DeepEquals, map[string]int{"ubuntu-16.04": 1})
+
+	dir = writeProject(c, strings.Replace(workersProject, "workers: 3", "workers: -1", 1), "suite/a")
+	_, err = spread.Load(dir)
+	c.Assert(err, ErrorMatches, `backend "lxd" has invalid number of workers: -1`)
+}
+
+const placementProject = `
+project: placement
+path: /remote/path
+backends:
+    linode:
+        systems: [ubuntu-16.04]
+        placement:
+            policy: spread
+            zones: [2, 6]
+suites:
+    suite/:
+        summary: Suite.
+`
+
+var placementErrors = []struct {
+	old, new string
+	err      string
+}{
+	{"policy: spread", "policy: pin", ""},
+	{"policy: spread", "policy: random", `backend "linode" has invalid placement policy "random", must be spread or pin`},
+	{"zones: [2, 6]", "zones: [2, 2]", `backend "linode" has invalid placement zone "2"`},
+	{"policy: spread\n            zones: [2, 6]", "policy: pin", `backend "linode" pins placement without listing zones`},
+	{"linode:\n", "lxd:\n", `backend "lxd" does not support placement`},
+}
+
+func (s *ProjectSuite) TestPlacement(c *C) {
+	dir := writeProject(c, placementProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	c.Assert(project.Backends["linode"].Placement, DeepEquals, &spread.Placement{Policy: "spread", Zones: []string{"2", "6"}})
+
+	for _, test := range placementErrors {
+		dir := writeProject(c, strings.Replace(placementProject, test.old, test.new, 1), "suite/a")
+		_, err := spread.Load(dir)
+		if test.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+
+	zones := []string{"2", "2", "6", "9"}
+	order := spread.PlacementOrder(&spread.Placement{Policy: "pin", Zones: []string{"6", "9"}}, zones, nil)
+	sort.Ints(order)
+	c.Assert(order, DeepEquals, []int{2, 3})
+
+	used := map[string]int{"2": 1}
+	order = spread.PlacementOrder(&spread.Placement{Policy: "spread", Zones: []string{"2", "6"}}, zones, used)
+	c.Assert(order, HasLen, 3)
+	c.Assert(order[0], Equals, 2)
+
+	c.Assert(spread.PlacementOrder(nil, zones, used), HasLen, 4)
+}
+
+const tagsProject = `
+project: tags
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04]
+        tags:
+            team: devices
+suites:
+    suite/:
+        summary: Suite.
+`
+
+var tagsErrors = []struct {
+	old, new string
+	err      string
+}{
+	{"team: devices", "team-name: devices", ""},
+	{"team: devices", "\"team name\": devices", `backend "lxd" has invalid tag name "team name"`},
+	{"team: devices", "team=x: devices", `backend "lxd" has invalid tag name "team=x"`},
+	{"lxd:\n", "linode:\n", ""},
+	{"lxd:\n", "local:\n", `backend "local" does not support tags`},
+}
+
+func (s *ProjectSuite) TestTags(c *C) {
+	dir := writeProject(c, tagsProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	c.Assert(project.Backends["lxd"].Tags, DeepEquals, map[string]string{"team": "devices"})
+
+	for _, test := range tagsErrors {
+		dir := writeProject(c, strings.Replace(tagsProject, test.old, test.new, 1), "suite/a")
+		_, err := spread.Load(dir)
+		if test.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+}
+
+const clockProject = `
+project: clock
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04]
+        clock-skew: 2s
+        clock-sync: 1m
+suites:
+    suite/:
+        summary: Suite.
+`
+
+var clockErrors = []struct {
+	old, new string
+	err      string
+}{
+	{"clock-sync: 1m", "clock-sync: 0s", ""},
+	{"clock-skew: 2s", "clock-skew: -2s", `backend "lxd" has negative clock-skew or clock-sync`},
+	{"clock-sync: 1m", "clock-sync: -1m", `backend "lxd" has negative clock-skew or clock-sync`},
+	{"clock-skew: 2s", "clock-skew: 0s", `backend "lxd" has clock-sync without clock-skew`},
+}
+
+func (s *ProjectSuite) TestClock(c *C) {
+	dir := writeProject(c, clockProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	c.Assert(project.Backends["lxd"].ClockSkew, Equals, 2*time.Second)
+	c.Assert(project.Backends["lxd"].ClockSync, Equals, time.Minute)
+
+	for _, test := range clockErrors {
+		dir := writeProject(c, strings.Replace(clockProject, test.old, test.new, 1), "suite/a")
+		_, err := spread.Load(dir)
+		if test.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+}
+
+const pathsProject = `
+project: paths
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04, fedora-30]
+        paths:
+            fedora-30: /home/spread/path/
+suites:
+    suite/:
+        summary: Suite.
+`
+
+var pathsErrors = []struct {
+	old, new string
+	err      string
+}{
+	{"fedora-30: /home/spread/path/", "ubuntu-16.04: /srv/path", ""},
+	{"fedora-30: /home/spread/path/", "debian-9: /srv/path", `backend "lxd" has path for unlisted system "debian-9"`},
+	{"fedora-30: /home/spread/path/", "fedora-30: spread/path", `backend "lxd" has invalid path for fedora-30, must be absolute and not /: spread/path`},
+	{"fedora-30: /home/spread/path/", "fedora-30: /", `backend "lxd" has invalid path for fedora-30, must be absolute and not /: /`},
+}
+
+func (s *ProjectSuite) TestPaths(c *C) {
+	dir := writeProject(c, pathsProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	backend := project.Backends["lxd"]
+	c.Assert(backend.Paths, DeepEquals, map[string]string{"fedora-30": "/home/spread/path"})
+
+	c.Assert(spread.RemotePath(project, backend, "fedora-30"), Equals, "/home/spread/path")
+	c.Assert(spread.RemotePath(project, backend, "ubuntu-16.04"), Equals, "/remote/path")
+	local := &spread.Backend{Name: "local", Type: "local", Paths: backend.Paths}
+	c.Assert(spread.RemotePath(project, local, "fedora-30"), Equals, project.Path)
+
+	for _, test := range pathsErrors {
+		dir := writeProject(c, strings.Replace(pathsProject, test.old, test.new, 1), "suite/a")
+		_, err := spread.Load(dir)
+		if test.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+}
+
+const slowProject = `
+project: slow
+path: /remote/path
+slow-factor: 1.5
+backends:
+    lxd:
+        systems: [ubuntu-16.04]
+suites:
+    suite/:
+        summary: Suite.
+`
+
+var slowErrors = []struct {
+	old, new string
+	err      string
+}{
+	{"slow-factor: 1.5", "slow-factor: 1", ""},
+	{"slow-factor: 1.5", "slow-factor: 0.5", `invalid project slow-factor, must be at least 1: 0.5`},
+	{"slow-factor: 1.5", "slow-factor: -2", `invalid project slow-factor, must be at least 1: -2`},
+}
+
+func (s *ProjectSuite) TestSlowFactor(c *C) {
+	dir := writeProject(c, slowProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	c.Assert(project.SlowFactor, Equals, 1.5)
+
+	dir = writeProject(c, strings.Replace(slowProject, "slow-factor: 1.5\n", "", 1), "suite/a")
+	project, err = spread.Load(dir)
+	c.Assert(err, IsNil)
+	c.Assert(project.SlowFactor, Equals, 1.0)
+
+	for _, test := range slowErrors {
+		dir := writeProject(c, strings.Replace(slowProject, test.old, test.new, 1), "suite/a")
+		_, err := spread.Load(dir)
+		if test.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+
+	dir = writeProject(c, slowProject, "suite/a")
+	err = ioutil.WriteFile(filepath.Join(dir, "suite/a/task.yaml"), []byte("summary: Task.\nexecute: true\nexpected-duration: -1m\n"), 0644)
+	c.Assert(err, IsNil)
+	_, err = spread.Load(dir)
+	c.Assert(err, ErrorMatches, `suite/a has invalid expected-duration: -1m0s`)
+}
+
+var workdirTests = []struct {
+	workdir string
+	err     string
+}{
+	{"build/output", ""},
+	{"build/../output", ""},
+	{".", ""},
+	{"/build", `suite/a has invalid workdir "/build", must be relative and within the project`},
+	{"..", `suite/a has invalid workdir "..", must be relative and within the project`},
+	{"../..", `suite/a has invalid workdir "../..", must be relative and within the project`},
+	{"build/../../other", `suite/a has invalid workdir "build/../../other", must be relative and within the project`},
+}
+
+func (s *ProjectSuite) TestWorkdir(c *C) {
+	for _, test := range workdirTests {
+		dir := writeProject(c, slowProject, "suite/a")
+		data := "summary: Task.\nexecute: true\nworkdir: " + strconv.Quote(test.workdir) + "\n"
+		err := ioutil.WriteFile(filepath.Join(dir, "suite/a/task.yaml"), []byte(data), 0644)
+		c.Assert(err, IsNil)
+		_, err = spread.Load(dir)
+		if test.err == "" {
+			c.Check(err, IsNil, Commentf("workdir: %s", test.workdir))
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+}
+
+const testCert = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+var checkCACertsTests = []struct {
+	filename string
+	content  string
+	path     string
+	err      string
+}{
+	{"", "", "", ""},
+	{"ca.crt", testCert, "$DIR/ca.crt", ""},
+	{"$DIR/ca.crt", testCert, "$DIR/ca.crt", ""},
+	{"certs/../ca.crt", testCert, "$DIR/ca.crt", ""},
+	{"ca.crt", "not a certificate\n", "", `backend "lxd" has invalid ca-certs: no certificates in $DIR/ca.crt`},
+	{"missing.crt", "", "", `backend "lxd" has invalid ca-certs: open $DIR/missing.crt: no such file or directory`},
+}
+
+func (s *ProjectSuite) TestCheckCACerts(c *C) {
+	backend := &spread.Backend{Name: "lxd"}
+	for _, test := range checkCACertsTests {
+		dir := c.MkDir()
+		expand := func(s string) string { return strings.Replace(s, "$DIR", dir, -1) }
+		if test.content != "" {
+			err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), []byte(test.content), 0644)
+			c.Assert(err, IsNil)
+		}
+		path, err := spread.CheckCACerts(backend, dir, expand(test.filename))
+		if test.err != "" {
+			c.Check(err, ErrorMatches, regexp.QuoteMeta(expand(test.err)))
+			continue
+		}
+		c.Check(err, IsNil)
+		c.Check(path, Equals, expand(test.path))
+	}
+}
+
+const storageProject = `
+project: storage
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04, fedora-30]
+        storage:
+            ubuntu-16.04: 10G
+suites:
+    suite/:
+        summary: Suite.
+`
+
+var storageErrors = []struct {
+	old, new string
+	err      string
+}{
+	{"ubuntu-16.04: 10G", "fedora-30: 1M", ""},
+	{"lxd:\n", "linode:\n", ""},
+	{"ubuntu-16.04: 10G", "debian-9: 10G", `backend "lxd" has storage for unlisted system "debian-9"`},
+	{"ubuntu-16.04: 10G", "ubuntu-16.04: 512K", `backend "lxd" has invalid storage for ubuntu-16.04, must be at least 1M: "512K"`},
+	{"ubuntu-16.04: 10G", "ubuntu-16.04: lots", `backend "lxd" has invalid storage for ubuntu-16.04, must be at least 1M: "lots"`},
+	{"lxd:\n", "local:\n", `backend "local" does not support storage`},
+}
+
+func (s *ProjectSuite) TestStorage(c *C) {
+	dir := writeProject(c, storageProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	backend := project.Backends["lxd"]
+	c.Assert(backend.StorageSize("ubuntu-16.04"), Equals, int64(10<<30))
+	c.Assert(backend.StorageSize("fedora-30"), Equals, int64(0))
+
+	for _, test := range storageErrors {
+		dir := writeProject(c, strings.Replace(storageProject, test.old, test.new, 1), "suite/a")
+		_, err := spread.Load(dir)
+		if test.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+}
+
+var parseSizeTests = []struct {
+	s    string
+	size int64
+	err  string
+}{
+	{"", 0, ""},
+	{"0", 0, ""},
+	{"512", 512, ""},
+	{"4K", 4 << 10, ""},
+	{"4k", 4 << 10, ""},
+	{"10M", 10 << 20, ""},
+	{"2G", 2 << 30, ""},
+	{"-1", 0, `invalid size "-1"`},
+	{"M", 0, `invalid size "M"`},
+	{"1.5M", 0, `invalid size "1.5M"`},
+	{"10MB", 0, `invalid size "10MB"`},
+}
+
+func (s *ProjectSuite) TestParseSize(c *C) {
+	for _, test := range parseSizeTests {
+		size, err := spread.ParseSize(test.s)
+		if test.err != "" {
+			c.Check(err, ErrorMatches, test.err)
+		} else {
+			c.Check(err, IsNil)
+			c.Check(size, Equals, test.size, Commentf("size: %q", test.s))
+		}
+	}
+}
+
+var checkFilesTests = []struct {
+	file spread.File
+	from string
+	perm os.FileMode
+	err  string
+}{
+	{spread.File{From: "creds", To: "/root/creds"}, "/project/creds", 0644, ""},
+	{spread.File{From: "/etc/creds", To: "/root/creds"}, "/etc/creds", 0644, ""},
+	{spread.File{From: "~/creds", To: "/root/creds"}, "/home/user/creds", 0644, ""},
+	{spread.File{From: "creds", To: "/root/creds", Secret: true}, "/project/creds", 0600, ""},
+	{spread.File{From: "creds", To: "/root/creds", Secret: true, Mode: "0640"}, "/project/creds", 0640, ""},
+	{spread.File{From: "run.sh", To: "/root/run.sh", Mode: "755"}, "/project/run.sh", 0755, ""},
+	{spread.File{From: "creds"}, "", 0, `backend "lxd" has file entry missing from or to field`},
+	{spread.File{To: "/root/creds"}, "", 0, `backend "lxd" has file entry missing from or to field`},
+	{spread.File{From: "creds", To: "root/creds"}, "", 0, `backend "lxd" has file with relative remote path: "root/creds"`},
+	{spread.File{From: "creds", To: "/root/creds", Mode: "rw"}, "", 0, `backend "lxd" has file /root/creds with invalid mode: "rw"`},
+	{spread.File{From: "creds", To: "/root/creds", Mode: "1777"}, "", 0, `backend "lxd" has file /root/creds with invalid mode: "1777"`},
+}
+
+func (s *ProjectSuite) TestCheckFiles(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", "/home/user")
+
+	backend := &spread.Backend{Name: "lxd"}
+	for _, test := range checkFilesTests {
+		f := test.file
+		err := spread.CheckFiles(backend, "/project", []*spread.File{&f})
+		if test.err != "" {
+			c.Check(err, ErrorMatches, test.err)
+			continue
+		}
+		c.Check(err, IsNil)
+		c.Check(f.From, Equals, test.from)
+		c.Check(f.Perm(), Equals, test.perm, Commentf("file: %#v", test.file))
+	}
+}
+
+func (s *ProjectSuite) TestJobsShards(c *C) {
+	dir := writeProject(c, rangeProject, "zsuite/a", "asuite/b")
+	data := []byte("summary: Sharded.\nshards: 3\nexecute: echo\n")
+	err := ioutil.WriteFile(filepath.Join(dir, "zsuite/a/task.yaml"), data, 0644)
+	c.Assert(err, IsNil)
+
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+
+	jobs, err := project.Jobs(&spread.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(jobNames(jobs), DeepEquals, []string{
+		"lxd:ubuntu-16.04:zsuite/a#0",
+		"lxd:ubuntu-16.04:zsuite/a#1",
+		"lxd:ubuntu-16.04:zsuite/a#2",
+		"lxd:ubuntu-16.04:asuite/b",
+	})
+	for i, job := range jobs[:3] {
+		c.Assert(job.Shard, Equals, i)
+		c.Assert(job.Environment["SPREAD_SHARD"], Equals, strconv.Itoa(i))
+		c.Assert(job.Environment["SPREAD_SHARDS"], Equals, "3")
+	}
+	c.Assert(jobs[3].Environment["SPREAD_SHARD"], Equals, "")
+}
+
+const envProject = `
+project: env
+path: /remote/path
+environment:
+    PROJECT: project
+    ENDPOINT: none
+    REGION: none
+backends:
+    lxd:
+        systems: [ubuntu-16.04]
+        environment:
+            ENDPOINT: https://lxd.example.com
+            REGION: local
+suites:
+    suite/:
+        summary: Overrides the region.
+        environment:
+            REGION: suite
+`
+
+func (s *ProjectSuite) TestBackendEnvironment(c *C) {
+	dir := writeProject(c, envProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+
+	jobs, err := project.Jobs(&spread.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(jobs, HasLen, 1)
+	env := jobs[0].Environment
+	c.Assert(env["PROJECT"], Equals, "project")
+	c.Assert(env["ENDPOINT"], Equals, "https://lxd.example.com")
+	c.Assert(env["REGION"], Equals, "suite")
+}
+
+const errorsProject = `
+project: errors
+path: /remote/path
+errors:
+    - match: rate limit
+      class: quota
+    - match: no such host
+      class: fatal
+backends:
+    lxd:
+        systems: [ubuntu-16.04]
+        errors:
+            - match: no such host
+              class: transient
+suites:
+    suite/:
+        summary: Suite.
+`
+
+func (s *ProjectSuite) TestErrorRules(c *C) {
+	dir := writeProject(c, errorsProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+
+	backend := project.Backends["lxd"]
+	c.Check(spread.Classify(project, backend, errors.New("API rate limit exceeded")), Equals, "quota")
+	c.Check(spread.Classify(project, backend, errors.New("dial: no such host")), Equals, "transient")
+	c.Check(spread.Classify(project, backend, errors.New("timeout")), Equals, "transient")
+
+	dir = writeProject(c, strings.Replace(errorsProject, "class: quota", "class: later", 1), "suite/a")
+	_, err = spread.Load(dir)
+	c.Assert(err, ErrorMatches, `project has invalid error class "later", must be transient, fatal, or quota`)
+}
+
+const shellProject = `
+project: shell
+path: /remote/path
+shell:
+    prepare: /bin/dash
+    execute: /bin/bash
+backends:
+    lxd:
+        systems: [ubuntu-16.04, alpine-3]
+        shells:
+            alpine-3:
+                execute: /bin/ash
+suites:
+    suite/:
+        summary: Suite.
+`
+
+func (s *ProjectSuite) TestShell(c *C) {
+	dir := writeProject(c, shellProject, "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+
+	jobs, err := project.Jobs(&spread.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(jobs, HasLen, 2)
+
+	shells := make(map[string]string)
+	for _, job := range jobs {
+		shells[job.Name+" prepare"] = spread.ShellFor(project, job, false)
+		shells[job.Name+" execute"] = spread.ShellFor(project, job, true)
+	}
+	c.Assert(shells, DeepEquals, map[string]string{
+		"lxd:alpine-3:suite/a prepare":     "/bin/dash",
+		"lxd:alpine-3:suite/a execute":     "/bin/ash",
+		"lxd:ubuntu-16.04:suite/a prepare": "/bin/dash",
+		"lxd:ubuntu-16.04:suite/a execute": "/bin/bash",
+	})
+
+	dir = writeProject(c, strings.Replace(shellProject, "/bin/ash", "ash", 1), "suite/a")
+	_, err = spread.Load(dir)
+	c.Assert(err, ErrorMatches, `backend "lxd" has invalid shell for alpine-3, must be an absolute path: ash`)
+}
+
+const scriptFilesProject = `
+project: script-files
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04]
+suites:
+    suite/:
+        summary: Suite.
+        prepare-file: prepare.sh
+`
+
+func (s *ProjectSuite) TestScriptFiles(c *C) {
+	dir := writeProject(c, scriptFilesProject)
+	err := os.MkdirAll(filepath.Join(dir, "suite", "a"), 0755)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "suite", "prepare.sh"), []byte("echo suite\n"), 0644)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "suite", "a", "run.sh"), []byte("echo task\n"), 0644)
+	c.Assert(err, IsNil)
+	task := filepath.Join(dir, "suite", "a", "task.yaml")
+	err = ioutil.WriteFile(task, []byte("summary: Task.\nexecute-file: run.sh\n"), 0644)
+	c.Assert(err, IsNil)
+
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	suite := project.Suites["suite/"]
+	c.Assert(suite.Prepare, Equals, "echo suite\n")
+	c.Assert(suite.Tasks["a"].Execute, Equals, "echo task\n")
+
+	err = ioutil.WriteFile(task, []byte("summary: Task.\nexecute: echo\nexecute-file: run.sh\n"), 0644)
+	c.Assert(err, IsNil)
+	_, err = spread.Load(dir)
+	c.Assert(err, ErrorMatches, "suite/a has both execute and execute-file")
+}
+
+const estimateProject = `
+project: estimate
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04*2]
+        price: 0.5
+        billing: 1h
+suites:
+    suite/:
+        summary: Suite.
+`
+
+func (s *ProjectSuite) TestEstimate(c *C) {
+	dir := writeProject(c, estimateProject, "suite/a", "suite/b", "suite/c")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	err = project.Estimate(&buf, &spread.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, ""+
+		"lxd:ubuntu-16.04  3 jobs  2 workers  2 servers  ~1m30s  ~1.00\n"+
+		"Estimated cost: ~1.00\n"+
+		"3 jobs without expected-duration assumed to take 1m0s.\n")
+
+	// Only the servers shared by the workers are billed.
+	dir = writeProject(c, strings.Replace(estimateProject, "billing: 1h", "billing: 1h\n        servers:\n            ubuntu-16.04: 1", 1), "suite/a", "suite/b", "suite/c")
+	project, err = spread.Load(dir)
+	c.Assert(err, IsNil)
+	buf.Reset()
+	err = project.Estimate(&buf, &spread.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, ""+
+		"lxd:ubuntu-16.04  3 jobs  2 workers  1 server  ~1m30s  ~0.50\n"+
+		"Estimated cost: ~0.50\n"+
+		"3 jobs without expected-duration assumed to take 1m0s.\n")
+}
+
+func (s *ProjectSuite) TestDump(c *C) {
+	dir := writeProject(c, strings.Replace(envProject, "    REGION: none\n", "    REGION: none\n    API_TOKEN: hunter2\n", 1), "suite/a")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	err = project.Dump(&buf, &spread.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(buf.String(), "hunter2"), Equals, false)
+
+	var dumped []struct {
+		Job         string
+		Execute     string
+		Environment map[string]string
+	}
+	err = yaml.Unmarshal(buf.Bytes(), &dumped)
+	c.Assert(err, IsNil)
+	c.Assert(dumped, HasLen, 1)
+	c.Assert(dumped[0].Job, Equals, "lxd:ubuntu-16.04:suite/a")
+	c.Assert(dumped[0].Execute, Equals, "echo")
+	c.Assert(dumped[0].Environment["REGION"], Equals, "suite")
+	c.Assert(dumped[0].Environment["API_TOKEN"], Equals, "*****")
+}
+
+func (s *ProjectSuite) TestFetchProjectArchive(c *C) {
+	dir := writeProject(c, envProject, "suite/a")
+	archive := filepath.Join(c.MkDir(), "project.tar.gz")
+	err := exec.Command("tar", "-czf", archive, "-C", filepath.Dir(dir), filepath.Base(dir)).Run()
+	c.Assert(err, IsNil)
+
+	path, err := spread.FetchProject(archive, c.MkDir())
+	c.Assert(err, IsNil)
+	project, err := spread.Load(path)
+	c.Assert(err, IsNil)
+	c.Assert(project.Name, Equals, "env")
+}
+
+const graphProject = `
+project: graph
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04*2]
+suites:
+    serial/:
+        summary: One at a time.
+        serial: true
+    parallel/:
+        summary: All at once.
+`
+
+func (s *ProjectSuite) TestGraph(c *C) {
+	dir := writeProject(c, graphProject, "serial/a", "serial/b", "parallel/c")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	err = project.Graph(&buf, &spread.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, `digraph spread {
+	rankdir=LR;
+	node [shape=box];
+	subgraph cluster_0 {
+		label="lxd:ubuntu-16.04 (2 workers)";
+		"lxd:ubuntu-16.04:serial/" [label="serial/ (serial)", shape=folder];
+		"lxd:ubuntu-16.04:serial/a" [label="serial/a"];
+		"lxd:ubuntu-16.04:serial/" -> "lxd:ubuntu-16.04:serial/a" [style=bold];
+		"lxd:ubuntu-16.04:serial/b" [label="serial/b"];
+		"lxd:ubuntu-16.04:serial/a" -> "lxd:ubuntu-16.04:serial/b" [style=bold];
+		"lxd:ubuntu-16.04:parallel/" [label="parallel/", shape=folder];
+		"lxd:ubuntu-16.04:parallel/c" [label="parallel/c"];
+		"lxd:ubuntu-16.04:parallel/" -> "lxd:ubuntu-16.04:parallel/c";
+	}
+}
+`)
+}
+
+func (s *ProjectSuite) TestJobsRange(c *C) {
+	dir := writeProject(c, rangeProject, "zsuite/b", "zsuite/a", "asuite/d", "asuite/c")
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+
+	jobs, err := project.Jobs(&spread.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(jobNames(jobs), DeepEquals, []string{
+		"lxd:ubuntu-16.04:zsuite/a",
+		"lxd:ubuntu-16.04:zsuite/b",
+		"lxd:ubuntu-16.04:asuite/c",
+		"lxd:ubuntu-16.04:asuite/d",
+	})
+
+	jobs, err = project.Jobs(&spread.Options{From: "zsuite/b", Until: "asuite/c"})
+	c.Assert(err, IsNil)
+	c.Assert(jobNames(jobs), DeepEquals, []string{
+		"lxd:ubuntu-16.04:zsuite/b",
+		"lxd:ubuntu-16.04:asuite/c",
+	})
+
+	filter, err := spread.NewFilter([]string{"zsuite/"})
+	c.Assert(err, IsNil)
+	jobs, err = project.Jobs(&spread.Options{From: "zsuite/b", Filter: filter})
+	c.Assert(err, IsNil)
+	c.Assert(jobNames(jobs), DeepEquals, []string{"lxd:ubuntu-16.04:zsuite/b"})
+
+	_, err = project.Jobs(&spread.Options{From: "asuite/c", Until: "zsuite/b"})
+	c.Assert(err, ErrorMatches, "task asuite/c comes after task zsuite/b in the project")
+
+	_, err = project.Jobs(&spread.Options{From: "asuite/x"})
+	c.Assert(err, ErrorMatches, `cannot find task "asuite/x" to run from`)
+
+	jobs, err = project.Jobs(&spread.Options{Continue: "asuite"})
+	c.Assert(err, IsNil)
+	c.Assert(jobNames(jobs), HasLen, 4)
+	for _, job := range jobs {
+		if job.Suite.Name == "zsuite/" {
+			c.Check(job.Skip(), Equals, "declared before suite asuite/ continued from")
+		} else {
+			c.Check(job.Skip(), Equals, "")
+		}
+	}
+
+	_, err = project.Jobs(&spread.Options{Continue: "xsuite/"})
+	c.Assert(err, ErrorMatches, `cannot find suite "xsuite/" to continue from`)
+}
+
+var conditionTests = []struct {
+	expr   string
+	result bool
+	err    string
+}{
+	{expr: `os == ubuntu`, result: true},
+	{expr: `os != "ubuntu"`, result: false},
+	{expr: `kernel >= 5.4`, result: true},
+	{expr: `kernel < 5.10`, result: false},
+	{expr: `kernel > 5.15.0-90-generic`, result: true},
+	{expr: `arch =~ "^(x86_64|aarch64)$"`, result: true},
+	{expr: `arch !~ 'arm'`, result: true},
+	{expr: `$FEATURE`, result: true},
+	{expr: `${MISSING}`, result: false},
+	{expr: `!$MISSING && (os == debian || $FEATURE == yes)`, result: true},
+	{expr: `os == debian || os == fedora && true`, result: false},
+	{expr: `false || 1`, result: true},
+	{expr: `model == x`, result: false},
+	{expr: `os ==`, err: `unexpected end of condition`},
+	{expr: `(os == ubuntu`, err: `missing closing parenthesis`},
+	{expr: `os == ubuntu)`, err: `unexpected "\)"`},
+	{expr: `os == "ubuntu`, err: `unterminated string in .*`},
+	{expr: `os == ubuntu; true`, err: `unexpected ";" in .*`},
+}
+
+func (s *ProjectSuite) TestConditions(c *C) {
+	facts := map[string]string{"os": "ubuntu", "kernel": "5.15.0-91-generic", "arch": "x86_64"}
+	env := map[string]string{"FEATURE": "yes"}
+	for _, test := range conditionTests {
+		c.Logf("Condition: %s", test.expr)
+		result, err := spread.EvalCondition(test.expr, facts, env)
+		if test.err != "" {
+			c.Check(err, ErrorMatches, test.err)
+		} else {
+			c.Check(err, IsNil)
+			c.Check(result, Equals, test.result)
+		}
+	}
+}
@@ -1,19 +1,92 @@
 package spread
 
 import (
+	"crypto/rand"
+	"crypto/sha1"
 	"fmt"
-	"math/rand"
+	mathrand "math/rand"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
-var rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+var rnd = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+
+// retrier computes the delays between consecutive attempts of an
+// operation according to the backoff settings of a backend.
+type retrier struct {
+	backoff *Backoff
+	delay   time.Duration
+}
+
+func (rt *retrier) next() time.Duration {
+	b := rt.backoff
+	if rt.delay == 0 {
+		rt.delay = b.Delay
+	} else {
+		rt.delay = time.Duration(float64(rt.delay) * b.Factor)
+	}
+	if b.Max > 0 && rt.delay > b.Max {
+		rt.delay = b.Max
+	}
+	// The global source is used as rnd is not safe for concurrent use.
+	return rt.delay - time.Duration(mathrand.Float64()*b.Jitter*float64(rt.delay))
+}
+
+func (rt *retrier) reset() {
+	rt.delay = 0
+}
 
 type Provider interface {
 	Backend() *Backend
 	Allocate(image ImageID, password string) (Server, error)
 	Reuse(data []byte, password string) (Server, error)
 	DiscardSnapshot(img ImageID) error
+	List() ([]ListedServer, error)
+}
+
+// ImagePreparer is implemented by providers able to fetch the images of
+// their systems ahead of time, so that workers don't stall downloading
+// them one after the other when allocating servers.
+type ImagePreparer interface {
+	PrepareImages(images []ImageID) error
+}
+
+// BatchAllocator is implemented by providers able to allocate servers
+// for many images more efficiently at once than one by one. The returned
+// servers match the given images in order, with nil entries for images
+// that could not be allocated.
+type BatchAllocator interface {
+	AllocateBatch(images []ImageID, password string) ([]Server, error)
+}
+
+// Stopper is implemented by providers able to stop servers instead of
+// discarding them, keeping their disks so that later runs may start them
+// again quickly. Stop returns the name to start the server by, and Start
+// returns nil if no stopped server has the given name.
+type Stopper interface {
+	Stop(server Server) (name string, err error)
+	Start(name string, password string) (Server, error)
+}
+
+// StorageServer is implemented by servers that may have an extra data
+// volume attached, as set in the storage field of their backend.
+type StorageServer interface {
+	Server
+
+	// Storage returns the device path of the data volume attached to
+	// the server, or the path it is mounted at for servers that cannot
+	// hold block devices, or an empty string if there is none.
+	Storage() string
+}
+
+// ListedServer is a server created by spread for the project backend,
+// as found by Provider.List, and the ID of the run that created it.
+type ListedServer struct {
+	Server Server
+	RunID  string
 }
 
 type Server interface {
@@ -57,6 +130,93 @@ func (img ImageID) Label(note string) string {
 	return fmt.Sprintf("%s %s%s", img, tstr, note)
 }
 
+// snapshotKey returns a key identifying the state of a server running
+// image after the project and backend are prepared. The key changes
+// whenever the scripts or environment used to prepare them change.
+func snapshotKey(p *Project, b *Backend, image ImageID) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", p.Name, b.Name, image.SystemID())
+	if alias := b.imageAlias(image); alias != "" {
+		fmt.Fprintf(h, "%s\x00", alias)
+	}
+	fmt.Fprintf(h, "%s\x00%s\x00", p.Prepare, b.Prepare)
+	for _, env := range []map[string]string{p.Environment, b.Environment} {
+		var keys []string
+		for key := range env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(h, "%s=%s\x00", key, env[key])
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:12]
+}
+
+// instanceTags returns the tags to apply to new servers of the backend
+// running image. These always include the project, backend, system, and
+// run ID, so servers created by spread may be found later.
+func instanceTags(p *Project, b *Backend, o *Options, image ImageID) map[string]string {
+	tags := make(map[string]string, len(b.Tags)+4)
+	for key, value := range b.Tags {
+		tags[key] = value
+	}
+	tags["spread-project"] = p.Name
+	tags["spread-backend"] = b.Name
+	tags["spread-system"] = string(image.SystemID())
+	tags["spread-run-id"] = o.RunID
+	return tags
+}
+
+var invalidInstanceChars = regexp.MustCompile("[^a-z0-9]+")
+
+// instanceName renders the instance name template of the backend for a
+// new server running image. The result holds only lowercase letters,
+// digits, and dashes, starts with a letter, and is at most maxLen long.
+// Long names are shortened by cutting the run ID, backend, and system
+// names, so the random part that keeps them unique is never lost.
+func instanceName(b *Backend, o *Options, image ImageID, maxLen int) string {
+	var buf [3]byte
+	rand.Read(buf[:])
+	random := fmt.Sprintf("%x", buf)
+	render := func(limit int) string {
+		cut := func(value string) string {
+			if len(value) > limit {
+				return value[:limit]
+			}
+			return value
+		}
+		name := os.Expand(b.InstanceName, func(key string) string {
+			switch key {
+			case "RUN_ID":
+				return cut(o.RunID)
+			case "BACKEND":
+				return cut(b.Name)
+			case "SYSTEM":
+				return cut(string(image.SystemID()))
+			case "RANDOM":
+				return random
+			}
+			return ""
+		})
+		name = invalidInstanceChars.ReplaceAllString(strings.ToLower(name), "-")
+		name = strings.Trim(name, "-")
+		if name == "" || name[0] < 'a' || name[0] > 'z' {
+			name = "spread-" + name
+		}
+		return name
+	}
+	for limit := maxLen; limit >= 0; limit-- {
+		if name := render(limit); len(name) <= maxLen {
+			return name
+		}
+	}
+	// The template alone is too long, so cut it and keep the random
+	// part at the end.
+	name := render(0)
+	return strings.TrimRight(name[:maxLen-len(random)-1], "-") + "-" + random
+}
+
 type UnknownServer struct {
 	Addr string
 }
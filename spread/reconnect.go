@@ -0,0 +1,38 @@
+package spread
+
+import (
+	"time"
+)
+
+// restartable returns whether the scripts of the given context of job
+// may run again from the start after the connection dropped under them.
+func restartable(job *Job, context interface{}) bool {
+	switch context {
+	case job:
+		return job.Task.Restartable
+	case job.Suite:
+		return job.Suite.Restartable
+	}
+	return false
+}
+
+// reconnect dials the server the client was connected to again after the
+// connection to it was lost, as many times as the backend allows.
+func (r *Runner) reconnect(client *Client, backend *Backend) error {
+	retry := &retrier{backoff: &backend.Backoff}
+	var err error
+	for i := 0; i < backend.Reconnect; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(retry.next()):
+			case <-r.tomb.Dying():
+				return err
+			}
+		}
+		if err = client.Reconnect(); err == nil {
+			return nil
+		}
+		debugf("%v", err)
+	}
+	return err
+}
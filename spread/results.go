@@ -0,0 +1,291 @@
+package spread
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// jobResult holds the outcome of a job as written into the results file.
+type jobResult struct {
+	Job     string        `yaml:"job"`
+	Backend string        `yaml:"backend"`
+	System  string        `yaml:"system"`
+	Suite   string        `yaml:"suite"`
+	Task    string        `yaml:"task"`
+	Variant string        `yaml:"variant,omitempty"`
+	Image   string        `yaml:"image,omitempty"`
+	Status  string        `yaml:"status"`
+	Reason  string        `yaml:"reason,omitempty"`
+	Results yaml.MapSlice `yaml:"results,omitempty"`
+
+	Environment map[string]string `yaml:"environment,omitempty"`
+	Truncated   bool              `yaml:"truncated,omitempty"`
+	Slow        bool              `yaml:"slow,omitempty"`
+	Leaked      []string          `yaml:"leaked,omitempty"`
+}
+
+var jobNameReplacer = strings.NewReplacer("/", "-", ":", "-")
+
+// resultsPath returns the remote path where the task of job may write
+// its own results, exposed to it as $SPREAD_RESULTS.
+func (r *Runner) resultsPath(job *Job) string {
+	return path.Join("/var/tmp/spread", r.project.Name, "results", jobNameReplacer.Replace(job.Name)+".yaml")
+}
+
+// outputPath returns the remote path where the task of job may write
+// variables for later jobs on the same server, exposed as $SPREAD_OUTPUT.
+func (r *Runner) outputPath(job *Job) string {
+	return path.Join("/var/tmp/spread", r.project.Name, "output", jobNameReplacer.Replace(job.Name)+".env")
+}
+
+// readOutput reads the KEY=value lines written by the task of job, if
+// any, into the variables provided to later jobs on the same server.
+func (r *Runner) readOutput(client *Client, job *Job) {
+	filename := r.outputPath(job)
+	if !client.exists(filename) {
+		return
+	}
+	data, err := client.ReadFile(filename)
+	if err != nil {
+		printf("Cannot read output of %s: %v", job, err)
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 || !varname.MatchString(line[:i]) || strings.Contains(line[:i], "/") {
+			printf("Ignoring invalid output line of %s: %q", job, line)
+			continue
+		}
+		if client.outputs == nil {
+			client.outputs = make(map[string]string)
+		}
+		client.outputs[line[:i]] = line[i+1:]
+		debugf("Output of %s: %s", job, line)
+	}
+}
+
+// outputEnv returns env with the variables output by earlier jobs on
+// the same server added, replacing any defined with the same name.
+func outputEnv(client *Client, env map[string]string) map[string]string {
+	if len(client.outputs) == 0 {
+		return env
+	}
+	oenv := make(map[string]string, len(env)+len(client.outputs))
+	for k, v := range env {
+		oenv[k] = v
+	}
+	for k, v := range client.outputs {
+		oenv[k] = v
+	}
+	return oenv
+}
+
+// keepEnv records the environment a script of job failed with, so that
+// the failure may be reproduced later. The environment goes into the
+// results file and, when artifacts are being fetched, into an environment
+// file next to the artifacts of job. Secrets are masked as in -dump.
+func (r *Runner) keepEnv(job *Job, env map[string]string) {
+	masked := make(map[string]string, len(env))
+	for k, v := range env {
+		masked[k] = maskVariable(k, v)
+	}
+
+	r.mu.Lock()
+	if r.envs == nil {
+		r.envs = make(map[*Job]map[string]string)
+	}
+	key := job
+	if job.parent != nil {
+		key = job.parent
+	}
+	if _, ok := r.envs[key]; !ok {
+		r.envs[key] = masked
+	}
+	r.mu.Unlock()
+
+	if r.options.Artifacts == "" {
+		return
+	}
+	dir := filepath.Join(r.options.Artifacts, job.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		printf("Cannot write environment of %s: %v", job, err)
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "environment"), envFile(masked), 0644); err != nil {
+		printf("Cannot write environment of %s: %v", job, err)
+	}
+}
+
+// envFile returns the content of the environment file exporting env,
+// sorted by variable name, with values quoted as scripts get them.
+func envFile(env map[string]string) []byte {
+	var keys []string
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "export %s=\"%s\"\n", k, env[k])
+	}
+	return buf.Bytes()
+}
+
+// outputTruncated records that output of the task of job was dropped
+// for going over the output limit.
+func (r *Runner) outputTruncated(job *Job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.trunc == nil {
+		r.trunc = make(map[*Job]bool)
+	}
+	if job.parent != nil {
+		job = job.parent
+	}
+	r.trunc[job] = true
+}
+
+// checkDuration warns about and records the task of job taking longer
+// to execute than it is expected to, by more than the slow factor of the
+// project. The task itself is not failed.
+func (r *Runner) checkDuration(job *Job, elapsed time.Duration) {
+	expected := job.Task.ExpectedDuration
+	if !tooSlow(elapsed, expected, r.project.SlowFactor) {
+		return
+	}
+	printf("WARNING: %s took %s to execute, expected %s.", job, elapsed.Round(time.Second), expected)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.TaskSlow = append(r.stats.TaskSlow, job)
+	if r.slow == nil {
+		r.slow = make(map[*Job]bool)
+	}
+	if job.parent != nil {
+		job = job.parent
+	}
+	r.slow[job] = true
+}
+
+// tooSlow returns whether elapsed is longer than expected by more than
+// the given factor. Nothing is too slow when nothing is expected.
+func tooSlow(elapsed, expected time.Duration, factor float64) bool {
+	return expected > 0 && float64(elapsed) > float64(expected)*factor
+}
+
+// readResults reads the results written by the task of job, if any.
+func (r *Runner) readResults(client *Client, job *Job) {
+	filename := r.resultsPath(job)
+	if !client.exists(filename) {
+		return
+	}
+	data, err := client.ReadFile(filename)
+	if err != nil {
+		printf("Cannot read results of %s: %v", job, err)
+		return
+	}
+	var results yaml.MapSlice
+	if err := yaml.Unmarshal(data, &results); err != nil {
+		printf("Cannot parse results of %s: %v", job, err)
+		return
+	}
+	debugf("Results of %s: %# v", job, results)
+	r.mu.Lock()
+	if job.parent != nil {
+		key := fmt.Sprintf("shard-%d", job.Shard)
+		r.results[job.parent] = append(r.results[job.parent], yaml.MapItem{Key: key, Value: results})
+	} else {
+		r.results[job] = results
+	}
+	r.mu.Unlock()
+}
+
+// jobImage returns the provider image the job ran on when it was not
+// derived from the system name, as overridden in the options or aliased
+// in the backend.
+func (r *Runner) jobImage(job *Job) string {
+	if image := r.options.image(job.Backend, job.System); image != "" {
+		return image
+	}
+	return job.Backend.imageAlias(job.System)
+}
+
+// jobStatus returns all jobs with a known outcome in declaration order,
+// and the status of each of them.
+func (r *Runner) jobStatus() ([]*Job, map[*Job]string) {
+	var jobs []*Job
+	status := make(map[*Job]string)
+	for _, bucket := range []struct {
+		jobs   []*Job
+		status string
+	}{
+		{r.stats.TaskDone, "passed"},
+		{r.stats.TaskCached, "cached"},
+		{r.stats.TaskError, "failed"},
+		{r.stats.TaskXFail, "xfailed"},
+		{r.stats.TaskXPass, "xpassed"},
+		{r.stats.TaskQuarantine, "quarantined"},
+		{r.stats.TaskAbort, "aborted"},
+		{r.stats.TaskSkip, "skipped"},
+	} {
+		for _, job := range bucket.jobs {
+			if _, ok := status[job]; !ok {
+				jobs = append(jobs, job)
+			}
+			status[job] = bucket.status
+		}
+	}
+	sort.Sort(jobsByOrder(jobs))
+	return jobs, status
+}
+
+// writeResults writes the outcome of all jobs into the results file.
+func (r *Runner) writeResults() error {
+	jobs, status := r.jobStatus()
+
+	var results []jobResult
+	for _, job := range jobs {
+		reason := r.skipped[job]
+		if reason == "" {
+			reason = r.aborted[job]
+		}
+		results = append(results, jobResult{
+			Job:     job.Name,
+			Backend: job.Backend.Name,
+			System:  string(job.System),
+			Suite:   job.Suite.Name,
+			Task:    job.Task.Name,
+			Variant: job.Variant,
+			Image:   r.jobImage(job),
+			Status:  status[job],
+			Reason:  reason,
+			Results: r.results[job],
+
+			Environment: r.envs[job],
+			Truncated:   r.trunc[job],
+			Slow:        r.slow[job],
+			Leaked:      r.leaked[job],
+		})
+	}
+	data, err := yaml.Marshal(results)
+	if err != nil {
+		return fmt.Errorf("cannot marshal results: %v", err)
+	}
+	if err := ioutil.WriteFile(r.options.Results, data, 0644); err != nil {
+		return fmt.Errorf("cannot write results file: %v", err)
+	}
+	return nil
+}
@@ -2,10 +2,15 @@ package spread
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"hash/fnv"
+	"net"
 	"sync"
 
 	"gopkg.in/tomb.v2"
+	"gopkg.in/yaml.v2"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -13,16 +18,69 @@ import (
 )
 
 type Options struct {
+	RunID    string
 	Password string
 	Filter   Filter
+	From     string
+	Until    string
+	Continue string
 	Reuse    map[string][]string
+	Images   map[string]string
 	Keep     bool
 	Debug    bool
 	Shell    bool
 	Abend    bool
 	Restore  bool
+	NoRecord bool
 	Resend   bool
 	Discard  bool
+	Affinity bool
+	Order    bool
+	Balance  bool
+	Local    bool
+	Pipeline bool
+
+	Quarantine   Filter
+	StopOnBroken bool
+
+	Artifacts    string
+	SkipPrepared bool
+	TaskOnly     bool
+	ReuseWait    time.Duration
+	ReuseStrict  bool
+	NotifyIdle   time.Duration
+	Results      string
+	Manifest     string
+	Cache        ResultCache
+	Control      string
+	GitHub       bool
+	SendLimit    int
+	FailOnSkip   bool
+	CheckState   bool
+
+	CheckIdempotent bool
+
+	// MinPassed and MinPassedPercent set how many tasks must pass for
+	// the run to succeed, in which case other failures are tolerated.
+	MinPassed        int
+	MinPassedPercent float64
+
+	KeepFailedEnv bool
+
+	// Args holds the command line the run was started with, as
+	// recorded in the manifest.
+	Args []string
+
+	LogFile     string
+	LogSize     int64
+	LogCompress bool
+	JobLogs     string
+}
+
+// image returns the provider image to allocate servers from for the
+// given backend system, as set in the Images option, if any.
+func (o *Options) image(backend *Backend, image ImageID) string {
+	return o.Images[backend.Name+":"+string(image.SystemID())]
 }
 
 type Runner struct {
@@ -33,15 +91,53 @@ type Runner struct {
 	options   *Options
 	providers map[string]Provider
 	reused    map[string]bool
+	discards  map[string]chan bool
+	sends     chan bool
+	snapshots map[[2]string]bool
 
 	done  chan bool
 	alive int
-
-	servers []Server
-	pending []*Job
-	stats   stats
-
-	suiteWorkers map[[3]string]int
+	spawn chan queueKey
+
+	workers map[string]*workerState
+	control net.Listener
+	paused  chan struct{}
+	release func()
+
+	manifest *manifest
+
+	servers   []Server
+	stopped   map[string][]string
+	pending   []*Job
+	running   map[*Job]bool
+	shards    map[*Job]*shardOutcome
+	results   map[*Job]yaml.MapSlice
+	failures  map[string]string
+	envs      map[*Job]map[string]string
+	trunc     map[*Job]bool
+	slow      map[*Job]bool
+	leaked    map[*Job][]string
+	cacheKeys map[*Job]string
+	cacheTree string
+	jobLogs   map[string]bool
+	partial   map[partialKey]bool
+	skipped   map[*Job]string
+	aborted   map[*Job]string
+	quits     map[[2]string]string
+	gone      map[[2]string]map[int]bool
+	queues    map[queueKey]*jobQueue
+	pool      map[queueKey]*sharedServer
+	stats     stats
+
+	controller  Server
+	secretFiles map[Server][]string
+	allocated   map[[2]string][]Server
+
+	suiteWorkers  map[[3]string]int
+	suiteOwners   map[[3]string]int
+	suiteSpent    map[[3]string]time.Duration
+	overSpent     map[[3]string]bool
+	systemWorkers map[[2]string]int
 }
 
 func Start(project *Project, options *Options) (*Runner, error) {
@@ -52,18 +148,48 @@ func Start(project *Project, options *Options) (*Runner, error) {
 		options:   options,
 		providers: make(map[string]Provider),
 		reused:    make(map[string]bool),
+		discards:  make(map[string]chan bool),
+		snapshots: make(map[[2]string]bool),
+		running:   make(map[*Job]bool),
+		shards:    make(map[*Job]*shardOutcome),
+		results:   make(map[*Job]yaml.MapSlice),
+		skipped:   make(map[*Job]string),
+		aborted:   make(map[*Job]string),
+		cacheKeys: make(map[*Job]string),
+		quits:     make(map[[2]string]string),
+		workers:   make(map[string]*workerState),
+		spawn:     make(chan queueKey),
+		pool:      make(map[queueKey]*sharedServer),
+
+		secretFiles: make(map[Server][]string),
+		allocated:   make(map[[2]string][]Server),
+
+		suiteWorkers:  make(map[[3]string]int),
+		suiteOwners:   make(map[[3]string]int),
+		systemWorkers: make(map[[2]string]int),
+	}
+
+	if options.SendLimit > 0 {
+		r.sends = make(chan bool, options.SendLimit)
+	}
+
+	if options.RunID == "" {
+		options.RunID = fmt.Sprintf("%08x", rnd.Uint32())
+	}
+	logf("Run ID is %s.", options.RunID)
 
-		suiteWorkers: make(map[[3]string]int),
+	if err := r.preflight(); err != nil {
+		return nil, err
 	}
 
 	for bname, backend := range project.Backends {
-		switch backend.Type {
-		case "linode":
-			r.providers[bname] = Linode(backend)
-		case "lxd":
-			r.providers[bname] = LXD(backend)
-		default:
-			return nil, fmt.Errorf("%s has unsupported type %q", backend, backend.Type)
+		provider, err := newProvider(project, backend, options)
+		if err != nil {
+			return nil, err
+		}
+		r.providers[bname] = provider
+		if backend.DiscardLimit > 0 {
+			r.discards[bname] = make(chan bool, backend.DiscardLimit)
 		}
 	}
 
@@ -71,7 +197,62 @@ func Start(project *Project, options *Options) (*Runner, error) {
 	if err != nil {
 		return nil, err
 	}
-	r.pending = pending
+	if options.TaskOnly {
+		// Fresh servers were never prepared, so skipping the fixture
+		// scripts on them would run tasks on an unprepared system.
+		for _, job := range pending {
+			if job.Backend.Type != "local" && len(options.Reuse[job.Backend.Name]) == 0 {
+				return nil, fmt.Errorf("cannot run %s with -task-only on fresh servers; use -reuse or a local backend", job.Backend)
+			}
+		}
+	}
+	if options.Cache != nil {
+		r.cacheTree, err = treeHash(project.Path, project.Include, project.Exclude)
+		if err != nil {
+			printf("WARNING: Cannot hash project tree, result cache disabled: %v", err)
+		}
+	}
+	for _, job := range pending {
+		if job.skip != "" {
+			r.skipped[job] = job.skip
+			r.stats.TaskSkip = append(r.stats.TaskSkip, job)
+			continue
+		}
+		if options.Cache != nil && r.cached(job) {
+			r.stats.TaskCached = append(r.stats.TaskCached, job)
+			continue
+		}
+		r.pending = append(r.pending, job)
+	}
+
+	if options.LogFile != "" {
+		if err := openLog(options.LogFile, options.LogSize, options.LogCompress); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.Manifest != "" {
+		if err := r.startManifest(); err != nil {
+			closeLog()
+			return nil, err
+		}
+	}
+
+	if release, err := registerRun(options.RunID); err != nil {
+		printf("WARNING: Cannot register run: %v", err)
+	} else {
+		r.release = release
+	}
+
+	if options.Control != "" {
+		l, err := net.Listen("unix", options.Control)
+		if err != nil {
+			closeLog()
+			return nil, fmt.Errorf("cannot listen on control socket: %v", err)
+		}
+		r.control = l
+		go r.serveControl(l)
+	}
 
 	r.tomb.Go(r.loop)
 	return r, nil
@@ -86,60 +267,143 @@ func (r *Runner) Stop() error {
 	return r.tomb.Wait()
 }
 
-func (r *Runner) loop() error {
+func (r *Runner) loop() (err error) {
 	defer func() {
-		logNames(debugf, "Pending jobs after workers returned", r.pending, taskName)
-		for _, job := range r.pending {
-			if job != nil {
-				r.add(&r.stats.TaskAbort, job)
+		pending := r.pendingJobs()
+		logNames(debugf, "Pending jobs after workers returned", pending, taskName)
+		var reasons []string
+		aborts := make(map[string]int)
+		for _, job := range pending {
+			r.add(&r.stats.TaskAbort, job)
+			reason := r.abortReason(job, err)
+			if aborts[reason] == 0 {
+				reasons = append(reasons, reason)
 			}
+			aborts[reason]++
+			if job.parent != nil {
+				job = job.parent
+			}
+			r.aborted[job] = reason
 		}
 		r.stats.log()
-		if r.options.Keep && len(r.servers) > 0 {
+		for _, reason := range reasons {
+			printf("Aborted %d task%s: %s.", aborts[reason], nth(aborts[reason], "s", "", "s"), reason)
+		}
+		if r.options.GitHub {
+			r.githubAnnotations()
+		}
+		if r.options.Results != "" {
+			if err := r.writeResults(); err != nil {
+				printf("Cannot write results: %v", err)
+			}
+		}
+		failOnSkip, failOnLeak := r.options.FailOnSkip, r.project.StateLeak == "fail"
+		if err == nil && (r.options.MinPassed > 0 || r.options.MinPassedPercent > 0) {
+			err = r.stats.threshold(r.options.MinPassed, r.options.MinPassedPercent, failOnSkip, failOnLeak)
+		} else if err == nil {
+			err = r.stats.err(failOnSkip, failOnLeak)
+		}
+		if r.manifest != nil {
+			if err := r.finishManifest(err); err != nil {
+				printf("Cannot write manifest: %v", err)
+			}
+		}
+		r.stopController()
+		for _, servers := range r.allocated {
+			for _, server := range servers {
+				printf("Discarding unused %s...", server)
+				if err := r.discard(server); err != nil {
+					printf("Error discarding %s: %v", server, err)
+				}
+			}
+		}
+		if args := r.reuseArgs(); r.options.Keep && args != "" {
 			for _, server := range r.servers {
-				printf("Keeping %s at %s", server, server.Address())
+				if server.Provider().Backend().Type != "local" {
+					printf("Keeping %s at %s", server, server.Address())
+				}
 			}
-			printf("Reuse with: spread %s", r.reuseArgs())
+			printf("Reuse with: spread %s", args)
 		}
+		if len(r.stopped) > 0 {
+			printf("Restart stopped servers with: spread %s", r.stoppedArgs())
+		}
+		if r.control != nil {
+			r.control.Close()
+		}
+		if r.release != nil {
+			r.release()
+		}
+		closeLog()
 	}()
 
-	// Find out how many workers are needed for each backend+system.
-	// Even if multiple workers per system are requested, must not
-	// have more workers than there are jobs.
-	type pair [2]string
-	workers := make(map[pair]int)
-	for _, backend := range r.project.Backends {
-		for _, system := range backend.Systems {
-			for _, job := range r.pending {
-				if job.Backend == backend && string(job.System) == system {
-					key := pair{backend.Name, system}
-					if backend.SystemWorkers[system] > workers[key] {
-						workers[key]++
-						r.alive++
-					} else {
-						break
-					}
-				}
-			}
+	// Panics here would leave workers behind with their servers, so wait
+	// for them to wind down after the run is stopped.
+	defer func() {
+		if v := recover(); v != nil {
+			err = r.crashed("run loop", v)
+			r.drain()
 		}
+	}()
+
+	// Workers are only counted as alive once started, so that draining
+	// after a panic does not wait for workers that never were.
+	workers := r.project.workerCounts(r.pending)
+	total := 0
+	for _, n := range workers {
+		total += n
+	}
+
+	r.done = make(chan bool, total)
+
+	for key, n := range workers {
+		r.systemWorkers[key] = n
 	}
 
-	r.done = make(chan bool, r.alive)
+	r.prepareImages()
+	r.allocateBatches()
+	r.queueJobs()
+
+	if err := r.startController(); err != nil {
+		return err
+	}
 
-	msg := fmt.Sprintf("Starting %d worker%s for the following jobs", r.alive, nth(r.alive, "", "", "s"))
+	msg := fmt.Sprintf("Starting %d worker%s for the following jobs", total, nth(total, "", "", "s"))
 	logNames(debugf, msg, r.pending, taskName)
 
-	for _, backend := range r.project.Backends {
-		for _, system := range backend.Systems {
-			n := workers[pair{backend.Name, system}]
-			for i := 0; i < n; i++ {
-				go r.worker(backend, ImageID(system))
-			}
+	// Backends and systems are gone over in sorted order so that
+	// workers start, and log their progress, in the same order on
+	// every run.
+	for _, key := range r.project.systemKeys() {
+		backend := r.project.Backends[key[0]]
+		for i := 0; i < workers[key]; i++ {
+			// Workers of the same system start apart from each
+			// other so they don't all hit the provider at once.
+			r.alive++
+			go r.worker(backend, ImageID(key[1]), i, time.Duration(i)*backend.RampUp)
 		}
 	}
 
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if r.options.NotifyIdle > 0 {
+		idleTimer = time.NewTimer(r.options.NotifyIdle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
 	for {
 		select {
+		case <-idle:
+			if d := idleFor(); d < r.options.NotifyIdle {
+				idleTimer.Reset(r.options.NotifyIdle - d)
+				continue
+			}
+			r.notifyIdle()
+			idleTimer.Reset(r.options.NotifyIdle)
+		case key := <-r.spawn:
+			r.alive++
+			go r.worker(r.project.Backends[key.backend], key.system, key.index, 0)
 		case <-r.done:
 			r.alive--
 			if r.alive > 0 {
@@ -161,33 +425,166 @@ const (
 )
 
 func (r *Runner) run(client *Client, job *Job, verb string, context interface{}, script string, abend *bool) bool {
+	if r.options.TaskOnly && context != job {
+		// The server is assumed to be prepared already, and left so.
+		if strings.TrimSpace(script) != "" {
+			logf("Skipping %s %s, running task scripts only.", verb, job.StringFor(context))
+		}
+		return true
+	}
+	partial := verb == restoring && r.takePartial(client, context)
+	if files := contextFiles(job, context); verb == preparing && len(files) > 0 {
+		if err := r.sendFiles(client, files); err != nil {
+			printf("Error %s %s: %v", verb, job.StringFor(context), err)
+			r.setPartial(client, context, true)
+			*abend = r.options.Abend
+			return false
+		}
+	}
 	script = strings.TrimSpace(script)
 	if len(script) == 0 {
+		if verb == executing && context == job {
+			return r.emptyExecute(job, abend)
+		}
 		return true
 	}
 	contextStr := job.StringFor(context)
+	env := outputEnv(client, packageEnv(client.packageManager, job.Environment))
+	for k, v := range client.nodeEnv {
+		env = withEnv(env, k, v)
+	}
+	if client.nodeRole != "" {
+		env = withEnv(env, "SPREAD_NODE_ROLE", client.nodeRole)
+	}
+	if r.controller != nil {
+		env = withEnv(env, "SPREAD_CONTROLLER", r.controller.Address())
+	}
+	if s, ok := client.Server().(StorageServer); ok && s.Storage() != "" {
+		env = withEnv(env, "SPREAD_STORAGE", s.Storage())
+	}
+	if partial {
+		env = withEnv(env, "SPREAD_PREPARE_FAILED", "1")
+	}
+	sentinel := r.sentinel(job, context)
+	if sentinel != "" {
+		env = withEnv(env, "SPREAD_PREPARED", sentinel)
+		if verb == preparing && r.options.SkipPrepared && client.exists(sentinel) {
+			logf("Skipping prepare of %s, already prepared.", contextStr)
+			return true
+		}
+	}
+	if context == job && verb == executing {
+		results := r.resultsPath(job)
+		output := r.outputPath(job)
+		env = withEnv(env, "SPREAD_RESULTS", results)
+		env = withEnv(env, "SPREAD_OUTPUT", output)
+		err := client.Run(fmt.Sprintf(`mkdir -p "%s" "%s" && rm -f "%s" "%s"`, path.Dir(results), path.Dir(output), results, output), "", nil)
+		if err != nil {
+			printf("Cannot clean up results of %s: %v", contextStr, err)
+		}
+	}
 	logf("%s %s...", strings.Title(verb), contextStr)
 	var dir string
 	if context == job.Backend || context == job.Project {
-		dir = r.project.RemotePath
+		dir = client.remotePath
+	} else if context == job && job.Task.Workdir != "" {
+		dir = path.Join(client.remotePath, job.Task.Workdir)
 	} else {
-		dir = filepath.Join(r.project.RemotePath, job.Task.Name)
+		dir = path.Join(client.remotePath, job.Task.Name)
 	}
 	if r.options.Shell && verb == executing {
-			printf("Starting shell instead of %s %s...", verb, job)
-			err := client.Shell("/bin/bash", dir, r.shellEnv(job, job.Environment))
-			if err != nil {
-				printf("Error running debug shell: %v", err)
+		printf("Starting shell instead of %s %s on %s at %s...", verb, job, client.Server(), client.Server().Address())
+		err := client.Shell("/bin/bash", dir, r.shellEnv(client, job, env))
+		if err != nil {
+			printf("Error running debug shell: %v", err)
+		}
+		printf("Continuing...")
+		return true
+	}
+	limit := r.project.outputLimit
+	if context == job && job.Task.outputLimit > 0 {
+		limit = job.Task.outputLimit
+	}
+	shell := r.shell(job, verb)
+	if context == job && verb == executing {
+		if cmd := r.limitCommand(client, job); cmd != "" {
+			if shell == "" {
+				shell = "/bin/sh"
 			}
-			printf("Continuing...")
-			return true
+			shell = cmd + " " + shell
+		}
+	}
+	trace := func() error {
+		output, truncated, err := client.TraceLimit(script, dir, env, shell, limit)
+		r.logJob(client, job, verb, context, output, err)
+		if truncated {
+			printf("WARNING: Output of %s truncated after %d bytes while %s it.", contextStr, limit, verb)
+			if context == job {
+				r.outputTruncated(job)
+			}
+		}
+		return err
+	}
+	if verb == preparing {
+		// Assume the worst until the script is known to have succeeded.
+		r.setPartial(client, context, true)
+	}
+	start := time.Now()
+	err := trace()
+	for drops := 0; drops < job.Backend.Reconnect; drops++ {
+		if _, ok := err.(*DisconnectError); !ok {
+			break
+		}
+		printf("Lost connection to %s while %s %s, reconnecting...", client.Server(), verb, contextStr)
+		if rerr := r.reconnect(client, job.Backend); rerr != nil {
+			printf("Cannot reconnect: %v", rerr)
+			break
+		}
+		if !restartable(job, context) {
+			printf("Reconnected to %s, but %s cannot be restarted.", client.Server(), contextStr)
+			break
+		}
+		printf("Reconnected to %s, %s %s again...", client.Server(), verb, contextStr)
+		err = trace()
+	}
+	for retries := 0; err != nil; retries++ {
+		outcome := r.exitOutcome(job, verb, context, err)
+		if outcome == exitRetry && retries < r.project.ExitRetries {
+			printf("Error %s %s: %v", verb, contextStr, err)
+			printf("Exit code %d of %s is retried, %s it again...", err.(*ExitStatusError).Status, contextStr, verb)
+			err = trace()
+			continue
+		}
+		if outcome == exitPass {
+			logf("Exit code %d of %s counts as success.", err.(*ExitStatusError).Status, contextStr)
+			err = nil
+		}
+		break
+	}
+	if verb == executing && context == job && job.Task.Exit != 0 {
+		err = expectExit(err, job.Task.Exit)
+	}
+	if err == nil && r.checksIdempotent(verb) {
+		err = r.checkIdempotent(client, job, verb, context, trace)
+	}
+	if verb == preparing && err == nil {
+		r.setPartial(client, context, false)
+	}
+	if verb == executing && context == job {
+		r.checkDuration(job, time.Since(start))
 	}
-	_, err := client.Trace(script, dir, job.Environment)
 	if err != nil {
 		printf("Error %s %s: %v", verb, contextStr, err)
+		r.failed(job, verb, context, err)
+		if e, ok := err.(*ExitStatusError); ok && e.Command != "" && context == job && verb == executing {
+			r.failedAt(job, e)
+		}
+		if r.options.KeepFailedEnv && context == job {
+			r.keepEnv(job, env)
+		}
 		if r.options.Debug {
-			printf("Starting shell to debug...")
-			err = client.Shell("/bin/bash", dir, r.shellEnv(job, job.Environment))
+			printf("Starting shell to debug error %s %s on %s at %s...", verb, contextStr, client.Server(), client.Server().Address())
+			err = client.Shell("/bin/bash", dir, r.shellEnv(client, job, env))
 			if err != nil {
 				printf("Error running debug shell: %v", err)
 			}
@@ -196,184 +593,1428 @@ func (r *Runner) run(client *Client, job *Job, verb string, context interface{},
 		*abend = r.options.Abend
 		return false
 	}
+	if sentinel != "" {
+		var err error
+		if verb == preparing {
+			err = client.Run(fmt.Sprintf(`mkdir -p "%s" && touch "%s"`, path.Dir(sentinel), sentinel), "", nil)
+		} else {
+			err = client.Run(fmt.Sprintf(`rm -f "%s"`, sentinel), "", nil)
+		}
+		if err != nil {
+			printf("Cannot update prepared marker of %s: %v", contextStr, err)
+		}
+	}
+	return true
+}
+
+// emptyExecute handles job having an empty execute script, per the
+// empty-execute setting of its suite, or else of the project. Such
+// tasks pass by default, even though they test nothing.
+func (r *Runner) emptyExecute(job *Job, abend *bool) bool {
+	mode := job.Suite.EmptyExecute
+	if mode == "" {
+		mode = r.project.EmptyExecute
+	}
+	switch mode {
+	case "warn":
+		printf("WARNING: %s has an empty execute script, nothing was tested.", job)
+	case "fail":
+		err := fmt.Errorf("execute script is empty")
+		printf("Error executing %s: %v", job, err)
+		r.failed(job, executing, job, err)
+		*abend = r.options.Abend
+		return false
+	}
 	return true
 }
 
-func (r *Runner) shellEnv(job *Job, env map[string]string) map[string]string {
+// expectExit returns the error of a script expected to exit with the
+// given status, nil if it did and an error otherwise.
+func expectExit(err error, status int) error {
+	if err == nil {
+		return fmt.Errorf("expected exit code %d, got 0", status)
+	}
+	if e, ok := err.(*ExitStatusError); ok {
+		if e.Status == status {
+			return nil
+		}
+		return fmt.Errorf("expected exit code %d, got %d: %v", status, e.Status, e.Err)
+	}
+	return err
+}
+
+// partialKey identifies a context prepared on a server.
+type partialKey struct {
+	server  Server
+	context interface{}
+}
+
+// setPartial records whether the prepare script of context failed or
+// was interrupted on the server the client is connected to, so that the
+// matching restore script may be told about it.
+func (r *Runner) setPartial(client *Client, context interface{}, partial bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := partialKey{client.Server(), context}
+	if !partial {
+		delete(r.partial, key)
+		return
+	}
+	if r.partial == nil {
+		r.partial = make(map[partialKey]bool)
+	}
+	r.partial[key] = true
+}
+
+// takePartial returns whether the prepare script of context failed or
+// was interrupted on the server the client is connected to, and forgets
+// about it.
+func (r *Runner) takePartial(client *Client, context interface{}) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := partialKey{client.Server(), context}
+	partial := r.partial[key]
+	delete(r.partial, key)
+	return partial
+}
+
+// withEnv returns a copy of env with key set to value.
+func withEnv(env map[string]string, key, value string) map[string]string {
+	copy := make(map[string]string, len(env)+1)
+	for k, v := range env {
+		copy[k] = v
+	}
+	copy[key] = value
+	return copy
+}
+
+// sentinel returns the path of the file marking that the given context
+// was prepared on the server, or the empty string if context is not
+// tracked. The file is created after a successful prepare and removed
+// after a successful restore.
+func (r *Runner) sentinel(job *Job, context interface{}) string {
+	var name string
+	switch context {
+	case job.Project:
+		name = "project"
+	case job.Backend:
+		name = "backend"
+	case job.Suite:
+		name = "suite-" + strings.Replace(strings.Trim(job.Suite.Name, "/"), "/", "-", -1)
+	default:
+		return ""
+	}
+	return path.Join("/var/tmp/spread", r.project.Name, "prepared", name)
+}
+
+func (r *Runner) shellEnv(client *Client, job *Job, env map[string]string) map[string]string {
 	senv := make(map[string]string)
 	for k, v := range env {
 		senv[k] = v
 	}
-	senv["HOME"] = r.project.RemotePath
-	senv["PS1"] = fmt.Sprintf(`%s:%s \w\$ `, job.Backend.Name, job.System)
-	return senv
+	// Other servers of the run may be needed to debug across machines.
+	var addrs []string
+	r.mu.Lock()
+	for _, server := range r.servers {
+		if addr := server.Address(); !contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	r.mu.Unlock()
+	senv["SPREAD_SERVERS"] = strings.Join(addrs, " ")
+	if job.Backend.Type == "local" {
+		// Leave the user's own shell setup alone.
+		return senv
+	}
+	senv["HOME"] = client.remotePath
+	// Name the job in the prompt, as shells of several workers may be
+	// open at once.
+	senv["PS1"] = fmt.Sprintf(`%s \w\$ `, job.Name)
+	return senv
+}
+
+// remotePath returns the path where the project data lives on
+// servers of the given backend running the given system.
+func (r *Runner) remotePath(backend *Backend, system ImageID) string {
+	if backend.Type == "local" {
+		return r.project.Path
+	}
+	if path, ok := backend.Paths[string(system.SystemID())]; ok {
+		return path
+	}
+	return r.project.RemotePath
+}
+
+// reusePath holds the remote project path recorded in the reuse data
+// of a server, so that reusing it finds the project data where the
+// run that allocated it left it, and the fingerprint of the backend
+// configuration it was allocated with.
+type reusePath struct {
+	Path   string `yaml:"spread-path"`
+	Config string `yaml:"spread-config"`
+}
+
+// checkReuseData returns the remote project path recorded in the reuse
+// data of a server, and why the backend configuration it was allocated
+// with does not match config, or an empty string if it does.
+func checkReuseData(data []byte, config string) (path, why string) {
+	var recorded reusePath
+	if err := yaml.Unmarshal(data, &recorded); err != nil {
+		return "", fmt.Sprintf("it was allocated with cannot be read: %v", err)
+	}
+	switch recorded.Config {
+	case config:
+		return recorded.Path, ""
+	case "":
+		return recorded.Path, "it was allocated with is unknown"
+	}
+	return recorded.Path, "changed since it was allocated"
+}
+
+// reuseConfig returns a fingerprint of the configuration of backend
+// that servers allocated for the given system depend on, so that
+// reusing them after it changed may be noticed. Only what the servers
+// were allocated with counts, as scripts and environment apply anew
+// to reused servers.
+func (r *Runner) reuseConfig(backend *Backend, image ImageID) string {
+	data, err := yaml.Marshal(&struct {
+		Type      string
+		System    string
+		Image     string
+		Storage   int64
+		Placement *Placement
+	}{
+		Type:      backend.Type,
+		System:    string(image.SystemID()),
+		Image:     r.options.image(backend, image) + backend.imageAlias(image),
+		Storage:   backend.storageSize(image),
+		Placement: backend.Placement,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// newProvider is a variable so that tests may replace providers.
+var newProvider = backendProvider
+
+func backendProvider(project *Project, backend *Backend, options *Options) (Provider, error) {
+	if backend.KeySecret != "" {
+		key, err := resolveSecret(backend.KeySecret)
+		if err != nil {
+			return nil, fmt.Errorf("%s key: %v", backend, err)
+		}
+		backend.Key = key
+	}
+	switch backend.Type {
+	case "linode":
+		return Linode(project, backend, options), nil
+	case "lxd":
+		return LXD(project, backend, options), nil
+	case "local":
+		if !options.Local {
+			return nil, fmt.Errorf("%s runs tasks directly on the local system; use -local to allow it", backend)
+		}
+		return Local(project, backend, options), nil
+	}
+	return nil, fmt.Errorf("%s has unsupported type %q", backend, backend.Type)
+}
+
+func (r *Runner) add(where *[]*Job, job *Job) {
+	// The result cache is written to after the lock is released.
+	var passed *Job
+	defer func() { r.cachePassed(passed) }()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	passed = r.addLocked(where, job)
+}
+
+type shardOutcome struct {
+	done  int
+	worst *[]*Job
+}
+
+// addLocked adds job to the given stats list. The outcomes of jobs that
+// are shards of a task are merged, and only once all shards are done
+// their parent job is added with the worst outcome among them. The job
+// added as passed, if any, is returned so that the caller may record it
+// in the result cache once r.mu is released.
+func (r *Runner) addLocked(where *[]*Job, job *Job) (passed *Job) {
+	if job.parent != nil && r.stats.outcome(where) >= 0 {
+		o := r.shards[job.parent]
+		if o == nil {
+			o = &shardOutcome{}
+			r.shards[job.parent] = o
+		}
+		o.done++
+		if o.worst == nil || r.stats.outcome(where) < r.stats.outcome(o.worst) {
+			o.worst = where
+		}
+		if o.done < job.Task.Shards {
+			return nil
+		}
+		where, job = o.worst, job.parent
+	}
+	*where = append(*where, job)
+	if where == &r.stats.TaskDone {
+		return job
+	}
+	return nil
+}
+
+// workerState tracks what a worker is doing, so it may be abandoned
+// via the control socket while the rest of the run continues.
+type workerState struct {
+	name   string
+	system [2]string
+	client *Client
+
+	// job is the job being worked on, and pending is whether its
+	// outcome is still unknown so it must be run elsewhere if the
+	// worker is abandoned.
+	job     *Job
+	pending bool
+	started time.Time
+
+	abandoned bool
+}
+
+// record adds job to the given stats list unless the worker was
+// abandoned, in which case the outcome of its work is meaningless.
+func (r *Runner) record(w *workerState, where *[]*Job, job *Job) {
+	// The result cache is written to after the lock is released.
+	var passed *Job
+	defer func() { r.cachePassed(passed) }()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if w.abandoned {
+		return
+	}
+	passed = r.addLocked(where, job)
+	if job == w.job && r.stats.outcome(where) >= 0 {
+		w.pending = false
+	}
+	if r.options.StopOnBroken && r.stats.broken(where) && r.tomb.Alive() {
+		printf("Stopping run after prepare or restore error...")
+		r.tomb.Kill(nil)
+	}
+}
+
+// abandon stops the worker with the given name or server address from
+// doing any further work, and queues its current job to run elsewhere.
+// The worker discards its server and is replaced by a new one.
+func (r *Runner) abandon(name string) error {
+	r.mu.Lock()
+	var found *workerState
+	for _, w := range r.workers {
+		if w.name != name && w.client.Server().Address() != name {
+			continue
+		}
+		if found != nil {
+			r.mu.Unlock()
+			return fmt.Errorf("%q matches more than one worker", name)
+		}
+		found = w
+	}
+	w := found
+	if w == nil || w.abandoned {
+		r.mu.Unlock()
+		return fmt.Errorf("cannot find worker %q", name)
+	}
+	w.abandoned = true
+	if w.job != nil && w.pending {
+		r.suiteWorkers[suiteWorkersKey(w.job)]--
+		delete(r.running, w.job)
+		r.queueJob(w.job)
+		printf("Abandoning %s on %s, queueing %s to run elsewhere...", w.name, w.client.Server(), w.job)
+		w.job = nil
+	} else {
+		printf("Abandoning %s on %s...", w.name, w.client.Server())
+	}
+	r.mu.Unlock()
+	return w.client.Close()
+}
+
+func suiteWorkersKey(job *Job) [3]string {
+	return [3]string{job.Backend.Name, string(job.System), job.Suite.Name}
+}
+
+func (r *Runner) worker(backend *Backend, system ImageID, index int, delay time.Duration) {
+	defer func() { r.done <- true }()
+
+	if delay > 0 {
+		debugf("Delaying worker %s:%s#%d by %s.", backend.Name, system, index+1, delay)
+		select {
+		case <-time.After(delay):
+		case <-r.tomb.Dying():
+			return
+		}
+	}
+
+	// Servers shared with other workers are left to the last of them,
+	// while nodes are the worker's own.
+	var server Server
+	var shared *sharedServer
+	var nodes *nodeGroup
+	var left, lastUser bool
+	defer func() {
+		if v := recover(); v != nil {
+			var servers []Server
+			if shared != nil && !left {
+				lastUser = shared.leave()
+			}
+			if server != nil && (shared == nil || lastUser) {
+				servers = append(servers, server)
+			}
+			if nodes != nil {
+				for _, client := range nodes.clients {
+					servers = append(servers, client.Server())
+				}
+			}
+			r.crashed(fmt.Sprintf("worker %s:%s#%d", backend.Name, system, index+1), v, servers...)
+		}
+	}()
+
+	var client *Client
+	client, shared = r.poolClient(backend, system, index)
+	if client == nil {
+		r.quit(backend, system, fmt.Sprintf("no server available for %s:%s", backend.Name, system))
+		r.mu.Lock()
+		r.workerGone(backend, system, index)
+		r.mu.Unlock()
+		return
+	}
+	server = client.Server()
+
+	w := &workerState{
+		name:   fmt.Sprintf("%s:%s#%d", backend.Name, system, index+1),
+		system: [2]string{backend.Name, string(system)},
+		client: client,
+	}
+	r.mu.Lock()
+	r.workers[w.name] = w
+	r.mu.Unlock()
+
+	var stats = &r.stats
+
+	var abend bool
+	var badProject bool
+	var destroyed bool
+	var badSuite = make(map[*Suite]bool)
+	var badFixture = make(map[*Fixture]bool)
+
+	var insideProject bool
+	var insideBackend bool
+	var insideSuite *Suite
+	var insideFixture *Fixture
+
+	// What the worker is inside of is recorded on the server, so that
+	// a later -restore run may restore it if this one dies midway.
+	var inside insideState
+	enter := func(job *Job, update func()) {
+		inside.Job = job.Name
+		update()
+		r.saveInside(client, index, &inside)
+	}
+	leave := func(update func()) {
+		update()
+		r.saveInside(client, index, &inside)
+	}
+
+	// Under -restore, servers holding such records are restored as
+	// recorded instead of as the selected jobs would have it.
+	// Workers sharing a server replay its records only once.
+	var replayed bool
+	if r.options.Restore && shared != nil {
+		shared.replay.Do(func() {
+			shared.replayed = r.replayInside(w, client, backend, &abend)
+		})
+		replayed = shared.replayed
+	} else if r.options.Restore {
+		replayed = r.replayInside(w, client, backend, &abend)
+	}
+
+	var job, last *Job
+
+	// A task restore may be left running while the next task on the
+	// same server is prepared, and must be waited on before going further.
+	var restoreJob *Job
+	var restored chan bool
+	waitRestore := func() bool {
+		if restored == nil {
+			return true
+		}
+		ok := <-restored
+		if !ok {
+			r.record(w, &stats.TaskRestoreError, restoreJob)
+			badProject = true
+		} else if inside.Job == restoreJob.Name {
+			// Unless the next task was entered meanwhile.
+			leave(func() { inside.Task = false })
+		}
+		restoreJob, restored = nil, nil
+		return ok
+	}
+
+	// next finishes the current job of the worker and takes its next
+	// one, or reports that the run is paused. The lock is released by
+	// defer so that a panic in between cannot leave the runner locked.
+	next := func() (job *Job, paused chan struct{}, overBudget bool) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if w.job != nil {
+			r.suiteWorkers[suiteWorkersKey(w.job)]--
+			r.spend(w.job, w.started)
+			delete(r.running, w.job)
+			w.job = nil
+		}
+		if destroyed || w.abandoned {
+			// The worker is replaced on a fresh server if needed.
+			return nil, nil, false
+		}
+		if badProject || abend || !r.tomb.Alive() {
+			r.workerGone(backend, system, index)
+			return nil, nil, false
+		}
+		if r.paused != nil {
+			return nil, r.paused, false
+		}
+		job = r.job(backend, system, index, insideSuite)
+		if job == nil {
+			r.workerGone(backend, system, index)
+			return nil, nil, false
+		}
+		r.suiteWorkers[suiteWorkersKey(job)]++
+		r.running[job] = true
+		w.job = job
+		w.pending = true
+		w.started = time.Now()
+		return job, nil, r.overBudget(job)
+	}
+
+	for {
+		// The retired flag is read before r.mu is taken, so that r.mu
+		// is never held while waiting on the lock of a shared server.
+		if shared != nil && shared.isRetired() {
+			destroyed = true
+		}
+		var paused chan struct{}
+		var overBudget bool
+		job, paused, overBudget = next()
+		if paused != nil {
+			// Servers are left alone while paused, so a restore still
+			// running is waited on and accounted for first.
+			waitRestore()
+			select {
+			case <-paused:
+			case <-r.tomb.Dying():
+			}
+			continue
+		}
+		if job == nil {
+			break
+		}
+
+		if restored != nil && !r.overlaps(restoreJob, job) {
+			waitRestore()
+		}
+
+		if overBudget {
+			r.record(w, &stats.TaskAbort, job)
+			continue
+		}
+
+		if replayed {
+			r.mu.Lock()
+			r.skipped[job] = "restored recorded state of its server instead"
+			r.mu.Unlock()
+			r.record(w, &stats.TaskSkip, job)
+			continue
+		}
+
+		if badSuite[job.Suite] || badFixture[job.Task.fixture] {
+			r.record(w, &stats.TaskAbort, job)
+			continue
+		}
+
+		if job.Task.cond != nil {
+			ok, err := r.conditionHolds(client, job)
+			if err != nil {
+				printf("Cannot evaluate condition of %s: %v", job, err)
+				r.record(w, &stats.TaskAbort, job)
+				continue
+			}
+			if !ok {
+				printf("Skipping %s, condition is false: %s", job, job.Task.If)
+				r.mu.Lock()
+				r.skipped[job] = "condition is false: " + job.Task.If
+				r.mu.Unlock()
+				r.record(w, &stats.TaskSkip, job)
+				continue
+			}
+		}
+
+		if insideFixture != nil && insideFixture != job.Task.fixture {
+			if !r.run(client, last, restoring, insideFixture, insideFixture.Restore, &abend) {
+				r.record(w, &stats.FixtureRestoreError, last)
+				r.record(w, &stats.TaskAbort, job)
+				badProject = true
+				continue
+			}
+			insideFixture = nil
+			leave(func() { inside.Fixture = false })
+		}
+
+		if insideSuite != nil && insideSuite != job.Suite {
+			if false {
+				printf("WARNING: Was inside missing suite %s on last run, so cannot restore it.", insideSuite)
+			} else if !r.run(client, last, restoring, insideSuite, insideSuite.Restore, &abend) {
+				r.record(w, &stats.SuiteRestoreError, last)
+				r.record(w, &stats.TaskAbort, job)
+				badProject = true
+				continue
+			}
+			if nodes != nil {
+				r.restoreNodes(nodes, last, !abend)
+				client.nodeEnv = nil
+				nodes = nil
+			}
+			insideSuite = nil
+			leave(func() { inside.Suite = false })
+		}
+
+		last = job
+
+		// Each context is considered entered as soon as its prepare script
+		// starts, so that its restore script runs even if prepare fails
+		// midway and leaves things behind. Only -abend prevents that.
+		if !insideProject {
+			insideProject = true
+			enter(job, func() { inside.Project, inside.Backend = true, true })
+			if !r.prepare(w, client, shared, job, &insideBackend, &abend) {
+				r.record(w, &stats.TaskAbort, job)
+				badProject = true
+				continue
+			}
+		}
+
+		if insideSuite != job.Suite {
+			insideSuite = job.Suite
+			enter(job, func() { inside.Suite = true })
+			if len(job.Suite.Nodes) > 0 && !r.options.Restore {
+				nodes = r.allocateNodes(backend, system, job.Suite)
+				if nodes != nil {
+					client.nodeEnv = nodes.env
+				}
+				if nodes == nil || !r.prepareNodes(nodes, job, &abend) {
+					r.record(w, &stats.SuitePrepareError, job)
+					r.record(w, &stats.TaskAbort, job)
+					badSuite[job.Suite] = true
+					continue
+				}
+			}
+			if !r.options.Restore && !r.run(client, job, preparing, job.Suite, job.Suite.Prepare, &abend) {
+				r.record(w, &stats.SuitePrepareError, job)
+				r.record(w, &stats.TaskAbort, job)
+				badSuite[job.Suite] = true
+				continue
+			}
+		}
+
+		if job.Task.fixture != nil && insideFixture != job.Task.fixture {
+			insideFixture = job.Task.fixture
+			enter(job, func() { inside.Fixture = true })
+			if !r.options.Restore && !r.run(client, job, preparing, insideFixture, insideFixture.Prepare, &abend) {
+				r.record(w, &stats.FixturePrepareError, job)
+				r.record(w, &stats.TaskAbort, job)
+				badFixture[insideFixture] = true
+				continue
+			}
+		}
+
+		var state map[string]string
+		if r.checksState(job) {
+			state = r.probeState(client, job)
+		}
+
+		enter(job, func() { inside.Task = true })
+		if r.options.Restore {
+			// Do not prepare or execute.
+		} else if !r.options.Restore && !r.runAcross(client, nodes, job, preparing, job.Task.Prepare, &abend) {
+			if job.quarantined {
+				r.record(w, &stats.TaskQuarantine, job)
+			} else {
+				r.record(w, &stats.TaskPrepareError, job)
+				r.record(w, &stats.TaskAbort, job)
+			}
+		} else if !waitRestore() {
+			// The server was left broken by the task restored meanwhile.
+			r.record(w, &stats.TaskAbort, job)
+		} else if !r.options.Restore && r.runAcross(client, nodes, job, executing, job.Task.Execute, &abend) {
+			r.readResults(client, job)
+			r.readOutput(client, job)
+			if job.Task.XFail != "" {
+				printf("WARNING: %s was expected to fail but passed.", job)
+				r.record(w, &stats.TaskXPass, job)
+			} else {
+				r.record(w, &stats.TaskDone, job)
+			}
+		} else if !r.options.Restore && job.Task.XFail != "" {
+			r.record(w, &stats.TaskXFail, job)
+		} else if !r.options.Restore && job.quarantined {
+			r.record(w, &stats.TaskQuarantine, job)
+		} else if !r.options.Restore {
+			r.record(w, &stats.TaskError, job)
+		}
+		waitRestore()
+		if !r.options.Restore {
+			r.fetchArtifacts(client, job)
+		}
+		if job.Task.Destructive && !r.options.Restore {
+			// Restoring is pointless as the server won't be used again.
+			printf("Server %s is unusable after destructive task %s.", client.Server(), job)
+			destroyed = true
+			if shared != nil {
+				r.retire(shared)
+			}
+			continue
+		}
+		if r.pipelined(job) && !abend {
+			restoreJob, restored = job, make(chan bool, 1)
+			go func(job *Job, nodes *nodeGroup) {
+				var abend bool
+				restored <- r.runAcross(client, nodes, job, restoring, job.Task.Restore, &abend)
+			}(job, nodes)
+			continue
+		}
+		// Under -abend only restores marked as always needed still run.
+		if (!abend || job.Task.AlwaysRestore) && !r.runAcross(client, nodes, job, restoring, job.Task.Restore, &abend) {
+			r.record(w, &stats.TaskRestoreError, job)
+			badProject = true
+		} else if !abend || job.Task.AlwaysRestore {
+			leave(func() { inside.Task = false })
+			if state != nil && !abend {
+				r.checkState(w, client, job, state)
+			}
+		}
+	}
+	waitRestore()
+
+	r.mu.Lock()
+	delete(r.workers, w.name)
+	abandoned := w.abandoned
+	r.mu.Unlock()
+	if badProject {
+		r.quit(backend, system, fmt.Sprintf("project or backend broken on %s", client.Server()))
+	} else if abend {
+		r.quit(backend, system, fmt.Sprintf("-abend stopped the worker on %s", client.Server()))
+	}
+	replace := abandoned || destroyed
+	if replace {
+		abend = true
+	}
+
+	// Workers sharing a server leave the project and backend restore,
+	// and the server itself, to the last one of them to finish.
+	lastUser = true
+	retired := false
+	if shared != nil {
+		shared.mu.Lock()
+		shared.users--
+		left = true
+		lastUser, retired = shared.users == 0, shared.retired
+		if lastUser {
+			insideProject, insideBackend = shared.insideProject, shared.insideBackend
+			if last == nil {
+				last = shared.job
+			}
+		} else {
+			insideProject, insideBackend = false, false
+		}
+		shared.mu.Unlock()
+	}
+
+	// Servers being replaced are not restored at all, while -abend still
+	// restores the contexts marked as always needing it.
+	mayRestore := func(always bool) bool {
+		return !abend || always && !replace
+	}
+	if insideFixture != nil && mayRestore(false) {
+		if !r.run(client, last, restoring, insideFixture, insideFixture.Restore, &abend) {
+			r.record(w, &stats.FixtureRestoreError, last)
+		}
+		insideFixture = nil
+	}
+	if insideSuite != nil && mayRestore(insideSuite.AlwaysRestore) {
+		if !r.run(client, last, restoring, insideSuite, insideSuite.Restore, &abend) {
+			r.record(w, &stats.SuiteRestoreError, last)
+		}
+		insideSuite = nil
+	}
+	if nodes != nil {
+		r.restoreNodes(nodes, last, !abend)
+		nodes = nil
+	}
+	if insideBackend && mayRestore(backend.AlwaysRestore) {
+		if !r.run(client, last, restoring, backend, backend.Restore, &abend) {
+			r.record(w, &stats.BackendRestoreError, last)
+		}
+		insideBackend = false
+	}
+	if insideProject && mayRestore(r.project.AlwaysRestore) {
+		if !r.run(client, last, restoring, r.project, r.project.Restore, &abend) {
+			r.record(w, &stats.ProjectRestoreError, last)
+		}
+		insideProject = false
+	}
+	if !replace && !r.options.Restore {
+		inside.Project, inside.Backend = insideProject, insideBackend
+		inside.Suite, inside.Fixture = insideSuite != nil, insideFixture != nil
+		if inside.Project || inside.Backend || inside.Suite || inside.Fixture || inside.Task {
+			r.saveInside(client, index, &inside)
+		} else {
+			r.clearInside(client, index)
+		}
+	}
+	server = client.Server()
+	if lastUser && !replace {
+		r.removeSecretFiles(client)
+	}
+	client.Close()
+	if lastUser && (!r.options.Keep || replace || retired) {
+		if backend.DiscardMode == "stop" && !replace && !retired {
+			r.stop(server)
+		} else {
+			printf("Discarding %s...", server)
+			if err := r.discard(server); err != nil {
+				printf("Error discarding %s: %v", server, err)
+			}
+		}
+	}
+	if replace {
+		r.mu.Lock()
+		for i, s := range r.servers {
+			if s == server && lastUser {
+				r.servers = append(r.servers[:i], r.servers[i+1:]...)
+				break
+			}
+		}
+		queued := r.queued(backend, system, index)
+		if !abandoned && !queued {
+			r.workerGone(backend, system, index)
+		}
+		r.mu.Unlock()
+		if abandoned {
+			printf("Replacing abandoned worker %s...", w.name)
+		} else if queued {
+			printf("Replacing worker %s on a fresh server...", w.name)
+		}
+		if abandoned || queued {
+			r.spawn <- queueKey{backend.Name, system, index}
+		}
+	}
+}
+
+// quit records why a worker for the given backend system quit before
+// running all of its jobs, so that jobs left behind may be explained.
+func (r *Runner) quit(backend *Backend, system ImageID, reason string) {
+	r.mu.Lock()
+	r.quits[[2]string{backend.Name, string(system)}] = reason
+	r.mu.Unlock()
+}
+
+// abortReason returns why job was left pending when the run finished,
+// given the error the run loop finished with.
+func (r *Runner) abortReason(job *Job, err error) string {
+	key := [2]string{job.Backend.Name, string(job.System)}
+	r.mu.Lock()
+	quit := r.quits[key]
+	r.mu.Unlock()
+	switch {
+	case err != nil:
+		return err.Error()
+	case r.systemWorkers[key] == 0:
+		return fmt.Sprintf("no worker for %s:%s", job.Backend.Name, job.System)
+	case quit != "":
+		return quit
+	case !r.tomb.Alive():
+		return "run stopped"
+	}
+	return fmt.Sprintf("no worker left for %s:%s", job.Backend.Name, job.System)
+}
+
+// queued returns whether there are jobs left in the queue that the given
+// worker picks its jobs from. It must be called with r.mu held.
+func (r *Runner) queued(backend *Backend, system ImageID, worker int) bool {
+	index := 0
+	if r.options.Affinity {
+		index = worker
+	}
+	q := r.queues[queueKey{backend.Name, system, index}]
+	return q != nil && len(q.suites) > 0
+}
+
+// prepare prepares the project and backend on the server the worker is
+// connected to, unless another worker sharing the server did it already.
+// It reports whether the server is prepared.
+func (r *Runner) prepare(w *workerState, client *Client, shared *sharedServer, job *Job, insideBackend, abend *bool) bool {
+	if shared != nil {
+		shared.mu.Lock()
+		if preparing := shared.preparing; preparing != nil {
+			shared.mu.Unlock()
+			<-preparing
+			shared.mu.Lock()
+			*insideBackend = shared.insideBackend
+			failed := shared.failed
+			shared.mu.Unlock()
+			return !failed
+		}
+		preparing := make(chan struct{})
+		shared.preparing = preparing
+		shared.insideProject = true
+		shared.job = job
+		shared.mu.Unlock()
+		defer close(preparing)
+	}
+	fail := func(where *[]*Job) bool {
+		r.record(w, where, job)
+		if shared != nil {
+			shared.mu.Lock()
+			shared.failed = true
+			shared.mu.Unlock()
+		}
+		return false
+	}
+
+	var stats = &r.stats
+
+	prepared := client.Server().Image().SnapshotID() != ""
+	if prepared && !r.options.Restore {
+		printf("Skipping project and backend preparation on %s, allocated from a prepared snapshot.", client.Server())
+	}
+	if !r.options.Restore && !prepared && !r.run(client, job, preparing, r.project, r.project.Prepare, abend) {
+		return fail(&stats.ProjectPrepareError)
+	}
+
+	*insideBackend = true
+	if shared != nil {
+		shared.mu.Lock()
+		shared.insideBackend = true
+		shared.mu.Unlock()
+	}
+	if !r.options.Restore && !prepared && !r.run(client, job, preparing, job.Backend, job.Backend.Prepare, abend) {
+		return fail(&stats.BackendPrepareError)
+	}
+	// Snapshots of servers from overridden images must not stand in for
+	// the usual image in later runs.
+	if !r.options.Restore && !r.options.TaskOnly && !prepared && job.Backend.Snapshot && r.options.image(job.Backend, job.System) == "" {
+		r.snapshot(client.Server())
+	}
+	return true
+}
+
+// prepareImages has the providers able to do so fetch the images of all
+// systems that will have workers, before any of them is allocated. Only
+// the LXD backend prepares images this way. Stopping the run gives up on
+// waiting for the downloads still in progress.
+func (r *Runner) prepareImages() {
+	if len(r.options.Reuse) > 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, bname := range r.project.backendNames() {
+		preparer, ok := r.providers[bname].(ImagePreparer)
+		if !ok {
+			continue
+		}
+		var images []ImageID
+		for _, system := range r.project.Backends[bname].Systems {
+			if r.systemWorkers[[2]string{bname, system}] > 0 {
+				images = append(images, ImageID(system))
+			}
+		}
+		if len(images) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := preparer.PrepareImages(images); err != nil {
+				printf("WARNING: %v", err)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-r.tomb.Dying():
+	}
+}
+
+// allocateBatches allocates the servers for all workers at once on the
+// backends able to do so, for workers to pick up as they start.
+func (r *Runner) allocateBatches() {
+	if len(r.options.Reuse) > 0 || !r.tomb.Alive() {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, bname := range r.project.backendNames() {
+		allocator, ok := r.providers[bname].(BatchAllocator)
+		if !ok {
+			continue
+		}
+		backend := r.project.Backends[bname]
+		var images []ImageID
+		for _, system := range backend.Systems {
+			n := r.systemWorkers[[2]string{bname, system}]
+			if servers := backend.SystemServers[system]; servers > 0 && servers < n {
+				n = servers
+			}
+			for i := 0; i < n; i++ {
+				images = append(images, ImageID(system))
+			}
+		}
+		if len(images) < 2 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			printf("Allocating %d servers on %s at once...", len(images), backend)
+			servers, err := allocator.AllocateBatch(images, r.options.Password)
+			if err != nil {
+				printf("Cannot allocate servers on %s at once: %v", backend, err)
+				return
+			}
+			r.mu.Lock()
+			for i, server := range servers {
+				if server != nil {
+					key := [2]string{backend.Name, string(images[i])}
+					r.allocated[key] = append(r.allocated[key], server)
+				}
+			}
+			r.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+// allocate returns a server for the backend and image allocated earlier
+// by allocateBatches, if one is left, or allocates a new one.
+func (r *Runner) allocate(backend *Backend, image ImageID) (Server, error) {
+	key := [2]string{backend.Name, string(image)}
+	r.mu.Lock()
+	servers := r.allocated[key]
+	if len(servers) > 0 {
+		r.allocated[key] = servers[1:]
+		r.mu.Unlock()
+		return servers[0], nil
+	}
+	r.mu.Unlock()
+	return r.providers[backend.Name].Allocate(image, r.options.Password)
+}
+
+// snapshot takes a snapshot of server after the project and backend were
+// prepared on it, so that servers in later runs may be allocated from it.
+// Only one snapshot is taken per backend and system in a run.
+func (r *Runner) snapshot(server Server) {
+	key := [2]string{server.Provider().Backend().Name, string(server.Image().SystemID())}
+	r.mu.Lock()
+	done := r.snapshots[key]
+	r.snapshots[key] = true
+	r.mu.Unlock()
+	if done {
+		return
+	}
+	printf("Snapshotting prepared %s...", server)
+	image, err := server.Snapshot()
+	if err != nil {
+		printf("Cannot snapshot %s: %v", server, err)
+		return
+	}
+	printf("Snapshotted %s as %s.", server, image)
+}
+
+// discard discards server, waiting first if its backend already has as
+// many discards in progress as its discard-limit allows.
+func (r *Runner) discard(server Server) error {
+	if sem, ok := r.discards[server.Provider().Backend().Name]; ok {
+		sem <- true
+		defer func() { <-sem }()
+	}
+	return server.Discard()
+}
+
+type queueKey struct {
+	backend string
+	system  ImageID
+	index   int
+}
+
+// jobQueue holds the pending jobs for a backend and system, grouped by
+// suite so that picking the next job for a worker does not require
+// scanning through all of them.
+type jobQueue struct {
+	suites  []*suiteQueue
+	bySuite map[*Suite]*suiteQueue
+}
+
+type suiteQueue struct {
+	suite *Suite
+	jobs  []*Job
+}
+
+func (q *jobQueue) push(job *Job, groupFixtures bool) {
+	sq := q.bySuite[job.Suite]
+	if sq == nil {
+		sq = &suiteQueue{suite: job.Suite}
+		q.bySuite[job.Suite] = sq
+		q.suites = append(q.suites, sq)
+	}
+	if fixture := job.Task.fixture; fixture != nil && groupFixtures {
+		// Keep jobs of the same fixture together so that it is
+		// prepared and restored as few times as possible.
+		for i := len(sq.jobs) - 1; i >= 0; i-- {
+			if sq.jobs[i].Task.fixture == fixture {
+				sq.jobs = append(sq.jobs, nil)
+				copy(sq.jobs[i+2:], sq.jobs[i+1:])
+				sq.jobs[i+1] = job
+				return
+			}
+		}
+	}
+	sq.jobs = append(sq.jobs, job)
+}
+
+func (q *jobQueue) pop(sq *suiteQueue) *Job {
+	return q.remove(sq, 0)
+}
+
+// remove takes the job at index i out of sq.
+func (q *jobQueue) remove(sq *suiteQueue, i int) *Job {
+	job := sq.jobs[i]
+	if i == 0 {
+		sq.jobs[0] = nil
+		sq.jobs = sq.jobs[1:]
+	} else {
+		sq.jobs = append(sq.jobs[:i], sq.jobs[i+1:]...)
+	}
+	if len(sq.jobs) == 0 {
+		delete(q.bySuite, sq.suite)
+		for i := range q.suites {
+			if q.suites[i] == sq {
+				q.suites = append(q.suites[:i], q.suites[i+1:]...)
+				break
+			}
+		}
+	}
+	return job
+}
+
+// queueJobs moves the pending jobs into the queues that workers pick
+// their jobs from. With the Affinity option set, each worker has a queue
+// of its own holding the jobs pinned to it.
+func (r *Runner) queueJobs() {
+	r.queues = make(map[queueKey]*jobQueue)
+	for _, job := range r.pending {
+		r.queueJob(job)
+	}
+	r.pending = nil
+}
+
+func (r *Runner) queueJob(job *Job) {
+	key := queueKey{job.Backend.Name, job.System, 0}
+	if r.options.Affinity {
+		key.index = r.affinity(job)
+	}
+	q := r.queues[key]
+	if q == nil {
+		q = &jobQueue{bySuite: make(map[*Suite]*suiteQueue)}
+		r.queues[key] = q
+	}
+	// Under the Order option jobs keep their order, even if that means
+	// preparing a fixture again for tasks declared apart.
+	q.push(job, !r.options.Order)
 }
 
-func (r *Runner) add(where *[]*Job, job *Job) {
+// notifyIdle reports progress after a quiet period, so that both humans
+// and log watchers can tell the run is still going.
+func (r *Runner) notifyIdle() {
 	r.mu.Lock()
-	*where = append(*where, job)
+	var running []string
+	for job := range r.running {
+		running = append(running, job.String())
+	}
+	paused := r.paused != nil
 	r.mu.Unlock()
-}
+	sort.Strings(running)
 
-func suiteWorkersKey(job *Job) [3]string {
-	return [3]string{job.Backend.Name, string(job.System), job.Suite.Name}
+	pending := len(r.pendingJobs())
+	state := "Still working"
+	if paused {
+		state = "Paused"
+	}
+	msg := fmt.Sprintf("%s with %d worker%s alive and %d job%s pending", state, r.alive, nth(r.alive, "s", "", "s"), pending, nth(pending, "s", "", "s"))
+	if len(running) > 0 {
+		msg += ", running " + strings.Join(running, ", ")
+	}
+	printf("%s.", msg)
 }
 
-func (r *Runner) worker(backend *Backend, system ImageID) {
-	defer func() { r.done <- true }()
+// pendingJobs returns all jobs not yet handed out to workers.
+func (r *Runner) pendingJobs() []*Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	jobs := append([]*Job(nil), r.pending...)
+	for _, q := range r.queues {
+		for _, sq := range q.suites {
+			jobs = append(jobs, sq.jobs...)
+		}
+	}
+	return jobs
+}
 
-	client := r.client(backend, system)
-	if client == nil {
+func (r *Runner) fetchArtifacts(client *Client, job *Job) {
+	if r.options.Artifacts == "" || len(job.Task.Artifacts) == 0 {
 		return
 	}
+	from := filepath.Join(client.remotePath, job.Task.Name)
+	to := filepath.Join(r.options.Artifacts, job.Name)
+	logf("Fetching artifacts of %s...", job)
+	if err := client.RecvDir(from, to, job.Task.Artifacts, job.Task.ArtifactsExclude); err != nil {
+		printf("Cannot fetch artifacts of %s: %v", job, err)
+	}
+}
 
-	var stats = &r.stats
-
-	var abend bool
-	var badProject bool
-	var badSuite = make(map[*Suite]bool)
-
-	var insideProject bool
-	var insideBackend bool
-	var insideSuite *Suite
-
-	var job, last *Job
-
-	for {
-		r.mu.Lock()
-		if job != nil {
-			r.suiteWorkers[suiteWorkersKey(job)]--
-		}
-		if badProject || abend || !r.tomb.Alive() {
-			r.mu.Unlock()
-			break
+func (r *Runner) job(backend *Backend, system ImageID, worker int, suite *Suite) *Job {
+	index := 0
+	if r.options.Affinity {
+		index = worker
+	}
+	q := r.queues[queueKey{backend.Name, system, index}]
+	if q == nil {
+		return nil
+	}
+	if r.options.Order {
+		return r.nextInOrder(q, worker)
+	}
+	if r.options.Balance {
+		return r.nextBalanced(q, worker, suite)
+	}
+	if sq := q.bySuite[suite]; sq != nil && r.available(sq.jobs[0], worker) {
+		// Best possible case.
+		return r.take(q, sq, worker)
+	}
+	var best *suiteQueue
+	var bestWorkers = 1000000
+	for _, sq := range q.suites {
+		job := sq.jobs[0]
+		if !r.available(job, worker) {
+			continue
 		}
-		job = r.job(backend, system, insideSuite)
-		if job == nil {
-			r.mu.Unlock()
-			break
+		if c := r.suiteWorkers[suiteWorkersKey(job)]; c < bestWorkers {
+			best = sq
+			bestWorkers = c
 		}
-		r.suiteWorkers[suiteWorkersKey(job)]++
-		r.mu.Unlock()
+	}
+	if best != nil {
+		return r.take(q, best, worker)
+	}
+	return nil
+}
 
-		if badSuite[job.Suite] {
-			r.add(&stats.TaskAbort, job)
+// nextInOrder returns the earliest job available to the worker in q in
+// the order tasks were declared in the project, so that runs are
+// predictable when debugging.
+func (r *Runner) nextInOrder(q *jobQueue, worker int) *Job {
+	var first *suiteQueue
+	for _, sq := range q.suites {
+		if !r.available(sq.jobs[0], worker) {
 			continue
 		}
+		if first == nil || (jobsByOrder{sq.jobs[0], first.jobs[0]}).Less(0, 1) {
+			first = sq
+		}
+	}
+	if first != nil {
+		return r.take(q, first, worker)
+	}
+	return nil
+}
 
-		if insideSuite != nil && insideSuite != job.Suite {
-			if false {
-				printf("WARNING: Was inside missing suite %s on last run, so cannot restore it.", insideSuite)
-			} else if !r.run(client, last, restoring, insideSuite, insideSuite.Restore, &abend) {
-				r.add(&stats.SuiteRestoreError, last)
-				r.add(&stats.TaskAbort, job)
-				badProject = true
-				continue
+// nextBalanced returns the next job available to the worker in q from
+// the task with the most queued jobs per worker running it, preferring
+// the worker's current suite on ties, and then the task queued first.
+// Unlike the default of sticking to the current suite, this spreads the
+// variants of a task over all the workers available, even when its suite
+// holds other tasks. Colocated suites still run their tasks in order.
+func (r *Runner) nextBalanced(q *jobQueue, worker int, suite *Suite) *Job {
+	var best *suiteQueue
+	var bestIndex, bestJobs, bestWorkers int
+	for _, sq := range q.suites {
+		if !r.available(sq.jobs[0], worker) {
+			continue
+		}
+		queued := make(map[*Task]int)
+		for _, job := range sq.jobs {
+			queued[job.Task]++
+		}
+		running := make(map[*Task]int)
+		for job := range r.running {
+			if job.Suite == sq.suite && job.Backend == sq.jobs[0].Backend && job.System == sq.jobs[0].System {
+				running[job.Task]++
 			}
-			insideSuite = nil
 		}
-
-		last = job
-
-		if !insideProject {
-			insideProject = true
-			if !r.options.Restore && !r.run(client, job, preparing, r.project, r.project.Prepare, &abend) {
-				r.add(&stats.ProjectPrepareError, job)
-				r.add(&stats.TaskAbort, job)
-				badProject = true
-				continue
+		for i, job := range sq.jobs {
+			if i > 0 && sq.suite.Colocate {
+				break
 			}
-
-			insideBackend = true
-			if !r.options.Restore && !r.run(client, job, preparing, backend, backend.Prepare, &abend) {
-				r.add(&stats.BackendPrepareError, job)
-				r.add(&stats.TaskAbort, job)
-				badProject = true
+			jobs := queued[job.Task]
+			if jobs == 0 {
+				// Not the first queued job of its task.
 				continue
 			}
-		}
-
-		if insideSuite != job.Suite {
-			insideSuite = job.Suite
-			if !r.options.Restore && !r.run(client, job, preparing, job.Suite, job.Suite.Prepare, &abend) {
-				r.add(&stats.SuitePrepareError, job)
-				r.add(&stats.TaskAbort, job)
-				badSuite[job.Suite] = true
-				continue
+			queued[job.Task] = 0
+			workers := running[job.Task] + 1
+			if best != nil {
+				// Compare jobs/workers with bestJobs/bestWorkers.
+				diff := jobs*bestWorkers - bestJobs*workers
+				if diff < 0 || diff == 0 && (sq.suite != suite || best.suite == suite) {
+					continue
+				}
 			}
+			best = sq
+			bestIndex = i
+			bestJobs = jobs
+			bestWorkers = workers
 		}
+	}
+	if best != nil {
+		return r.takeAt(q, best, bestIndex, worker)
+	}
+	return nil
+}
 
-		if r.options.Restore {
-			// Do not prepare or execute.
-		} else if !r.options.Restore && !r.run(client, job, preparing, job, job.Task.Prepare, &abend) {
-			r.add(&stats.TaskPrepareError, job)
-			r.add(&stats.TaskAbort, job)
-		} else if !r.options.Restore && r.run(client, job, executing, job, job.Task.Execute, &abend) {
-			r.add(&stats.TaskDone, job)
-		} else if !r.options.Restore {
-			r.add(&stats.TaskError, job)
-		}
-		if !abend && !r.run(client, job, restoring, job, job.Task.Restore, &abend) {
-			r.add(&stats.TaskRestoreError, job)
-			badProject = true
-		}
+// available returns whether job may be handed out to the given worker
+// considering the constraints of its suite.
+func (r *Runner) available(job *Job, worker int) bool {
+	if r.serialBusy(job) {
+		return false
+	}
+	if job.Suite.Colocate {
+		owner, ok := r.suiteOwners[suiteWorkersKey(job)]
+		return !ok || owner == worker
 	}
+	return true
+}
 
-	if !abend && insideSuite != nil {
-		if !r.run(client, last, restoring, insideSuite, insideSuite.Restore, &abend) {
-			r.add(&stats.SuiteRestoreError, last)
-		}
-		insideSuite = nil
+// take pops the next job from sq for the given worker. Jobs of colocated
+// suites are all handed out to the worker that takes the first of them.
+func (r *Runner) take(q *jobQueue, sq *suiteQueue, worker int) *Job {
+	return r.takeAt(q, sq, 0, worker)
+}
+
+// takeAt is like take, but pops the job at index i of sq instead.
+func (r *Runner) takeAt(q *jobQueue, sq *suiteQueue, i int, worker int) *Job {
+	job := q.remove(sq, i)
+	if job.Suite.Colocate {
+		r.suiteOwners[suiteWorkersKey(job)] = worker
 	}
-	if !abend && insideBackend {
-		if !r.run(client, last, restoring, backend, backend.Restore, &abend) {
-			r.add(&stats.BackendRestoreError, last)
+	return job
+}
+
+// workerGone releases the colocated suites owned by the worker with the
+// given index, and the jobs pinned to it, once it is gone for good so
+// that other workers may run them. It must be called with r.mu held.
+func (r *Runner) workerGone(backend *Backend, system ImageID, index int) {
+	for key, owner := range r.suiteOwners {
+		if key[0] == backend.Name && key[1] == string(system) && owner == index {
+			delete(r.suiteOwners, key)
 		}
-		insideBackend = false
 	}
-	if !abend && insideProject {
-		if !r.run(client, last, restoring, r.project, r.project.Restore, &abend) {
-			r.add(&stats.ProjectRestoreError, last)
-		}
-		insideProject = false
+	r.dropAffinity(backend, system, index)
+}
+
+// serialBusy returns whether another worker is running a task from
+// the serial suite that job is part of.
+func (r *Runner) serialBusy(job *Job) bool {
+	return job.Suite.Serial && r.suiteWorkers[suiteWorkersKey(job)] > 0
+}
+
+// affinity returns the index of the worker that job is pinned to when
+// the Affinity option is set. The choice depends only on the task name,
+// variant, and number of workers for the job's system, so the same tasks
+// end up sharing a server across runs. Jobs pinned to a worker that is
+// gone are hashed again over the workers still running.
+func (r *Runner) affinity(job *Job) int {
+	key := [2]string{job.Backend.Name, string(job.System)}
+	n := r.systemWorkers[key]
+	if n < 2 {
+		return 0
 	}
-	server := client.Server()
-	client.Close()
-	if !r.options.Keep {
-		printf("Discarding %s...", server)
-		if err := server.Discard(); err != nil {
-			printf("Error discarding %s: %v", server, err)
+	h := fnv.New32a()
+	if job.Suite.Colocate {
+		h.Write([]byte(suiteName(job)))
+	} else {
+		h.Write([]byte(taskName(job)))
+	}
+	// Spread the shards of a task over different workers.
+	sum := h.Sum32() + uint32(job.Shard)
+	index := int(sum % uint32(n))
+	gone := r.gone[key]
+	if !gone[index] {
+		return index
+	}
+	var alive []int
+	for i := 0; i < n; i++ {
+		if !gone[i] {
+			alive = append(alive, i)
 		}
 	}
+	if len(alive) == 0 {
+		return index
+	}
+	return alive[sum%uint32(len(alive))]
 }
 
-func (r *Runner) job(backend *Backend, system ImageID, suite *Suite) *Job {
-	var best = -1
-	var bestWorkers = 1000000
-	for i, job := range r.pending {
-		if job == nil {
-			continue
-		}
-		if job.Backend != backend || job.System != system {
-			// Different backend or system is not an option at all.
-			continue
-		}
-		if job.Suite == suite {
-			// Best possible case.
-			best = i
-			break
-		}
-		if c := r.suiteWorkers[suiteWorkersKey(job)]; c < bestWorkers {
-			best = i
-			bestWorkers = c
-		}
+// dropAffinity records that the worker with the given index is gone
+// for good and hashes the jobs left pinned to it over the workers of
+// the same system still running, if any. It must be called with r.mu held.
+func (r *Runner) dropAffinity(backend *Backend, system ImageID, index int) {
+	if !r.options.Affinity {
+		return
 	}
-	if best >= 0 {
-		job := r.pending[best]
-		r.pending[best] = nil
-		return job
+	key := [2]string{backend.Name, string(system)}
+	if r.gone == nil {
+		r.gone = make(map[[2]string]map[int]bool)
+	}
+	if r.gone[key] == nil {
+		r.gone[key] = make(map[int]bool)
+	}
+	r.gone[key][index] = true
+	if len(r.gone[key]) >= r.systemWorkers[key] {
+		// Nobody left to run them, so they are reported as aborted.
+		return
+	}
+	qkey := queueKey{backend.Name, system, index}
+	q := r.queues[qkey]
+	if q == nil || len(q.suites) == 0 {
+		return
+	}
+	delete(r.queues, qkey)
+	var jobs []*Job
+	for _, sq := range q.suites {
+		jobs = append(jobs, sq.jobs...)
+	}
+	debugf("Worker %s:%s#%d is gone, moving its %d job%s to other workers.", backend.Name, system, index+1, len(jobs), nth(len(jobs), "s", "", "s"))
+	for _, job := range jobs {
+		r.queueJob(job)
 	}
-	return nil
 }
 
 func (r *Runner) client(backend *Backend, image ImageID) *Client {
@@ -383,22 +2024,36 @@ func (r *Runner) client(backend *Backend, image ImageID) *Client {
 	var client *Client
 	var server Server
 	var err error
+	var allocRetry = &retrier{backoff: &backend.Backoff}
+	var mismatched = make(map[string]bool)
+	var failedRounds int
+
+	// release closes the client of a server that cannot be used, and
+	// leaves a reused one for other workers to try.
+	release := func(server Server, reused bool) {
+		client.Close()
+		if reused {
+			r.mu.Lock()
+			r.reused[server.Address()] = false
+			mismatched[server.Address()] = true
+			r.mu.Unlock()
+		}
+	}
 	for r.tomb.Alive() {
 
-		// Look for a server available for reuse.
+		// Look for a server available for reuse. Servers are matched
+		// against the system once their reuse data is read.
 		reused := false
 		r.mu.Lock()
 		for _, addr := range r.options.Reuse[backend.Name] {
-			if r.reused[addr] {
+			if r.reused[addr] || mismatched[addr] {
 				continue
 			}
-			// FIXME This is broken. Needs to account for the image.
-			//       Store backend in reuse data (already has image)
-			//       and pre-discover all servers before getting here.
 			r.reused[addr] = true
 			server = &UnknownServer{addr}
 			reused = true
 			printf("Reusing %s:%s...", backend.Name, image.SystemID())
+			break
 		}
 		r.mu.Unlock()
 
@@ -410,69 +2065,120 @@ func (r *Runner) client(backend *Backend, image ImageID) *Client {
 			}
 
 			printf("Allocating %s:%s...", backend.Name, image.SystemID())
-			var timeout = time.After(30 * time.Second)
+			var timeout = time.After(allocateTimeout)
 			var relog = time.NewTicker(8 * time.Second)
 			defer relog.Stop()
-			var retry = time.NewTicker(5 * time.Second)
-			defer retry.Stop()
 			err = nil
 		Allocate:
 			for {
 				lerr := err
-				server, err = r.providers[backend.Name].Allocate(image, r.options.Password)
+				server, err = r.allocate(backend, image)
 				if err == nil {
+					allocRetry.reset()
 					break
 				}
+				class := r.classify(backend, err)
 				if lerr == nil || lerr.Error() != err.Error() {
 					printf("Cannot allocate %s:%s: %v", backend.Name, image.SystemID(), err)
-					if _, ok := err.(*FatalError); ok {
-						return nil
-					}
+				}
+				if class == fatalError {
+					return nil
 				}
 
-				// TODO Check if the error is unrecoverable (bad key, no machines whatsoever, etc).
-
+				retry := time.After(allocRetry.retryDelay(class))
+			AllocateWait:
+				for {
+					select {
+					case <-retry:
+						break AllocateWait
+					case <-relog.C:
+						printf("Cannot allocate %s:%s: %v", backend.Name, image.SystemID(), err)
+					case <-r.tomb.Dying():
+						break Allocate
+					}
+				}
 				select {
-				case <-retry.C:
-				case <-relog.C:
-					printf("Cannot allocate %s:%s: %v", backend.Name, image.SystemID(), err)
 				case <-timeout:
 					break Allocate
-				case <-r.tomb.Dying():
-					break Allocate
+				default:
 				}
 			}
 			if err != nil {
+				failedRounds++
+				if r.degrade(backend, image, failedRounds) {
+					return nil
+				}
 				continue
 			}
+			failedRounds = 0
+			if err := forgetHostKey(backend, server.Address()); err != nil {
+				printf("WARNING: %v", err)
+			}
+		}
+
+		if s, ok := server.(*UnknownServer); ok {
+			if stopper, ok := r.providers[backend.Name].(Stopper); ok {
+				started, err := stopper.Start(s.Address(), r.options.Password)
+				if err != nil {
+					printf("Cannot start %s: %v", s.Address(), err)
+					continue
+				}
+				if started != nil && started.Image().SystemID() != image.SystemID() {
+					// Leave it for a worker of its own system.
+					debugf("Server %s runs %s rather than %s, looking for another one.", started, started.Image().SystemID(), image.SystemID())
+					r.mu.Lock()
+					r.reused[s.Address()] = false
+					mismatched[s.Address()] = true
+					r.mu.Unlock()
+					continue
+				}
+				if started != nil {
+					server = started
+				}
+			}
 		}
 
 		printf("Connecting to %s...", server)
 
 		var timeout = time.After(60 * time.Second)
+		if reused && r.options.ReuseWait > 0 {
+			// Kept servers may be briefly down, such as while rebooting.
+			timeout = time.After(r.options.ReuseWait)
+		}
 		var relog = time.NewTicker(8 * time.Second)
 		defer relog.Stop()
-		var retry = time.NewTicker(5 * time.Second)
-		defer retry.Stop()
+		var dialRetry = &retrier{backoff: &backend.Backoff}
 	Dial:
 		for {
 			lerr := err
-			client, err = Dial(server, r.options.Password)
+			client, err = Dial(server, backend, r.options.Password)
 			if err == nil {
 				break
 			}
 			if lerr == nil || lerr.Error() != err.Error() {
 				debugf("Cannot connect to %s: %v", server, err)
 			}
+			class := r.classify(backend, err)
+			if class == fatalError {
+				break Dial
+			}
 
+			retry := time.After(dialRetry.retryDelay(class))
+		DialWait:
+			for {
+				select {
+				case <-retry:
+					break DialWait
+				case <-relog.C:
+					debugf("Cannot connect to %s: %v", server, err)
+				case <-r.tomb.Dying():
+					break Dial
+				}
+			}
 			select {
-			case <-retry.C:
-			case <-relog.C:
-				debugf("Cannot connect to %s: %v", server, err)
 			case <-timeout:
 				break Dial
-			case <-r.tomb.Dying():
-				break Dial
+			default:
 			}
 		}
 		if err != nil {
@@ -480,15 +2186,18 @@ func (r *Runner) client(backend *Backend, image ImageID) *Client {
 				printf("Cannot connect to %s: %v", server, err)
 			} else {
 				printf("Discarding %s, cannot connect: %v", server, err)
-				server.Discard()
+				r.discard(server)
 			}
 			continue
 		}
-		if !reused {
-			err = client.WriteFile("/.spread.yaml", server.ReuseData())
+		client.remotePath = r.remotePath(backend, server.Image())
+		if data := server.ReuseData(); !reused && data != nil {
+			data = append(data, fmt.Sprintf("spread-path: %q\n", client.remotePath)...)
+			data = append(data, fmt.Sprintf("spread-config: %q\n", r.reuseConfig(backend, image))...)
+			err = client.WriteFile("/.spread.yaml", data)
 			if err != nil {
 				printf("Discarding %s, cannot write reuse data: %s", server, err)
-				server.Discard()
+				r.discard(server)
 				continue
 			}
 		}
@@ -504,58 +2213,145 @@ func (r *Runner) client(backend *Backend, image ImageID) *Client {
 				printf("Cannot reuse %s on %s: %v", server, backend, err)
 				continue
 			}
+			recordedPath, why := checkReuseData(data, r.reuseConfig(backend, image))
+			if s.Image().SystemID() != image.SystemID() {
+				// Leave it for a worker of its own system.
+				debugf("Server %s runs %s rather than %s, looking for another one.", s, s.Image().SystemID(), image.SystemID())
+				client.Close()
+				r.mu.Lock()
+				r.reused[server.Address()] = false
+				mismatched[server.Address()] = true
+				r.mu.Unlock()
+				continue
+			}
+			if why != "" {
+				if r.options.ReuseStrict {
+					printf("Cannot reuse %s, the %s configuration %s.", s, backend, why)
+					client.Close()
+					continue
+				}
+				printf("WARNING: Reusing %s, but the %s configuration %s.", s, backend, why)
+			}
 			server = s
 			client.server = s
+			client.remotePath = r.remotePath(backend, server.Image())
+			if recordedPath != "" {
+				client.remotePath = recordedPath
+			}
 		}
 
 		printf("Connected to %s.", server)
 
+		client.packageManager = detectPackageManager(client)
+		if client.packageManager != nil {
+			debugf("Package manager on %s is %s.", server, client.packageManager.Name)
+		}
+
+		r.checkClock(client, backend)
+
 		send := true
-		if reused && r.options.Resend {
-			printf("Removing project data from %s at %s...", server, r.project.RemotePath)
-			if err := client.RemoveAll(r.project.RemotePath); err != nil {
+		if backend.Type == "local" {
+			printf("Using local project data at %s.", client.remotePath)
+			send = false
+		} else if reused && r.options.Resend {
+			printf("Removing project data from %s at %s...", server, client.remotePath)
+			if err := client.RemoveAll(client.remotePath); err != nil {
 				printf("Cannot remove project data from %s: %v", server, err)
 			}
 		} else if reused {
-			empty, err := client.MissingOrEmpty(r.project.RemotePath)
+			empty, err := client.MissingOrEmpty(client.remotePath)
 			if err != nil {
 				printf("Cannot send project data to %s: %v", server, err)
 				continue
 			}
 			send = empty
+		} else if server.Image().SnapshotID() != "" {
+			// The snapshot holds project data from the run that took it.
+			if err := client.RemoveAll(client.remotePath); err != nil {
+				printf("Discarding %s, cannot remove project data: %v", server, err)
+				r.discard(server)
+				continue
+			}
 		}
 
 		if send {
+			if r.sends != nil {
+				r.sends <- true
+			}
 			printf("Sending project data to %s...", server)
-			err := client.Send(r.project.Path, r.project.RemotePath, r.project.Include, r.project.Exclude)
+			err := client.Send(r.project.Path, client.remotePath, r.project.Include, r.project.Exclude)
+			if r.sends != nil {
+				<-r.sends
+			}
 			if err != nil {
 				if reused {
 					printf("Cannot send project data to %s: %v", server, err)
 				} else {
 					printf("Discarding %s, cannot send project data: %s", server, err)
-					server.Discard()
+					r.discard(server)
 				}
 				continue
 			}
-		} else {
+		} else if reused {
 			printf("Reusing project data on %s...", server)
 		}
 
-		r.servers = append(r.servers, server)
+		if err := r.sendFiles(client, backend.Files); err != nil {
+			release(server, reused)
+			if reused {
+				printf("Cannot send files to %s: %v", server, err)
+			} else {
+				printf("Discarding %s, %v", server, err)
+				r.discard(server)
+			}
+			continue
+		}
+
+		if err := r.installCACerts(client, backend); err != nil {
+			release(server, reused)
+			if reused {
+				printf("Cannot prepare %s: %v", server, err)
+			} else {
+				printf("Discarding %s, %v", server, err)
+				r.discard(server)
+			}
+			continue
+		}
+
+		r.addServer(backend, server)
 		return client
 	}
 
 	return nil
 }
 
+// addServer tracks server as one of the servers of the run.
+func (r *Runner) addServer(backend *Backend, server Server) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.servers = append(r.servers, server)
+	r.manifestServer(backend, server)
+}
+
+// reuseArgs returns the command line options reusing the servers kept
+// by the run, or an empty string if none may be reused. Local backends
+// run on this very system, so there is nothing of theirs to reuse.
 func (r *Runner) reuseArgs() string {
 	buf := &bytes.Buffer{}
 	reuse := make(map[string][]string)
 	backends := make([]string, 0, len(r.servers))
 	for _, server := range r.servers {
-		backend := server.Provider().Backend().Name
-		backends = append(backends, backend)
-		reuse[backend] = append(reuse[backend], server.Address())
+		backend := server.Provider().Backend()
+		if backend.Type == "local" {
+			continue
+		}
+		if len(reuse[backend.Name]) == 0 {
+			backends = append(backends, backend.Name)
+		}
+		reuse[backend.Name] = append(reuse[backend.Name], server.Address())
+	}
+	if len(backends) == 0 {
+		return ""
 	}
 	sort.Strings(backends)
 	buf.WriteString("-pass=")
@@ -599,25 +2395,82 @@ func (r *Runner) reuseArgs() string {
 
 type stats struct {
 	TaskDone            []*Job
+	TaskCached          []*Job
+	TaskXFail           []*Job
+	TaskXPass           []*Job
+	TaskQuarantine      []*Job
+	TaskSkip            []*Job
+	TaskSlow            []*Job
+	TaskLeak            []*Job
 	TaskError           []*Job
 	TaskAbort           []*Job
 	TaskPrepareError    []*Job
 	TaskRestoreError    []*Job
+	FixturePrepareError []*Job
+	FixtureRestoreError []*Job
 	SuitePrepareError   []*Job
 	SuiteRestoreError   []*Job
 	BackendPrepareError []*Job
 	BackendRestoreError []*Job
 	ProjectPrepareError []*Job
 	ProjectRestoreError []*Job
+
+	// failedAt holds where failed tasks failed, when known.
+	failedAt map[*Job]string
+}
+
+// outcome returns the priority of where as a task outcome, lower being
+// worse, or -1 if it is not one of the task outcome lists.
+func (s *stats) outcome(where *[]*Job) int {
+	for i, outcome := range []*[]*Job{&s.TaskError, &s.TaskQuarantine, &s.TaskXFail, &s.TaskAbort, &s.TaskXPass, &s.TaskDone, &s.TaskSkip} {
+		if where == outcome {
+			return i
+		}
+	}
+	return -1
+}
+
+// brokenLists returns the lists of jobs with failed prepare and restore
+// scripts.
+func (s *stats) brokenLists() []*[]*Job {
+	return []*[]*Job{
+		&s.TaskPrepareError, &s.TaskRestoreError,
+		&s.FixturePrepareError, &s.FixtureRestoreError,
+		&s.SuitePrepareError, &s.SuiteRestoreError,
+		&s.BackendPrepareError, &s.BackendRestoreError,
+		&s.ProjectPrepareError, &s.ProjectRestoreError,
+	}
+}
+
+// broken returns whether where is one of the lists of jobs with failed
+// prepare and restore scripts.
+func (s *stats) broken(where *[]*Job) bool {
+	for _, list := range s.brokenLists() {
+		if where == list {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *stats) log() {
 	printf("Successful tasks: %d", len(s.TaskDone))
+	if len(s.TaskCached) > 0 {
+		printf("Cached tasks: %d", len(s.TaskCached))
+	}
 	printf("Aborted tasks: %d", len(s.TaskAbort))
 
-	logNames(printf, "Failed tasks", s.TaskError, taskName)
+	logNames(printf, "Failed tasks", s.TaskError, s.failedTaskName)
+	logNames(printf, "Failed tasks as expected", s.TaskXFail, taskName)
+	logNames(printf, "Unexpectedly successful tasks", s.TaskXPass, taskName)
+	logNames(printf, "Failed quarantined tasks", s.TaskQuarantine, taskName)
+	logNames(printf, "Skipped tasks", s.TaskSkip, taskName)
+	logNames(printf, "Slower than expected tasks", s.TaskSlow, taskName)
+	logNames(printf, "Tasks leaking state", s.TaskLeak, taskName)
 	logNames(printf, "Failed task prepare", s.TaskPrepareError, taskName)
 	logNames(printf, "Failed task restore", s.TaskRestoreError, taskName)
+	logNames(printf, "Failed fixture prepare", s.FixturePrepareError, fixtureName)
+	logNames(printf, "Failed fixture restore", s.FixtureRestoreError, fixtureName)
 	logNames(printf, "Failed suite prepare", s.SuitePrepareError, suiteName)
 	logNames(printf, "Failed suite restore", s.SuiteRestoreError, suiteName)
 	logNames(printf, "Failed backend prepare", s.BackendPrepareError, backendName)
@@ -626,9 +2479,136 @@ func (s *stats) log() {
 	logNames(printf, "Failed project restore", s.ProjectRestoreError, projectName)
 }
 
+// RunError is returned by Runner.Wait when the run was not entirely
+// successful, and tells apart tasks that failed from problems that
+// prevented tasks from running at all.
+type RunError struct {
+	// Failed is the number of tasks that ran and failed, including
+	// those expected to fail that succeeded instead.
+	Failed int
+	// Aborted is the number of tasks that could not run, due to
+	// servers that could not be allocated or connected to, prepare
+	// errors, or the run being stopped.
+	Aborted int
+	// Broken is the number of prepare and restore scripts that failed.
+	Broken int
+	// Skipped is the number of tasks that were skipped, only counted
+	// with the FailOnSkip option.
+	Skipped int
+	// Leaked is the number of tasks that changed state of the server
+	// they were not allowed to, only counted when the project sets
+	// state-leak to fail.
+	Leaked int
+	// Unmet describes the minimum of passed tasks set by the MinPassed
+	// or MinPassedPercent options when the run fell short of it.
+	Unmet string
+}
+
+// Infrastructure returns whether there were failures other than tasks
+// failing to execute, meaning some tasks may not have had a chance to
+// run successfully.
+func (e *RunError) Infrastructure() bool {
+	return e.Aborted > 0 || e.Broken > 0
+}
+
+func (e *RunError) Error() string {
+	var msgs []string
+	if e.Failed > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d task%s failed", e.Failed, nth(e.Failed, "s", "", "s")))
+	}
+	if e.Aborted > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d task%s aborted", e.Aborted, nth(e.Aborted, "s", "", "s")))
+	}
+	if e.Broken > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d prepare or restore error%s", e.Broken, nth(e.Broken, "s", "", "s")))
+	}
+	if e.Skipped > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d task%s skipped", e.Skipped, nth(e.Skipped, "s", "", "s")))
+	}
+	if e.Leaked > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d task%s leaked state", e.Leaked, nth(e.Leaked, "s", "", "s")))
+	}
+	if e.Unmet != "" {
+		msgs = append(msgs, e.Unmet)
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// err returns a RunError if the run wasn't entirely successful. With
+// failOnSkip set, skipped tasks are also considered unsuccessful, and
+// with failOnLeak set so are tasks leaking state.
+func (s *stats) err(failOnSkip, failOnLeak bool) error {
+	e := &RunError{
+		Failed:  len(s.TaskError) + len(s.TaskXPass),
+		Aborted: len(s.TaskAbort),
+	}
+	if failOnSkip {
+		e.Skipped = len(s.TaskSkip)
+	}
+	if failOnLeak {
+		e.Leaked = len(s.TaskLeak)
+	}
+	for _, jobs := range s.brokenLists() {
+		e.Broken += len(*jobs)
+	}
+	if e.Failed == 0 && e.Aborted == 0 && e.Broken == 0 && e.Skipped == 0 && e.Leaked == 0 {
+		return nil
+	}
+	return e
+}
+
+// threshold returns a RunError if fewer tasks than the given count or
+// percentage of the tasks that ran passed, and nil otherwise, however
+// many other tasks failed. Tasks failing as expected count as passed.
+// Skipped and leaking tasks still fail the run as they would with err.
+func (s *stats) threshold(count int, percent float64, failOnSkip, failOnLeak bool) error {
+	passed := len(s.TaskDone) + len(s.TaskCached) + len(s.TaskXFail)
+	total := passed + len(s.TaskXPass) + len(s.TaskQuarantine) + len(s.TaskError) + len(s.TaskAbort)
+	var unmet string
+	if passed < count {
+		unmet = fmt.Sprintf("%d of %d tasks passed, at least %d required", passed, total, count)
+	} else if percent > 0 && (total == 0 || float64(passed)*100 < percent*float64(total)) {
+		unmet = fmt.Sprintf("%d of %d tasks passed, at least %g%% required", passed, total, percent)
+	}
+	e, _ := s.err(failOnSkip, failOnLeak).(*RunError)
+	if unmet == "" && (e == nil || e.Skipped == 0 && e.Leaked == 0) {
+		return nil
+	}
+	if e == nil {
+		e = &RunError{}
+	}
+	e.Unmet = unmet
+	return e
+}
+
 func projectName(job *Job) string { return "project" }
 func backendName(job *Job) string { return job.Backend.Name }
 func suiteName(job *Job) string   { return job.Suite.Name }
+func fixtureName(job *Job) string { return job.Task.fixture.String() }
+
+// failedAt records the command that made the execute script of job
+// fail, so that the run summary may point at it.
+func (r *Runner) failedAt(job *Job, e *ExitStatusError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stats.failedAt == nil {
+		r.stats.failedAt = make(map[*Job]string)
+	}
+	at := fmt.Sprintf("failed at `%s` (exit %d)", maskSecrets(e.Command), e.Status)
+	r.stats.failedAt[job] = at
+	if job.parent != nil {
+		r.stats.failedAt[job.parent] = at
+	}
+}
+
+// failedTaskName is like taskName, but follows it with where the task
+// failed, when known.
+func (s *stats) failedTaskName(job *Job) string {
+	if at, ok := s.failedAt[job]; ok {
+		return taskName(job) + " " + at
+	}
+	return taskName(job)
+}
 
 func taskName(job *Job) string {
 	if job.Variant == "" {
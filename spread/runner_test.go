@@ -0,0 +1,2375 @@
+package spread_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/snapcore/spread/spread"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+)
+
+type RunnerSuite struct {
+	home string
+}
+
+var _ = Suite(&RunnerSuite{})
+
+func (s *RunnerSuite) SetUpTest(c *C) {
+	// Local runs record state under the home directory.
+	s.home = os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
+}
+
+func (s *RunnerSuite) TearDownTest(c *C) {
+	os.Setenv("HOME", s.home)
+}
+
+func queueJobs(backend *spread.Backend, suites []*spread.Suite, n int) []*spread.Job {
+	var jobs []*spread.Job
+	for i := 0; i < n; i++ {
+		suite := suites[i%len(suites)]
+		task := &spread.Task{Name: fmt.Sprintf("%stask-%d", suite.Name, i)}
+		jobs = append(jobs, &spread.Job{
+			Name:    fmt.Sprintf("%s:ubuntu-16.04:%s", backend.Name, task.Name),
+			Backend: backend,
+			System:  "ubuntu-16.04",
+			Suite:   suite,
+			Task:    task,
+		})
+	}
+	return jobs
+}
+
+// writeRunProject writes the given spread.yaml into dir, along with the
+// task.yaml of each task, keyed by the task path.
+func writeRunProject(c *C, dir, yaml string, tasks map[string]string) {
+	err := ioutil.WriteFile(filepath.Join(dir, "spread.yaml"), []byte(yaml), 0644)
+	c.Assert(err, IsNil)
+	for name, task := range tasks {
+		err := os.MkdirAll(filepath.Join(dir, name), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(filepath.Join(dir, name, "task.yaml"), []byte(task), 0644)
+		c.Assert(err, IsNil)
+	}
+}
+
+// runProject runs the project in dir on the local backend with the
+// given options, and returns the outcome of the run.
+func runProject(c *C, dir string, options *spread.Options) error {
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	options.Local = true
+	options.Password = "secret"
+	r, err := spread.Start(project, options)
+	c.Assert(err, IsNil)
+	return r.Wait()
+}
+
+func (s *RunnerSuite) TestJobSelection(c *C) {
+	backend := &spread.Backend{Name: "backend"}
+	suites := []*spread.Suite{{Name: "a/"}, {Name: "b/"}, {Name: "c/", Serial: true}}
+	jobs := queueJobs(backend, suites, 6)
+	r := spread.NewQueueRunner(jobs, &spread.Options{})
+
+	// Nothing for other backends or systems.
+	c.Assert(r.NextJob(&spread.Backend{Name: "other"}, "ubuntu-16.04", nil), IsNil)
+	c.Assert(r.NextJob(backend, "ubuntu-14.04", nil), IsNil)
+
+	// Stick to the current suite while possible.
+	job1 := r.NextJob(backend, "ubuntu-16.04", suites[1])
+	c.Assert(job1, Equals, jobs[1])
+	job2 := r.NextJob(backend, "ubuntu-16.04", suites[1])
+	c.Assert(job2, Equals, jobs[4])
+
+	// Otherwise pick the suite with the fewest workers.
+	job3 := r.NextJob(backend, "ubuntu-16.04", suites[1])
+	c.Assert(job3, Equals, jobs[0])
+	job4 := r.NextJob(backend, "ubuntu-16.04", nil)
+	c.Assert(job4, Equals, jobs[2])
+
+	// Serial suites run a single task at a time.
+	job5 := r.NextJob(backend, "ubuntu-16.04", suites[2])
+	c.Assert(job5, Equals, jobs[3])
+	c.Assert(r.NextJob(backend, "ubuntu-16.04", nil), IsNil)
+	r.DoneJob(job4)
+	job6 := r.NextJob(backend, "ubuntu-16.04", nil)
+	c.Assert(job6, Equals, jobs[5])
+
+	c.Assert(r.NextJob(backend, "ubuntu-16.04", nil), IsNil)
+}
+
+func (s *RunnerSuite) TestBalancedJobSelection(c *C) {
+	backend := &spread.Backend{Name: "backend"}
+	suites := []*spread.Suite{{Name: "a/"}, {Name: "b/"}}
+	jobs := queueJobs(backend, []*spread.Suite{suites[0]}, 1)
+	task := &spread.Task{Name: "b/task"}
+	for i := 1; i <= 5; i++ {
+		variant := fmt.Sprintf("v%d", i)
+		jobs = append(jobs, &spread.Job{
+			Name:    "backend:ubuntu-16.04:b/task:" + variant,
+			Backend: backend,
+			System:  "ubuntu-16.04",
+			Suite:   suites[1],
+			Task:    task,
+			Variant: variant,
+		})
+	}
+	r := spread.NewQueueRunner(jobs, &spread.Options{Balance: true})
+
+	// Pick the suite with the most queued jobs per worker, even if
+	// that means leaving the current one, so that variants of the
+	// same task run on different workers.
+	job1 := r.NextWorkerJob(backend, "ubuntu-16.04", 0, suites[0])
+	c.Assert(job1, Equals, jobs[1])
+	job2 := r.NextWorkerJob(backend, "ubuntu-16.04", 1, suites[0])
+	c.Assert(job2, Equals, jobs[2])
+	r.DoneJob(job1)
+	job3 := r.NextWorkerJob(backend, "ubuntu-16.04", 0, suites[1])
+	c.Assert(job3, Equals, jobs[3])
+	r.DoneJob(job2)
+	r.DoneJob(job3)
+	job4 := r.NextWorkerJob(backend, "ubuntu-16.04", 0, suites[1])
+	c.Assert(job4, Equals, jobs[4])
+
+	// A last variant with a worker already on its suite weighs
+	// less than a job in a suite with no workers.
+	job5 := r.NextWorkerJob(backend, "ubuntu-16.04", 1, suites[1])
+	c.Assert(job5, Equals, jobs[0])
+	job6 := r.NextWorkerJob(backend, "ubuntu-16.04", 1, suites[0])
+	c.Assert(job6, Equals, jobs[5])
+	c.Assert(r.NextWorkerJob(backend, "ubuntu-16.04", 1, nil), IsNil)
+}
+
+func (s *RunnerSuite) TestBalancedVariantSelection(c *C) {
+	backend := &spread.Backend{Name: "backend"}
+	suite := &spread.Suite{Name: "a/"}
+	jobs := []*spread.Job{{
+		Name:    "backend:ubuntu-16.04:a/other",
+		Backend: backend,
+		System:  "ubuntu-16.04",
+		Suite:   suite,
+		Task:    &spread.Task{Name: "a/other"},
+	}}
+	task := &spread.Task{Name: "a/task"}
+	for i := 1; i <= 3; i++ {
+		variant := fmt.Sprintf("v%d", i)
+		jobs = append(jobs, &spread.Job{
+			Name:    "backend:ubuntu-16.04:a/task:" + variant,
+			Backend: backend,
+			System:  "ubuntu-16.04",
+			Suite:   suite,
+			Task:    task,
+			Variant: variant,
+		})
+	}
+	r := spread.NewQueueRunner(jobs, &spread.Options{Balance: true})
+
+	// Variants are weighed per task within the suite, so the task
+	// with many of them goes first even though queued after another.
+	job1 := r.NextWorkerJob(backend, "ubuntu-16.04", 0, nil)
+	c.Assert(job1, Equals, jobs[1])
+
+	// With a worker on it, the task weighs as much as the other one,
+	// which is queued first.
+	job2 := r.NextWorkerJob(backend, "ubuntu-16.04", 1, nil)
+	c.Assert(job2, Equals, jobs[0])
+
+	// The variants left end up on both workers.
+	r.DoneJob(job1)
+	job3 := r.NextWorkerJob(backend, "ubuntu-16.04", 0, suite)
+	c.Assert(job3, Equals, jobs[2])
+	r.DoneJob(job2)
+	job4 := r.NextWorkerJob(backend, "ubuntu-16.04", 1, suite)
+	c.Assert(job4, Equals, jobs[3])
+	c.Assert(r.NextWorkerJob(backend, "ubuntu-16.04", 1, suite), IsNil)
+}
+
+func (s *RunnerSuite) TestColocatedJobSelection(c *C) {
+	backend := &spread.Backend{Name: "backend"}
+	suites := []*spread.Suite{{Name: "a/", Colocate: true}, {Name: "b/"}}
+	jobs := queueJobs(backend, suites, 6)
+	r := spread.NewQueueRunner(jobs, &spread.Options{})
+
+	// The first worker taking a colocated task owns the suite.
+	job1 := r.NextWorkerJob(backend, "ubuntu-16.04", 0, nil)
+	c.Assert(job1, Equals, jobs[0])
+	job2 := r.NextWorkerJob(backend, "ubuntu-16.04", 1, nil)
+	c.Assert(job2, Equals, jobs[1])
+	job3 := r.NextWorkerJob(backend, "ubuntu-16.04", 1, suites[1])
+	c.Assert(job3, Equals, jobs[3])
+	job4 := r.NextWorkerJob(backend, "ubuntu-16.04", 1, suites[1])
+	c.Assert(job4, Equals, jobs[5])
+	c.Assert(r.NextWorkerJob(backend, "ubuntu-16.04", 1, suites[1]), IsNil)
+
+	// So its remaining tasks run there, in order.
+	job5 := r.NextWorkerJob(backend, "ubuntu-16.04", 0, suites[0])
+	c.Assert(job5, Equals, jobs[2])
+	job6 := r.NextWorkerJob(backend, "ubuntu-16.04", 0, suites[0])
+	c.Assert(job6, Equals, jobs[4])
+	c.Assert(r.NextWorkerJob(backend, "ubuntu-16.04", 0, nil), IsNil)
+}
+
+var restoreAfterFailedPrepareTests = []struct {
+	fail  string
+	steps []string
+}{{
+	fail:  "project",
+	steps: []string{"project-prepare", "project-restore-partial"},
+}, {
+	fail:  "backend",
+	steps: []string{"project-prepare", "backend-prepare", "backend-restore-partial", "project-restore"},
+}, {
+	fail: "suite",
+	steps: []string{"project-prepare", "backend-prepare", "suite-prepare",
+		"suite-restore-partial", "backend-restore", "project-restore"},
+}, {
+	fail: "task",
+	steps: []string{"project-prepare", "backend-prepare", "suite-prepare", "task-prepare",
+		"task-restore-partial", "suite-restore", "backend-restore", "project-restore"},
+}}
+
+func (s *RunnerSuite) TestRestoreAfterFailedPrepare(c *C) {
+	for _, test := range restoreAfterFailedPrepareTests {
+		c.Logf("Failing %s prepare", test.fail)
+		dir := c.MkDir()
+		logFile := filepath.Join(dir, "log")
+		script := func(context, verb string) string {
+			script := fmt.Sprintf("echo %s-%s >> %s", context, verb, logFile)
+			if verb == "restore" {
+				// Restore scripts are told whether their prepare failed.
+				script = fmt.Sprintf("echo %s-%s${SPREAD_PREPARE_FAILED:+-partial} >> %s", context, verb, logFile)
+			}
+			if context == test.fail && verb == "prepare" {
+				script += "; exit 1"
+			}
+			return strconv.Quote(script)
+		}
+		writeRunProject(c, dir, fmt.Sprintf(`
+project: restore-test
+path: /remote/path
+prepare: %s
+restore: %s
+backends:
+    local:
+        systems: [ubuntu-16.04]
+        prepare: %s
+        restore: %s
+suites:
+    tests/:
+        summary: Tests
+        prepare: %s
+        restore: %s
+`, script("project", "prepare"), script("project", "restore"),
+			script("backend", "prepare"), script("backend", "restore"),
+			script("suite", "prepare"), script("suite", "restore")), map[string]string{
+			"tests/task": fmt.Sprintf(`
+summary: Task
+prepare: %s
+execute: %s
+restore: %s
+`, script("task", "prepare"), script("task", "execute"), script("task", "restore")),
+		})
+
+		c.Assert(runProject(c, dir, &spread.Options{}), NotNil)
+
+		data, err := ioutil.ReadFile(logFile)
+		c.Assert(err, IsNil)
+		c.Check(strings.Fields(string(data)), DeepEquals, test.steps)
+	}
+}
+
+func (s *RunnerSuite) TestPipeline(c *C) {
+	dir := c.MkDir()
+	logFile := filepath.Join(dir, "log")
+	task := func(name string) string {
+		return fmt.Sprintf(`
+summary: Task
+prepare: echo %[1]s-prepare >> %[2]s
+execute: echo %[1]s-execute >> %[2]s
+restore: sleep 0.5; echo %[1]s-restore >> %[2]s
+`, name, logFile)
+	}
+	writeRunProject(c, dir, `
+project: pipeline-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{"tests/a": task("a"), "tests/b": task("b")})
+
+	c.Assert(runProject(c, dir, &spread.Options{Order: true, Pipeline: true}), IsNil)
+
+	// The restore of a overlaps the prepare of b, but not its execution.
+	data, err := ioutil.ReadFile(logFile)
+	c.Assert(err, IsNil)
+	c.Check(strings.Fields(string(data)), DeepEquals, []string{
+		"a-prepare", "a-execute", "b-prepare", "a-restore", "b-execute", "b-restore",
+	})
+
+	// Nothing is left recorded for a later -restore run.
+	paths, err := filepath.Glob(filepath.Join(os.Getenv("HOME"), ".spread", "spread-inside-*"))
+	c.Assert(err, IsNil)
+	c.Assert(paths, HasLen, 0)
+}
+
+func (s *RunnerSuite) TestFixture(c *C) {
+	dir := c.MkDir()
+	logFile := filepath.Join(dir, "log")
+	task := func(name, fixture string) string {
+		return fmt.Sprintf("summary: Task\nfixture: %q\nexecute: echo %s >> %s\n", fixture, name, logFile)
+	}
+	writeRunProject(c, dir, fmt.Sprintf(`
+project: fixture-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+        fixtures:
+            db:
+                summary: Database
+                prepare: echo db-prepare >> %[1]s
+                restore: echo db-restore >> %[1]s
+`, logFile), map[string]string{
+		"tests/a": task("a", "db"),
+		"tests/b": task("b", ""),
+		"tests/c": task("c", "db"),
+	})
+
+	c.Assert(runProject(c, dir, &spread.Options{}), IsNil)
+
+	// Tasks of the fixture run together, within a single prepare and restore.
+	data, err := ioutil.ReadFile(logFile)
+	c.Assert(err, IsNil)
+	c.Check(strings.Fields(string(data)), DeepEquals, []string{
+		"db-prepare", "a", "c", "db-restore", "b",
+	})
+
+	// With -order they keep the order they were declared in instead.
+	c.Assert(os.Remove(logFile), IsNil)
+	c.Assert(runProject(c, dir, &spread.Options{Order: true}), IsNil)
+	data, err = ioutil.ReadFile(logFile)
+	c.Assert(err, IsNil)
+	c.Check(strings.Fields(string(data)), DeepEquals, []string{
+		"db-prepare", "a", "db-restore", "b", "db-prepare", "c", "db-restore",
+	})
+}
+
+func (s *RunnerSuite) TestSharedServer(c *C) {
+	for _, servers := range []int{1, 3} {
+		c.Logf("Running 3 workers over %d servers", servers)
+		dir := c.MkDir()
+		logFile := filepath.Join(dir, "log")
+		task := "summary: Task\nexecute: sleep 0.5\n"
+		writeRunProject(c, dir, fmt.Sprintf(`
+project: shared-test
+path: /remote/path
+prepare: echo project-prepare >> %s
+backends:
+    local:
+        systems: [ubuntu-16.04*3]
+        servers:
+            ubuntu-16.04: %d
+suites:
+    tests/:
+        summary: Tests
+`, logFile, servers), map[string]string{"tests/a": task, "tests/b": task, "tests/c": task})
+
+		c.Assert(runProject(c, dir, &spread.Options{}), IsNil)
+
+		// The project is prepared once per server, not once per worker.
+		data, err := ioutil.ReadFile(logFile)
+		c.Assert(err, IsNil)
+		c.Check(strings.Fields(string(data)), HasLen, servers)
+	}
+}
+
+func (s *RunnerSuite) TestExitCode(c *C) {
+	dir := c.MkDir()
+	writeRunProject(c, dir, `
+project: exit-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{
+		"tests/expected": "summary: Task\nexit-code: 3\nexecute: exit 3\n",
+		"tests/zero":     "summary: Task\nexit-code: 3\nexecute: true\n",
+		"tests/other":    "summary: Task\nexit-code: 3\nexecute: exit 4\n",
+	})
+
+	err := runProject(c, dir, &spread.Options{})
+	c.Assert(err, FitsTypeOf, &spread.RunError{})
+	c.Assert(err.(*spread.RunError).Failed, Equals, 2)
+}
+
+var runErrorTests = []struct {
+	tasks          map[string]string
+	prepare        string
+	failed         int
+	aborted        int
+	broken         int
+	infrastructure bool
+}{{
+	tasks: map[string]string{"tests/a": "summary: Task\nexecute: true\n"},
+}, {
+	tasks: map[string]string{
+		"tests/a": "summary: Task\nexecute: true\n",
+		"tests/b": "summary: Task\nexecute: exit 1\n",
+	},
+	failed: 1,
+}, {
+	tasks: map[string]string{
+		"tests/a": "summary: Task\nprepare: exit 1\nexecute: true\n",
+		"tests/b": "summary: Task\nexecute: exit 1\n",
+	},
+	failed:         1,
+	aborted:        1,
+	broken:         1,
+	infrastructure: true,
+}, {
+	tasks:          map[string]string{"tests/a": "summary: Task\nexecute: true\n"},
+	prepare:        "exit 1",
+	aborted:        1,
+	broken:         1,
+	infrastructure: true,
+}}
+
+func (s *RunnerSuite) TestRunError(c *C) {
+	for i, test := range runErrorTests {
+		dir := c.MkDir()
+		prepare := test.prepare
+		if prepare == "" {
+			prepare = "true"
+		}
+		writeRunProject(c, dir, `
+project: run-error-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+        prepare: `+prepare+`
+suites:
+    tests/:
+        summary: Tests
+`, test.tasks)
+
+		err := runProject(c, dir, &spread.Options{})
+		if test.failed+test.aborted+test.broken == 0 {
+			c.Check(err, IsNil)
+			continue
+		}
+		c.Assert(err, FitsTypeOf, &spread.RunError{})
+		rerr := err.(*spread.RunError)
+		c.Check(rerr.Failed, Equals, test.failed, Commentf("test %d", i))
+		c.Check(rerr.Aborted, Equals, test.aborted, Commentf("test %d", i))
+		c.Check(rerr.Broken, Equals, test.broken, Commentf("test %d", i))
+		c.Check(rerr.Infrastructure(), Equals, test.infrastructure, Commentf("test %d", i))
+	}
+}
+
+func (s *RunnerSuite) TestXFail(c *C) {
+	dir := c.MkDir()
+	results := filepath.Join(dir, "results.yaml")
+	writeRunProject(c, dir, `
+project: xfail-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{
+		"tests/xfail": "summary: Task\nxfail: true\nexecute: exit 1\n",
+		"tests/xpass": "summary: Task\nxfail: Fixed already.\nexecute: true\n",
+		"tests/pass":  "summary: Task\nexecute: true\n",
+	})
+
+	var buf bytes.Buffer
+	spread.Logger = log.New(&buf, "", 0)
+	defer func() { spread.Logger = nil }()
+
+	// Expected failures don't fail the run, while unexpected successes do.
+	err := runProject(c, dir, &spread.Options{Results: results})
+	c.Assert(err, FitsTypeOf, &spread.RunError{})
+	rerr := err.(*spread.RunError)
+	c.Check(rerr.Failed, Equals, 1)
+	c.Check(rerr.Aborted, Equals, 0)
+	c.Check(rerr.Broken, Equals, 0)
+	c.Check(buf.String(), Matches, `(?s).*WARNING: local:ubuntu-16.04:tests/xpass was expected to fail but passed\..*`)
+	c.Check(buf.String(), Matches, `(?s).*Failed tasks as expected: 1\n.*`)
+	c.Check(buf.String(), Matches, `(?s).*Unexpectedly successful tasks: 1\n.*`)
+
+	data, err := ioutil.ReadFile(results)
+	c.Assert(err, IsNil)
+	var entries []struct {
+		Job    string
+		Status string
+	}
+	c.Assert(yaml.Unmarshal(data, &entries), IsNil)
+	status := make(map[string]string)
+	for _, entry := range entries {
+		status[entry.Job] = entry.Status
+	}
+	c.Assert(status, DeepEquals, map[string]string{
+		"local:ubuntu-16.04:tests/xfail": "xfailed",
+		"local:ubuntu-16.04:tests/xpass": "xpassed",
+		"local:ubuntu-16.04:tests/pass":  "passed",
+	})
+}
+
+var failedCommandTests = []struct {
+	output  string
+	command string
+}{
+	{"", ""},
+	{"hello\n", ""},
+	{"+ true\n+ apt-get install foo\nE: Unable to locate package foo\n", "apt-get install foo"},
+	{"+ echo a\na\n++ id -u\n", "id -u"},
+	{"+ test -f /etc/foo\n1 + 2\n", "test -f /etc/foo"},
+}
+
+func (s *RunnerSuite) TestFailedCommand(c *C) {
+	for _, test := range failedCommandTests {
+		c.Check(spread.FailedCommand([]byte(test.output)), Equals, test.command, Commentf("output: %q", test.output))
+	}
+}
+
+var remoteTimeTests = []struct {
+	output string
+	time   time.Time
+	err    string
+}{
+	{"1500000000.123456789\n", time.Unix(1500000000, 123456789), ""},
+	{"1500000000\n", time.Unix(1500000000, 0), ""},
+	{"1500000000.%N\n", time.Unix(1500000000, 0), ""},
+	{"1500000000.123\n", time.Unix(1500000000, 0), ""},
+	{"Mon Jul 14\n", time.Time{}, `cannot parse remote time "Mon Jul 14"`},
+	{"", time.Time{}, `cannot parse remote time ""`},
+}
+
+func (s *RunnerSuite) TestParseRemoteTime(c *C) {
+	for _, test := range remoteTimeTests {
+		t, err := spread.ParseRemoteTime(test.output)
+		if test.err != "" {
+			c.Check(err, ErrorMatches, test.err)
+			continue
+		}
+		c.Check(err, IsNil)
+		c.Check(t.Equal(test.time), Equals, true, Commentf("output: %q", test.output))
+	}
+}
+
+var limitedBufferTests = []struct {
+	limit     int64
+	writes    []string
+	kept      string
+	truncated bool
+}{
+	{0, []string{"abc", "def"}, "abcdef", false},
+	{6, []string{"abc", "def"}, "abcdef", false},
+	{5, []string{"abc", "def"}, "abcde\n...truncated...\n", true},
+	{3, []string{"abc", "def", "ghi"}, "abc\n...truncated...\n", true},
+	{2, []string{"abcdef"}, "ab\n...truncated...\n", true},
+}
+
+func (s *RunnerSuite) TestLimitedBuffer(c *C) {
+	for _, test := range limitedBufferTests {
+		kept, truncated := spread.LimitedWrite(test.limit, test.writes...)
+		c.Check(kept, Equals, test.kept, Commentf("limit %d, writes %q", test.limit, test.writes))
+		c.Check(truncated, Equals, test.truncated, Commentf("limit %d, writes %q", test.limit, test.writes))
+	}
+}
+
+var tooSlowTests = []struct {
+	elapsed, expected time.Duration
+	factor            float64
+	slow              bool
+}{
+	{time.Hour, 0, 1, false},
+	{time.Minute, time.Minute, 1, false},
+	{time.Minute + time.Second, time.Minute, 1, true},
+	{90 * time.Second, time.Minute, 1.5, false},
+	{91 * time.Second, time.Minute, 1.5, true},
+	{time.Second, time.Minute, 1, false},
+}
+
+func (s *RunnerSuite) TestTooSlow(c *C) {
+	for _, test := range tooSlowTests {
+		c.Check(spread.TooSlow(test.elapsed, test.expected, test.factor), Equals, test.slow,
+			Commentf("elapsed %s, expected %s, factor %v", test.elapsed, test.expected, test.factor))
+	}
+}
+
+var jobLogEntryTests = []struct {
+	verb   string
+	output string
+	err    error
+	entry  string
+}{{
+	verb:  "executing",
+	entry: "-- Executing lxd:ubuntu-16.04:tests/a on server 10.0.0.1 at 2016-07-01T10:00:00Z\n-- Done executing\n\n",
+}, {
+	verb:   "preparing",
+	output: "+ apt update\nok",
+	entry:  "-- Preparing lxd:ubuntu-16.04:tests/a on server 10.0.0.1 at 2016-07-01T10:00:00Z\n+ apt update\nok\n-- Done preparing\n\n",
+}, {
+	verb:   "executing",
+	output: "+ false\n",
+	err:    &spread.ExitStatusError{Status: 1, Err: fmt.Errorf("exit status 1")},
+	entry:  "-- Executing lxd:ubuntu-16.04:tests/a on server 10.0.0.1 at 2016-07-01T10:00:00Z\n+ false\n-- Error executing: exit status 1\n\n",
+}, {
+	verb:  "restoring",
+	err:   &spread.DisconnectError{Err: fmt.Errorf("EOF")},
+	entry: "-- Restoring lxd:ubuntu-16.04:tests/a on server 10.0.0.1 at 2016-07-01T10:00:00Z\n-- Error restoring: connection lost: EOF\n\n",
+}}
+
+func (s *RunnerSuite) TestJobLogEntry(c *C) {
+	at := time.Date(2016, 7, 1, 10, 0, 0, 0, time.UTC)
+	for _, test := range jobLogEntryTests {
+		entry := spread.JobLogEntry(test.verb, "lxd:ubuntu-16.04:tests/a", "server 10.0.0.1", at, []byte(test.output), test.err)
+		c.Check(entry, Equals, test.entry)
+	}
+
+	job := &spread.Job{Name: "lxd:ubuntu-16.04:tests/sub/a:variant"}
+	c.Check(spread.JobLogPath("/logs", job), Equals, "/logs/lxd:ubuntu-16.04:tests:sub:a:variant.log")
+}
+
+var envFileTests = []struct {
+	env  map[string]string
+	file string
+}{
+	{nil, ""},
+	{map[string]string{"A": "1"}, "export A=\"1\"\n"},
+	{map[string]string{"B": "$(id -u)", "A": ""}, "export A=\"\"\nexport B=\"$(id -u)\"\n"},
+	{map[string]string{"PATH": "/snap/bin:$PATH", "SPREAD_JOB": "lxd:ubuntu-16.04:tests/a"}, "export PATH=\"/snap/bin:$PATH\"\nexport SPREAD_JOB=\"lxd:ubuntu-16.04:tests/a\"\n"},
+}
+
+func (s *RunnerSuite) TestEnvFile(c *C) {
+	for _, test := range envFileTests {
+		c.Check(string(spread.EnvFile(test.env)), Equals, test.file)
+	}
+}
+
+func (s *RunnerSuite) TestResults(c *C) {
+	dir := c.MkDir()
+	results := filepath.Join(dir, "results.yaml")
+	writeRunProject(c, dir, `
+project: results-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{
+		"tests/a":       "summary: Task\nexecute: |\n    printf 'count: 3\\nname: a\\n' > $SPREAD_RESULTS\n",
+		"tests/b":       "summary: Task\nexecute: |\n    echo 'count: [' > $SPREAD_RESULTS\n",
+		"tests/c":       "summary: Task\nexecute: true\n",
+		"tests/sharded": "summary: Task\nshards: 2\nexecute: |\n    echo shard: $SPREAD_SHARD > $SPREAD_RESULTS\n",
+	})
+
+	var buf bytes.Buffer
+	spread.Logger = log.New(&buf, "", 0)
+	defer func() { spread.Logger = nil }()
+
+	c.Assert(runProject(c, dir, &spread.Options{Results: results, Order: true}), IsNil)
+	data, err := ioutil.ReadFile(results)
+	c.Assert(err, IsNil)
+	var entries []struct {
+		Job     string
+		Status  string
+		Results yaml.MapSlice
+	}
+	c.Assert(yaml.Unmarshal(data, &entries), IsNil)
+	found := make(map[string]string)
+	for _, entry := range entries {
+		c.Check(entry.Status, Equals, "passed")
+		data, err := yaml.Marshal(entry.Results)
+		c.Assert(err, IsNil)
+		found[entry.Job] = string(data)
+	}
+
+	// Invalid results are reported and left out, without failing the
+	// task, and the results of shards are merged under the task.
+	c.Assert(found, DeepEquals, map[string]string{
+		"local:ubuntu-16.04:tests/a":       "count: 3\nname: a\n",
+		"local:ubuntu-16.04:tests/b":       "{}\n",
+		"local:ubuntu-16.04:tests/c":       "{}\n",
+		"local:ubuntu-16.04:tests/sharded": "shard-0:\n  shard: 0\nshard-1:\n  shard: 1\n",
+	})
+	c.Assert(buf.String(), Matches, `(?s).*Cannot parse results of local:ubuntu-16.04:tests/b: yaml: .*`)
+}
+
+func (s *RunnerSuite) TestOutput(c *C) {
+	dir := c.MkDir()
+	logFile := filepath.Join(dir, "log")
+	writeRunProject(c, dir, `
+project: output-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+        colocate: true
+`, map[string]string{
+		"tests/a": `
+summary: Task
+execute: |
+    cat > $SPREAD_OUTPUT <<EOF
+    # REJECTED=comment
+    REPLACED=output
+    FIRST=a
+
+    bad-name=x
+    =empty
+    noequals
+    a/b=x
+    EOF
+`,
+		"tests/b": fmt.Sprintf(`
+summary: Task
+environment:
+    KEPT: task
+    REPLACED: task
+execute: |
+    echo "$KEPT $REPLACED $FIRST $REJECTED" >> %s
+    echo FIRST=b > $SPREAD_OUTPUT
+`, logFile),
+		"tests/c": fmt.Sprintf("summary: Task\nexecute: echo $FIRST >> %s\n", logFile),
+	})
+
+	var buf bytes.Buffer
+	spread.Logger = log.New(&buf, "", 0)
+	defer func() { spread.Logger = nil }()
+
+	// Output variables replace those defined by the task, and later
+	// output replaces earlier output. Comments and blank lines are
+	// skipped, and lines without a valid variable name are reported.
+	c.Assert(runProject(c, dir, &spread.Options{Order: true}), IsNil)
+	data, err := ioutil.ReadFile(logFile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "task output a \nb\n")
+	const prefix = "Ignoring invalid output line of local:ubuntu-16.04:tests/a: "
+	var invalid []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if i := strings.Index(line, prefix); i >= 0 {
+			invalid = append(invalid, line[i+len(prefix):])
+		}
+	}
+	c.Assert(invalid, DeepEquals, []string{`"bad-name=x"`, `"=empty"`, `"noequals"`, `"a/b=x"`})
+}
+
+func (s *RunnerSuite) TestWorkdir(c *C) {
+	dir := c.MkDir()
+	log := filepath.Join(dir, "log")
+	writeRunProject(c, dir, `
+project: workdir-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{
+		"tests/a": fmt.Sprintf("summary: Task\nworkdir: build/../output\nexecute: pwd >> %s\n", log),
+		"tests/b": fmt.Sprintf("summary: Task\nexecute: pwd >> %s\n", log),
+	})
+	c.Assert(os.MkdirAll(filepath.Join(dir, "output"), 0755), IsNil)
+
+	c.Assert(runProject(c, dir, &spread.Options{Order: true}), IsNil)
+	data, err := ioutil.ReadFile(log)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, filepath.Join(dir, "output")+"\n"+filepath.Join(dir, "tests/b")+"\n")
+}
+
+func (s *RunnerSuite) TestKeepFailedEnvMasked(c *C) {
+	dir := c.MkDir()
+	artifacts := c.MkDir()
+	writeRunProject(c, dir, `
+project: env-test
+path: /remote/path
+environment:
+    API_TOKEN: token-value
+    DB_PASSWORD: password-value
+    PLAIN: plain-value
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{"tests/task": "summary: Task\nexecute: exit 1\n"})
+
+	// Variables named like secrets are masked, as in -dump.
+	c.Assert(runProject(c, dir, &spread.Options{Artifacts: artifacts, KeepFailedEnv: true}), NotNil)
+	data, err := ioutil.ReadFile(filepath.Join(artifacts, "local:ubuntu-16.04:tests/task", "environment"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Matches, `(?s).*export API_TOKEN="\*\*\*\*\*"\n.*`)
+	c.Check(string(data), Matches, `(?s).*export DB_PASSWORD="\*\*\*\*\*"\n.*`)
+	c.Check(string(data), Matches, `(?s).*export PLAIN="plain-value"\n.*`)
+	c.Check(string(data), Not(Matches), `(?s).*(token|password)-value.*`)
+}
+
+var colorizeTests = []struct {
+	msg     string
+	colored string
+}{
+	{"", ""},
+	{"Successful tasks: 2", "\x1b[32mSuccessful tasks: 2\x1b[0m"},
+	{"Error executing task:\n-----\nError here\n-----", "\x1b[31mError executing task:\x1b[0m\n-----\nError here\n-----"},
+	{"WARNING: Clock is off.", "\x1b[33mWARNING: Clock is off.\x1b[0m"},
+	{"Preparing task...", "\x1b[2mPreparing task...\x1b[0m"},
+	{"Aborted tasks: 0", "Aborted tasks: 0"},
+}
+
+func (s *RunnerSuite) TestColorize(c *C) {
+	for _, test := range colorizeTests {
+		c.Check(spread.Colorize(test.msg), Equals, test.colored)
+	}
+}
+
+var githubEscapeTests = []struct {
+	s        string
+	data     string
+	property string
+}{
+	{"", "", ""},
+	{"plain text", "plain text", "plain text"},
+	{"50% done", "50%25 done", "50%25 done"},
+	{"line\r\nnext", "line%0D%0Anext", "line%0D%0Anext"},
+	{"lxd:ubuntu-16.04:tests/a", "lxd:ubuntu-16.04:tests/a", "lxd%3Aubuntu-16.04%3Atests/a"},
+	{"a, b", "a, b", "a%2C b"},
+}
+
+func (s *RunnerSuite) TestGitHubEscape(c *C) {
+	for _, test := range githubEscapeTests {
+		c.Check(spread.EscapeData(test.s), Equals, test.data, Commentf("string: %q", test.s))
+		c.Check(spread.EscapeProperty(test.s), Equals, test.property, Commentf("string: %q", test.s))
+	}
+}
+
+func (s *RunnerSuite) TestExitCodes(c *C) {
+	dir := c.MkDir()
+	flaky := filepath.Join(dir, "flaky")
+	writeRunProject(c, dir, `
+project: exit-codes-test
+path: /remote/path
+exit-codes:
+    75: retry
+    77: pass
+    255: pass
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{
+		"tests/flaky":  "summary: Task\nexecute: test -f " + flaky + " || { touch " + flaky + "; exit 75; }\n",
+		"tests/broken": "summary: Task\nexecute: exit 75\n",
+		"tests/pass":   "summary: Task\nexecute: exit 77\n",
+		"tests/ssh":    "summary: Task\nexecute: exit 255\n",
+	})
+
+	c.Assert(runProject(c, dir, &spread.Options{}), ErrorMatches, "1 task failed")
+}
+
+func (s *RunnerSuite) TestExitOutcome(c *C) {
+	project := &spread.Project{ExitCodes: map[int]string{255: "retry", 1: "fail"}}
+	backend := &spread.Backend{ExitCodes: map[int]string{1: "pass"}}
+	job := &spread.Job{Backend: backend, Task: &spread.Task{}}
+	tests := []struct {
+		err     error
+		outcome string
+	}{
+		{&spread.ExitStatusError{Status: 255, Err: fmt.Errorf("exit status 255")}, "retry"},
+		{&spread.ExitStatusError{Status: 1, Err: fmt.Errorf("exit status 1")}, "pass"},
+		{&spread.ExitStatusError{Status: 2, Err: fmt.Errorf("exit status 2")}, ""},
+		{&spread.DisconnectError{Err: fmt.Errorf("EOF")}, ""},
+		{fmt.Errorf("other"), ""},
+	}
+	for _, test := range tests {
+		c.Check(spread.ExitOutcome(project, job, test.err), Equals, test.outcome, Commentf("error: %v", test.err))
+	}
+}
+
+func (s *RunnerSuite) TestSuiteBudget(c *C) {
+	dir := c.MkDir()
+	writeRunProject(c, dir, `
+project: budget-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+        budget: 1ns
+`, map[string]string{
+		"tests/a": "summary: Task\nexecute: echo a\n",
+		"tests/b": "summary: Task\nexecute: echo b\n",
+	})
+
+	c.Assert(runProject(c, dir, &spread.Options{}), ErrorMatches, "1 task aborted")
+}
+
+func (s *RunnerSuite) TestCheckBackends(c *C) {
+	dir := c.MkDir()
+	writeRunProject(c, dir, `
+project: check-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{"tests/task": "summary: Task\nexecute: true\n"})
+
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	err = spread.CheckBackends(&buf, project, &spread.Options{Local: true, Password: "secret"})
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, "local:ubuntu-16.04 ok\n")
+
+	buf.Reset()
+	err = spread.CheckBackends(&buf, project, &spread.Options{Password: "secret"})
+	c.Assert(err, ErrorMatches, "1 of 1 backends failed")
+	c.Assert(buf.String(), Equals, `local:ubuntu-16.04 failed: backend "local" runs tasks directly on the local system; use -local to allow it`+"\n")
+}
+
+func (s *RunnerSuite) TestTaskOnly(c *C) {
+	dir := c.MkDir()
+	log := filepath.Join(dir, "log")
+	writeRunProject(c, dir, fmt.Sprintf(`
+project: task-only-test
+path: /remote/path
+prepare: echo project-prepare >> %[1]s
+restore: echo project-restore >> %[1]s
+backends:
+    local:
+        systems: [ubuntu-16.04]
+        prepare: echo backend-prepare >> %[1]s
+suites:
+    tests/:
+        summary: Tests
+        prepare: echo suite-prepare >> %[1]s
+        restore: echo suite-restore >> %[1]s
+`, log), map[string]string{
+		"tests/task": fmt.Sprintf("summary: Task\nprepare: echo task-prepare >> %[1]s\nexecute: echo task-execute >> %[1]s\nrestore: echo task-restore >> %[1]s\n", log),
+	})
+
+	c.Assert(runProject(c, dir, &spread.Options{TaskOnly: true}), IsNil)
+
+	data, err := ioutil.ReadFile(log)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "task-prepare\ntask-execute\ntask-restore\n")
+}
+
+func (s *RunnerSuite) TestTaskOnlyFresh(c *C) {
+	dir := c.MkDir()
+	writeRunProject(c, dir, `
+project: task-only-test
+path: /remote/path
+backends:
+    lxd:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{"tests/task": "summary: Task\nexecute: echo\n"})
+
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	_, err = spread.Start(project, &spread.Options{TaskOnly: true, Password: "secret"})
+	c.Assert(err, ErrorMatches, `cannot run backend "lxd" with -task-only on fresh servers; use -reuse or a local backend`)
+}
+
+var alwaysRestoreTests = []struct {
+	project, suite, task bool
+	restored             string
+}{
+	{false, false, false, ""},
+	{false, false, true, "task\n"},
+	{false, true, false, "suite\n"},
+	{true, false, false, "project\n"},
+	{true, true, true, "task\nsuite\nproject\n"},
+}
+
+func (s *RunnerSuite) TestAlwaysRestore(c *C) {
+	for _, test := range alwaysRestoreTests {
+		dir := c.MkDir()
+		log := filepath.Join(dir, "log")
+		writeRunProject(c, dir, fmt.Sprintf(`
+project: always-restore-test
+path: /remote/path
+always-restore: %v
+restore: echo project >> %s
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+        always-restore: %v
+        restore: echo suite >> %s
+`, test.project, log, test.suite, log), map[string]string{
+			"tests/task": fmt.Sprintf("summary: Task\nexecute: exit 1\nalways-restore: %v\nrestore: echo task >> %s\n", test.task, log),
+		})
+
+		// Under -abend only the restores marked as always needed run.
+		c.Check(runProject(c, dir, &spread.Options{Abend: true}), ErrorMatches, "1 task failed")
+		data, _ := ioutil.ReadFile(log)
+		c.Check(string(data), Equals, test.restored, Commentf("project %v, suite %v, task %v", test.project, test.suite, test.task))
+	}
+}
+
+var stopOnBrokenTests = []struct {
+	task     string
+	err      string
+	executed string
+}{
+	{"execute: exit 1\n", "1 task failed", "b\n"},
+	{"prepare: exit 1\nexecute: true\n", "2 tasks aborted, 1 prepare or restore error", ""},
+	{"execute: true\nrestore: exit 1\n", "1 task aborted, 1 prepare or restore error", ""},
+}
+
+func (s *RunnerSuite) TestStopOnBroken(c *C) {
+	for _, test := range stopOnBrokenTests {
+		dir := c.MkDir()
+		log := filepath.Join(dir, "log")
+		writeRunProject(c, dir, `
+project: stop-on-broken-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{
+			"tests/a": "summary: Task\n" + test.task,
+			"tests/b": "summary: Task\nexecute: echo b >> " + log + "\n",
+		})
+
+		// Task errors leave the run going, prepare and restore errors don't.
+		c.Check(runProject(c, dir, &spread.Options{StopOnBroken: true, Order: true}), ErrorMatches, test.err)
+		data, _ := ioutil.ReadFile(log)
+		c.Check(string(data), Equals, test.executed, Commentf("task: %q", test.task))
+	}
+}
+
+var abortReasonTests = []struct {
+	err     error
+	workers int
+	quit    string
+	stopped bool
+	reason  string
+}{
+	{fmt.Errorf("cannot allocate controller: boom"), 1, "", false, "cannot allocate controller: boom"},
+	{nil, 0, "", false, "no worker for lxd:ubuntu-16.04"},
+	{nil, 1, "no server available for lxd:ubuntu-16.04", true, "no server available for lxd:ubuntu-16.04"},
+	{nil, 1, "", true, "run stopped"},
+	{nil, 1, "", false, "no worker left for lxd:ubuntu-16.04"},
+}
+
+func (s *RunnerSuite) TestAbortReason(c *C) {
+	job := &spread.Job{Backend: &spread.Backend{Name: "lxd"}, System: "ubuntu-16.04"}
+	for _, test := range abortReasonTests {
+		reason := spread.AbortReason(job, test.err, test.workers, test.quit, test.stopped)
+		c.Check(reason, Equals, test.reason)
+	}
+}
+
+var statusTests = []struct {
+	pending                int
+	paused                 bool
+	workers                []spread.StatusWorker
+	passed, failed, broken int
+	status                 string
+}{{
+	status: `{"run-id":"run","pending":0,"servers":0,"workers":[],"stats":{"aborted":0,"broken":0,"failed":0,"passed":0,"quarantined":0,"skipped":0,"slow":0,"xfailed":0,"xpassed":0}}`,
+}, {
+	pending: 3,
+	paused:  true,
+	workers: []spread.StatusWorker{
+		{Name: "lxd:ubuntu-16.04 (2)", Addr: "10.0.0.2"},
+		{Name: "lxd:ubuntu-16.04 (1)", Addr: "10.0.0.1", Job: "lxd:ubuntu-16.04:tests/a"},
+	},
+	passed: 2,
+	failed: 1,
+	broken: 1,
+	status: `{"run-id":"run","paused":true,"pending":3,"servers":2,"workers":[` +
+		`{"name":"lxd:ubuntu-16.04 (1)","server":"server 10.0.0.1","address":"10.0.0.1","job":"lxd:ubuntu-16.04:tests/a"},` +
+		`{"name":"lxd:ubuntu-16.04 (2)","server":"server 10.0.0.2","address":"10.0.0.2"}],` +
+		`"stats":{"aborted":0,"broken":1,"failed":1,"passed":2,"quarantined":0,"skipped":0,"slow":0,"xfailed":0,"xpassed":0}}`,
+}}
+
+func (s *RunnerSuite) TestStatus(c *C) {
+	for _, test := range statusTests {
+		status, err := spread.RunStatus(test.pending, test.paused, test.workers, test.passed, test.failed, test.broken)
+		c.Check(err, IsNil)
+		c.Check(status, Equals, test.status)
+	}
+}
+
+func (s *RunnerSuite) TestManifest(c *C) {
+	dir := c.MkDir()
+	writeRunProject(c, dir, `
+project: manifest-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{
+		"tests/a": "summary: Task\nexecute: true\n",
+		"tests/b": "summary: Task\nexecute: exit 1\n",
+	})
+
+	filename := filepath.Join(c.MkDir(), "manifest.yaml")
+	options := &spread.Options{Manifest: filename, Args: []string{"-pass=secret", "tests/"}}
+	c.Assert(runProject(c, dir, options), ErrorMatches, "1 task failed")
+
+	var m struct {
+		RunID    string              `yaml:"run-id"`
+		Project  string              `yaml:"project"`
+		TreeHash string              `yaml:"tree-hash"`
+		Args     []string            `yaml:"args"`
+		Jobs     []string            `yaml:"jobs"`
+		Finished *time.Time          `yaml:"finished"`
+		Outcome  map[string][]string `yaml:"outcome"`
+		Error    string              `yaml:"error"`
+		Servers  []struct {
+			Backend string `yaml:"backend"`
+			System  string `yaml:"system"`
+			Address string `yaml:"address"`
+		} `yaml:"servers"`
+	}
+	data, err := ioutil.ReadFile(filename)
+	c.Assert(err, IsNil)
+	c.Assert(yaml.Unmarshal(data, &m), IsNil)
+
+	c.Check(m.RunID, Equals, options.RunID)
+	c.Check(m.Project, Equals, "manifest-test")
+	c.Check(m.TreeHash, Matches, "[0-9a-f]{64}")
+	c.Check(m.Args, DeepEquals, []string{"-pass=*****", "tests/"})
+	sort.Strings(m.Jobs)
+	c.Check(m.Jobs, DeepEquals, []string{"local:ubuntu-16.04:tests/a", "local:ubuntu-16.04:tests/b"})
+	c.Check(m.Finished, NotNil)
+	c.Check(m.Outcome, DeepEquals, map[string][]string{
+		"passed": {"local:ubuntu-16.04:tests/a"},
+		"failed": {"local:ubuntu-16.04:tests/b"},
+	})
+	c.Check(m.Error, Equals, "1 task failed")
+	c.Assert(m.Servers, HasLen, 1)
+	c.Check(m.Servers[0].Backend, Equals, "local")
+	c.Check(m.Servers[0].System, Equals, "ubuntu-16.04")
+	c.Check(m.Servers[0].Address, Equals, "localhost")
+}
+
+var treeHashTests = []struct {
+	file    string
+	content string
+	exclude []string
+	changed bool
+}{
+	{"", "", nil, false},
+	{"tests/a/task.yaml", "summary: Changed.\n", nil, true},
+	{"lib/helper.sh", "echo changed\n", nil, true},
+	{"lib/new.sh", "echo new\n", nil, true},
+	{"lib/new.sh", "echo new\n", []string{"lib/new.sh"}, false},
+	{"", "", []string{"lib"}, true},
+}
+
+func (s *RunnerSuite) TestTreeHash(c *C) {
+	write := func(dir, file, content string) {
+		c.Assert(os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644), IsNil)
+	}
+	base := c.MkDir()
+	write(base, "tests/a/task.yaml", "summary: Task.\n")
+	write(base, "lib/helper.sh", "echo helper\n")
+	hash, err := spread.TreeHash(base, []string{"."}, nil)
+	c.Assert(err, IsNil)
+
+	for _, test := range treeHashTests {
+		dir := c.MkDir()
+		write(dir, "tests/a/task.yaml", "summary: Task.\n")
+		write(dir, "lib/helper.sh", "echo helper\n")
+		if test.file != "" {
+			write(dir, test.file, test.content)
+		}
+		// Times are left out of the hash.
+		c.Assert(os.Chtimes(filepath.Join(dir, "lib/helper.sh"), time.Unix(0, 0), time.Unix(0, 0)), IsNil)
+		h, err := spread.TreeHash(dir, []string{"."}, test.exclude)
+		c.Assert(err, IsNil)
+		c.Check(h != hash, Equals, test.changed, Commentf("file %q, exclude %q", test.file, test.exclude))
+	}
+}
+
+var preflightTests = []struct {
+	script string
+	err    string
+}{
+	{"", ""},
+	{"test -f spread.yaml", ""},
+	{"test \"$SPREAD_PROJECT\" = preflight-test", ""},
+	{"exit 1", "preflight script failed: exit status 1"},
+	{"echo missing tool >&2; exit 1", "preflight script failed: missing tool"},
+	{"false; true", "preflight script failed: exit status 1"},
+}
+
+func (s *RunnerSuite) TestPreflight(c *C) {
+	for _, test := range preflightTests {
+		dir := c.MkDir()
+		log := filepath.Join(dir, "log")
+		writeRunProject(c, dir, fmt.Sprintf(`
+project: preflight-test
+path: /remote/path
+preflight: %q
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, test.script), map[string]string{"tests/task": "summary: Task\nexecute: echo executed >> " + log + "\n"})
+		project, err := spread.Load(dir)
+		c.Assert(err, IsNil)
+		r, err := spread.Start(project, &spread.Options{Local: true, Password: "secret"})
+		if test.err != "" {
+			// Nothing runs when the preflight script fails.
+			c.Check(err, ErrorMatches, test.err)
+			_, serr := os.Stat(log)
+			c.Check(os.IsNotExist(serr), Equals, true)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(r.Wait(), IsNil)
+	}
+}
+
+func (s *RunnerSuite) TestColocateOwnerGone(c *C) {
+	dir := c.MkDir()
+	log := filepath.Join(dir, "log")
+	writeRunProject(c, dir, `
+project: colocate-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04*2]
+suites:
+    colocated/:
+        summary: Colocated
+        colocate: true
+    other/:
+        summary: Other
+`, map[string]string{
+		"colocated/a": "summary: Task\nexecute: echo\nrestore: exit 1\n",
+		"colocated/b": fmt.Sprintf("summary: Task\nexecute: echo b >> %s\n", log),
+		"colocated/c": fmt.Sprintf("summary: Task\nexecute: echo c >> %s\n", log),
+		"other/slow":  "summary: Task\nexecute: sleep 1\n",
+	})
+
+	// The worker breaking its server on the first colocated task quits,
+	// and the other one takes over the rest of the suite.
+	err := runProject(c, dir, &spread.Options{Order: true})
+	c.Assert(err, NotNil)
+	data, err := ioutil.ReadFile(log)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "b\nc\n")
+}
+
+func (s *RunnerSuite) TestFindOrphans(c *C) {
+	dir := c.MkDir()
+	writeRunProject(c, dir, `
+project: project
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+    linode:
+        key: secret
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{"tests/task": "summary: Task\nexecute: echo\n"})
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+
+	// Linode servers tagged with the project backend are found.
+	var changes []string
+	restore := spread.FakeLinodeAPI(linodeOrphans(&changes))
+	orphans, err := spread.FindOrphans(project, &spread.Options{Local: true})
+	restore()
+	c.Assert(err, IsNil)
+	c.Assert(orphans, HasLen, 1)
+	c.Assert(orphans[0].RunID, Equals, "gone")
+
+	// Backends that cannot list their servers fail clearly rather than
+	// reporting there are none.
+	defer spread.FakeLinodeAPI(linodeActions(map[string]string{"test.echo": "{}", "linode.list": "[]"}, map[string]string{
+		"linode.list": `[{"ERRORCODE": 5, "ERRORMESSAGE": "Object not found"}]`,
+	}))()
+	orphans, err = spread.FindOrphans(project, &spread.Options{Local: true})
+	c.Assert(err, ErrorMatches, "cannot find orphaned servers of linode backend")
+	c.Assert(orphans, HasLen, 0)
+}
+
+// control sends cmd to the control handler of r and returns its reply.
+func control(c *C, r *spread.Runner, cmd string) string {
+	client, server := net.Pipe()
+	defer client.Close()
+	go r.HandleControl(server)
+	_, err := fmt.Fprintf(client, "%s\n", cmd)
+	c.Assert(err, IsNil)
+	reply, err := bufio.NewReader(client).ReadString('\n')
+	c.Assert(err, IsNil)
+	return strings.TrimSuffix(reply, "\n")
+}
+
+func (s *RunnerSuite) TestPauseResume(c *C) {
+	dir := c.MkDir()
+	log := filepath.Join(dir, "log")
+	tasks := make(map[string]string)
+	for _, name := range []string{"a", "b", "c"} {
+		tasks["tests/"+name] = fmt.Sprintf("summary: Task\nexecute: echo %s >> %s; sleep 0.2\nrestore: sleep 0.2; echo restore-%s >> %s\n", name, log, name, log)
+	}
+	writeRunProject(c, dir, `
+project: pause-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, tasks)
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	r, err := spread.Start(project, &spread.Options{Local: true, Password: "secret", Pipeline: true, Order: true})
+	c.Assert(err, IsNil)
+
+	c.Assert(control(c, r, "resume"), Equals, "error: run is not paused")
+	c.Assert(control(c, r, "pause"), Equals, "ok")
+	c.Assert(control(c, r, "pause"), Equals, "error: run is already paused")
+	c.Assert(control(c, r, "status"), Matches, `.*"paused":true.*`)
+
+	// At most the job taken before pausing runs, and its pipelined
+	// restore is done while the worker waits.
+	readLog := func() string {
+		data, err := ioutil.ReadFile(log)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+	time.Sleep(time.Second)
+	paused := readLog()
+	c.Assert(paused == "" || paused == "a\nrestore-a\n", Equals, true, Commentf("log: %q", paused))
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(readLog(), Equals, paused)
+
+	c.Assert(control(c, r, "resume"), Equals, "ok")
+	c.Assert(r.Wait(), IsNil)
+	done := strings.Fields(readLog())
+	sort.Strings(done)
+	c.Assert(done, DeepEquals, []string{"a", "b", "c", "restore-a", "restore-b", "restore-c"})
+}
+
+func (s *RunnerSuite) TestArtifacts(c *C) {
+	dir := c.MkDir()
+	artifacts := c.MkDir()
+	writeRunProject(c, dir, `
+project: artifacts-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{"tests/task": `
+summary: Task
+artifacts:
+    - output/
+    - "*.log"
+artifacts-exclude:
+    - "*.core"
+execute: |
+    mkdir -p output/sub
+    echo data > output/sub/data.txt
+    echo dump > output/sub/app.core
+    echo log > run.log
+    echo other > other.txt
+`})
+
+	c.Assert(runProject(c, dir, &spread.Options{Artifacts: artifacts}), IsNil)
+
+	var found []string
+	root := filepath.Join(artifacts, "local:ubuntu-16.04:tests/task")
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			found = append(found, rel)
+		}
+		return err
+	})
+	c.Assert(err, IsNil)
+	sort.Strings(found)
+	c.Assert(found, DeepEquals, []string{"output/sub/data.txt", "run.log"})
+}
+
+func (s *RunnerSuite) TestLocalProvider(c *C) {
+	backend := &spread.Backend{Name: "local", Type: "local"}
+	p := spread.Local(&spread.Project{}, backend, &spread.Options{})
+	c.Assert(p.Backend(), Equals, backend)
+
+	server, err := p.Allocate("ubuntu-16.04", "secret")
+	c.Assert(err, IsNil)
+	c.Assert(server.Provider(), Equals, p)
+	c.Assert(server.Address(), Equals, "localhost")
+	c.Assert(server.Image(), Equals, spread.ImageID("ubuntu-16.04"))
+	c.Assert(server.String(), Equals, "local:ubuntu-16.04 (localhost)")
+	c.Assert(server.ReuseData(), IsNil)
+
+	// Discarding leaves the local system alone.
+	c.Assert(server.Discard(), IsNil)
+
+	listed, err := p.List()
+	c.Assert(err, IsNil)
+	c.Assert(listed, HasLen, 0)
+	_, err = p.Reuse(nil, "secret")
+	c.Assert(err, ErrorMatches, `cannot reuse servers on backend "local"`)
+}
+
+// keptServer is a server of a remote backend kept after a run.
+type keptServer struct {
+	spread.UnknownServer
+	provider spread.Provider
+}
+
+func (s *keptServer) Provider() spread.Provider { return s.provider }
+
+func (s *RunnerSuite) TestReuseArgs(c *C) {
+	project := &spread.Project{}
+	options := &spread.Options{Password: "secret", Keep: true}
+	local := spread.Local(project, &spread.Backend{Name: "local", Type: "local"}, options)
+	lxd := spread.LXD(project, &spread.Backend{Name: "lxd", Type: "lxd"}, options)
+	localServer, err := local.Allocate("ubuntu-16.04", "secret")
+	c.Assert(err, IsNil)
+	kept := func(addr string) spread.Server {
+		return &keptServer{spread.UnknownServer{Addr: addr}, lxd}
+	}
+
+	// The local system is never listed for reuse.
+	c.Assert(spread.ReuseArgs([]spread.Server{localServer}, options), Equals, "")
+	c.Assert(spread.ReuseArgs([]spread.Server{kept("10.0.0.2"), localServer, kept("10.0.0.1")}, options),
+		Equals, "-pass=secret -reuse=lxd:10.0.0.1,10.0.0.2 -keep")
+}
+
+var checkReuseDataTests = []struct {
+	data string
+	path string
+	why  string
+}{
+	{"spread-path: /remote/path\nspread-config: abc\n", "/remote/path", ""},
+	{"address: 10.0.0.1\nspread-config: abc\n", "", ""},
+	{"spread-path: /remote/path\nspread-config: def\n", "/remote/path", "changed since it was allocated"},
+	{"spread-path: /remote/path\n", "/remote/path", "it was allocated with is unknown"},
+	{"spread-path: [/remote/path]\nspread-config: abc\n", "", "(?s)it was allocated with cannot be read: .*"},
+	{"spread-config: abc\n\tbroken", "", "(?s)it was allocated with cannot be read: .*"},
+}
+
+func (s *RunnerSuite) TestCheckReuseData(c *C) {
+	for _, test := range checkReuseDataTests {
+		path, why := spread.CheckReuseData([]byte(test.data), "abc")
+		c.Check(path, Equals, test.path, Commentf("data: %q", test.data))
+		c.Check(why, Matches, test.why, Commentf("data: %q", test.data))
+	}
+}
+
+func (s *RunnerSuite) TestAbandon(c *C) {
+	dir := c.MkDir()
+	logFile := filepath.Join(dir, "log")
+	started := filepath.Join(dir, "started")
+	writeRunProject(c, dir, `
+project: abandon-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{
+		"tests/a": fmt.Sprintf("summary: Task\nexecute: |\n    if [ ! -f %[1]s ]; then touch %[1]s; sleep 1; fi\n    echo a >> %[2]s\n", started, logFile),
+		"tests/b": fmt.Sprintf("summary: Task\nexecute: echo b >> %s\n", logFile),
+	})
+	var buf bytes.Buffer
+	spread.Logger = log.New(&buf, "", 0)
+	defer func() { spread.Logger = nil }()
+
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	r, err := spread.Start(project, &spread.Options{Local: true, Password: "secret", Order: true})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Assert(control(c, r, "abandon local:ubuntu-16.04#2"), Equals, `error: cannot find worker "local:ubuntu-16.04#2"`)
+	c.Assert(control(c, r, "abandon local:ubuntu-16.04#1"), Equals, "ok")
+	c.Assert(control(c, r, "abandon local:ubuntu-16.04#1"), Matches, `error: cannot find worker .*`)
+
+	// The job abandoned runs again on the worker replacing the
+	// abandoned one, which then goes on with the rest of the run.
+	c.Assert(r.Wait(), IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*Abandoning local:ubuntu-16.04#1 on .*, queueing local:ubuntu-16.04:tests/a to run elsewhere.*`)
+	c.Assert(buf.String(), Matches, `(?s).*Replacing abandoned worker local:ubuntu-16.04#1.*`)
+	data, err := ioutil.ReadFile(logFile)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Count(string(data), "a\n") >= 1, Equals, true, Commentf("log: %q", data))
+	c.Assert(strings.Count(string(data), "b\n"), Equals, 1)
+}
+
+func (s *RunnerSuite) TestMinPassed(c *C) {
+	dir := c.MkDir()
+	yaml := `
+project: threshold-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`
+	writeRunProject(c, dir, yaml, map[string]string{
+		"tests/a": "summary: Task\nexecute: true\n",
+		"tests/b": "summary: Task\nexecute: true\n",
+		"tests/c": "summary: Task\nexecute: false\n",
+	})
+
+	c.Assert(runProject(c, dir, &spread.Options{MinPassed: 2}), IsNil)
+
+	err := runProject(c, dir, &spread.Options{MinPassedPercent: 80})
+	c.Assert(err, ErrorMatches, "1 task failed, 2 of 3 tasks passed, at least 80% required")
+
+	// Skipped tasks still fail the run when asked to.
+	writeRunProject(c, dir, yaml, map[string]string{"tests/d": "summary: Task\nif: $MISSING\nexecute: true\n"})
+	err = runProject(c, dir, &spread.Options{MinPassed: 2, FailOnSkip: true})
+	c.Assert(err, ErrorMatches, "1 task failed, 1 task skipped")
+}
+
+func (s *RunnerSuite) TestStateLeak(c *C) {
+	dir := c.MkDir()
+	stateFile := filepath.Join(dir, "state")
+	writeRunProject(c, dir, fmt.Sprintf(`
+project: state-test
+path: /remote/path
+state:
+    files: cat %[1]s
+state-leak: fail
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+        prepare: touch %[1]s
+`, stateFile), map[string]string{
+		"tests/clean":   fmt.Sprintf("summary: Task\nexecute: echo clean >> %[1]s\nrestore: sed -i /clean/d %[1]s\n", stateFile),
+		"tests/leaky":   fmt.Sprintf("summary: Task\nexecute: echo leaky >> %[1]s\n", stateFile),
+		"tests/allowed": fmt.Sprintf("summary: Task\nallow-state: [files]\nexecute: echo allowed >> %[1]s\n", stateFile),
+	})
+
+	c.Assert(runProject(c, dir, &spread.Options{CheckState: true}), ErrorMatches, "1 task leaked state")
+}
+
+var checkIdempotentTests = []struct {
+	task string
+	err  string
+}{{
+	task: "prepare: mkdir -p %[1]s/good\nrestore: rm -rf %[1]s/good\n",
+}, {
+	task: "prepare: mkdir %[1]s/failing\n",
+	err:  "1 task aborted, 1 prepare or restore error",
+}, {
+	task: "restore: echo restored >> %[1]s/log\n",
+	err:  "1 prepare or restore error",
+}}
+
+func (s *RunnerSuite) TestCheckIdempotent(c *C) {
+	for _, test := range checkIdempotentTests {
+		dir := c.MkDir()
+		writeRunProject(c, dir, fmt.Sprintf(`
+project: idempotent-test
+path: /remote/path
+state:
+    log: cat %[1]s/log 2>/dev/null || true
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, dir), map[string]string{
+			"tests/task": fmt.Sprintf("summary: Task\nexecute: true\n"+test.task, dir),
+		})
+
+		err := runProject(c, dir, &spread.Options{CheckIdempotent: true})
+		if test.err == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, test.err)
+		}
+	}
+}
+
+func (s *RunnerSuite) TestEmptyExecute(c *C) {
+	dir := c.MkDir()
+	writeRunProject(c, dir, `
+project: empty-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+        empty-execute: fail
+    other/:
+        summary: Other tests
+`, map[string]string{
+		"tests/empty": "summary: Task\n",
+		"tests/full":  "summary: Task\nexecute: true\n",
+		"other/empty": "summary: Task\n",
+	})
+
+	c.Assert(runProject(c, dir, &spread.Options{}), ErrorMatches, "1 task failed")
+}
+
+func (s *RunnerSuite) TestResultCache(c *C) {
+	dir := c.MkDir()
+	// Files outside the project, as it is all part of the cache key.
+	runs := filepath.Join(c.MkDir(), "runs")
+	yaml := `
+project: cache-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`
+	writeRunProject(c, dir, yaml, map[string]string{
+		"tests/pass": "summary: Task\nexecute: echo pass >> " + runs + "\n",
+		"tests/fail": "summary: Task\nexecute: echo fail >> " + runs + "; false\n",
+	})
+
+	cache := spread.NewDirCache(filepath.Join(c.MkDir(), "cache"))
+	run := func() string {
+		c.Assert(runProject(c, dir, &spread.Options{Cache: cache}), ErrorMatches, "1 task failed")
+		data, err := ioutil.ReadFile(runs)
+		c.Assert(err, IsNil)
+		os.Remove(runs)
+		return string(data)
+	}
+
+	c.Assert(run(), Equals, "fail\npass\n")
+	c.Assert(run(), Equals, "fail\n")
+
+	// Changing the task invalidates its cached result.
+	writeRunProject(c, dir, yaml, map[string]string{
+		"tests/pass": "summary: Task\nexecute: echo pass >> " + runs + "; true\n",
+	})
+	c.Assert(run(), Equals, "fail\npass\n")
+	c.Assert(run(), Equals, "fail\n")
+
+	// So does changing any other file sent to servers.
+	err := ioutil.WriteFile(filepath.Join(dir, "helper.sh"), []byte("true\n"), 0644)
+	c.Assert(err, IsNil)
+	c.Assert(run(), Equals, "fail\npass\n")
+}
+
+func (s *RunnerSuite) TestNodes(c *C) {
+	dir := c.MkDir()
+	log := filepath.Join(dir, "log")
+	exec := filepath.Join(dir, "exec")
+	writeRunProject(c, dir, fmt.Sprintf(`
+project: nodes-test
+path: /remote/path
+prepare: echo "project-prepare ${SPREAD_NODE_ROLE:-main}" >> %[1]s
+restore: echo "project-restore ${SPREAD_NODE_ROLE:-main}" >> %[1]s
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+        nodes:
+            db: 2
+            web-front: 1
+        prepare: echo "prepare ${SPREAD_NODE_ROLE:-main}" >> %[1]s
+        restore: echo "restore ${SPREAD_NODE_ROLE:-main}" >> %[1]s
+`, log), map[string]string{
+		"tests/cluster": fmt.Sprintf("summary: Task\nexecute: echo ${SPREAD_NODE_ROLE:-main} $SPREAD_NODE_DB_2 $SPREAD_NODES_WEB_FRONT $SPREAD_NODES >> %s\n", exec),
+	})
+
+	c.Assert(runProject(c, dir, &spread.Options{}), IsNil)
+
+	// Nodes are prepared and restored as the server of the worker is.
+	output, err := ioutil.ReadFile(log)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, ""+
+		"project-prepare main\n"+
+		"project-prepare db\nprepare db\nproject-prepare db\nprepare db\n"+
+		"project-prepare web-front\nprepare web-front\nprepare main\n"+
+		"restore main\nrestore db\nproject-restore db\nrestore db\nproject-restore db\n"+
+		"restore web-front\nproject-restore web-front\nproject-restore main\n")
+
+	// And tasks run across all of them at once.
+	output, err = ioutil.ReadFile(exec)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	sort.Strings(lines)
+	c.Assert(lines, DeepEquals, []string{
+		"db localhost localhost localhost localhost localhost",
+		"db localhost localhost localhost localhost localhost",
+		"main localhost localhost localhost localhost localhost",
+		"web-front localhost localhost localhost localhost localhost",
+	})
+}
+
+func (s *RunnerSuite) TestRestoreRecordedShared(c *C) {
+	dir := c.MkDir()
+	log := filepath.Join(dir, "log")
+	writeRunProject(c, dir, fmt.Sprintf(`
+project: replay-test
+path: /remote/path
+restore: echo project-restore >> %[1]s
+backends:
+    local:
+        systems: [ubuntu-16.04*2]
+        servers:
+            ubuntu-16.04: 1
+suites:
+    tests/:
+        summary: Tests
+        restore: echo suite-restore >> %[1]s
+`, log), map[string]string{
+		"tests/a": "summary: Task\nexecute: true\n",
+		"tests/b": "summary: Task\nexecute: true\n",
+	})
+	records := filepath.Join(os.Getenv("HOME"), ".spread")
+	c.Assert(os.MkdirAll(records, 0755), IsNil)
+	for i, record := range []string{
+		"job: local:ubuntu-16.04:tests/a\nproject: true\nsuite: true\n",
+		"job: local:ubuntu-16.04:tests/b\nsuite: true\n",
+	} {
+		path := filepath.Join(records, fmt.Sprintf("spread-inside-replay-test-%d.yaml", i+1))
+		c.Assert(ioutil.WriteFile(path, []byte(record), 0644), IsNil)
+	}
+
+	c.Assert(runProject(c, dir, &spread.Options{Restore: true}), IsNil)
+
+	// Workers sharing the server replay its records only once.
+	data, err := ioutil.ReadFile(log)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "suite-restore\nsuite-restore\nproject-restore\n")
+	paths, err := filepath.Glob(filepath.Join(records, "spread-inside-*"))
+	c.Assert(err, IsNil)
+	c.Assert(paths, HasLen, 0)
+}
+
+func (s *RunnerSuite) TestReuseConfig(c *C) {
+	backend := &spread.Backend{Name: "lxd", Type: "lxd", Prepare: "true"}
+	config := spread.ReuseConfig(backend, "ubuntu-16.04")
+
+	// Scripts and environment apply anew to reused servers.
+	backend.Prepare = "false"
+	backend.Environment = map[string]string{"FOO": "bar"}
+	c.Assert(spread.ReuseConfig(backend, "ubuntu-16.04"), Equals, config)
+
+	// What servers were allocated with does not.
+	backend.Images = map[string]string{"ubuntu-16.04": "ubuntu:16.04"}
+	c.Assert(spread.ReuseConfig(backend, "ubuntu-16.04"), Not(Equals), config)
+	c.Assert(spread.ReuseConfig(backend, "ubuntu-18.04"), Not(Equals), config)
+}
+
+// stoppedProvider starts the stopped servers it is asked for as new
+// servers of the given system.
+type stoppedProvider struct {
+	spread.Provider
+	system spread.ImageID
+}
+
+func (p *stoppedProvider) Stop(server spread.Server) (string, error) {
+	return server.Address(), nil
+}
+
+func (p *stoppedProvider) Start(name, password string) (spread.Server, error) {
+	return p.Allocate(p.system, password)
+}
+
+func (s *RunnerSuite) TestReuseStartedServer(c *C) {
+	for _, system := range []spread.ImageID{"ubuntu-16.04", "debian-9"} {
+		c.Logf("Starting server of %s", system)
+		restore := spread.FakeProviders(func(p spread.Provider) spread.Provider {
+			return &stoppedProvider{p, system}
+		})
+		dir := c.MkDir()
+		log := filepath.Join(dir, "log")
+		writeRunProject(c, dir, `
+project: start-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{"tests/task": "summary: Task\nexecute: echo executed >> " + log + "\n"})
+
+		err := runProject(c, dir, &spread.Options{Reuse: map[string][]string{"local": {"localhost"}}})
+		restore()
+
+		// Started servers of other systems are left alone.
+		_, serr := os.Stat(log)
+		if system == "ubuntu-16.04" {
+			c.Check(err, IsNil)
+			c.Check(serr, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, "1 task aborted")
+			c.Check(os.IsNotExist(serr), Equals, true)
+		}
+	}
+}
+
+// scarceProvider allocates only as many servers as it has capacity for,
+// failing transiently afterwards.
+type scarceProvider struct {
+	spread.Provider
+	mu       sync.Mutex
+	capacity int
+}
+
+func (p *scarceProvider) Allocate(image spread.ImageID, password string) (spread.Server, error) {
+	p.mu.Lock()
+	if p.capacity == 0 {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("out of capacity")
+	}
+	p.capacity--
+	p.mu.Unlock()
+	return p.Provider.Allocate(image, password)
+}
+
+func (s *RunnerSuite) TestDegradeWorkers(c *C) {
+	defer spread.SetAllocateTimeout(50 * time.Millisecond)()
+	defer spread.FakeProviders(func(p spread.Provider) spread.Provider {
+		return &scarceProvider{Provider: p, capacity: 1}
+	})()
+	var buf bytes.Buffer
+	spread.Logger = log.New(&buf, "", 0)
+	defer func() { spread.Logger = nil }()
+
+	dir := c.MkDir()
+	task := "summary: Task\nexecute: sleep 0.5\n"
+	writeRunProject(c, dir, `
+project: degrade-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04*2]
+        backoff:
+            delay: 10ms
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{"tests/a": task, "tests/b": task, "tests/c": task})
+
+	// The worker left without a server gives up after a few rounds,
+	// and the one running goes through all jobs.
+	c.Assert(runProject(c, dir, &spread.Options{}), IsNil)
+	c.Assert(buf.String(), Matches, "(?s).*Cannot allocate more servers for local:ubuntu-16.04, requested 2 workers, running with 1.*")
+	c.Assert(strings.Count(buf.String(), "Cannot allocate more servers"), Equals, 1)
+}
+
+func (s *RunnerSuite) TestDegradeAffinity(c *C) {
+	defer spread.SetAllocateTimeout(50 * time.Millisecond)()
+	defer spread.FakeProviders(func(p spread.Provider) spread.Provider {
+		return &scarceProvider{Provider: p, capacity: 1}
+	})()
+
+	dir := c.MkDir()
+	log := filepath.Join(dir, "log")
+	tasks := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		tasks["tests/"+name] = fmt.Sprintf("summary: Task\nexecute: sleep 0.2; echo %s >> %s\n", name, log)
+	}
+	writeRunProject(c, dir, `
+project: affinity-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04*2]
+        backoff:
+            delay: 10ms
+suites:
+    tests/:
+        summary: Tests
+`, tasks)
+
+	// The tasks pinned to the worker that gave up run on the other one.
+	c.Assert(runProject(c, dir, &spread.Options{Affinity: true}), IsNil)
+	data, err := ioutil.ReadFile(log)
+	c.Assert(err, IsNil)
+	done := strings.Fields(string(data))
+	sort.Strings(done)
+	c.Assert(done, DeepEquals, []string{"a", "b", "c", "d", "e", "f"})
+}
+
+var quarantineTests = []struct {
+	tasks map[string]string
+	err   string
+}{{
+	tasks: map[string]string{
+		"tests/a": "summary: Task\nprepare: exit 1\nexecute: true\n",
+		"tests/b": "summary: Task\nexecute: exit 1\n",
+	},
+}, {
+	// The server is left broken for the tasks that follow.
+	tasks: map[string]string{
+		"tests/a": "summary: Task\nexecute: true\nrestore: exit 1\n",
+	},
+	err: "1 prepare or restore error",
+}, {
+	tasks: map[string]string{
+		"tests/c": "summary: Task\nprepare: exit 1\nexecute: true\n",
+	},
+	err: "1 task aborted, 1 prepare or restore error",
+}}
+
+func (s *RunnerSuite) TestQuarantine(c *C) {
+	quarantine, err := spread.NewFilter([]string{"tests/a", "tests/b"})
+	c.Assert(err, IsNil)
+	for _, test := range quarantineTests {
+		dir := c.MkDir()
+		writeRunProject(c, dir, `
+project: quarantine-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, test.tasks)
+		err := runProject(c, dir, &spread.Options{Quarantine: quarantine})
+		if test.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+}
+
+// batchProvider allocates servers in batches, counting the servers
+// allocated in batches and one by one.
+type batchProvider struct {
+	spread.Provider
+	mu      sync.Mutex
+	batched int
+	single  int
+}
+
+func (p *batchProvider) Allocate(image spread.ImageID, password string) (spread.Server, error) {
+	p.mu.Lock()
+	p.single++
+	p.mu.Unlock()
+	return p.Provider.Allocate(image, password)
+}
+
+func (p *batchProvider) AllocateBatch(images []spread.ImageID, password string) ([]spread.Server, error) {
+	var servers []spread.Server
+	for _, image := range images {
+		server, err := p.Provider.Allocate(image, password)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	p.mu.Lock()
+	p.batched += len(servers)
+	p.mu.Unlock()
+	return servers, nil
+}
+
+func (s *RunnerSuite) TestAllocateBatch(c *C) {
+	var providers []*batchProvider
+	defer spread.FakeProviders(func(p spread.Provider) spread.Provider {
+		bp := &batchProvider{Provider: p}
+		providers = append(providers, bp)
+		return bp
+	})()
+
+	dir := c.MkDir()
+	task := "summary: Task\nexecute: sleep 0.1\n"
+	writeRunProject(c, dir, `
+project: batch-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04*2, ubuntu-18.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{"tests/a": task, "tests/b": task, "tests/c": task})
+
+	// Workers pick up the servers allocated at once for them.
+	c.Assert(runProject(c, dir, &spread.Options{}), IsNil)
+	c.Assert(providers, HasLen, 1)
+	c.Assert(providers[0].batched, Equals, 3)
+	c.Assert(providers[0].single, Equals, 0)
+}
+
+func (s *RunnerSuite) TestControllerAllocatedApart(c *C) {
+	var providers []*batchProvider
+	defer spread.FakeProviders(func(p spread.Provider) spread.Provider {
+		bp := &batchProvider{Provider: p}
+		providers = append(providers, bp)
+		return bp
+	})()
+
+	dir := c.MkDir()
+	task := "summary: Task\nexecute: true\n"
+	writeRunProject(c, dir, `
+project: controller-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04*2]
+suites:
+    tests/:
+        summary: Tests
+controller:
+    backend: local
+    system: ubuntu-16.04
+`, map[string]string{"tests/a": task, "tests/b": task})
+
+	// The controller doesn't take the servers allocated for workers.
+	c.Assert(runProject(c, dir, &spread.Options{}), IsNil)
+	c.Assert(providers, HasLen, 1)
+	c.Assert(providers[0].batched, Equals, 2)
+	c.Assert(providers[0].single, Equals, 1)
+}
+
+var sharedServersTests = []struct {
+	workers int
+	servers int
+}{
+	{4, 1},
+	{4, 2},
+	{3, 2},
+}
+
+func (s *RunnerSuite) TestSharedServers(c *C) {
+	for _, test := range sharedServersTests {
+		var providers []*batchProvider
+		restore := spread.FakeProviders(func(p spread.Provider) spread.Provider {
+			bp := &batchProvider{Provider: p}
+			providers = append(providers, bp)
+			return bp
+		})
+
+		dir := c.MkDir()
+		logFile := filepath.Join(dir, "log")
+		token := filepath.Join(dir, "token")
+		sent := filepath.Join(dir, "sent", "token")
+		c.Assert(ioutil.WriteFile(token, []byte("secret-token-value\n"), 0600), IsNil)
+		tasks := make(map[string]string)
+		for i := 0; i < 8; i++ {
+			tasks[fmt.Sprintf("tests/task%d", i)] = fmt.Sprintf("summary: Task\nexecute: |\n    test -f %s\n    echo task >> %s\n    sleep 0.1\n", sent, logFile)
+		}
+		writeRunProject(c, dir, fmt.Sprintf(`
+project: shared-test
+path: /remote/path
+prepare: echo project-prepare >> %[1]s
+restore: echo project-restore >> %[1]s
+backends:
+    local:
+        systems: [ubuntu-16.04*%[2]d]
+        servers:
+            ubuntu-16.04: %[3]d
+        prepare: echo backend-prepare >> %[1]s
+        restore: echo backend-restore >> %[1]s
+        files:
+            - from: %[4]s
+              to: %[5]s
+              secret: true
+suites:
+    tests/:
+        summary: Tests
+`, logFile, test.workers, test.servers, token, sent), tasks)
+
+		var buf bytes.Buffer
+		spread.Logger = log.New(&buf, "", 0)
+		spread.Verbose = true
+		err := runProject(c, dir, &spread.Options{})
+		spread.Logger = nil
+		spread.Verbose = false
+		restore()
+		c.Assert(err, IsNil)
+		comment := Commentf("workers: %d, servers: %d", test.workers, test.servers)
+
+		// Each shared server is allocated, sent files, prepared, and
+		// restored once, and released by the last worker using it.
+		c.Assert(providers, HasLen, 1)
+		c.Check(providers[0].batched+providers[0].single, Equals, test.servers, comment)
+		c.Check(strings.Count(buf.String(), "Sending "+token), Equals, test.servers, comment)
+		c.Check(strings.Count(buf.String(), "Discarding "), Equals, test.servers, comment)
+		_, err = os.Stat(sent)
+		c.Check(os.IsNotExist(err), Equals, true, comment)
+
+		data, err := ioutil.ReadFile(logFile)
+		c.Assert(err, IsNil)
+		count := make(map[string]int)
+		for _, line := range strings.Fields(string(data)) {
+			count[line]++
+		}
+		c.Check(count, DeepEquals, map[string]int{
+			"project-prepare": test.servers,
+			"backend-prepare": test.servers,
+			"task":            8,
+			"backend-restore": test.servers,
+			"project-restore": test.servers,
+		}, comment)
+	}
+}
+
+func (s *RunnerSuite) TestControllerKeep(c *C) {
+	dir := c.MkDir()
+	writeRunProject(c, dir, `
+project: controller-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+controller:
+    backend: local
+    system: ubuntu-16.04
+`, map[string]string{"tests/a": "summary: Task\nexecute: true\n"})
+
+	var buf bytes.Buffer
+	spread.Logger = log.New(&buf, "", 0)
+	defer func() { spread.Logger = nil }()
+
+	c.Assert(runProject(c, dir, &spread.Options{}), IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*Discarding controller .*`)
+
+	// The controller is kept along with the servers of workers.
+	buf.Reset()
+	c.Assert(runProject(c, dir, &spread.Options{Keep: true}), IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*Keeping controller .* at localhost\n.*`)
+	c.Assert(buf.String(), Not(Matches), `(?s).*Discarding controller .*`)
+}
+
+// panicProvider allocates servers in batches normally, recording which
+// are discarded, but panics when allocating them one by one.
+type panicProvider struct {
+	spread.Provider
+	mu        sync.Mutex
+	discarded []string
+}
+
+type panicServer struct {
+	spread.Server
+	p *panicProvider
+}
+
+func (s *panicServer) Discard() error {
+	s.p.mu.Lock()
+	s.p.discarded = append(s.p.discarded, string(s.Image()))
+	s.p.mu.Unlock()
+	return s.Server.Discard()
+}
+
+func (p *panicProvider) Allocate(image spread.ImageID, password string) (spread.Server, error) {
+	panic("cannot allocate")
+}
+
+func (p *panicProvider) AllocateBatch(images []spread.ImageID, password string) ([]spread.Server, error) {
+	var servers []spread.Server
+	for _, image := range images {
+		server, err := p.Provider.Allocate(image, password)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, &panicServer{server, p})
+	}
+	return servers, nil
+}
+
+func (s *RunnerSuite) TestPanicDiscards(c *C) {
+	var providers []*panicProvider
+	defer spread.FakeProviders(func(p spread.Provider) spread.Provider {
+		pp := &panicProvider{Provider: p}
+		providers = append(providers, pp)
+		return pp
+	})()
+
+	dir := c.MkDir()
+	writeRunProject(c, dir, `
+project: panic-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04*2]
+suites:
+    tests/:
+        summary: Tests
+controller:
+    backend: local
+    system: ubuntu-16.04
+`, map[string]string{"tests/a": "summary: Task\nexecute: true\n", "tests/b": "summary: Task\nexecute: true\n"})
+
+	// The servers allocated for the workers are discarded when the run
+	// panics allocating the controller, before any worker used them.
+	err := runProject(c, dir, &spread.Options{})
+	c.Assert(err, ErrorMatches, "internal error in run loop: cannot allocate")
+	c.Assert(providers, HasLen, 1)
+	c.Assert(providers[0].discarded, DeepEquals, []string{"ubuntu-16.04", "ubuntu-16.04"})
+}
+
+// stuckProvider never finishes preparing its images.
+type stuckProvider struct {
+	spread.Provider
+	preparing chan bool
+}
+
+func (p *stuckProvider) PrepareImages(images []spread.ImageID) error {
+	p.preparing <- true
+	select {}
+}
+
+func (s *RunnerSuite) TestStopPreparingImages(c *C) {
+	preparing := make(chan bool, 1)
+	defer spread.FakeProviders(func(p spread.Provider) spread.Provider {
+		return &stuckProvider{p, preparing}
+	})()
+
+	dir := c.MkDir()
+	log := filepath.Join(dir, "log")
+	writeRunProject(c, dir, `
+project: images-test
+path: /remote/path
+backends:
+    local:
+        systems: [ubuntu-16.04]
+suites:
+    tests/:
+        summary: Tests
+`, map[string]string{"tests/task": "summary: Task\nexecute: echo executed >> " + log + "\n"})
+	project, err := spread.Load(dir)
+	c.Assert(err, IsNil)
+	r, err := spread.Start(project, &spread.Options{Local: true, Password: "secret"})
+	c.Assert(err, IsNil)
+	<-preparing
+
+	// Stopping the run doesn't wait for the images.
+	stopped := make(chan error, 1)
+	go func() { stopped <- r.Stop() }()
+	select {
+	case err := <-stopped:
+		c.Assert(err, ErrorMatches, "1 task aborted")
+	case <-time.After(5 * time.Second):
+		c.Fatalf("run still waiting for images after stopping")
+	}
+	_, err = os.Stat(log)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func BenchmarkJobSelection(b *testing.B) {
+	benchmarkJobSelection(b, spread.NewQueueRunner, (*spread.Runner).NextJob)
+}
+
+// BenchmarkLinearJobSelection measures the scan of every pending job
+// that the queues replaced, for comparison.
+func BenchmarkLinearJobSelection(b *testing.B) {
+	benchmarkJobSelection(b, spread.NewLinearRunner, (*spread.Runner).LinearNextJob)
+}
+
+type nextJobFunc func(r *spread.Runner, backend *spread.Backend, system spread.ImageID, suite *spread.Suite) *spread.Job
+
+// benchmarkJobSelection has a worker pick 50k jobs spread over 100
+// suites, mostly sticking to the suite of the previous job.
+func benchmarkJobSelection(b *testing.B, newRunner func([]*spread.Job, *spread.Options) *spread.Runner, next nextJobFunc) {
+	backend := &spread.Backend{Name: "backend"}
+	var suites []*spread.Suite
+	for i := 0; i < 100; i++ {
+		suites = append(suites, &spread.Suite{Name: fmt.Sprintf("suite-%d/", i)})
+	}
+	jobs := queueJobs(backend, suites, 50000)
+	r := newRunner(jobs, &spread.Options{})
+	b.ResetTimer()
+
+	var last *spread.Job
+	for i := 0; i < b.N; i++ {
+		var suite *spread.Suite
+		if last != nil && i%10 != 0 {
+			suite = last.Suite
+		}
+		job := next(r, backend, "ubuntu-16.04", suite)
+		if job == nil {
+			b.StopTimer()
+			r = newRunner(jobs, &spread.Options{})
+			b.StartTimer()
+			continue
+		}
+		r.DoneJob(job)
+		last = job
+	}
+}
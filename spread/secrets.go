@@ -0,0 +1,60 @@
+package spread
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// secretManagers lists the supported secrets managers, by the prefix used
+// to reference their secrets.
+var secretManagers = []string{"vault", "aws", "gcp"}
+
+// splitSecret splits a secret reference such as "vault:secret/linode#key"
+// into the manager and the name of the secret in it.
+func splitSecret(ref string) (manager, name string, ok bool) {
+	i := strings.Index(ref, ":")
+	if i < 0 || !contains(secretManagers, ref[:i]) || i == len(ref)-1 {
+		return "", "", false
+	}
+	return ref[:i], ref[i+1:], true
+}
+
+// resolveSecret obtains the value of the referenced secret by running the
+// command line tool of its secrets manager. The value is masked from all
+// messages logged from then on.
+func resolveSecret(ref string) (string, error) {
+	manager, name, ok := splitSecret(ref)
+	if !ok {
+		return "", fmt.Errorf("invalid secret reference %q", ref)
+	}
+
+	var cmd *exec.Cmd
+	switch manager {
+	case "vault":
+		path, field := name, "value"
+		if i := strings.LastIndex(name, "#"); i >= 0 {
+			path, field = name[:i], name[i+1:]
+		}
+		cmd = exec.Command("vault", "kv", "get", "-field="+field, path)
+	case "aws":
+		cmd = exec.Command("aws", "secretsmanager", "get-secret-value", "--secret-id", name, "--query", "SecretString", "--output", "text")
+	case "gcp":
+		cmd = exec.Command("gcloud", "secrets", "versions", "access", "latest", "--secret="+name)
+	}
+
+	debugf("Obtaining %s secret %s...", manager, name)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot obtain %s secret %s: %v", manager, name, outputErr(stderr.Bytes(), err))
+	}
+	secret := strings.TrimRight(string(output), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("cannot obtain %s secret %s: secret is empty", manager, name)
+	}
+	maskSecret(secret)
+	return secret, nil
+}
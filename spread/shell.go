@@ -0,0 +1,52 @@
+package spread
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Shell defines the shells that scripts are run with on servers. The
+// prepare shell runs prepare and restore scripts, and the execute shell
+// runs execute scripts. Both default to /bin/sh when unset.
+type Shell struct {
+	Prepare string
+	Execute string
+}
+
+// checkShell makes sure the shells set in context are absolute paths.
+func checkShell(context fmt.Stringer, what string, shell *Shell) error {
+	if shell == nil {
+		return nil
+	}
+	for _, path := range []string{shell.Prepare, shell.Execute} {
+		if path != "" && !filepath.IsAbs(path) {
+			return fmt.Errorf("%s has invalid %s, must be an absolute path: %s", context, what, path)
+		}
+	}
+	return nil
+}
+
+// shell returns the shell to run the script of verb for job with, as
+// set for its system in the backend shells field, or else in the shell
+// field of the backend or of the project, each phase being resolved on
+// its own. It returns an empty string for the default shell.
+func (r *Runner) shell(job *Job, verb string) string {
+	shells := []*Shell{
+		job.Backend.Shells[string(job.System)],
+		job.Backend.Shell,
+		r.project.Shell,
+	}
+	for _, shell := range shells {
+		if shell == nil {
+			continue
+		}
+		path := shell.Prepare
+		if verb == executing {
+			path = shell.Execute
+		}
+		if path != "" {
+			return path
+		}
+	}
+	return ""
+}
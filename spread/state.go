@@ -0,0 +1,113 @@
+package spread
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxStateDiff is how many changed lines of each probe are shown when a
+// task leaks state.
+const maxStateDiff = 10
+
+// checksState returns whether the state of the server is probed before
+// and after job runs, to find out whether it leaks changes.
+func (r *Runner) checksState(job *Job) bool {
+	return r.options.CheckState && !r.options.Restore && len(r.project.State) > 0
+}
+
+// probeState runs the state probes of the project on the server the
+// client is connected to, and returns their output by name. Probes that
+// fail are reported and left out.
+func (r *Runner) probeState(client *Client, job *Job) map[string]string {
+	state := make(map[string]string, len(r.project.State))
+	for _, name := range sortedKeys(r.project.State) {
+		output, err := client.Output(r.project.State[name], client.remotePath, job.Environment)
+		if err != nil {
+			printf("Cannot probe %s state on %s: %v", name, client.Server(), err)
+			continue
+		}
+		state[name] = string(output)
+	}
+	return state
+}
+
+// checkState compares the state of the server after job was restored
+// with the state before it was prepared, and reports and records the
+// job as leaking state if anything changed that the task is not
+// allowed to change.
+func (r *Runner) checkState(w *workerState, client *Client, job *Job, before map[string]string) {
+	after := r.probeState(client, job)
+	var leaked []string
+	for _, name := range sortedKeys(before) {
+		if contains(job.Task.AllowState, name) {
+			continue
+		}
+		if _, ok := after[name]; !ok {
+			continue
+		}
+		diff := stateDiff(before[name], after[name])
+		if len(diff) == 0 {
+			continue
+		}
+		if len(diff) > maxStateDiff {
+			diff = append(diff[:maxStateDiff], fmt.Sprintf("(%d more)", len(diff)-maxStateDiff))
+		}
+		printf("WARNING: %s changed %s state:\n    %s", job, name, strings.Join(diff, "\n    "))
+		leaked = append(leaked, name)
+	}
+	if len(leaked) == 0 {
+		return
+	}
+	r.record(w, &r.stats.TaskLeak, job)
+	r.mu.Lock()
+	if r.leaked == nil {
+		r.leaked = make(map[*Job][]string)
+	}
+	if job.parent != nil {
+		job = job.parent
+	}
+	for _, name := range leaked {
+		if !contains(r.leaked[job], name) {
+			r.leaked[job] = append(r.leaked[job], name)
+		}
+	}
+	r.mu.Unlock()
+}
+
+// stateDiff returns the lines only found in before prefixed by "-" and
+// the ones only found in after prefixed by "+", ignoring their order.
+func stateDiff(before, after string) []string {
+	count := make(map[string]int)
+	for _, line := range strings.Split(before, "\n") {
+		count[line]--
+	}
+	for _, line := range strings.Split(after, "\n") {
+		count[line]++
+	}
+	var diff []string
+	for line, n := range count {
+		for ; n < 0; n++ {
+			diff = append(diff, "-"+line)
+		}
+		for ; n > 0; n-- {
+			diff = append(diff, "+"+line)
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool {
+		if diff[i][1:] != diff[j][1:] {
+			return diff[i][1:] < diff[j][1:]
+		}
+		return diff[i] < diff[j]
+	})
+	return diff
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,57 @@
+package spread
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// stop stops the server instead of discarding it, per the discard-mode
+// of its backend, recording its name so the run may tell how to start
+// it again. Servers that cannot be stopped are discarded.
+func (r *Runner) stop(server Server) {
+	backend := server.Provider().Backend()
+	printf("Stopping %s...", server)
+	name, err := server.Provider().(Stopper).Stop(server)
+	if err != nil {
+		printf("Error stopping %s, discarding it: %v", server, err)
+		if err := r.discard(server); err != nil {
+			printf("Error discarding %s: %v", server, err)
+		}
+		return
+	}
+	r.mu.Lock()
+	if r.stopped == nil {
+		r.stopped = make(map[string][]string)
+	}
+	r.stopped[backend.Name] = append(r.stopped[backend.Name], name)
+	r.mu.Unlock()
+}
+
+// stoppedArgs returns the command line options that make a later run
+// start and reuse the servers stopped by this one.
+func (r *Runner) stoppedArgs() string {
+	var backends []string
+	for backend := range r.stopped {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+
+	var reuse []string
+	for _, backend := range backends {
+		names := r.stopped[backend]
+		sort.Strings(names)
+		reuse = append(reuse, backend+":"+strings.Join(names, ","))
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("-pass=")
+	buf.WriteString(r.options.Password)
+	buf.WriteString(" -reuse=")
+	if len(reuse) > 1 {
+		buf.WriteString("'" + strings.Join(reuse, " ") + "'")
+	} else {
+		buf.WriteString(reuse[0])
+	}
+	return buf.String()
+}